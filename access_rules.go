@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/cloudflare/cloudflare-go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ipListEnforcement     = "ip_list"
+	accessRuleEnforcement = "access_rules"
+)
+
+// usesAccessRules returns true if the zone's decisions are enforced through IP access rules.
+func (worker *CloudflareWorker) usesAccessRules(zone ZoneConfig) bool {
+	if zone.Enforcement != "" {
+		return zone.Enforcement == accessRuleEnforcement
+	}
+	return worker.Account.Enforcement == accessRuleEnforcement
+}
+
+// ipListZones returns the zones whose decisions are enforced through IP lists and firewall rules.
+func (worker *CloudflareWorker) ipListZones() []ZoneConfig {
+	zones := make([]ZoneConfig, 0)
+	for _, zone := range worker.Account.ZoneConfigs {
+		if !worker.usesAccessRules(zone) {
+			zones = append(zones, zone)
+		}
+	}
+	return zones
+}
+
+// ipListActions returns the actions which need an IP list.
+func (worker *CloudflareWorker) ipListActions() map[string]struct{} {
+	actions := make(map[string]struct{})
+	for _, zone := range worker.ipListZones() {
+		for _, action := range zone.Actions {
+			actions[action] = struct{}{}
+		}
+	}
+	return actions
+}
+
+// newBackends returns the backends enforcing the decisions of the worker's account.
+// When every zone uses access rules, they share account level rules, which apply to every zone of the
+// account. Otherwise the zones using access rules get zone level rules, so that the zones using IP lists,
+// and the zones of the account which aren't configured, aren't enforced by access rules.
+func (worker *CloudflareWorker) newBackends() []enforcementBackend {
+	backends := make([]enforcementBackend, 0)
+	if len(worker.ipListZones()) > 0 {
+		backends = append(backends, &ipListBackend{worker: worker})
+	} else if worker.Account.Enforcement == accessRuleEnforcement {
+		backends = append(backends, &accessRuleBackend{worker: worker})
+		return backends
+	}
+	for _, zone := range worker.Account.ZoneConfigs {
+		if worker.usesAccessRules(zone) {
+			backends = append(backends, &accessRuleBackend{worker: worker, zoneID: zone.ID})
+		}
+	}
+	return backends
+}
+
+// accessRuleTarget returns the access rule target for the IP or range.
+// Cloudflare only accepts /16 and /24 IPv4 ranges and /32, /48 and /64 IPv6 ranges.
+func accessRuleTarget(value string) (string, error) {
+	if !strings.Contains(value, "/") {
+		if ip := net.ParseIP(value); ip != nil && ip.To4() == nil {
+			return "ip6", nil
+		}
+		return "ip", nil
+	}
+	ip, ipNet, err := net.ParseCIDR(value)
+	if err != nil {
+		return "", err
+	}
+	ones, _ := ipNet.Mask.Size()
+	if ip.To4() != nil {
+		if ones == 32 {
+			return "ip", nil
+		}
+		if ones == 16 || ones == 24 {
+			return "ip_range", nil
+		}
+	} else if ones == 32 || ones == 48 || ones == 64 {
+		return "ip_range", nil
+	}
+	return "", fmt.Errorf("range %s is not supported by access rules", value)
+}
+
+// accessRuleBackend enforces IPs and ranges through one IP access rule per IP. Account level rules are
+// used when zoneID is empty. Countries and AS are not enforced by this backend.
+type accessRuleBackend struct {
+	worker *CloudflareWorker
+	zoneID string
+}
+
+func (b *accessRuleBackend) Name() string {
+	return accessRuleEnforcement
+}
+
+// notes returns the notes of the rules created by the bouncer, they start with the IP list prefix
+// to tell them apart from the rules created by users.
+func (b *accessRuleBackend) notes(comment string) string {
+	return fmt.Sprintf("%s: %s", b.worker.Account.IPListPrefix, comment)
+}
+
+func (b *accessRuleBackend) logger() *log.Entry {
+	if b.zoneID == "" {
+		return b.worker.Logger.WithFields(log.Fields{"backend": b.Name()})
+	}
+	return b.worker.Logger.WithFields(log.Fields{"backend": b.Name(), "zone_id": b.zoneID})
+}
+
+func (b *accessRuleBackend) ruleIDByIP(action string) map[string]string {
+	state, ok := b.worker.CFStateByAction[action]
+	if !ok {
+		return nil
+	}
+	if state.AccessRuleIDsByZoneID == nil {
+		state.AccessRuleIDsByZoneID = make(map[string]map[string]string)
+	}
+	if state.AccessRuleIDsByZoneID[b.zoneID] == nil {
+		state.AccessRuleIDsByZoneID[b.zoneID] = make(map[string]string)
+	}
+	return state.AccessRuleIDsByZoneID[b.zoneID]
+}
+
+func (b *accessRuleBackend) createRule(rule cloudflare.AccessRule) (*cloudflare.AccessRuleResponse, error) {
+	if b.zoneID == "" {
+		return b.worker.getAPI().CreateAccountAccessRule(b.worker.Ctx, b.worker.Account.ID, rule)
+	}
+	return b.worker.getAPI().CreateZoneAccessRule(b.worker.Ctx, b.zoneID, rule)
+}
+
+func (b *accessRuleBackend) deleteRule(id string) error {
+	var err error
+	if b.zoneID == "" {
+		_, err = b.worker.getAPI().DeleteAccountAccessRule(b.worker.Ctx, b.worker.Account.ID, id)
+	} else {
+		_, err = b.worker.getAPI().DeleteZoneAccessRule(b.worker.Ctx, b.zoneID, id)
+	}
+	return err
+}
+
+func (b *accessRuleBackend) listRules(page int) (*cloudflare.AccessRuleListResponse, error) {
+	filter := cloudflare.AccessRule{Notes: b.notes("")}
+	if b.zoneID == "" {
+		return b.worker.getAPI().ListAccountAccessRules(b.worker.Ctx, b.worker.Account.ID, filter, page)
+	}
+	return b.worker.getAPI().ListZoneAccessRules(b.worker.Ctx, b.zoneID, filter, page)
+}
+
+func (b *accessRuleBackend) ApplyIPs(action string, add []edgeIP, remove []string) (applyResult, error) {
+	result := applyResult{}
+	ruleIDByIP := b.ruleIDByIP(action)
+	if ruleIDByIP == nil {
+		return result, fmt.Errorf("no state for action %s", action)
+	}
+
+	for _, ip := range remove {
+		id, ok := ruleIDByIP[ip]
+		if !ok {
+			continue
+		}
+		if err := b.deleteRule(id); err != nil {
+			return result, err
+		}
+		delete(ruleIDByIP, ip)
+		result.Removed++
+	}
+
+	for _, ip := range add {
+		if _, ok := ruleIDByIP[ip.Value]; ok {
+			continue
+		}
+		target, err := accessRuleTarget(ip.Value)
+		if err != nil {
+			b.logger().Warningf("not enforcing %s: %s", ip.Value, err)
+			result.drop(ip.Value, "unsupported_range")
+			continue
+		}
+		resp, err := b.createRule(cloudflare.AccessRule{
+			Mode:          action,
+			Notes:         b.notes(ip.Comment),
+			Configuration: cloudflare.AccessRuleConfiguration{Target: target, Value: ip.Value},
+		})
+		if err != nil {
+			return result, err
+		}
+		ruleIDByIP[ip.Value] = resp.Result.ID
+		result.Added++
+	}
+	return result, nil
+}
+
+func (b *accessRuleBackend) ApplyRule(action string, expression string) (applyResult, error) {
+	// access rules have no expression, countries and AS need the ip_list enforcement.
+	return applyResult{}, nil
+}
+
+// Cleanup deletes every access rule created by the bouncer, including the ones missing from the state.
+func (b *accessRuleBackend) Cleanup() error {
+	ids := make([]string, 0)
+	for page, totalPages := 1, 1; page <= totalPages; page++ {
+		resp, err := b.listRules(page)
+		if err != nil {
+			return err
+		}
+		for _, rule := range resp.Result {
+			if strings.HasPrefix(rule.Notes, b.notes("")) {
+				ids = append(ids, rule.ID)
+			}
+		}
+		totalPages = resp.TotalPages
+	}
+	for _, id := range ids {
+		if err := b.deleteRule(id); err != nil {
+			return err
+		}
+	}
+	b.logger().Infof("deleted %d access rules", len(ids))
+	for _, state := range b.worker.CFStateByAction {
+		delete(state.AccessRuleIDsByZoneID, b.zoneID)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+func Test_accessRuleTarget(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{value: "1.2.3.4", want: "ip"},
+		{value: "1.2.3.4/32", want: "ip"},
+		{value: "1.2.3.0/24", want: "ip_range"},
+		{value: "1.2.0.0/16", want: "ip_range"},
+		{value: "1.2.3.0/28", wantErr: true},
+		{value: "2001:db8::1", want: "ip6"},
+		{value: "2001:db8::/32", want: "ip_range"},
+		{value: "2001:db8::/48", want: "ip_range"},
+		{value: "2001:db8::/64", want: "ip_range"},
+		{value: "2001:db8::/56", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := accessRuleTarget(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("accessRuleTarget() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("accessRuleTarget() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCloudflareWorker_newBackends(t *testing.T) {
+	tests := []struct {
+		name    string
+		account AccountConfig
+		want    []string // backend name and zone of access rules
+	}{
+		{
+			name:    "default is ip list",
+			account: AccountConfig{ZoneConfigs: []ZoneConfig{{ID: "zone1"}}},
+			want:    []string{"ip_list"},
+		},
+		{
+			name:    "account level access rules",
+			account: AccountConfig{Enforcement: "access_rules", ZoneConfigs: []ZoneConfig{{ID: "zone1"}, {ID: "zone2"}}},
+			want:    []string{"access_rules:"},
+		},
+		{
+			name:    "zone level access rules",
+			account: AccountConfig{ZoneConfigs: []ZoneConfig{{ID: "zone1"}, {ID: "zone2", Enforcement: "access_rules"}}},
+			want:    []string{"ip_list", "access_rules:zone2"},
+		},
+		{
+			name:    "account level access rules with an ip list zone",
+			account: AccountConfig{Enforcement: "access_rules", ZoneConfigs: []ZoneConfig{{ID: "zone1"}, {ID: "zone2", Enforcement: "ip_list"}}},
+			want:    []string{"ip_list", "access_rules:zone1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			worker := &CloudflareWorker{Account: tt.account}
+			got := make([]string, 0)
+			for _, backend := range worker.newBackends() {
+				if b, ok := backend.(*accessRuleBackend); ok {
+					got = append(got, b.Name()+":"+b.zoneID)
+				} else {
+					got = append(got, backend.Name())
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("want=%+v, found=%+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestAccessRuleBackend(t *testing.T) {
+	ip1 := "1.2.3.4"
+	ip2 := "2001:0db8:85a3:0000:0000:8a2e:0370:7334"
+	ban := "ban"
+	scenario := "crowdsec/demo"
+	var tokenCallCount uint32
+
+	api := &mockCloudflareAPI{
+		AccessRulesByZone: map[string][]cloudflare.AccessRule{
+			"": {{ID: "user-rule", Notes: "added by hand"}},
+		},
+	}
+	account := AccountConfig{
+		ID:            "dummyID",
+		ZoneConfigs:   []ZoneConfig{{ID: "zone1", Actions: []string{"block"}, ActionSet: map[string]struct{}{"block": {}}}},
+		IPListPrefix:  "crowdsec",
+		DefaultAction: "block",
+		Enforcement:   accessRuleEnforcement,
+	}
+	worker := &CloudflareWorker{
+		Account:         account,
+		API:             api,
+		CFStateByAction: map[string]*CloudflareState{"block": {Action: "block"}},
+		UpdatedState:    make(chan *stateUpdate, 10),
+		Logger:          log.WithFields(log.Fields{"account_id": "test worker"}),
+		Count:           prometheus.NewCounter(prometheus.CounterOpts{}),
+		tokenCallCount:  &tokenCallCount,
+	}
+
+	worker.NewIPDecisions = []*models.Decision{
+		{Value: &ip1, Type: &ban, Scenario: &scenario},
+		{Value: &ip2, Type: &ban, Scenario: &scenario},
+	}
+	if err := worker.AddNewIPs(); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.AccessRulesByZone[""]) != 3 {
+		t.Fatalf("expected 2 new access rules, found %+v", api.AccessRulesByZone[""])
+	}
+	created := api.AccessRulesByZone[""][1]
+	if created.Mode != "block" || created.Configuration.Target != "ip" || created.Configuration.Value != ip1 || created.Notes != "crowdsec: crowdsec/demo" {
+		t.Errorf("unexpected access rule %+v", created)
+	}
+	wantIDs := map[string]string{"1.2.3.4": "-1", "2001:db8:85a3::/64": "-2"}
+	if !reflect.DeepEqual(worker.CFStateByAction["block"].AccessRuleIDsByZoneID[""], wantIDs) {
+		t.Errorf("want=%+v, found=%+v", wantIDs, worker.CFStateByAction["block"].AccessRuleIDsByZoneID[""])
+	}
+
+	worker.ExpiredIPDecisions = []*models.Decision{{Value: &ip1, Type: &ban, Scenario: &scenario}}
+	if err := worker.DeleteIPs(); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.AccessRulesByZone[""]) != 2 {
+		t.Errorf("expected the rule of %s to be deleted, found %+v", ip1, api.AccessRulesByZone[""])
+	}
+
+	if err := worker.cleanUp(); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.AccessRulesByZone[""]) != 1 || api.AccessRulesByZone[""][0].ID != "user-rule" {
+		t.Errorf("expected only the user's rule to be left, found %+v", api.AccessRulesByZone[""])
+	}
+	if len(worker.CFStateByAction["block"].AccessRuleIDsByZoneID) != 0 {
+		t.Errorf("expected empty state after cleanup, found %+v", worker.CFStateByAction["block"].AccessRuleIDsByZoneID)
+	}
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// zoneStatus is a zone of an account as shown by the admin API.
+type zoneStatus struct {
+	ZoneID      string `json:"zone_id"`
+	Enforcement string `json:"enforcement"`
+	// action -> ID of the filter of the firewall rule enforcing it
+	FilterIDByAction map[string]string `json:"filter_id_by_action"`
+	PausedActions    []string          `json:"paused_actions"`
+}
+
+// actionStatus is the state of an action of an account as shown by the admin API.
+type actionStatus struct {
+	Action            string   `json:"action"`
+	IPListID          string   `json:"ip_list_id,omitempty"`
+	IPListName        string   `json:"ip_list_name,omitempty"`
+	IPListSize        int      `json:"ip_list_size"`
+	Expression        string   `json:"expression,omitempty"`
+	Countries         []string `json:"countries"`
+	AutonomousSystems []string `json:"autonomous_systems"`
+	AccessRuleCount   int      `json:"access_rule_count"`
+	// AccessRulesByZoneID counts the access rules by zone, the rules of the account have an empty zone.
+	AccessRulesByZoneID map[string]int `json:"access_rules_by_zone_id,omitempty"`
+	ManualBanCount      int            `json:"manual_ban_count"`
+}
+
+// accountStatus is the state of the worker of an account as shown by the admin API.
+type accountStatus struct {
+	workerHealthStatus
+	PendingNewDecisions     int             `json:"pending_new_decisions"`
+	PendingExpiredDecisions int             `json:"pending_expired_decisions"`
+	APICallsThisSecond      uint32          `json:"api_calls_this_second"`
+	APICallsPerSecondLimit  uint32          `json:"api_calls_per_second_limit"`
+	Zones                   []zoneStatus    `json:"zones"`
+	Actions                 []actionStatus  `json:"actions"`
+	RecentErrors            []recordedError `json:"recent_errors"`
+}
+
+// publishStatus records the zones, states and pending decisions of the worker for the admin API. It is
+// called from the worker's goroutine, the admin API only reads the recorded copy.
+func (worker *CloudflareWorker) publishStatus() {
+	if worker.Health == nil {
+		return
+	}
+	zones := make([]zoneStatus, 0, len(worker.Account.ZoneConfigs))
+	for _, zone := range worker.Account.ZoneConfigs {
+		status := zoneStatus{ZoneID: zone.ID, Enforcement: ipListEnforcement, FilterIDByAction: make(map[string]string), PausedActions: worker.pausedActions(zone.ID)}
+		if worker.usesAccessRules(zone) {
+			status.Enforcement = accessRuleEnforcement
+		}
+		for _, action := range zone.Actions {
+			if state, ok := worker.CFStateByAction[action]; ok {
+				if filterID, ok := state.FilterIDByZoneID[zone.ID]; ok {
+					status.FilterIDByAction[action] = filterID
+				}
+			}
+		}
+		zones = append(zones, status)
+	}
+	actions := make([]actionStatus, 0, len(worker.CFStateByAction))
+	for action, state := range worker.CFStateByAction {
+		status := actionStatus{
+			Action:            action,
+			IPListSize:        len(state.IPListState.ItemByIP),
+			Expression:        state.CurrExpr,
+			Countries:         sortedKeys(state.CountrySet),
+			AutonomousSystems: sortedKeys(state.AutonomousSystemSet),
+			ManualBanCount:    len(state.ManualBans),
+		}
+		if state.IPListState.IPList != nil {
+			status.IPListID = state.IPListState.IPList.ID
+			status.IPListName = state.IPListState.IPList.Name
+		}
+		for zoneID, ruleIDByIP := range state.AccessRuleIDsByZoneID {
+			if len(ruleIDByIP) == 0 {
+				continue
+			}
+			if status.AccessRulesByZoneID == nil {
+				status.AccessRulesByZoneID = make(map[string]int)
+			}
+			status.AccessRulesByZoneID[zoneID] = len(ruleIDByIP)
+			status.AccessRuleCount += len(ruleIDByIP)
+		}
+		actions = append(actions, status)
+	}
+	sort.Slice(actions, func(i, j int) bool { return actions[i].Action < actions[j].Action })
+	pendingNew := len(worker.NewIPDecisions) + len(worker.NewCountryDecisions) + len(worker.NewASDecisions)
+	pendingExpired := len(worker.ExpiredIPDecisions) + len(worker.ExpiredCountryDecisions) + len(worker.ExpiredASDecisions)
+	worker.Health.recordStatus(zones, actions, pendingNew, pendingExpired)
+}
+
+func (h *workerHealth) accountStatus(now time.Time, staleAfter time.Duration, pollsLAPI bool) accountStatus {
+	status := accountStatus{workerHealthStatus: h.status(now, staleAfter, pollsLAPI), APICallsPerSecondLimit: CallsPerSecondLimit}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	status.PendingNewDecisions = h.pendingNew
+	status.PendingExpiredDecisions = h.pendingExpired
+	status.Zones = h.zones
+	status.Actions = h.actions
+	status.RecentErrors = append([]recordedError{}, h.recentErrors...)
+	if h.apiCallCount != nil {
+		status.APICallsThisSecond = atomic.LoadUint32(h.apiCallCount)
+	}
+	return status
+}
+
+func (r *healthRegistry) accountStatuses() []accountStatus {
+	now := time.Now()
+	statuses := make([]accountStatus, 0, len(r.workers))
+	for _, h := range r.workers {
+		statuses = append(statuses, h.accountStatus(now, r.staleAfter, r.pollsLAPI))
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].AccountID < statuses[j].AccountID })
+	return statuses
+}
+
+// adminRequest is a change requested through the admin API, applied by the worker of an account.
+type adminRequest struct {
+	apply func(worker *CloudflareWorker) error
+	done  chan error
+}
+
+// adminAPI serves the status of the workers and forwards the requested changes to them.
+type adminAPI struct {
+	health *healthRegistry
+	// account ID -> requests to the account's worker
+	requests   map[string]chan *adminRequest
+	zoneIDs    map[string][]string
+	accountIDs []string
+	timeout    time.Duration
+}
+
+func newAdminAPI(health *healthRegistry) *adminAPI {
+	return &adminAPI{health: health, requests: make(map[string]chan *adminRequest), zoneIDs: make(map[string][]string), timeout: time.Minute}
+}
+
+// register returns the channel of the requests to the account's worker. It must be called before serving.
+func (api *adminAPI) register(account AccountConfig) chan *adminRequest {
+	requests := make(chan *adminRequest)
+	api.requests[account.ID] = requests
+	api.accountIDs = append(api.accountIDs, account.ID)
+	for _, zone := range account.ZoneConfigs {
+		api.zoneIDs[account.ID] = append(api.zoneIDs[account.ID], zone.ID)
+	}
+	return requests
+}
+
+// selectAccounts returns the requested accounts, every account when none is requested.
+func (api *adminAPI) selectAccounts(accountIDs []string) ([]string, error) {
+	if len(accountIDs) == 0 {
+		return api.accountIDs, nil
+	}
+	for _, accountID := range accountIDs {
+		if _, ok := api.requests[accountID]; !ok {
+			return nil, fmt.Errorf("unknown account %s", accountID)
+		}
+	}
+	return accountIDs, nil
+}
+
+func (api *adminAPI) handleStatus(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.health.accountStatuses())
+}
+
+// adminResult is the outcome of a request for an account.
+type adminResult struct {
+	AccountID string `json:"account_id"`
+	Error     string `json:"error,omitempty"`
+}
+
+// dispatch sends the change to the workers of the accounts, which apply it concurrently, and writes their
+// results once they are all done or the timeout expired.
+func (api *adminAPI) dispatch(w http.ResponseWriter, req *http.Request, accountIDs []string, apply func(worker *CloudflareWorker) error) {
+	ctx, cancel := context.WithTimeout(req.Context(), api.timeout)
+	defer cancel()
+	resultStream := make(chan adminResult, len(accountIDs))
+	for _, accountID := range accountIDs {
+		accountReq := &adminRequest{apply: apply, done: make(chan error, 1)}
+		go func(accountID string, requests chan *adminRequest) {
+			result := adminResult{AccountID: accountID}
+			select {
+			case requests <- accountReq:
+			case <-ctx.Done():
+				result.Error = "worker is busy or not set up"
+				resultStream <- result
+				return
+			}
+			select {
+			case err := <-accountReq.done:
+				if err != nil {
+					result.Error = err.Error()
+				}
+			case <-ctx.Done():
+				result.Error = "timed out, the change is applied in the background"
+			}
+			resultStream <- result
+		}(accountID, api.requests[accountID])
+	}
+	status := http.StatusOK
+	results := make([]adminResult, 0, len(accountIDs))
+	for range accountIDs {
+		result := <-resultStream
+		if result.Error != "" {
+			status = http.StatusInternalServerError
+		}
+		results = append(results, result)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].AccountID < results[j].AccountID })
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(results)
+}
+
+// handleBan forwards the manual ban or unban to the workers of the requested accounts, or of every
+// account, and waits until they enforced it at cloudflare.
+func (api *adminAPI) handleBan(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "expecting POST", http.StatusMethodNotAllowed)
+		return
+	}
+	banReq := manualBanRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&banReq); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	banReq.Unban = req.URL.Path == "/unban"
+	if err := banReq.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	accountIDs, err := api.selectAccounts(banReq.Accounts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	api.dispatch(w, req, accountIDs, func(worker *CloudflareWorker) error {
+		return worker.applyManualBan(&banReq)
+	})
+}
+
+// handleImport forwards the imported bans to the workers of every account, each one enforces the bans of
+// its account.
+func (api *adminAPI) handleImport(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "expecting POST", http.StatusMethodNotAllowed)
+		return
+	}
+	importReq := importRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&importReq); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := importReq.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	api.dispatch(w, req, api.accountIDs, func(worker *CloudflareWorker) error {
+		return worker.importBans(&importReq)
+	})
+}
+
+// handlePause forwards the pause or resume to the workers of the requested accounts and zones.
+func (api *adminAPI) handlePause(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "expecting POST", http.StatusMethodNotAllowed)
+		return
+	}
+	pauseReq := pauseRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&pauseReq); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pauseReq.Resume = req.URL.Path == "/resume"
+	accountIDs, err := api.selectAccounts(pauseReq.Accounts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(pauseReq.Zones) > 0 {
+		accountIDs, err = api.selectZoneAccounts(accountIDs, pauseReq.Zones)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	api.dispatch(w, req, accountIDs, func(worker *CloudflareWorker) error {
+		return worker.setRulesPaused(pauseReq.Zones, !pauseReq.Resume)
+	})
+}
+
+// selectZoneAccounts returns the accounts owning the zones. Every zone must belong to one of the accounts.
+func (api *adminAPI) selectZoneAccounts(accountIDs []string, zoneIDs []string) ([]string, error) {
+	accountIDByZoneID := make(map[string]string)
+	for _, accountID := range accountIDs {
+		for _, zoneID := range api.zoneIDs[accountID] {
+			accountIDByZoneID[zoneID] = accountID
+		}
+	}
+	selected := make(map[string]struct{})
+	for _, zoneID := range zoneIDs {
+		accountID, ok := accountIDByZoneID[zoneID]
+		if !ok {
+			return nil, fmt.Errorf("unknown zone %s", zoneID)
+		}
+		selected[accountID] = struct{}{}
+	}
+	return sortedKeys(selected), nil
+}
+
+func newAdminHandler(api *adminAPI) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", api.handleStatus)
+	mux.HandleFunc("/ban", api.handleBan)
+	mux.HandleFunc("/unban", api.handleBan)
+	mux.HandleFunc("/import", api.handleImport)
+	mux.HandleFunc("/pause", api.handlePause)
+	mux.HandleFunc("/resume", api.handlePause)
+	return mux
+}
+
+// serveAdmin serves the admin API on the unix socket. The socket is only accessible to the bouncer's user.
+func serveAdmin(socketPath string, api *adminAPI) error {
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("while removing previous admin socket: %w", err)
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		return err
+	}
+	return http.Serve(listener, newAdminHandler(api))
+}
+
+// adminClient returns a HTTP client querying the admin API on the unix socket.
+func adminClient(socketPath string) *http.Client {
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+}
+
+// requestManualBan sends the manual ban or unban to the admin API of a running bouncer.
+func requestManualBan(socketPath string, banReq manualBanRequest) ([]adminResult, error) {
+	path := "/ban"
+	if banReq.Unban {
+		path = "/unban"
+	}
+	return postAdminRequest(socketPath, path, banReq)
+}
+
+// adminRunning returns whether a bouncer serves the admin API on the unix socket.
+func adminRunning(socketPath string) bool {
+	conn, err := net.DialTimeout("unix", socketPath, time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// postAdminRequest sends the request to the admin API of a running bouncer and returns the results of
+// the accounts.
+func postAdminRequest(socketPath string, path string, request interface{}) ([]adminResult, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	client := adminClient(socketPath)
+	client.Timeout = 2 * time.Minute
+	resp, err := client.Post("http://bouncer"+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("while querying the bouncer, is it running? %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusBadRequest {
+		msg, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("invalid request: %s", strings.TrimSpace(string(msg)))
+	}
+	results := make([]adminResult, 0)
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return nil, fmt.Errorf("admin API returned %s: %w", resp.Status, err)
+	}
+	return results, nil
+}
+
+// queryStatus returns the status of the accounts from the admin API of a running bouncer.
+func queryStatus(socketPath string) ([]accountStatus, error) {
+	resp, err := adminClient(socketPath).Get("http://bouncer/status")
+	if err != nil {
+		return nil, fmt.Errorf("while querying the bouncer, is it running? %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("admin API returned %s", resp.Status)
+	}
+	statuses := make([]accountStatus, 0)
+	if err := json.NewDecoder(resp.Body).Decode(&statuses); err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+func formatSince(t *time.Time, now time.Time) string {
+	if t == nil {
+		return "never"
+	}
+	return fmt.Sprintf("%s ago", now.Sub(*t).Round(time.Second))
+}
+
+func joinOrNone(values []string) string {
+	if len(values) == 0 {
+		return "-"
+	}
+	return strings.Join(values, ",")
+}
+
+// writeStatus writes the status of the accounts either as tables or as JSON.
+func writeStatus(w io.Writer, statuses []accountStatus, format string) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "	")
+		return encoder.Encode(statuses)
+	case "table", "":
+		now := time.Now()
+		for _, status := range statuses {
+			state := "running"
+			switch {
+			case !status.Alive:
+				state = "dead"
+			case status.Disabled:
+				state = "disabled"
+			case status.Degraded:
+				state = "degraded"
+			case !status.Ready:
+				state = "setting up"
+			case status.Stale:
+				state = "stale"
+			}
+			fmt.Fprintf(w, "Account %s: %s\n", status.AccountID, state)
+			if status.Restarts > 0 {
+				fmt.Fprintf(w, "  restarts: %d\n", status.Restarts)
+			}
+			fmt.Fprintf(w, "  last cloudflare sync: %s, last LAPI poll: %s\n", formatSince(status.LastCloudflareSync, now), formatSince(status.LastLAPIPoll, now))
+			fmt.Fprintf(w, "  pending decisions: %d new, %d expired\n", status.PendingNewDecisions, status.PendingExpiredDecisions)
+			fmt.Fprintf(w, "  API calls: %d this second, limit %d/s\n", status.APICallsThisSecond, status.APICallsPerSecondLimit)
+
+			tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "  ZONE\tENFORCEMENT\tFILTERS\tPAUSED")
+			for _, zone := range status.Zones {
+				filters := make([]string, 0, len(zone.FilterIDByAction))
+				for action, filterID := range zone.FilterIDByAction {
+					filters = append(filters, fmt.Sprintf("%s=%s", action, filterID))
+				}
+				sort.Strings(filters)
+				fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", zone.ZoneID, zone.Enforcement, joinOrNone(filters), joinOrNone(zone.PausedActions))
+			}
+			fmt.Fprintln(tw, "  ACTION\tIP LIST\tITEMS\tACCESS RULES\tMANUAL BANS\tCOUNTRIES\tAS")
+			for _, action := range status.Actions {
+				list := "-"
+				if action.IPListName != "" {
+					list = fmt.Sprintf("%s (%s)", action.IPListName, action.IPListID)
+				}
+				fmt.Fprintf(tw, "  %s\t%s\t%d\t%d\t%d\t%s\t%s\n", action.Action, list, action.IPListSize, action.AccessRuleCount, action.ManualBanCount, joinOrNone(action.Countries), joinOrNone(action.AutonomousSystems))
+			}
+			if err := tw.Flush(); err != nil {
+				return err
+			}
+			if len(status.RecentErrors) > 0 {
+				fmt.Fprintln(w, "  recent errors:")
+				for _, recorded := range status.RecentErrors {
+					fmt.Fprintf(w, "    %s %s\n", recorded.At.Format(time.RFC3339), recorded.Error)
+				}
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown status output format '%s', expecting 'table' or 'json'", format)
+	}
+}
+
+// writeAdminResults writes the result of a request for every account, it fails if any account failed.
+func writeAdminResults(w io.Writer, results []adminResult, success string) error {
+	failed := 0
+	for _, result := range results {
+		if result.Error != "" {
+			failed++
+			fmt.Fprintf(w, "%s: failed: %s\n", result.AccountID, result.Error)
+			continue
+		}
+		fmt.Fprintf(w, "%s: %s\n", result.AccountID, success)
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed on %d accounts", failed)
+	}
+	return nil
+}
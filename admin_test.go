@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+)
+
+func TestCloudflareWorker_publishStatus(t *testing.T) {
+	ip := "1.2.3.4"
+	worker := &CloudflareWorker{
+		Account: AccountConfig{
+			ID: "account1",
+			ZoneConfigs: []ZoneConfig{
+				{ID: "zone1", Actions: []string{"block"}},
+				{ID: "zone2", Actions: []string{"challenge"}, Enforcement: accessRuleEnforcement},
+			},
+		},
+		CFStateByAction: map[string]*CloudflareState{
+			"block": {
+				Action:           "block",
+				FilterIDByZoneID: map[string]string{"zone1": "filter1"},
+				IPListState:      IPListState{IPList: &cloudflare.IPList{ID: "list1", Name: "crowdsec_block"}, ItemByIP: map[string]cloudflare.IPListItem{"1.2.3.4": {}}},
+				CountrySet:       map[string]struct{}{"FR": {}, "BE": {}},
+			},
+			"challenge": {
+				Action:                "challenge",
+				AccessRuleIDsByZoneID: map[string]map[string]string{"zone2": {"5.6.7.8": "rule1"}},
+			},
+		},
+		NewIPDecisions:      []*models.Decision{{Value: &ip}},
+		ExpiredASDecisions:  []*models.Decision{{Value: &ip}},
+		ExpiredIPDecisions:  []*models.Decision{{Value: &ip}},
+		NewCountryDecisions: []*models.Decision{{Value: &ip}},
+	}
+	var apiCallCount uint32 = 2
+	registry := newHealthRegistry(time.Minute, true)
+	worker.Health = registry.register("account1", &apiCallCount)
+	worker.Health.recordError(errors.New("rate limited"))
+	worker.publishStatus()
+
+	status := registry.accountStatuses()[0]
+	if status.PendingNewDecisions != 2 || status.PendingExpiredDecisions != 2 || status.APICallsThisSecond != 2 {
+		t.Errorf("unexpected counters %+v", status)
+	}
+	if len(status.Zones) != 2 || status.Zones[0].FilterIDByAction["block"] != "filter1" || status.Zones[1].Enforcement != accessRuleEnforcement {
+		t.Errorf("unexpected zones %+v", status.Zones)
+	}
+	if len(status.Actions) != 2 || status.Actions[0].IPListSize != 1 || strings.Join(status.Actions[0].Countries, ",") != "BE,FR" || status.Actions[1].AccessRuleCount != 1 {
+		t.Errorf("unexpected actions %+v", status.Actions)
+	}
+	if len(status.RecentErrors) != 1 || status.RecentErrors[0].Error != "rate limited" {
+		t.Errorf("unexpected errors %+v", status.RecentErrors)
+	}
+}
+
+func TestAdminStatus(t *testing.T) {
+	registry := newHealthRegistry(time.Minute, true)
+	health := registry.register("account1", nil)
+	health.setReady()
+	health.recordStatus([]zoneStatus{{ZoneID: "zone1", Enforcement: ipListEnforcement, FilterIDByAction: map[string]string{"block": "filter1"}}},
+		[]actionStatus{{Action: "block", IPListID: "list1", IPListName: "crowdsec_block", IPListSize: 3}}, 1, 0)
+	for i := 0; i < maxRecentErrors+2; i++ {
+		health.recordError(errors.New("rate limited"))
+	}
+
+	socketPath := filepath.Join(t.TempDir(), "admin.sock")
+	go serveAdmin(socketPath, newAdminAPI(registry))
+	var statuses []accountStatus
+	var err error
+	for i := 0; i < 50; i++ {
+		if statuses, err = queryStatus(socketPath); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1 || !statuses[0].Ready || len(statuses[0].Actions) != 1 || statuses[0].PendingNewDecisions != 1 {
+		t.Fatalf("unexpected status %+v", statuses)
+	}
+	if len(statuses[0].RecentErrors) != maxRecentErrors {
+		t.Errorf("expected %d recent errors, found %d", maxRecentErrors, len(statuses[0].RecentErrors))
+	}
+
+	buf := bytes.Buffer{}
+	if err := writeStatus(&buf, statuses, "table"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Account account1: running", "block=filter1", "crowdsec_block (list1)", "1 new, 0 expired"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("expected %q in\n%s", want, buf.String())
+		}
+	}
+	if err := writeStatus(&buf, statuses, "xml"); err == nil {
+		t.Error("expected error on unknown format")
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// auditEntry is a change made at cloudflare, as written in the audit log. IPs, Countries and
+// AutonomousSystems are the values the change bans, or unbans when it deletes.
+type auditEntry struct {
+	Time                      time.Time       `json:"time"`
+	AccountID                 string          `json:"account_id"`
+	ZoneID                    string          `json:"zone_id,omitempty"`
+	Operation                 string          `json:"operation"` // create, update or delete
+	Resource                  string          `json:"resource"`  // ip_list, ip_list_items, firewall_rule, filter or access_rule
+	ID                        string          `json:"id,omitempty"`
+	Name                      string          `json:"name,omitempty"`
+	Action                    string          `json:"action,omitempty"`
+	Expression                string          `json:"expression,omitempty"`
+	Paused                    *bool           `json:"paused,omitempty"`
+	IPs                       []string        `json:"ips,omitempty"`
+	Countries                 []string        `json:"countries,omitempty"`
+	AutonomousSystems         []string        `json:"autonomous_systems,omitempty"`
+	UnbannedCountries         []string        `json:"unbanned_countries,omitempty"`
+	UnbannedAutonomousSystems []string        `json:"unbanned_autonomous_systems,omitempty"`
+	Decisions                 []auditDecision `json:"decisions,omitempty"`
+}
+
+// auditDecision is the decision a change was made for.
+type auditDecision struct {
+	Value    string `json:"value"`
+	Expired  bool   `json:"expired,omitempty"`
+	ID       int64  `json:"id,omitempty"`
+	Origin   string `json:"origin,omitempty"`
+	Scenario string `json:"scenario,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+	Type     string `json:"type,omitempty"`
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func newAuditDecision(decision *models.Decision, expired bool) auditDecision {
+	return auditDecision{
+		Value:    stringValue(decision.Value),
+		Expired:  expired,
+		ID:       decision.ID,
+		Origin:   stringValue(decision.Origin),
+		Scenario: stringValue(decision.Scenario),
+		Scope:    stringValue(decision.Scope),
+		Type:     stringValue(decision.Type),
+	}
+}
+
+// auditLog appends the changes made at cloudflare to a JSON lines file, the methods are safe to call on
+// a nil auditLog.
+type auditLog struct {
+	mu  sync.Mutex
+	out io.WriteCloser
+}
+
+// newAuditLog returns the audit log of the config, nil when it is disabled.
+func newAuditLog(conf AuditLogConfig) *auditLog {
+	if conf.Path == "" {
+		return nil
+	}
+	return &auditLog{out: &lumberjack.Logger{
+		Filename:   conf.Path,
+		MaxSize:    conf.MaxSize,
+		MaxBackups: conf.MaxBackups,
+		MaxAge:     conf.MaxAge,
+		Compress:   conf.Compress,
+	}}
+}
+
+func (l *auditLog) record(entry auditEntry) {
+	if l == nil {
+		return
+	}
+	entry.Time = time.Now().UTC()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Errorf("while encoding audit entry: %s", err)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.out.Write(append(line, '\n')); err != nil {
+		log.Errorf("while writing audit entry: %s", err)
+	}
+}
+
+func (l *auditLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.out.Close()
+}
+
+type auditKey struct {
+	value   string
+	expired bool
+}
+
+// rememberDecisions keeps the decisions being applied, the audit entries of the changes they cause name
+// them. They are forgotten once the rules are updated.
+func (worker *CloudflareWorker) rememberDecisions(decisions []*models.Decision, expired bool) {
+	if worker.Audit == nil {
+		return
+	}
+	if worker.auditDecisions == nil {
+		worker.auditDecisions = make(map[auditKey]*models.Decision)
+	}
+	for _, decision := range decisions {
+		worker.auditDecisions[auditKey{value: normalizeDecisionValue(*decision.Value), expired: expired}] = decision
+	}
+}
+
+// decisionsOf returns the remembered decisions on the values.
+func (worker *CloudflareWorker) decisionsOf(values []string, expired bool) []auditDecision {
+	decisions := make([]auditDecision, 0)
+	for _, value := range values {
+		if decision, ok := worker.auditDecisions[auditKey{value: value, expired: expired}]; ok {
+			decisions = append(decisions, newAuditDecision(decision, expired))
+		}
+	}
+	return decisions
+}
+
+var (
+	countryExprPattern = regexp.MustCompile(`ip\.geoip\.country in \{([^}]*)\}`)
+	asExprPattern      = regexp.MustCompile(`ip\.geoip\.asnum in \{([^}]*)\}`)
+)
+
+// expressionValues returns the values of the set matched by the pattern in the expression of a rule.
+func expressionValues(pattern *regexp.Regexp, expression string) map[string]struct{} {
+	values := make(map[string]struct{})
+	if match := pattern.FindStringSubmatch(expression); match != nil {
+		for _, value := range strings.Fields(match[1]) {
+			values[strings.Trim(value, `"`)] = struct{}{}
+		}
+	}
+	return values
+}
+
+// setDifference returns the sorted values of a which aren't in b.
+func setDifference(a map[string]struct{}, b map[string]struct{}) []string {
+	values := make([]string, 0)
+	for value := range a {
+		if _, ok := b[value]; !ok {
+			values = append(values, value)
+		}
+	}
+	sort.Strings(values)
+	return values
+}
+
+// auditingCloudflareAPI writes an audit entry for every change the wrapped API made at cloudflare. It
+// reads the state of the worker to find what the changes affect and the decisions they were made for.
+type auditingCloudflareAPI struct {
+	api    cloudflareAPI
+	worker *CloudflareWorker
+	// the last known expression of each filter, to tell the countries and AS an update changes.
+	exprByFilterID map[string]string
+	ipListNameByID map[string]string
+}
+
+func newAuditingCloudflareAPI(api cloudflareAPI, worker *CloudflareWorker) *auditingCloudflareAPI {
+	auditing := &auditingCloudflareAPI{
+		api:            api,
+		worker:         worker,
+		exprByFilterID: make(map[string]string),
+		ipListNameByID: make(map[string]string),
+	}
+	for _, state := range worker.CFStateByAction {
+		for _, filterID := range state.FilterIDByZoneID {
+			auditing.exprByFilterID[filterID] = state.CurrExpr
+		}
+		if state.IPListState.IPList != nil {
+			auditing.ipListNameByID[state.IPListState.IPList.ID] = state.IPListState.IPList.Name
+		}
+	}
+	return auditing
+}
+
+func (api *auditingCloudflareAPI) record(entry auditEntry) {
+	entry.AccountID = api.worker.Account.ID
+	api.worker.Audit.record(entry)
+}
+
+// recordExpression records the creation or update of a rule or filter with the countries and AS it bans
+// and unbans.
+func (api *auditingCloudflareAPI) recordExpression(entry auditEntry, filterID string) {
+	previous := api.exprByFilterID[filterID]
+	for _, values := range []struct {
+		pattern  *regexp.Regexp
+		banned   *[]string
+		unbanned *[]string
+	}{
+		{countryExprPattern, &entry.Countries, &entry.UnbannedCountries},
+		{asExprPattern, &entry.AutonomousSystems, &entry.UnbannedAutonomousSystems},
+	} {
+		current, before := expressionValues(values.pattern, entry.Expression), expressionValues(values.pattern, previous)
+		*values.banned = setDifference(current, before)
+		*values.unbanned = setDifference(before, current)
+		entry.Decisions = append(entry.Decisions, api.worker.decisionsOf(*values.banned, false)...)
+		entry.Decisions = append(entry.Decisions, api.worker.decisionsOf(*values.unbanned, true)...)
+	}
+	if filterID != "" {
+		api.exprByFilterID[filterID] = entry.Expression
+	}
+	api.record(entry)
+}
+
+// actionOfIPList returns the action of the state owning the IP list.
+func (api *auditingCloudflareAPI) actionOfIPList(id string) string {
+	for action, state := range api.worker.CFStateByAction {
+		if state.IPListState.IPList != nil && state.IPListState.IPList.ID == id {
+			return action
+		}
+	}
+	return ""
+}
+
+// ipsOfIPList returns the IPs the state has in the list, sorted.
+func (api *auditingCloudflareAPI) ipsOfIPList(id string) []string {
+	ips := make([]string, 0)
+	for _, state := range api.worker.CFStateByAction {
+		if state.IPListState.IPList == nil || state.IPListState.IPList.ID != id {
+			continue
+		}
+		for ip := range state.IPListState.ItemByIP {
+			ips = append(ips, ip)
+		}
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+func (api *auditingCloudflareAPI) Filters(ctx context.Context, zoneID string, pageOpts cloudflare.PaginationOptions) ([]cloudflare.Filter, error) {
+	filters, err := api.api.Filters(ctx, zoneID, pageOpts)
+	for _, filter := range filters {
+		api.exprByFilterID[filter.ID] = filter.Expression
+	}
+	return filters, err
+}
+
+func (api *auditingCloudflareAPI) ListZones(ctx context.Context, z ...string) ([]cloudflare.Zone, error) {
+	return api.api.ListZones(ctx, z...)
+}
+
+func (api *auditingCloudflareAPI) ListIPLists(ctx context.Context) ([]cloudflare.IPList, error) {
+	ipLists, err := api.api.ListIPLists(ctx)
+	for _, ipList := range ipLists {
+		api.ipListNameByID[ipList.ID] = ipList.Name
+	}
+	return ipLists, err
+}
+
+func (api *auditingCloudflareAPI) ListIPListItems(ctx context.Context, id string) ([]cloudflare.IPListItem, error) {
+	return api.api.ListIPListItems(ctx, id)
+}
+
+func (api *auditingCloudflareAPI) FirewallRules(ctx context.Context, zone string, opts cloudflare.PaginationOptions) ([]cloudflare.FirewallRule, error) {
+	rules, err := api.api.FirewallRules(ctx, zone, opts)
+	for _, rule := range rules {
+		api.exprByFilterID[rule.Filter.ID] = rule.Filter.Expression
+	}
+	return rules, err
+}
+
+func (api *auditingCloudflareAPI) ListAccountAccessRules(ctx context.Context, accountID string, accessRule cloudflare.AccessRule, page int) (*cloudflare.AccessRuleListResponse, error) {
+	return api.api.ListAccountAccessRules(ctx, accountID, accessRule, page)
+}
+
+func (api *auditingCloudflareAPI) ListZoneAccessRules(ctx context.Context, zoneID string, accessRule cloudflare.AccessRule, page int) (*cloudflare.AccessRuleListResponse, error) {
+	return api.api.ListZoneAccessRules(ctx, zoneID, accessRule, page)
+}
+
+func (api *auditingCloudflareAPI) CreateIPList(ctx context.Context, name string, desc string, typ string) (cloudflare.IPList, error) {
+	ipList, err := api.api.CreateIPList(ctx, name, desc, typ)
+	if err == nil {
+		api.ipListNameByID[ipList.ID] = ipList.Name
+		api.record(auditEntry{Operation: "create", Resource: "ip_list", ID: ipList.ID, Name: ipList.Name})
+	}
+	return ipList, err
+}
+
+func (api *auditingCloudflareAPI) DeleteIPList(ctx context.Context, id string) (cloudflare.IPListDeleteResponse, error) {
+	// the items are deleted with the list.
+	ips := api.ipsOfIPList(id)
+	resp, err := api.api.DeleteIPList(ctx, id)
+	if err == nil {
+		api.record(auditEntry{Operation: "delete", Resource: "ip_list", ID: id, Name: api.ipListNameByID[id], Action: api.actionOfIPList(id), IPs: ips})
+	}
+	return resp, err
+}
+
+func (api *auditingCloudflareAPI) CreateIPListItems(ctx context.Context, id string, items []cloudflare.IPListItemCreateRequest) ([]cloudflare.IPListItem, error) {
+	created, err := api.api.CreateIPListItems(ctx, id, items)
+	if err == nil {
+		ips := make([]string, len(items))
+		for i, item := range items {
+			ips[i] = item.IP
+		}
+		api.record(auditEntry{Operation: "create", Resource: "ip_list_items", ID: id, Name: api.ipListNameByID[id], Action: api.actionOfIPList(id), IPs: ips, Decisions: api.worker.decisionsOf(ips, false)})
+	}
+	return created, err
+}
+
+func (api *auditingCloudflareAPI) DeleteIPListItems(ctx context.Context, id string, items cloudflare.IPListItemDeleteRequest) ([]cloudflare.IPListItem, error) {
+	// the IPs are read before the call, the state forgets them once they are deleted.
+	ipByItemID := make(map[string]string)
+	for _, state := range api.worker.CFStateByAction {
+		if state.IPListState.IPList != nil && state.IPListState.IPList.ID == id {
+			for ip, item := range state.IPListState.ItemByIP {
+				ipByItemID[item.ID] = ip
+			}
+		}
+	}
+	action := api.actionOfIPList(id)
+	remaining, err := api.api.DeleteIPListItems(ctx, id, items)
+	if err == nil {
+		ips := make([]string, 0, len(items.Items))
+		for _, item := range items.Items {
+			if ip, ok := ipByItemID[item.ID]; ok {
+				ips = append(ips, ip)
+			}
+		}
+		api.record(auditEntry{Operation: "delete", Resource: "ip_list_items", ID: id, Name: api.ipListNameByID[id], Action: action, IPs: ips, Decisions: api.worker.decisionsOf(ips, true)})
+	}
+	return remaining, err
+}
+
+func (api *auditingCloudflareAPI) CreateFirewallRules(ctx context.Context, zone string, rules []cloudflare.FirewallRule) ([]cloudflare.FirewallRule, error) {
+	created, err := api.api.CreateFirewallRules(ctx, zone, rules)
+	if err == nil {
+		for _, rule := range created {
+			api.recordExpression(auditEntry{Operation: "create", Resource: "firewall_rule", ZoneID: zone, ID: rule.ID, Action: rule.Action, Expression: rule.Filter.Expression}, rule.Filter.ID)
+		}
+	}
+	return created, err
+}
+
+func (api *auditingCloudflareAPI) UpdateFirewallRules(ctx context.Context, zone string, rules []cloudflare.FirewallRule) ([]cloudflare.FirewallRule, error) {
+	updated, err := api.api.UpdateFirewallRules(ctx, zone, rules)
+	if err == nil {
+		for _, rule := range rules {
+			paused := rule.Paused
+			api.record(auditEntry{Operation: "update", Resource: "firewall_rule", ZoneID: zone, ID: rule.ID, Action: rule.Action, Paused: &paused})
+		}
+	}
+	return updated, err
+}
+
+func (api *auditingCloudflareAPI) DeleteFirewallRules(ctx context.Context, zoneID string, firewallRuleIDs []string) error {
+	err := api.api.DeleteFirewallRules(ctx, zoneID, firewallRuleIDs)
+	if err == nil {
+		for _, id := range firewallRuleIDs {
+			api.record(auditEntry{Operation: "delete", Resource: "firewall_rule", ZoneID: zoneID, ID: id})
+		}
+	}
+	return err
+}
+
+func (api *auditingCloudflareAPI) UpdateFilters(ctx context.Context, zoneID string, filters []cloudflare.Filter) ([]cloudflare.Filter, error) {
+	updated, err := api.api.UpdateFilters(ctx, zoneID, filters)
+	if err == nil {
+		for _, filter := range filters {
+			api.recordExpression(auditEntry{Operation: "update", Resource: "filter", ZoneID: zoneID, ID: filter.ID, Expression: filter.Expression}, filter.ID)
+		}
+	}
+	return updated, err
+}
+
+func (api *auditingCloudflareAPI) DeleteFilters(ctx context.Context, zoneID string, filterIDs []string) error {
+	err := api.api.DeleteFilters(ctx, zoneID, filterIDs)
+	if err == nil {
+		for _, id := range filterIDs {
+			entry := auditEntry{Operation: "delete", Resource: "filter", ZoneID: zoneID, ID: id}
+			// the countries and AS of the filter aren't banned in the zone anymore.
+			entry.UnbannedCountries = setDifference(expressionValues(countryExprPattern, api.exprByFilterID[id]), nil)
+			entry.UnbannedAutonomousSystems = setDifference(expressionValues(asExprPattern, api.exprByFilterID[id]), nil)
+			delete(api.exprByFilterID, id)
+			api.record(entry)
+		}
+	}
+	return err
+}
+
+// accessRuleIP returns the IP enforced by the access rule, from the state of the worker.
+func (api *auditingCloudflareAPI) accessRuleIP(zoneID string, id string) (string, string) {
+	for action, state := range api.worker.CFStateByAction {
+		for ip, ruleID := range state.AccessRuleIDsByZoneID[zoneID] {
+			if ruleID == id {
+				return ip, action
+			}
+		}
+	}
+	return "", ""
+}
+
+func (api *auditingCloudflareAPI) recordAccessRuleCreation(zoneID string, accessRule cloudflare.AccessRule, resp *cloudflare.AccessRuleResponse) {
+	ips := []string{accessRule.Configuration.Value}
+	api.record(auditEntry{Operation: "create", Resource: "access_rule", ZoneID: zoneID, ID: resp.Result.ID, Action: accessRule.Mode, IPs: ips, Decisions: api.worker.decisionsOf(ips, false)})
+}
+
+func (api *auditingCloudflareAPI) recordAccessRuleDeletion(zoneID string, id string, ip string, action string) {
+	entry := auditEntry{Operation: "delete", Resource: "access_rule", ZoneID: zoneID, ID: id, Action: action}
+	if ip != "" {
+		entry.IPs = []string{ip}
+		entry.Decisions = api.worker.decisionsOf(entry.IPs, true)
+	}
+	api.record(entry)
+}
+
+func (api *auditingCloudflareAPI) CreateAccountAccessRule(ctx context.Context, accountID string, accessRule cloudflare.AccessRule) (*cloudflare.AccessRuleResponse, error) {
+	resp, err := api.api.CreateAccountAccessRule(ctx, accountID, accessRule)
+	if err == nil {
+		api.recordAccessRuleCreation("", accessRule, resp)
+	}
+	return resp, err
+}
+
+func (api *auditingCloudflareAPI) CreateZoneAccessRule(ctx context.Context, zoneID string, accessRule cloudflare.AccessRule) (*cloudflare.AccessRuleResponse, error) {
+	resp, err := api.api.CreateZoneAccessRule(ctx, zoneID, accessRule)
+	if err == nil {
+		api.recordAccessRuleCreation(zoneID, accessRule, resp)
+	}
+	return resp, err
+}
+
+func (api *auditingCloudflareAPI) DeleteAccountAccessRule(ctx context.Context, accountID, accessRuleID string) (*cloudflare.AccessRuleResponse, error) {
+	ip, action := api.accessRuleIP("", accessRuleID)
+	resp, err := api.api.DeleteAccountAccessRule(ctx, accountID, accessRuleID)
+	if err == nil {
+		api.recordAccessRuleDeletion("", accessRuleID, ip, action)
+	}
+	return resp, err
+}
+
+func (api *auditingCloudflareAPI) DeleteZoneAccessRule(ctx context.Context, zoneID, accessRuleID string) (*cloudflare.AccessRuleResponse, error) {
+	ip, action := api.accessRuleIP(zoneID, accessRuleID)
+	resp, err := api.api.DeleteZoneAccessRule(ctx, zoneID, accessRuleID)
+	if err == nil {
+		api.recordAccessRuleDeletion(zoneID, accessRuleID, ip, action)
+	}
+	return resp, err
+}
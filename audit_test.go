@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+)
+
+type nopCloseBuffer struct {
+	bytes.Buffer
+}
+
+func (b *nopCloseBuffer) Close() error { return nil }
+
+func readAuditEntries(t *testing.T, out *nopCloseBuffer) []auditEntry {
+	entries := make([]auditEntry, 0)
+	scanner := bufio.NewScanner(&out.Buffer)
+	for scanner.Scan() {
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("invalid audit line %s: %s", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAuditingCloudflareAPI(t *testing.T) {
+	out := &nopCloseBuffer{}
+	worker := newTestWorker()
+	worker.Audit = &auditLog{out: out}
+	worker.CFStateByAction["challenge"].CurrExpr = `(ip.geoip.country in {"DE"})`
+	worker.API = newAuditingCloudflareAPI(worker.API, worker)
+	decision := func(id int64, value string, scope string) *models.Decision {
+		decisionType, scenario, origin := "captcha", "crowdsecurity/http-probing", "crowdsec"
+		return &models.Decision{ID: id, Value: &value, Scope: &scope, Type: &decisionType, Scenario: &scenario, Origin: &origin}
+	}
+
+	worker.CollectLAPIStream(&models.DecisionsStreamResponse{New: []*models.Decision{
+		decision(1, "1.2.3.4", "Ip"),
+		decision(2, "FR", "Country"),
+	}})
+	if err := worker.AddNewIPs(); err != nil {
+		t.Fatal(err)
+	}
+	if err := worker.SendCountryBans(); err != nil {
+		t.Fatal(err)
+	}
+	if err := worker.UpdateRules(); err != nil {
+		t.Fatal(err)
+	}
+	worker.CollectLAPIStream(&models.DecisionsStreamResponse{Deleted: []*models.Decision{decision(1, "1.2.3.4", "Ip")}})
+	if err := worker.DeleteIPs(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := readAuditEntries(t, out)
+	if len(entries) != 3 {
+		t.Fatalf("expected an entry for the item creation, the filter update and the item deletion, found %+v", entries)
+	}
+	created, updated, deleted := entries[0], entries[1], entries[2]
+	if created.Operation != "create" || created.Resource != "ip_list_items" || created.ID != "list1" || created.Action != "challenge" || created.AccountID != "account1" {
+		t.Errorf("unexpected creation entry %+v", created)
+	}
+	if len(created.IPs) != 1 || created.IPs[0] != "1.2.3.4" {
+		t.Errorf("expected the created IP, found %v", created.IPs)
+	}
+	if len(created.Decisions) != 1 || created.Decisions[0].ID != 1 || created.Decisions[0].Scenario != "crowdsecurity/http-probing" || created.Decisions[0].Origin != "crowdsec" {
+		t.Errorf("expected the decision of the IP, found %+v", created.Decisions)
+	}
+	if updated.Operation != "update" || updated.Resource != "filter" || updated.ZoneID != "zone1" || updated.ID != "filter1" {
+		t.Errorf("unexpected update entry %+v", updated)
+	}
+	if len(updated.Countries) != 1 || updated.Countries[0] != "FR" || len(updated.UnbannedCountries) != 1 || updated.UnbannedCountries[0] != "DE" {
+		t.Errorf("expected FR to be banned and DE unbanned, found %v and %v", updated.Countries, updated.UnbannedCountries)
+	}
+	if len(updated.Decisions) != 1 || updated.Decisions[0].ID != 2 {
+		t.Errorf("expected the decision of the country, found %+v", updated.Decisions)
+	}
+	if deleted.Operation != "delete" || deleted.Resource != "ip_list_items" || len(deleted.IPs) != 1 || deleted.IPs[0] != "1.2.3.4" {
+		t.Errorf("unexpected deletion entry %+v", deleted)
+	}
+	if len(deleted.Decisions) != 1 || !deleted.Decisions[0].Expired {
+		t.Errorf("expected the expired decision of the IP, found %+v", deleted.Decisions)
+	}
+}
+
+func Test_newAuditLog(t *testing.T) {
+	if newAuditLog(AuditLogConfig{}) != nil {
+		t.Error("expected the audit log to be disabled without a path")
+	}
+	var disabled *auditLog
+	disabled.record(auditEntry{Operation: "create"})
+	if err := disabled.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAuditingCloudflareAPI_DeleteIPList(t *testing.T) {
+	out := &nopCloseBuffer{}
+	worker := newTestWorker()
+	worker.Audit = &auditLog{out: out}
+	state := worker.CFStateByAction["challenge"]
+	state.IPListState.ItemByIP["5.6.7.8"] = cloudflare.IPListItem{ID: "i2", IP: "5.6.7.8"}
+	state.IPListState.ItemByIP["1.2.3.4"] = cloudflare.IPListItem{ID: "i1", IP: "1.2.3.4"}
+	worker.API = newAuditingCloudflareAPI(worker.API, worker)
+
+	if _, err := worker.API.DeleteIPList(worker.Ctx, "list1"); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := readAuditEntries(t, out)
+	if len(entries) != 1 {
+		t.Fatalf("expected an entry for the list deletion, found %+v", entries)
+	}
+	deleted := entries[0]
+	if deleted.Operation != "delete" || deleted.Resource != "ip_list" || deleted.ID != "list1" || deleted.Action != "challenge" {
+		t.Errorf("unexpected deletion entry %+v", deleted)
+	}
+	if len(deleted.IPs) != 2 || deleted.IPs[0] != "1.2.3.4" || deleted.IPs[1] != "5.6.7.8" {
+		t.Errorf("expected the items of the list, found %v", deleted.IPs)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// edgeIP is an IP or a range to enforce at the edge, with the reason it is enforced.
+type edgeIP struct {
+	Value   string
+	Comment string
+}
+
+// applyResult reports what a backend changed at the edge.
+type applyResult struct {
+	Added   int
+	Removed int
+	Updated int
+	// Dropped contains the added IPs and ranges the backend can't enforce, with the reason.
+	Dropped map[string]string
+}
+
+// drop records that the IP or range can't be enforced.
+func (result *applyResult) drop(value string, reason string) {
+	if result.Dropped == nil {
+		result.Dropped = make(map[string]string)
+	}
+	result.Dropped[value] = reason
+}
+
+// enforcementBackend enforces the decisions of an account at the edge. The worker computes the IPs
+// to start and to stop enforcing from the decisions, the backend applies the changes and reports them.
+type enforcementBackend interface {
+	// Name identifies the backend in logs.
+	Name() string
+	// ApplyIPs makes the backend enforce the IPs and ranges of add and stop enforcing the ones of remove
+	// for the action. The IPs which are already enforced, or not enforced, are skipped.
+	ApplyIPs(action string, add []edgeIP, remove []string) (applyResult, error)
+	// ApplyRule makes the backend enforce the expression for the action.
+	ApplyRule(action string, expression string) (applyResult, error)
+	// Cleanup deletes everything the backend created at the edge.
+	Cleanup() error
+}
+
+// decisionIPs returns the IPs and ranges of the decisions, commented with the scenario of their first
+// decision. They are sorted to make the API calls deterministic.
+func decisionIPs(decisions []*models.Decision) []edgeIP {
+	ips := make([]edgeIP, 0, len(decisions))
+	seen := make(map[string]struct{}, len(decisions))
+	for _, decision := range decisions {
+		value := normalizeDecisionValue(*decision.Value)
+		if _, ok := seen[value]; ok {
+			continue
+		}
+		seen[value] = struct{}{}
+		ips = append(ips, edgeIP{Value: value, Comment: *decision.Scenario})
+	}
+	sort.Slice(ips, func(i, j int) bool { return ips[i].Value < ips[j].Value })
+	return ips
+}
+
+// decisionValues returns the IPs and ranges of the decisions, sorted.
+func decisionValues(decisions []*models.Decision) []string {
+	ips := decisionIPs(decisions)
+	values := make([]string, len(ips))
+	for i, ip := range ips {
+		values[i] = ip.Value
+	}
+	return values
+}
+
+// ipListBackend enforces IPs through one cloudflare IP list per action and the countries, AS and
+// the list through one firewall rule per zone and action. With access_rule_fallback, the IPs which
+// don't fit in the IP lists are enforced through access rules in the zones of the action.
+type ipListBackend struct {
+	worker *CloudflareWorker
+}
+
+func (b *ipListBackend) Name() string {
+	return ipListEnforcement
+}
+
+// overflowBackends returns the access rules of the zones enforcing the action through the IP list.
+func (b *ipListBackend) overflowBackends(action string) []*accessRuleBackend {
+	backends := make([]*accessRuleBackend, 0)
+	if !b.worker.Account.AccessRuleFallback {
+		return backends
+	}
+	for _, zone := range b.worker.ipListZones() {
+		if _, ok := zone.ActionSet[action]; ok {
+			backends = append(backends, &accessRuleBackend{worker: b.worker, zoneID: zone.ID})
+		}
+	}
+	return backends
+}
+
+// overflowIPs returns at most limit IPs enforced with the access rules of the overflow backends and
+// missing from the list and from add, so that they move to the list once it has room.
+func (b *ipListBackend) overflowIPs(action string, overflowBackends []*accessRuleBackend, add []edgeIP, limit int) []edgeIP {
+	state := b.worker.CFStateByAction[action]
+	skipped := make(map[string]struct{}, len(add))
+	for _, ip := range add {
+		skipped[ip.Value] = struct{}{}
+	}
+	ips := make([]edgeIP, 0)
+	for _, backend := range overflowBackends {
+		for value := range backend.ruleIDByIP(action) {
+			_, listed := state.IPListState.ItemByIP[value]
+			if _, ok := skipped[value]; ok || listed {
+				continue
+			}
+			skipped[value] = struct{}{}
+			ips = append(ips, edgeIP{Value: value})
+		}
+	}
+	sort.Slice(ips, func(i, j int) bool { return ips[i].Value < ips[j].Value })
+	if len(ips) > limit {
+		ips = ips[:limit]
+	}
+	return ips
+}
+
+func (b *ipListBackend) ApplyIPs(action string, add []edgeIP, remove []string) (applyResult, error) {
+	result := applyResult{}
+	state, ok := b.worker.CFStateByAction[action]
+	if !ok {
+		return result, fmt.Errorf("no state for action %s", action)
+	}
+	if _, ok := b.worker.ipListActions()[action]; !ok {
+		// only zones using access rules have this action, there is no list for it.
+		return result, nil
+	}
+
+	unlisted := make([]string, 0, len(remove))
+	for _, ip := range remove {
+		if _, ok := state.IPListState.ItemByIP[ip]; ok {
+			unlisted = append(unlisted, ip)
+		}
+	}
+	if len(unlisted) > 0 {
+		deleteIPs := cloudflare.IPListItemDeleteRequest{Items: make([]cloudflare.IPListItemDeleteItemRequest, 0)}
+		for _, ip := range unlisted {
+			deleteIPs.Items = append(deleteIPs.Items, cloudflare.IPListItemDeleteItemRequest{ID: state.IPListState.ItemByIP[ip].ID})
+		}
+		_, err := b.worker.getAPI().DeleteIPListItems(b.worker.Ctx, state.IPListState.IPList.ID, deleteIPs)
+		if err != nil {
+			return result, err
+		}
+		state.IPListState.IPList.NumItems -= len(unlisted)
+		for _, ip := range unlisted {
+			delete(state.IPListState.ItemByIP, ip)
+		}
+		result.Removed = len(unlisted)
+	}
+
+	listed := make([]edgeIP, 0, len(add))
+	for _, ip := range add {
+		if _, ok := state.IPListState.ItemByIP[ip.Value]; !ok {
+			listed = append(listed, ip)
+		}
+	}
+	overflowBackends := b.overflowBackends(action)
+	capacity := b.worker.ipListCapacity()
+	if len(overflowBackends) > 0 && capacity > len(listed) {
+		listed = append(listed, b.overflowIPs(action, overflowBackends, add, capacity-len(listed))...)
+	}
+	overflow := make([]edgeIP, 0)
+	if capacity >= 0 && len(listed) > capacity {
+		wasFull := b.worker.ipListsFull
+		b.worker.notifyIPListsFull(len(listed) - capacity)
+		if !b.worker.Account.AccessRuleFallback {
+			logf := b.worker.Logger.Warningf
+			if wasFull {
+				logf = b.worker.Logger.Debugf
+			}
+			logf("ip lists are full (%s), not banning %d IPs until there is room", b.worker.ListEntitlements, len(listed)-capacity)
+			for _, ip := range listed[capacity:] {
+				result.drop(ip.Value, "ip_list_full")
+			}
+		}
+		overflow = listed[capacity:]
+		listed = listed[:capacity]
+	} else if len(listed) > 0 {
+		b.worker.ipListsFull = false
+	}
+
+	if len(listed) > 0 {
+		newIPs := make([]cloudflare.IPListItemCreateRequest, len(listed))
+		for i, ip := range listed {
+			newIPs[i] = cloudflare.IPListItemCreateRequest{IP: ip.Value, Comment: ip.Comment}
+		}
+		state.IPListState.IPList.NumItems += len(listed)
+		items, err := b.worker.getAPI().CreateIPListItems(b.worker.Ctx, state.IPListState.IPList.ID, newIPs)
+		if err != nil {
+			return result, err
+		}
+		for _, item := range items {
+			state.IPListState.ItemByIP[item.IP] = item
+		}
+		result.Added = len(listed)
+	}
+	if len(overflowBackends) == 0 {
+		return result, nil
+	}
+	// the IPs now in the list no longer need their access rules.
+	unruled := append([]string{}, remove...)
+	for _, ip := range listed {
+		unruled = append(unruled, ip.Value)
+	}
+	return b.applyOverflow(action, overflowBackends, overflow, unruled, result)
+}
+
+// applyOverflow makes the access rules of the zones enforce the IPs which don't fit in the IP list
+// and stop enforcing the removed ones.
+func (b *ipListBackend) applyOverflow(action string, overflowBackends []*accessRuleBackend, add []edgeIP, remove []string, result applyResult) (applyResult, error) {
+	added, removed := 0, 0
+	for _, backend := range overflowBackends {
+		overflowResult, err := backend.ApplyIPs(action, add, remove)
+		if err != nil {
+			return result, err
+		}
+		if overflowResult.Added > 0 {
+			backend.logger().Warningf("ip lists are full (%s), banned %d IPs with access rules", b.worker.ListEntitlements, overflowResult.Added)
+		}
+		if overflowResult.Added > added {
+			added = overflowResult.Added
+		}
+		if overflowResult.Removed > removed {
+			removed = overflowResult.Removed
+		}
+		for value, reason := range overflowResult.Dropped {
+			result.drop(value, reason)
+		}
+	}
+	result.Added += added
+	result.Removed += removed
+	return result, nil
+}
+
+func (b *ipListBackend) ApplyRule(action string, expression string) (applyResult, error) {
+	result := applyResult{}
+	state, ok := b.worker.CFStateByAction[action]
+	if !ok {
+		return result, fmt.Errorf("no state for action %s", action)
+	}
+	for _, zone := range b.worker.ipListZones() {
+		zoneLogger := b.worker.Logger.WithFields(log.Fields{"zone_id": zone.ID})
+		if _, ok := zone.ActionSet[action]; !ok {
+			// this action is not supported by this zone
+			zoneLogger.Debug("rules are same")
+			continue
+		}
+		updatedFilters := []cloudflare.Filter{{ID: state.FilterIDByZoneID[zone.ID], Expression: expression}}
+		zoneLogger.Infof("updating %d rules", len(updatedFilters))
+		_, err := b.worker.getAPI().UpdateFilters(b.worker.Ctx, zone.ID, updatedFilters)
+		if err != nil {
+			return result, err
+		}
+		result.Updated += len(updatedFilters)
+	}
+	return result, nil
+}
+
+func (b *ipListBackend) Cleanup() error {
+	if err := b.worker.deleteExistingIPList(); err != nil {
+		return err
+	}
+	if !b.worker.Account.AccessRuleFallback {
+		return nil
+	}
+	for _, zone := range b.worker.ipListZones() {
+		if err := (&accessRuleBackend{worker: b.worker, zoneID: zone.ID}).Cleanup(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// memoryBackend enforces decisions in memory, it allows testing the worker without cloudflare.
+type memoryBackend struct {
+	IPsByAction  map[string]map[string]edgeIP
+	ExprByAction map[string]string
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{IPsByAction: make(map[string]map[string]edgeIP), ExprByAction: make(map[string]string)}
+}
+
+func (b *memoryBackend) Name() string {
+	return "memory"
+}
+
+func (b *memoryBackend) ApplyIPs(action string, add []edgeIP, remove []string) (applyResult, error) {
+	result := applyResult{}
+	if b.IPsByAction[action] == nil {
+		b.IPsByAction[action] = make(map[string]edgeIP)
+	}
+	for _, ip := range add {
+		if _, ok := b.IPsByAction[action][ip.Value]; !ok {
+			b.IPsByAction[action][ip.Value] = ip
+			result.Added++
+		}
+	}
+	for _, ip := range remove {
+		if _, ok := b.IPsByAction[action][ip]; ok {
+			delete(b.IPsByAction[action], ip)
+			result.Removed++
+		}
+	}
+	return result, nil
+}
+
+func (b *memoryBackend) ApplyRule(action string, expression string) (applyResult, error) {
+	b.ExprByAction[action] = expression
+	return applyResult{Updated: 1}, nil
+}
+
+func (b *memoryBackend) Cleanup() error {
+	b.IPsByAction = make(map[string]map[string]edgeIP)
+	b.ExprByAction = make(map[string]string)
+	return nil
+}
+
+func Test_decisionIPs(t *testing.T) {
+	ip1, ip2, range1 := "1.2.3.5", "1.2.3.4", "2001:0db8:85a3:0000:0000:8a2e:0370:7334"
+	scenario1, scenario2 := "crowdsec/demo", "crowdsec/other"
+	decisions := []*models.Decision{
+		{Value: &ip1, Scenario: &scenario1},
+		{Value: &range1, Scenario: &scenario1},
+		{Value: &ip2, Scenario: &scenario1},
+		{Value: &ip1, Scenario: &scenario2},
+	}
+	want := []edgeIP{
+		{Value: "1.2.3.4", Comment: scenario1},
+		{Value: "1.2.3.5", Comment: scenario1},
+		{Value: "2001:db8:85a3::/64", Comment: scenario1},
+	}
+	if got := decisionIPs(decisions); !reflect.DeepEqual(got, want) {
+		t.Errorf("want=%+v, found=%+v", want, got)
+	}
+	if got := decisionValues(decisions); !reflect.DeepEqual(got, []string{"1.2.3.4", "1.2.3.5", "2001:db8:85a3::/64"}) {
+		t.Errorf("unexpected values %+v", got)
+	}
+}
+
+func TestCloudflareWorker_withBackend(t *testing.T) {
+	ip1 := "1.2.3.4"
+	ip2 := "2001:0db8:85a3:0000:0000:8a2e:0370:7334"
+	ban := "ban"
+	captcha := "captcha"
+	scenario := "crowdsec/demo"
+
+	backend := newMemoryBackend()
+	account := AccountConfig{
+		ID:            "dummyID",
+		ZoneConfigs:   []ZoneConfig{{ID: "zone1", Actions: []string{"block"}, ActionSet: map[string]struct{}{"block": {}}}},
+		DefaultAction: "block",
+	}
+	worker := &CloudflareWorker{
+		Account:         account,
+		Backends:        []enforcementBackend{backend},
+		CFStateByAction: map[string]*CloudflareState{"block": {Action: "block"}},
+		UpdatedState:    make(chan *stateUpdate, 10),
+		Logger:          log.WithFields(log.Fields{"account_id": "test worker"}),
+	}
+	worker.NewIPDecisions = []*models.Decision{
+		{Value: &ip1, Type: &ban, Scenario: &scenario},
+		{Value: &ip2, Type: &captcha, Scenario: &scenario},
+	}
+	if err := worker.AddNewIPs(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]edgeIP{
+		"1.2.3.4":            {Value: "1.2.3.4", Comment: scenario},
+		"2001:db8:85a3::/64": {Value: "2001:db8:85a3::/64", Comment: scenario},
+	}
+	if !reflect.DeepEqual(backend.IPsByAction["block"], want) {
+		t.Errorf("want=%+v, found=%+v", want, backend.IPsByAction["block"])
+	}
+
+	worker.ExpiredIPDecisions = []*models.Decision{{Value: &ip1, Type: &ban, Scenario: &scenario}}
+	if err := worker.DeleteIPs(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := backend.IPsByAction["block"]["1.2.3.4"]; ok || len(backend.IPsByAction["block"]) != 1 {
+		t.Errorf("expected only the ipv6 range to be left, found=%+v", backend.IPsByAction["block"])
+	}
+
+	worker.CFStateByAction["block"].CountrySet = map[string]struct{}{"FR": {}}
+	if err := worker.UpdateRules(); err != nil {
+		t.Fatal(err)
+	}
+	if backend.ExprByAction["block"] != `(ip.geoip.country in {"FR"})` {
+		t.Errorf("unexpected expression %s", backend.ExprByAction["block"])
+	}
+}
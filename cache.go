@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// cacheVersion is the version of the cache format written by this bouncer.
+// Version 1 is the plain JSON array of states written by the first releases.
+const cacheVersion = 3
+
+// stateCache is the content of the cache file. Checksum is the hex encoded sha256 of the compact JSON of States.
+type stateCache struct {
+	Version  int             `json:"version"`
+	Checksum string          `json:"checksum"`
+	Owner    *cacheOwner     `json:"owner,omitempty"`
+	States   json.RawMessage `json:"states"`
+}
+
+// cacheOwner identifies the config a cache belongs to.
+type cacheOwner struct {
+	ConfigHash string   `json:"config_hash"`
+	AccountIDs []string `json:"account_ids"`
+}
+
+// newCacheOwner returns the owner of the caches written with the accounts. Tokens are not part of the
+// hash, rotating them doesn't change the state at cloudflare.
+func newCacheOwner(accounts []AccountConfig) cacheOwner {
+	owner := cacheOwner{AccountIDs: make([]string, 0, len(accounts))}
+	hashed := make([]AccountConfig, len(accounts))
+	for i, account := range accounts {
+		owner.AccountIDs = append(owner.AccountIDs, account.ID)
+		hashed[i] = account
+		hashed[i].Token = ""
+	}
+	sort.Strings(owner.AccountIDs)
+	data, _ := json.Marshal(hashed)
+	sum := sha256.Sum256(data)
+	owner.ConfigHash = hex.EncodeToString(sum[:])
+	return owner
+}
+
+// cacheMigrations upgrade the states of the cache from the version they are keyed by to the next one.
+var cacheMigrations = map[int]func(json.RawMessage) (json.RawMessage, error){
+	// version 2 only wraps the states with a version and a checksum.
+	1: func(states json.RawMessage) (json.RawMessage, error) { return states, nil },
+	// version 3 adds the owner, caches without owner are adopted by the first config using them.
+	2: func(states json.RawMessage) (json.RawMessage, error) { return states, nil },
+}
+
+func statesChecksum(states json.RawMessage) (string, error) {
+	compact := bytes.Buffer{}
+	if err := json.Compact(&compact, states); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(compact.Bytes())
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// parseCache validates the cache and migrates it to the current version.
+func parseCache(data []byte) (json.RawMessage, *cacheOwner, error) {
+	cache := stateCache{}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		cache.Version = 1
+		cache.States = trimmed
+	} else {
+		if err := json.Unmarshal(data, &cache); err != nil {
+			return nil, nil, err
+		}
+		if cache.Version < 2 || cache.Version > cacheVersion {
+			return nil, nil, fmt.Errorf("unsupported cache version %d, this bouncer supports up to version %d", cache.Version, cacheVersion)
+		}
+		checksum, err := statesChecksum(cache.States)
+		if err != nil {
+			return nil, nil, err
+		}
+		if checksum != cache.Checksum {
+			return nil, nil, fmt.Errorf("cache checksum mismatch, expected %s found %s", cache.Checksum, checksum)
+		}
+	}
+
+	states := cache.States
+	for version := cache.Version; version < cacheVersion; version++ {
+		var err error
+		if states, err = cacheMigrations[version](states); err != nil {
+			return nil, nil, fmt.Errorf("while migrating cache from version %d: %w", version, err)
+		}
+		log.Infof("migrated cache from version %d to %d", version, version+1)
+	}
+	return states, cache.Owner, nil
+}
+
+// loadCachedStates loads the cache into states and returns its owner, which is nil for caches without owner.
+func loadCachedStates(states *[]CloudflareState) (*cacheOwner, error) {
+	if _, err := os.Stat(cachePath); err != nil {
+		log.Debug("no cache found")
+		return nil, nil
+	}
+	f, err := os.Open(cachePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	rawStates, owner, err := parseCache(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errCorruptCache, err)
+	}
+	if err := json.Unmarshal(rawStates, &states); err != nil {
+		return nil, fmt.Errorf("%w: %s", errCorruptCache, err)
+	}
+	return owner, nil
+}
+
+// errCorruptCache is the error of the caches which can't be parsed, have a wrong checksum or an unsupported
+// version. The other errors, such as permission or I/O errors, don't mean the cache is unusable.
+var errCorruptCache = errors.New("corrupt cache")
+
+// discardCorruptCache moves the unusable cache aside, the bouncer then starts as if there was no cache.
+func discardCorruptCache(cause error) {
+	corruptPath := cachePath + ".corrupt"
+	log.Warningf("cache %s is unusable (%s), moving it to %s and rebuilding state from the IP lists at cloudflare", cachePath, cause, corruptPath)
+	if err := os.Rename(cachePath, corruptPath); err != nil {
+		log.Errorf("while moving cache: %s", err)
+	}
+}
+
+// dumpStates writes the cache atomically: a crash or a full disk leaves either the previous or the new cache.
+func dumpStates(states *[]CloudflareState, owner *cacheOwner) error {
+	rawStates, err := json.Marshal(states)
+	if err != nil {
+		return err
+	}
+	checksum, err := statesChecksum(rawStates)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(stateCache{Version: cacheVersion, Checksum: checksum, Owner: owner, States: rawStates}, "", "	")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(cachePath, data, 0600)
+}
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath) // no-op once renamed
+
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	// persist the rename itself.
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+var errCacheLocked = errors.New("the cache is used by another bouncer, is it running?")
+
+// lockCache takes the lock of the cache, held by the bouncer writing it until it exits. It fails at once
+// when another bouncer holds it.
+func lockCache() (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(cachePath+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("%w: %s", errCacheLocked, cachePath)
+		}
+		return nil, err
+	}
+	return func() { f.Close() }, nil
+}
+
+// migrateLegacyCache moves the cache from its location in previous releases to the default location.
+func migrateLegacyCache() error {
+	if _, err := os.Stat(cachePath); err == nil {
+		return nil
+	}
+	data, err := os.ReadFile(legacyCachePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0700); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(cachePath, data, 0600); err != nil {
+		return err
+	}
+	log.Infof("moved cache from %s to %s", legacyCachePath, cachePath)
+	if err := os.Remove(legacyCachePath); err != nil {
+		log.Warningf("while deleting legacy cache: %s", err)
+	}
+	return nil
+}
+
+// readLegacyCacheInPlace makes the commands which only read the cache read it from its location in
+// previous releases, as long as it wasn't moved to the default location.
+func readLegacyCacheInPlace() {
+	if _, err := os.Stat(cachePath); err == nil {
+		return
+	}
+	if _, err := os.Stat(legacyCachePath); err == nil {
+		cachePath = legacyCachePath
+	}
+}
+
+func deleteCacheIfExists() error {
+	var err error
+	if _, err = os.Stat(cachePath); err == nil {
+		err = os.Remove(cachePath)
+	}
+	return err
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_dumpStates(t *testing.T) {
+	cachePath = filepath.Join(t.TempDir(), "cache.json")
+	states := []CloudflareState{{Action: "block", AccountID: "1", CurrExpr: "(ip.src in $crowdsec_block)"}}
+	if err := dumpStates(&states, nil); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600, found %o", info.Mode().Perm())
+	}
+	entries, _ := os.ReadDir(filepath.Dir(cachePath))
+	if len(entries) != 1 {
+		t.Errorf("expected only the cache in the directory, found %d files", len(entries))
+	}
+
+	loaded := make([]CloudflareState, 0)
+	if _, err := loadCachedStates(&loaded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(states, loaded) {
+		t.Errorf("expected=%+v\n found=%+v", states, loaded)
+	}
+}
+
+func Test_parseCache(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{
+			name: "version 1 is migrated",
+			data: `[{"Action": "block"}]`,
+		},
+		{
+			name: "valid checksum",
+			data: `{"version": 2, "checksum": "fdafd84f795b8ac2837925097872aef09a4269688c1b6f1d3aadc6e2dc9c6a4e", "states": [{"Action": "block"}]}`,
+		},
+		{
+			name:    "checksum mismatch",
+			data:    `{"version": 2, "checksum": "fdafd84f795b8ac2837925097872aef09a4269688c1b6f1d3aadc6e2dc9c6a4e", "states": [{"Action": "challenge"}]}`,
+			wantErr: "checksum mismatch",
+		},
+		{
+			name:    "newer version",
+			data:    `{"version": 99, "checksum": "", "states": []}`,
+			wantErr: "unsupported cache version 99",
+		},
+		{
+			name:    "partial write",
+			data:    `{"version": 2, "checksum": "fdafd84f795b8ac2837925097872`,
+			wantErr: "unexpected end of JSON input",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := parseCache([]byte(tt.data))
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("expected error containing '%s', found %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func Test_discardCorruptCache(t *testing.T) {
+	cachePath = filepath.Join(t.TempDir(), "cache.json")
+	if err := os.WriteFile(cachePath, []byte(`{"version": 2, "chec`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	states := make([]CloudflareState, 0)
+	_, err := loadCachedStates(&states)
+	if err == nil {
+		t.Fatal("expected error on corrupt cache")
+	}
+	discardCorruptCache(err)
+	if _, err := os.Stat(cachePath); !os.IsNotExist(err) {
+		t.Errorf("expected cache to be moved, found %v", err)
+	}
+	if _, err := os.Stat(cachePath + ".corrupt"); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_openStateStore_unreadableCache(t *testing.T) {
+	cachePath = filepath.Join(t.TempDir(), "cache.json")
+	// reading a directory fails like an I/O error would.
+	if err := os.Mkdir(cachePath, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openStateStore(jsonStateStore); err == nil || errors.Is(err, errCorruptCache) {
+		t.Errorf("expected the read error to be returned, found %v", err)
+	}
+	if _, err := os.Stat(cachePath + ".corrupt"); !os.IsNotExist(err) {
+		t.Errorf("expected the cache not to be discarded, found %v", err)
+	}
+}
+
+func Test_adoptStateStore(t *testing.T) {
+	owner := newCacheOwner([]AccountConfig{{ID: "account1", Token: "token1"}, {ID: "account2"}})
+	rotated := newCacheOwner([]AccountConfig{{ID: "account1", Token: "token2"}, {ID: "account2"}})
+	if owner.ConfigHash != rotated.ConfigHash {
+		t.Errorf("expected token rotation to keep the config hash")
+	}
+
+	tests := []struct {
+		name         string
+		cachedOwner  *cacheOwner
+		newOwner     cacheOwner
+		wantErr      bool
+		wantAccounts []string
+	}{
+		{
+			name:         "cache without owner is adopted",
+			newOwner:     owner,
+			wantAccounts: []string{"account1", "account2"},
+		},
+		{
+			name:         "removed account is forgotten",
+			cachedOwner:  &owner,
+			newOwner:     newCacheOwner([]AccountConfig{{ID: "account1"}}),
+			wantAccounts: []string{"account1"},
+		},
+		{
+			name:        "cache of another instance is refused",
+			cachedOwner: &owner,
+			newOwner:    newCacheOwner([]AccountConfig{{ID: "account3"}}),
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &jsonFileStore{
+				states: []CloudflareState{{AccountID: "account1", Action: "block"}, {AccountID: "account2", Action: "block"}},
+				owner:  tt.cachedOwner,
+			}
+			err := adoptStateStore(store, tt.newOwner)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("adoptStateStore() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(store.Owner(), &tt.newOwner) {
+				t.Errorf("expected owner %+v, found %+v", tt.newOwner, store.Owner())
+			}
+			got := make([]string, 0)
+			for _, state := range store.states {
+				got = append(got, state.AccountID)
+			}
+			if !reflect.DeepEqual(got, tt.wantAccounts) {
+				t.Errorf("want=%+v, found=%+v", tt.wantAccounts, got)
+			}
+		})
+	}
+}
+
+func Test_migrateLegacyCache(t *testing.T) {
+	dir := t.TempDir()
+	legacyCachePath = filepath.Join(dir, "etc", "cache.json")
+	cachePath = filepath.Join(dir, "lib", "cache.json")
+	if err := migrateLegacyCache(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cachePath); !os.IsNotExist(err) {
+		t.Errorf("expected no cache without legacy cache, found %v", err)
+	}
+
+	if err := os.Mkdir(filepath.Dir(legacyCachePath), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(legacyCachePath, []byte(`[{"Action": "block"}]`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateLegacyCache(); err != nil {
+		t.Fatal(err)
+	}
+	states := make([]CloudflareState, 0)
+	if _, err := loadCachedStates(&states); err != nil || len(states) != 1 {
+		t.Errorf("expected the legacy cache to be moved, found %+v, %v", states, err)
+	}
+	if _, err := os.Stat(legacyCachePath); !os.IsNotExist(err) {
+		t.Errorf("expected legacy cache to be deleted, found %v", err)
+	}
+}
+
+func Test_lockCache(t *testing.T) {
+	cachePath = filepath.Join(t.TempDir(), "cache", "cloudflare-cache.json")
+	unlock, err := lockCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lockCache(); !errors.Is(err, errCacheLocked) {
+		t.Errorf("expected the cache to be locked, found %v", err)
+	}
+	unlock()
+	unlock, err = lockCache()
+	if err != nil {
+		t.Fatalf("expected the cache to be unlocked, found %s", err)
+	}
+	unlock()
+}
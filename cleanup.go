@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// cleanupScope selects the zones and actions a cleanup applies to in the selected accounts, or the zones
+// a setup applies to. Every zone, or every action, is selected when none are.
+type cleanupScope struct {
+	ZoneIDs []string
+	Actions []string
+}
+
+func (scope cleanupScope) isEmpty() bool {
+	return len(scope.ZoneIDs) == 0 && len(scope.Actions) == 0
+}
+
+func (scope cleanupScope) hasZone(zoneID string) bool {
+	return len(scope.ZoneIDs) == 0 || contains(scope.ZoneIDs, zoneID)
+}
+
+func (scope cleanupScope) hasAction(action string) bool {
+	return len(scope.Actions) == 0 || contains(scope.Actions, action)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// remainingAccount returns the config of the account without the zones and actions of the scope.
+// Zones left without action are removed.
+func (scope cleanupScope) remainingAccount(account AccountConfig) AccountConfig {
+	remaining := account
+	remaining.ZoneConfigs = make([]ZoneConfig, 0, len(account.ZoneConfigs))
+	for _, zone := range account.ZoneConfigs {
+		if !scope.hasZone(zone.ID) {
+			remaining.ZoneConfigs = append(remaining.ZoneConfigs, zone)
+			continue
+		}
+		kept := zone
+		kept.Actions = make([]string, 0, len(zone.Actions))
+		kept.ActionSet = make(map[string]struct{}, len(zone.Actions))
+		for _, action := range zone.Actions {
+			if !scope.hasAction(action) {
+				kept.Actions = append(kept.Actions, action)
+				kept.ActionSet[action] = struct{}{}
+			}
+		}
+		if len(kept.Actions) > 0 {
+			remaining.ZoneConfigs = append(remaining.ZoneConfigs, kept)
+		}
+	}
+	return remaining
+}
+
+// selectAccounts restricts the accounts of the config to the ones having a zone of the scope. It fails if a
+// zone or an action of the scope isn't in the selected accounts.
+func (scope cleanupScope) selectAccounts(conf *bouncerConfig) error {
+	foundZones := make(map[string]struct{})
+	foundActions := make(map[string]struct{})
+	selected := make([]AccountConfig, 0, len(conf.CloudflareConfig.Accounts))
+	for _, account := range conf.CloudflareConfig.Accounts {
+		hasZone := false
+		for _, zone := range account.ZoneConfigs {
+			if !scope.hasZone(zone.ID) {
+				continue
+			}
+			hasZone = true
+			foundZones[zone.ID] = struct{}{}
+			for _, action := range zone.Actions {
+				foundActions[action] = struct{}{}
+			}
+		}
+		if hasZone {
+			selected = append(selected, account)
+		}
+	}
+	for _, zoneID := range scope.ZoneIDs {
+		if _, ok := foundZones[zoneID]; !ok {
+			return fmt.Errorf("zone %s is not in the config of the selected accounts", zoneID)
+		}
+	}
+	missing := make([]string, 0)
+	for _, action := range scope.Actions {
+		if _, ok := foundActions[action]; !ok {
+			missing = append(missing, action)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("action %s is not used by the selected zones", strings.Join(missing, ", "))
+	}
+	conf.CloudflareConfig.Accounts = selected
+	return nil
+}
+
+// cleanUpScope deletes what the bouncer created at cloudflare for the zones and actions of the scope. The
+// rules and filters of the zones are detached, an IP list is only deleted when no remaining zone uses its
+// action. It relies on the cached state to find them, the whole account is cleaned up when the scope
+// leaves it without zone.
+func (worker *CloudflareWorker) cleanUpScope(scope cleanupScope) error {
+	remaining := scope.remainingAccount(worker.Account)
+	if len(remaining.ZoneConfigs) == 0 {
+		return worker.cleanUp()
+	}
+	if worker.stateIsNew() {
+		worker.Logger.Warning("no cached state for the account, its components at cloudflare are unknown: nothing to clean up")
+		return nil
+	}
+	defer worker.publishState()
+	worker.Account = remaining
+	worker.Backends = nil
+	if err := worker.reconcileState(); err != nil {
+		return err
+	}
+	worker.Logger.Info("cleaned up the selected zones and actions, remove them from the config or the next run sets them up again")
+	return nil
+}
+
+// restrictSetUp makes the setup of the worker only apply to the zones of the scope. The account keeps them
+// and the zones the cached state already enforces actions in, which are left as they are. The other zones
+// are set up by the next run.
+func (worker *CloudflareWorker) restrictSetUp(scope cleanupScope) {
+	selected := worker.Account
+	selected.ZoneConfigs = make([]ZoneConfig, 0, len(worker.Account.ZoneConfigs))
+	for _, zone := range worker.Account.ZoneConfigs {
+		if scope.hasZone(zone.ID) {
+			selected.ZoneConfigs = append(selected.ZoneConfigs, zone)
+			continue
+		}
+		kept := zone
+		kept.Actions = make([]string, 0, len(zone.Actions))
+		kept.ActionSet = make(map[string]struct{}, len(zone.Actions))
+		for _, action := range zone.Actions {
+			if worker.isSetUp(zone, action) {
+				kept.Actions = append(kept.Actions, action)
+				kept.ActionSet[action] = struct{}{}
+			}
+		}
+		if len(kept.Actions) > 0 {
+			selected.ZoneConfigs = append(selected.ZoneConfigs, kept)
+		}
+	}
+	worker.Account = selected
+	worker.setUpZoneIDs = scope.ZoneIDs
+}
+
+// isSetUp returns true if the cached state enforces the action in the zone.
+func (worker *CloudflareWorker) isSetUp(zone ZoneConfig, action string) bool {
+	state, ok := worker.CFStateByAction[action]
+	if !ok {
+		return false
+	}
+	if _, ok := state.FilterIDByZoneID[zone.ID]; ok {
+		return true
+	}
+	if len(state.AccessRuleIDsByZoneID[zone.ID]) > 0 {
+		return true
+	}
+	return worker.usesAccessRules(zone) && len(state.AccessRuleIDsByZoneID[""]) > 0
+}
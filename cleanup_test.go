@@ -0,0 +1,204 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+)
+
+// newCleanupTestWorker returns a test worker of two zones sharing the block action, with the cached states of the
+// lists and rules of its API.
+func newCleanupTestWorker() *CloudflareWorker {
+	worker := newTestWorker()
+	worker.Account.DefaultAction = "block"
+	worker.Account.ZoneConfigs = []ZoneConfig{
+		{ID: "zone1", Actions: []string{"block", "challenge"}, ActionSet: map[string]struct{}{"block": {}, "challenge": {}}},
+		{ID: "zone2", Actions: []string{"block"}, ActionSet: map[string]struct{}{"block": {}}},
+	}
+	worker.API = &mockCloudflareAPI{
+		IPLists: []cloudflare.IPList{{ID: "11", Name: "crowdsec_block"}, {ID: "13", Name: "crowdsec_challenge"}},
+		FirewallRulesList: []cloudflare.FirewallRule{
+			{ID: "r1", Action: "block", Filter: cloudflare.Filter{ID: "f1", Expression: "ip.src in $crowdsec_block"}},
+			{ID: "r3", Action: "challenge", Filter: cloudflare.Filter{ID: "f3", Expression: "ip.src in $crowdsec_challenge"}},
+		},
+		FilterList: []cloudflare.Filter{
+			{ID: "f1", Expression: "ip.src in $crowdsec_block"},
+			{ID: "f3", Expression: "ip.src in $crowdsec_challenge"},
+		},
+		ZoneList:    []cloudflare.Zone{{ID: "zone1"}, {ID: "zone2"}},
+		IPListItems: make(map[string][]cloudflare.IPListItem),
+	}
+	createdOn := time.Now()
+	block, challenge := newTestState("account1", "block", 0), newTestState("account1", "challenge", 0)
+	block.IPListState.IPList.ID, block.IPListState.IPList.CreatedOn = "11", &createdOn
+	block.FilterIDByZoneID = map[string]string{"zone1": "f1", "zone2": "f1"}
+	challenge.IPListState.IPList.ID, challenge.IPListState.IPList.CreatedOn = "13", &createdOn
+	challenge.FilterIDByZoneID = map[string]string{"zone1": "f3"}
+	worker.CFStateByAction = map[string]*CloudflareState{"block": block, "challenge": challenge}
+	return worker
+}
+
+func Test_cleanupScope_remainingAccount(t *testing.T) {
+	tests := []struct {
+		name  string
+		scope cleanupScope
+		want  map[string][]string
+	}{
+		{name: "zone", scope: cleanupScope{ZoneIDs: []string{"zone2"}}, want: map[string][]string{"zone1": {"block", "challenge"}}},
+		{name: "action", scope: cleanupScope{Actions: []string{"block"}}, want: map[string][]string{"zone1": {"challenge"}}},
+		{name: "action of a zone", scope: cleanupScope{ZoneIDs: []string{"zone1"}, Actions: []string{"block"}}, want: map[string][]string{"zone1": {"challenge"}, "zone2": {"block"}}},
+		{name: "everything", scope: cleanupScope{ZoneIDs: []string{"zone1", "zone2"}}, want: map[string][]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make(map[string][]string)
+			for _, zone := range tt.scope.remainingAccount(newCleanupTestWorker().Account).ZoneConfigs {
+				got[zone.ID] = zone.Actions
+				if len(zone.ActionSet) != len(zone.Actions) {
+					t.Errorf("expected the action set of %s to match its actions, found %v", zone.ID, zone.ActionSet)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("want %v, found %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_cleanupScope_selectAccounts(t *testing.T) {
+	conf := &bouncerConfig{CloudflareConfig: CloudflareConfig{Accounts: []AccountConfig{
+		newCleanupTestWorker().Account,
+		{ID: "account2", ZoneConfigs: []ZoneConfig{{ID: "zone3", Actions: []string{"block"}}}},
+	}}}
+	if err := (cleanupScope{ZoneIDs: []string{"zone4"}}).selectAccounts(conf); err == nil {
+		t.Error("expected an unknown zone to be refused")
+	}
+	if err := (cleanupScope{ZoneIDs: []string{"zone2"}, Actions: []string{"challenge"}}).selectAccounts(conf); err == nil {
+		t.Error("expected an action the zone doesn't have to be refused")
+	}
+	if err := (cleanupScope{ZoneIDs: []string{"zone3"}}).selectAccounts(conf); err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.CloudflareConfig.Accounts) != 1 || conf.CloudflareConfig.Accounts[0].ID != "account2" {
+		t.Errorf("expected only account2 to be selected, found %+v", conf.CloudflareConfig.Accounts)
+	}
+}
+
+func TestCloudflareWorker_cleanUpScope(t *testing.T) {
+	type change struct {
+		Operation string
+		Resource  string
+		ZoneID    string
+		ID        string
+	}
+	tests := []struct {
+		name        string
+		scope       cleanupScope
+		want        []change
+		wantActions []string
+	}{
+		{
+			name:  "action used by a single zone deletes its list",
+			scope: cleanupScope{ZoneIDs: []string{"zone1"}, Actions: []string{"challenge"}},
+			want: []change{
+				{"delete", "firewall_rule", "zone1", "r3"},
+				{"delete", "firewall_rule", "zone2", "r3"},
+				{"delete", "filter", "zone1", "f3"},
+				{"delete", "filter", "zone2", "f3"},
+				{"delete", "ip_list", "", "13"},
+			},
+			wantActions: []string{"block"},
+		},
+		{
+			name:        "zone only detaches its rules",
+			scope:       cleanupScope{ZoneIDs: []string{"zone2"}},
+			want:        []change{{"delete", "firewall_rule", "zone2", "r1"}, {"delete", "filter", "zone2", "f1"}},
+			wantActions: []string{"block", "challenge"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fixture := newCleanupTestWorker()
+			worker, recorder := newPlanWorker(fixture.Account, fixture.API, fixture.CFStateByAction, fixture.tokenCallCount)
+			changes, err := planAccount(worker, recorder, planModeCleanup, tt.scope)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]change, len(changes))
+			for i, c := range changes {
+				got[i] = change{c.Operation, c.Resource, c.ZoneID, c.ID}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("want %+v\n found %+v", tt.want, got)
+			}
+			actions := make([]string, 0)
+			for action := range worker.CFStateByAction {
+				actions = append(actions, action)
+			}
+			if len(actions) != len(tt.wantActions) {
+				t.Errorf("want states of %v, found %v", tt.wantActions, actions)
+			}
+			if _, ok := worker.CFStateByAction["block"].FilterIDByZoneID["zone2"]; ok == contains(tt.scope.ZoneIDs, "zone2") {
+				t.Errorf("unexpected block filters %v", worker.CFStateByAction["block"].FilterIDByZoneID)
+			}
+		})
+	}
+}
+
+func TestCloudflareWorker_restrictSetUp(t *testing.T) {
+	tests := []struct {
+		name   string
+		cached bool
+	}{
+		{name: "cached state sets up the missing rules", cached: true},
+		{name: "without cache"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fixture := newCleanupTestWorker()
+			if tt.cached {
+				// zone2 gained the block action since the setup.
+				delete(fixture.CFStateByAction["block"].FilterIDByZoneID, "zone2")
+			} else {
+				fixture.CFStateByAction = map[string]*CloudflareState{}
+			}
+			worker, recorder := newPlanWorker(fixture.Account, fixture.API, fixture.CFStateByAction, fixture.tokenCallCount)
+			changes, err := planAccount(worker, recorder, planModeSetup, cleanupScope{ZoneIDs: []string{"zone2"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			created := false
+			for _, c := range changes {
+				if c.ZoneID == "zone1" {
+					t.Errorf("expected zone1 to be left as is, found %+v", c)
+				}
+				if c.Operation == "create" && c.Resource == "firewall_rule" && c.ZoneID == "zone2" {
+					created = true
+				}
+			}
+			if !created {
+				t.Errorf("expected a rule to be created in zone2, found %+v", changes)
+			}
+			if _, ok := worker.CFStateByAction["challenge"]; ok != tt.cached {
+				t.Errorf("expected the challenge state to be kept only when cached, found %+v", worker.CFStateByAction)
+			}
+		})
+	}
+}
+
+func TestJSONFileStore_updateRemovesActions(t *testing.T) {
+	store := &jsonFileStore{states: []CloudflareState{*newTestState("account1", "block", 1), *newTestState("account1", "challenge", 1), *newTestState("account2", "block", 1)}}
+	cachePath = t.TempDir() + "/cache.json"
+	if err := store.Update(newStateUpdate(map[string]*CloudflareState{"block": newTestState("account1", "block", 2)})); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0)
+	for _, state := range store.states {
+		got = append(got, stateKey(&state))
+	}
+	if !reflect.DeepEqual(got, []string{"account1/block", "account2/block"}) {
+		t.Errorf("expected the challenge state of account1 to be removed, found %v", got)
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/crowdsecurity/cs-cloudflare-bouncer/version"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	runCommand      = "run"
+	setupCommand    = "setup"
+	cleanupCommand  = "cleanup"
+	generateCommand = "generate"
+	validateCommand = "validate"
+	statusCommand   = "status"
+	versionCommand  = "version"
+	exportCommand   = "export"
+	importCommand   = "import"
+)
+
+// cliOptions is the parsed command line: the command to run and its options.
+type cliOptions struct {
+	command    string
+	configPath string
+	output     string
+	dryRun     bool
+	plan       bool
+	accounts   []string
+	zones      []string
+	actions    []string
+	tokens     string
+	exportPath string
+	importPath string
+	banFormat  string
+	// banDuration is the duration of the imported bans without one.
+	banDuration time.Duration
+	// args are the arguments of the commands parsing their own flags.
+	args []string
+}
+
+// listFlag is a flag which can be repeated, or given comma separated values.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// cliCommand is a subcommand of the bouncer. Commands without flags parse their own arguments.
+type cliCommand struct {
+	name    string
+	args    string
+	summary string
+	flags   func(flags *flag.FlagSet, opts *cliOptions)
+}
+
+var cliCommands = []cliCommand{
+	{name: runCommand, summary: "run the bouncer, this is the default command", flags: func(flags *flag.FlagSet, opts *cliOptions) {
+		flags.BoolVar(&opts.dryRun, "dry-run", opts.dryRun, "run the bouncer without making any change at cloudflare, the changes are logged instead")
+	}},
+	{name: setupCommand, summary: "only set up the ip lists and rules at cloudflare and exit", flags: func(flags *flag.FlagSet, opts *cliOptions) {
+		scopedCommandFlags(flags, opts)
+		flags.Var((*listFlag)(&opts.zones), "zone", "ID of a zone to set up, can be repeated or comma separated. Every zone of the accounts by default")
+	}},
+	{name: cleanupCommand, summary: "delete the ip lists and rules created by the bouncer at cloudflare and exit", flags: func(flags *flag.FlagSet, opts *cliOptions) {
+		scopedCommandFlags(flags, opts)
+		flags.Var((*listFlag)(&opts.zones), "zone", "ID of a zone to detach the bouncer from, can be repeated or comma separated. Every zone of the accounts by default")
+		flags.Var((*listFlag)(&opts.actions), "action", "action to stop enforcing, can be repeated or comma separated. Every action by default")
+	}},
+	{name: generateCommand, args: "token[,token...]", summary: "print a config for the accounts and zones the tokens have access to", flags: func(flags *flag.FlagSet, opts *cliOptions) {}},
+	{name: validateCommand, summary: "check the config and print its accounts and zones", flags: outputFlag},
+	{name: statusCommand, summary: "print the status of the running bouncer", flags: outputFlag},
+	{name: versionCommand, summary: "print version information", flags: outputFlag},
+	{name: exportCommand, args: "[file]", summary: "export the enforced IPs, ranges, countries and AS to the file, stdout by default", flags: banFormatFlag},
+	{name: importCommand, args: "file", summary: "enforce the bans of the exported file at cloudflare and exit", flags: func(flags *flag.FlagSet, opts *cliOptions) {
+		banFormatFlag(flags, opts)
+		flags.DurationVar(&opts.banDuration, "duration", defaultManualBanDuration, "duration of the bans which have none, they are lifted once it elapsed")
+		flags.BoolVar(&opts.dryRun, "dry-run", opts.dryRun, "log the changes instead of making them at cloudflare")
+	}},
+	{name: "ban", args: "[options] value", summary: "ban a value at once through the running bouncer"},
+	{name: "unban", args: "[options] value", summary: "lift a ban at once through the running bouncer"},
+	{name: "pause", args: "[options]", summary: "pause the rules of the bouncer at cloudflare"},
+	{name: "resume", args: "[options]", summary: "resume the rules of the bouncer at cloudflare"},
+}
+
+func outputFlag(flags *flag.FlagSet, opts *cliOptions) {
+	flags.StringVar(&opts.output, "output", opts.output, "output format, either 'table' or 'json'")
+	flags.StringVar(&opts.output, "o", opts.output, "shorthand for -output")
+}
+
+func banFormatFlag(flags *flag.FlagSet, opts *cliOptions) {
+	flags.StringVar(&opts.banFormat, "f", exportFormatJSON, "format of the file, either 'json', 'csv' or 'cloudflare'")
+}
+
+func scopedCommandFlags(flags *flag.FlagSet, opts *cliOptions) {
+	flags.Var((*listFlag)(&opts.accounts), "account", "ID of an account to restrict the command to, can be repeated or comma separated. Every account by default")
+	flags.BoolVar(&opts.plan, "plan", false, "print the changes the command would make at cloudflare without applying them")
+	flags.BoolVar(&opts.dryRun, "dry-run", opts.dryRun, "log the changes instead of making them at cloudflare")
+	outputFlag(flags, opts)
+}
+
+func printCommands(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s [-c config] [command] [options]\n\nCommands:\n", name)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, command := range cliCommands {
+		fmt.Fprintf(tw, "  %s\t%s\n", command.name, command.summary)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\nRun '%s command -h' for the options of a command.\n", name)
+}
+
+// parseCommandLine parses the arguments of the bouncer, the command being its first positional argument.
+// Without command the flags of the previous releases are accepted, most of them are deprecated.
+func parseCommandLine(args []string, output io.Writer) (*cliOptions, error) {
+	opts := &cliOptions{}
+	global := flag.NewFlagSet(name, flag.ContinueOnError)
+	global.SetOutput(output)
+	global.StringVar(&opts.configPath, "c", DEFAULT_CONFIG_PATH, "path to config file")
+	global.StringVar(&opts.output, "o", "table", "output format of the plan and of 'status', either 'table' or 'json'")
+	global.BoolVar(&opts.dryRun, "dry-run", false, "run the bouncer without making any change at cloudflare, the changes are logged instead")
+	configTokens := global.String("g", "", "deprecated, use 'generate'")
+	onlySetup := global.Bool("s", false, "deprecated, use 'setup'")
+	cleanup := global.Bool("d", false, "deprecated, use 'cleanup'")
+	ver := global.Bool("v", false, "deprecated, use 'version'")
+	plan := global.Bool("p", false, "deprecated, use 'setup -plan' or 'cleanup -plan'")
+	exportPath := global.String("export", "", "deprecated, use 'export'")
+	importPath := global.String("import", "", "deprecated, use 'import'")
+	banFormat := global.String("f", exportFormatJSON, "deprecated, use the '-f' option of 'export' or 'import'")
+	global.Usage = func() {
+		printCommands(global.Output())
+		fmt.Fprintln(global.Output(), "\nOptions:")
+		global.PrintDefaults()
+	}
+	if err := global.Parse(args); err != nil {
+		return nil, err
+	}
+
+	legacyFlags := make([]string, 0)
+	global.Visit(func(f *flag.Flag) {
+		if strings.HasPrefix(f.Usage, "deprecated") {
+			legacyFlags = append(legacyFlags, "-"+f.Name)
+		}
+	})
+	if global.Arg(0) == "help" {
+		global.Usage()
+		return nil, flag.ErrHelp
+	}
+	if global.NArg() == 0 {
+		opts.command = runCommand
+		return opts, parseLegacyFlags(opts, legacyFlags, *configTokens, *onlySetup, *cleanup, *ver, *plan, *exportPath, *importPath, *banFormat)
+	}
+	if len(legacyFlags) > 0 {
+		return nil, fmt.Errorf("'%s' can't be used with the '%s' command", strings.Join(legacyFlags, "', '"), global.Arg(0))
+	}
+
+	opts.command = global.Arg(0)
+	for _, command := range cliCommands {
+		if command.name != opts.command {
+			continue
+		}
+		if command.flags == nil {
+			opts.args = global.Args()[1:]
+			return opts, nil
+		}
+		flags := flag.NewFlagSet(command.name, flag.ContinueOnError)
+		flags.SetOutput(output)
+		flags.StringVar(&opts.configPath, "c", opts.configPath, "path to config file")
+		command.flags(flags, opts)
+		flags.Usage = func() {
+			fmt.Fprintf(flags.Output(), "Usage: %s %s [options] %s\n\n%s.\n\nOptions:\n", name, command.name, command.args, strings.ToUpper(command.summary[:1])+command.summary[1:])
+			flags.PrintDefaults()
+		}
+		if err := flags.Parse(global.Args()[1:]); err != nil {
+			return nil, err
+		}
+		return opts, parseCommandArgs(opts, flags)
+	}
+	printCommands(output)
+	return nil, fmt.Errorf("unknown command '%s'", opts.command)
+}
+
+// parseCommandArgs checks the positional arguments of the command.
+func parseCommandArgs(opts *cliOptions, flags *flag.FlagSet) error {
+	args := flags.Args()
+	switch opts.command {
+	case generateCommand:
+		if len(args) == 0 {
+			flags.Usage()
+			return fmt.Errorf("%s expects at least one token", opts.command)
+		}
+		opts.tokens = strings.Join(args, ",")
+		return nil
+	case exportCommand:
+		opts.exportPath = "-"
+		if len(args) == 1 {
+			opts.exportPath = args[0]
+		}
+		if len(args) > 1 {
+			flags.Usage()
+			return fmt.Errorf("%s expects at most one file", opts.command)
+		}
+		return nil
+	case importCommand:
+		if len(args) != 1 {
+			flags.Usage()
+			return fmt.Errorf("%s expects one file", opts.command)
+		}
+		opts.importPath = args[0]
+		return nil
+	}
+	if len(args) != 0 {
+		flags.Usage()
+		return fmt.Errorf("%s expects no argument", opts.command)
+	}
+	return nil
+}
+
+// parseLegacyFlags selects the command of the flags of the previous releases.
+func parseLegacyFlags(opts *cliOptions, legacyFlags []string, configTokens string, onlySetup bool, cleanup bool, ver bool,
+	plan bool, exportPath string, importPath string, banFormat string) error {
+	if cleanup && onlySetup {
+		return fmt.Errorf("conflicting cli arguments, pass only one of '-d' or '-s' ")
+	}
+	if plan && !cleanup && !onlySetup {
+		return fmt.Errorf("'-p' requires one of '-d' or '-s'")
+	}
+	if importPath != "" && (cleanup || onlySetup || plan || exportPath != "") {
+		return fmt.Errorf("conflicting cli arguments, '-import' can't be used with '-d', '-s', '-p' or '-export'")
+	}
+	opts.plan = plan
+	opts.tokens = configTokens
+	opts.exportPath = exportPath
+	opts.importPath = importPath
+	opts.banFormat = banFormat
+	if importPath != "" {
+		opts.banDuration = defaultManualBanDuration
+	}
+	switch {
+	case ver:
+		opts.command = versionCommand
+	case configTokens != "":
+		opts.command = generateCommand
+	case exportPath != "":
+		opts.command = exportCommand
+	case importPath != "":
+		opts.command = importCommand
+	case onlySetup:
+		opts.command = setupCommand
+	case cleanup:
+		opts.command = cleanupCommand
+	}
+	if len(legacyFlags) > 0 {
+		replacement := opts.command
+		if plan {
+			replacement += " -plan"
+		}
+		log.Warningf("deprecated flags '%s', use '%s %s' instead", strings.Join(legacyFlags, "', '"), name, replacement)
+	}
+	return nil
+}
+
+// selectConfigAccounts restricts the accounts of the config to the selected ones, every account when none are selected.
+func selectConfigAccounts(conf *bouncerConfig, accountIDs []string) error {
+	if len(accountIDs) == 0 {
+		return nil
+	}
+	accountByID := make(map[string]AccountConfig, len(conf.CloudflareConfig.Accounts))
+	for _, account := range conf.CloudflareConfig.Accounts {
+		accountByID[account.ID] = account
+	}
+	selected := make([]AccountConfig, 0, len(accountIDs))
+	selectedIDs := make(map[string]struct{}, len(accountIDs))
+	for _, id := range accountIDs {
+		account, ok := accountByID[id]
+		if !ok {
+			return fmt.Errorf("account %s is not in the config", id)
+		}
+		if _, ok := selectedIDs[id]; ok {
+			continue
+		}
+		selectedIDs[id] = struct{}{}
+		selected = append(selected, account)
+	}
+	conf.CloudflareConfig.Accounts = selected
+	return nil
+}
+
+// configSummary is the config as printed by the validate command.
+type configSummary struct {
+	ConfigPath string                 `json:"config_path"`
+	Valid      bool                   `json:"valid"`
+	Error      string                 `json:"error,omitempty"`
+	Accounts   []accountConfigSummary `json:"accounts,omitempty"`
+}
+
+type accountConfigSummary struct {
+	ID            string              `json:"id"`
+	DefaultAction string              `json:"default_action"`
+	IPListPrefix  string              `json:"ip_list_prefix"`
+	Zones         []zoneConfigSummary `json:"zones"`
+}
+
+type zoneConfigSummary struct {
+	ID          string   `json:"id"`
+	Actions     []string `json:"actions"`
+	Enforcement string   `json:"enforcement"`
+}
+
+func summarizeConfig(configPath string, conf *bouncerConfig, err error) configSummary {
+	summary := configSummary{ConfigPath: configPath, Valid: err == nil}
+	if err != nil {
+		summary.Error = err.Error()
+		return summary
+	}
+	for _, account := range conf.CloudflareConfig.Accounts {
+		accountSummary := accountConfigSummary{ID: account.ID, DefaultAction: account.DefaultAction, IPListPrefix: account.IPListPrefix, Zones: make([]zoneConfigSummary, 0)}
+		for _, zone := range account.ZoneConfigs {
+			enforcement := ipListEnforcement
+			if (&CloudflareWorker{Account: account}).usesAccessRules(zone) {
+				enforcement = accessRuleEnforcement
+			}
+			accountSummary.Zones = append(accountSummary.Zones, zoneConfigSummary{ID: zone.ID, Actions: zone.Actions, Enforcement: enforcement})
+		}
+		summary.Accounts = append(summary.Accounts, accountSummary)
+	}
+	sort.Slice(summary.Accounts, func(i, j int) bool { return summary.Accounts[i].ID < summary.Accounts[j].ID })
+	return summary
+}
+
+// runValidateCommand checks the config and writes its summary, it fails if the config is invalid.
+func runValidateCommand(w io.Writer, configPath string, format string) error {
+	conf, err := NewConfig(configPath)
+	summary := summarizeConfig(configPath, conf, err)
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "	")
+		if encodeErr := encoder.Encode(summary); encodeErr != nil {
+			return encodeErr
+		}
+	case "table", "":
+		if err != nil {
+			break
+		}
+		fmt.Fprintf(w, "%s is valid\n", configPath)
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ACCOUNT\tZONE\tACTIONS\tENFORCEMENT")
+		for _, account := range summary.Accounts {
+			for _, zone := range account.Zones {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", account.ID, zone.ID, strings.Join(zone.Actions, ","), zone.Enforcement)
+			}
+		}
+		if flushErr := tw.Flush(); flushErr != nil {
+			return flushErr
+		}
+	default:
+		return fmt.Errorf("unknown output format '%s', expecting 'table' or 'json'", format)
+	}
+	if err != nil {
+		return fmt.Errorf("%s is invalid: %s", configPath, err)
+	}
+	return nil
+}
+
+// writeVersion writes the version information of the bouncer.
+func writeVersion(w io.Writer, format string) error {
+	switch format {
+	case "json":
+		return json.NewEncoder(w).Encode(map[string]string{
+			"version":    version.Version,
+			"tag":        version.Tag,
+			"build_date": version.BuildDate,
+			"go_version": version.GoVersion,
+		})
+	case "table", "":
+		_, err := fmt.Fprint(w, version.ShowStr())
+		return err
+	}
+	return fmt.Errorf("unknown output format '%s', expecting 'table' or 'json'", format)
+}
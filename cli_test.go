@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_parseCommandLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    cliOptions
+		wantErr bool
+	}{
+		{name: "run by default", args: []string{"-c", "cfg.yaml"}, want: cliOptions{command: runCommand, configPath: "cfg.yaml", output: "table", banFormat: exportFormatJSON}},
+		{name: "setup of accounts", args: []string{"setup", "-account", "a1,a2", "--account", "a3", "--plan", "--output", "json"},
+			want: cliOptions{command: setupCommand, configPath: DEFAULT_CONFIG_PATH, output: "json", plan: true, accounts: []string{"a1", "a2", "a3"}}},
+		{name: "config before the command", args: []string{"-c", "cfg.yaml", "-o", "json", "status"}, want: cliOptions{command: statusCommand, configPath: "cfg.yaml", output: "json"}},
+		{name: "config of the command", args: []string{"cleanup", "-c", "cfg.yaml", "-dry-run"}, want: cliOptions{command: cleanupCommand, configPath: "cfg.yaml", output: "table", dryRun: true}},
+		{name: "generate", args: []string{"generate", "t1", "t2"}, want: cliOptions{command: generateCommand, configPath: DEFAULT_CONFIG_PATH, output: "table", tokens: "t1,t2"}},
+		{name: "export to stdout", args: []string{"export", "-f", "csv"}, want: cliOptions{command: exportCommand, configPath: DEFAULT_CONFIG_PATH, output: "table", exportPath: "-", banFormat: "csv"}},
+		{name: "ban parses its own flags", args: []string{"ban", "-duration", "1h", "1.2.3.4"}, want: cliOptions{command: "ban", configPath: DEFAULT_CONFIG_PATH, output: "table", args: []string{"-duration", "1h", "1.2.3.4"}}},
+		{name: "deprecated setup", args: []string{"-s", "-p"}, want: cliOptions{command: setupCommand, configPath: DEFAULT_CONFIG_PATH, output: "table", plan: true, banFormat: exportFormatJSON}},
+		{name: "deprecated generate", args: []string{"-g", "t1,t2"}, want: cliOptions{command: generateCommand, configPath: DEFAULT_CONFIG_PATH, output: "table", tokens: "t1,t2", banFormat: exportFormatJSON}},
+		{name: "deprecated import", args: []string{"-import", "bans.csv", "-f", "csv"}, want: cliOptions{command: importCommand, configPath: DEFAULT_CONFIG_PATH, output: "table", importPath: "bans.csv", banFormat: "csv", banDuration: defaultManualBanDuration}},
+		{name: "deprecated conflicting flags", args: []string{"-s", "-d"}, wantErr: true},
+		{name: "deprecated plan without command", args: []string{"-p"}, wantErr: true},
+		{name: "deprecated flag with command", args: []string{"-d", "setup"}, wantErr: true},
+		{name: "unknown command", args: []string{"start"}, wantErr: true},
+		{name: "import without file", args: []string{"import"}, wantErr: true},
+		{name: "unexpected argument", args: []string{"setup", "zone1"}, wantErr: true},
+		{name: "setup of zones", args: []string{"setup", "-zone", "z1", "-zone", "z2"}, want: cliOptions{command: setupCommand, configPath: DEFAULT_CONFIG_PATH, output: "table", zones: []string{"z1", "z2"}}},
+		{name: "cleanup of zones and actions", args: []string{"cleanup", "-zone", "z1,z2", "-action", "block"}, want: cliOptions{command: cleanupCommand, configPath: DEFAULT_CONFIG_PATH, output: "table", zones: []string{"z1", "z2"}, actions: []string{"block"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCommandLine(tt.args, ioutil.Discard)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCommandLine() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("want %+v, found %+v", tt.want, *got)
+			}
+		})
+	}
+}
+
+func Test_parseCommandLine_help(t *testing.T) {
+	for _, args := range [][]string{{"help"}, {"-h"}, {"setup", "-h"}} {
+		usage := &bytes.Buffer{}
+		if _, err := parseCommandLine(args, usage); err != flag.ErrHelp {
+			t.Errorf("%v: expected help, found %v", args, err)
+		}
+		if !bytes.Contains(usage.Bytes(), []byte("Usage: "+name)) {
+			t.Errorf("%v: expected the usage, found %s", args, usage.String())
+		}
+	}
+}
+
+func Test_selectConfigAccounts(t *testing.T) {
+	conf := &bouncerConfig{CloudflareConfig: CloudflareConfig{Accounts: []AccountConfig{{ID: "a1"}, {ID: "a2"}, {ID: "a3"}}}}
+	if err := selectConfigAccounts(conf, []string{"a4"}); err == nil {
+		t.Error("expected an unknown account to be refused")
+	}
+	if err := selectConfigAccounts(conf, []string{"a3", "a1", "a3"}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(conf.CloudflareConfig.Accounts, []AccountConfig{{ID: "a3"}, {ID: "a1"}}) {
+		t.Errorf("unexpected accounts %+v", conf.CloudflareConfig.Accounts)
+	}
+}
+
+func Test_runValidateCommand(t *testing.T) {
+	out := &bytes.Buffer{}
+	if err := runValidateCommand(out, "./test_data/valid_config.yaml", "json"); err != nil {
+		t.Fatal(err)
+	}
+	summary := configSummary{}
+	if err := json.Unmarshal(out.Bytes(), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if !summary.Valid || len(summary.Accounts) != 1 || summary.Accounts[0].Zones[0].Enforcement != ipListEnforcement {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+
+	invalidPath := filepath.Join(t.TempDir(), "invalid.yaml")
+	config := "cloudflare_config:\n  accounts:\n  - id: account1\n    token: token\n    default_action: ban\n"
+	if err := ioutil.WriteFile(invalidPath, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := runValidateCommand(out, invalidPath, "json"); err == nil {
+		t.Fatal("expected the config to be invalid")
+	}
+	if err := json.Unmarshal(out.Bytes(), &summary); err != nil || summary.Valid || summary.Error == "" {
+		t.Errorf("expected the error in the summary, found %+v %v", summary, err)
+	}
+}
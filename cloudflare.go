@@ -13,6 +13,7 @@ import (
 	"github.com/cloudflare/cloudflare-go"
 	"github.com/crowdsecurity/crowdsec/pkg/models"
 	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -33,6 +34,27 @@ type ZoneLock struct {
 type IPListState struct {
 	IPList   *cloudflare.IPList
 	ItemByIP map[string]cloudflare.IPListItem
+	// loadItems reads ItemByIP from the state store, it is set while the items of a stored state aren't loaded.
+	loadItems func() (map[string]cloudflare.IPListItem, error)
+}
+
+// itemsLoaded returns false if the items are still in the state store.
+func (s *IPListState) itemsLoaded() bool {
+	return s.ItemByIP != nil || s.loadItems == nil
+}
+
+// load reads the items from the state store if they aren't loaded yet.
+func (s *IPListState) load() error {
+	if s.itemsLoaded() {
+		return nil
+	}
+	items, err := s.loadItems()
+	if err != nil {
+		return err
+	}
+	s.ItemByIP = items
+	s.loadItems = nil
+	return nil
 }
 
 // one firewall rule per zone.
@@ -44,6 +66,12 @@ type CloudflareState struct {
 	IPListState         IPListState
 	CountrySet          map[string]struct{}
 	AutonomousSystemSet map[string]struct{}
+	// zone ID (empty for account level rules) -> IP -> ID of the access rule enforcing it
+	AccessRuleIDsByZoneID map[string]map[string]string `json:",omitempty"`
+	// value -> ban made through the admin API
+	ManualBans map[string]manualBan `json:",omitempty"`
+	// zones in which the rule of this state is paused
+	PausedZoneIDs map[string]struct{} `json:",omitempty"`
 }
 
 func setToExprList(set map[string]struct{}, quotes bool) string {
@@ -109,7 +137,7 @@ type CloudflareWorker struct {
 	CFStateByAction         map[string]*CloudflareState
 	Ctx                     context.Context
 	LAPIStream              chan *models.DecisionsStreamResponse
-	UpdatedState            chan map[string]*CloudflareState
+	UpdatedState            chan *stateUpdate
 	UpdateFrequency         time.Duration
 	NewIPDecisions          []*models.Decision
 	ExpiredIPDecisions      []*models.Decision
@@ -118,9 +146,32 @@ type CloudflareWorker struct {
 	NewCountryDecisions     []*models.Decision
 	ExpiredCountryDecisions []*models.Decision
 	API                     cloudflareAPI
+	Backends                []enforcementBackend
 	Wg                      *sync.WaitGroup
 	Count                   prometheus.Counter
+	DryRun                  bool
+	DryRunCount             *prometheus.CounterVec
+	Metrics                 *bouncerMetrics
+	Audit                   *auditLog
+	Webhooks                *webhookNotifier
+	ZoneEntitlements        map[string]planEntitlements
+	ListEntitlements        planEntitlements
+	Health                  *workerHealth
+	AdminRequests           chan *adminRequest
+	Stop                    <-chan struct{}
 	tokenCallCount          *uint32
+	setUpDone               bool
+	receivedDecisions       map[*models.Decision]trackedDecision
+	awaitingRules           []trackedDecision
+	auditDecisions          map[auditKey]*models.Decision
+	ipListsFull             bool
+	// overCapacity are the pending new IP decisions which didn't fit in the full IP lists.
+	overCapacity     map[*models.Decision]struct{}
+	publishedItemIDs map[string]map[string]string
+	// setUpZoneIDs are the zones a setup is restricted to, every zone when empty.
+	setUpZoneIDs []string
+	// pendingRuleBans are the events of the countries and AS banned by the next UpdateRules.
+	pendingRuleBans []webhookEvent
 }
 
 type cloudflareAPI interface {
@@ -129,13 +180,21 @@ type cloudflareAPI interface {
 	CreateIPList(ctx context.Context, name string, desc string, typ string) (cloudflare.IPList, error)
 	DeleteIPList(ctx context.Context, id string) (cloudflare.IPListDeleteResponse, error)
 	ListIPLists(ctx context.Context) ([]cloudflare.IPList, error)
+	ListIPListItems(ctx context.Context, id string) ([]cloudflare.IPListItem, error)
 	CreateFirewallRules(ctx context.Context, zone string, rules []cloudflare.FirewallRule) ([]cloudflare.FirewallRule, error)
 	DeleteFirewallRules(ctx context.Context, zoneID string, firewallRuleIDs []string) error
 	FirewallRules(ctx context.Context, zone string, opts cloudflare.PaginationOptions) ([]cloudflare.FirewallRule, error)
+	UpdateFirewallRules(ctx context.Context, zone string, rules []cloudflare.FirewallRule) ([]cloudflare.FirewallRule, error)
 	CreateIPListItems(ctx context.Context, id string, items []cloudflare.IPListItemCreateRequest) ([]cloudflare.IPListItem, error)
 	DeleteIPListItems(ctx context.Context, id string, items cloudflare.IPListItemDeleteRequest) ([]cloudflare.IPListItem, error)
 	DeleteFilters(ctx context.Context, zoneID string, filterIDs []string) error
 	UpdateFilters(ctx context.Context, zoneID string, filters []cloudflare.Filter) ([]cloudflare.Filter, error)
+	ListAccountAccessRules(ctx context.Context, accountID string, accessRule cloudflare.AccessRule, page int) (*cloudflare.AccessRuleListResponse, error)
+	CreateAccountAccessRule(ctx context.Context, accountID string, accessRule cloudflare.AccessRule) (*cloudflare.AccessRuleResponse, error)
+	DeleteAccountAccessRule(ctx context.Context, accountID, accessRuleID string) (*cloudflare.AccessRuleResponse, error)
+	ListZoneAccessRules(ctx context.Context, zoneID string, accessRule cloudflare.AccessRule, page int) (*cloudflare.AccessRuleListResponse, error)
+	CreateZoneAccessRule(ctx context.Context, zoneID string, accessRule cloudflare.AccessRule) (*cloudflare.AccessRuleResponse, error)
+	DeleteZoneAccessRule(ctx context.Context, zoneID, accessRuleID string) (*cloudflare.AccessRuleResponse, error)
 }
 
 func min(a int, b int) int {
@@ -211,8 +270,7 @@ func (worker *CloudflareWorker) getMutexByZoneID(zoneID string) (*sync.Mutex, er
 }
 
 func (worker *CloudflareWorker) getAPI() cloudflareAPI {
-	atomic.AddUint32(worker.tokenCallCount, 1)
-	if *worker.tokenCallCount > CallsPerSecondLimit {
+	if atomic.AddUint32(worker.tokenCallCount, 1) > CallsPerSecondLimit {
 		time.Sleep(time.Second)
 	}
 	worker.Count.Inc()
@@ -316,9 +374,13 @@ func (worker *CloudflareWorker) removeIPListDependencies(IPListName string) erro
 		return err
 	}
 
-	zoneIDs := make([]string, len(zones))
-	for i, zone := range zones {
-		zoneIDs[i] = zone.ID
+	zoneIDs := make([]string, 0, len(zones))
+	for _, zone := range zones {
+		if len(worker.setUpZoneIDs) > 0 && !contains(worker.setUpZoneIDs, zone.ID) {
+			// the rules of the zones left out of the setup are kept.
+			continue
+		}
+		zoneIDs = append(zoneIDs, zone.ID)
 	}
 
 	worker.Logger.Debugf("found %d zones on this account", len(zones))
@@ -345,14 +407,39 @@ func (worker *CloudflareWorker) getIPListID(IPListName string, IPLists []cloudfl
 }
 
 func (worker *CloudflareWorker) setUpIPList() error {
-	err := worker.deleteExistingIPList()
+	IPLists, err := worker.getAPI().ListIPLists(worker.Ctx)
 	if err != nil {
 		return err
 	}
 
+	listActions := worker.ipListActions()
 	for action, state := range worker.CFStateByAction {
-		ipList := *state.IPListState.IPList
-		tmp, err := worker.getAPI().CreateIPList(worker.Ctx, ipList.Name, fmt.Sprintf("%s IP list by crowdsec", action), "ip")
+		IPList := state.IPListState.IPList
+		id := worker.getIPListID(IPList.Name, IPLists) // requires ip list name
+		if id != nil {
+			worker.Logger.Infof("ip list %s already exists", IPList.Name)
+			// the rules are recreated.
+			err = worker.removeIPListDependencies(IPList.Name) // requires ip list name
+			if err != nil {
+				return err
+			}
+		}
+		if _, ok := listActions[action]; !ok {
+			if id != nil {
+				// enforced without ip list, the list isn't used anymore.
+				if _, err = worker.getAPI().DeleteIPList(worker.Ctx, *id); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if id != nil {
+			if err := worker.adoptIPList(state, *id, IPLists); err != nil {
+				return err
+			}
+			continue
+		}
+		tmp, err := worker.getAPI().CreateIPList(worker.Ctx, IPList.Name, fmt.Sprintf("%s IP list by crowdsec", action), "ip")
 		if err != nil {
 			return err
 		}
@@ -364,8 +451,45 @@ func (worker *CloudflareWorker) setUpIPList() error {
 	return nil
 }
 
+// adoptIPList makes the state use the existing IP list. When the state doesn't know the list, because
+// the cache was lost, its items are read and kept as manual bans: they are lifted after
+// defaultManualBanDuration unless CrowdSec still has a decision on them.
+func (worker *CloudflareWorker) adoptIPList(state *CloudflareState, id string, IPLists []cloudflare.IPList) error {
+	for _, ipList := range IPLists {
+		if ipList.ID != id {
+			continue
+		}
+		known := state.IPListState.IPList.CreatedOn != nil && state.IPListState.IPList.ID == id
+		*state.IPListState.IPList = ipList
+		state.UpdateExpr()
+		if known {
+			return nil
+		}
+		items, err := worker.getAPI().ListIPListItems(worker.Ctx, id)
+		if err != nil {
+			return err
+		}
+		state.IPListState.ItemByIP = make(map[string]cloudflare.IPListItem, len(items))
+		if state.ManualBans == nil {
+			state.ManualBans = make(map[string]manualBan)
+		}
+		expiration := time.Now().Add(defaultManualBanDuration)
+		for _, item := range items {
+			state.IPListState.ItemByIP[item.IP] = item
+			comment := strings.TrimPrefix(item.Comment, manualBanOrigin+": ")
+			if comment == manualBanOrigin {
+				comment = ""
+			}
+			state.ManualBans[item.IP] = manualBan{Scope: ipScope(item.IP), DecisionType: decisionTypeByCloudflareAction[state.Action], Comment: comment, Expiration: expiration}
+		}
+		worker.Logger.Infof("kept the %d items of ip list %s until %s", len(items), ipList.Name, expiration.Format(time.RFC3339))
+		return nil
+	}
+	return fmt.Errorf("ip list %s not found", id)
+}
+
 func (worker *CloudflareWorker) setUpRules() error {
-	for _, zone := range worker.Account.ZoneConfigs {
+	for _, zone := range worker.ipListZones() {
 		zoneLogger := worker.Logger.WithFields(log.Fields{"zone_id": zone.ID})
 		for _, action := range zone.Actions {
 			ruleExpression := worker.CFStateByAction[action].CurrExpr
@@ -383,90 +507,185 @@ func (worker *CloudflareWorker) setUpRules() error {
 	return nil
 }
 
+// accountActionFor returns the action IP decisions with the given action are enforced with.
+// IP decisions are applied at account level, so in case some zones support this action and others don't,
+// we put this in account's default action. Returns false if the decisions must be dropped.
+func (worker *CloudflareWorker) accountActionFor(action string) (string, bool) {
+	if allZonesHaveAction(worker.Account.ZoneConfigs, action) {
+		return action, true
+	}
+	if worker.Account.DefaultAction == "none" {
+		return "", false
+	}
+	return worker.Account.DefaultAction, true
+}
+
+func (worker *CloudflareWorker) getBackends() []enforcementBackend {
+	if worker.Backends == nil {
+		worker.Backends = worker.newBackends()
+	}
+	return worker.Backends
+}
+
+// cleanUp deletes everything the bouncer created at cloudflare for the account.
+func (worker *CloudflareWorker) cleanUp() error {
+	for _, backend := range worker.getBackends() {
+		if err := backend.Cleanup(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (worker *CloudflareWorker) AddNewIPs() error {
-	// IP decisions are applied at account level
-	decisonsByAction := dedupAndClassifyDecisionsByAction(worker.NewIPDecisions)
+	worker.rememberDecisions(worker.NewIPDecisions, false)
+	decisonsByAction := worker.classifyDecisions(worker.NewIPDecisions, false)
+	// the IPs banned in this tick, a webhook is sent for large waves.
+	bannedCount, bannedDecisions := 0, make([]*models.Decision, 0)
+	// the decisions which didn't fit in the IP lists, they are retried on the next update.
+	retried := make([]*models.Decision, 0)
 	for action, decisions := range decisonsByAction {
-		// In case some zones support this action and others don't,  we put this in account's default action.
-		if !allZonesHaveAction(worker.Account.ZoneConfigs, action) {
-			if worker.Account.DefaultAction == "none" {
-				worker.Logger.Debugf("dropping IP decisions with unsupported action %s", action)
-				continue
-			}
-			action = worker.Account.DefaultAction
-			worker.Logger.Debugf("ip action defaulted to %s", action)
-		}
-		state := worker.CFStateByAction[action]
-		newIPs := make([]cloudflare.IPListItemCreateRequest, 0)
-		for _, decision := range decisions {
-			// check if ip already exists in state. Send if not exists.
-			ip := normalizeDecisionValue(*decision.Value)
-			if _, ok := state.IPListState.ItemByIP[ip]; !ok {
-				newIPs = append(newIPs, cloudflare.IPListItemCreateRequest{
-					IP:      ip,
-					Comment: *decision.Scenario,
-				})
-				worker.CFStateByAction[action].IPListState.IPList.NumItems++
+		accountAction, ok := worker.accountActionFor(action)
+		if !ok {
+			worker.Logger.Debugf("dropping IP decisions with unsupported action %s", action)
+			worker.Metrics.recordDropped(worker.Account.ID, decisions, "unsupported_action")
+			continue
+		}
+		if accountAction != action {
+			worker.Logger.Debugf("ip action defaulted to %s", accountAction)
+			if action != "defaulted" {
+				worker.Metrics.recordDefaulted(worker.Account.ID, decisions, "action_not_in_every_zone")
 			}
 		}
-		if len(newIPs) > 0 {
-			items, err := worker.getAPI().CreateIPListItems(worker.Ctx, state.IPListState.IPList.ID, newIPs)
+		added, dropped := 0, make(map[string]string)
+		add := decisionIPs(decisions)
+		for _, backend := range worker.getBackends() {
+			result, err := backend.ApplyIPs(accountAction, add, nil)
 			if err != nil {
 				return err
 			}
-			worker.Logger.Infof("banned %d IPs", len(newIPs))
-			for _, item := range items {
-				worker.CFStateByAction[action].IPListState.ItemByIP[item.IP] = item
+			if result.Added > 0 {
+				worker.Logger.WithFields(log.Fields{"backend": backend.Name()}).Infof("banned %d IPs", result.Added)
+			}
+			if result.Added > added {
+				added = result.Added
+			}
+			for value, reason := range result.Dropped {
+				dropped[value] = reason
 			}
 		}
-
+		decisions, full := worker.dropUnenforced(decisions, dropped)
+		retried = append(retried, full...)
+		if added > 0 {
+			bannedCount += added
+			bannedDecisions = append(bannedDecisions, decisions...)
+		}
+		worker.Metrics.recordApplied(worker.Account.ID, decisions, false)
+		worker.confirmDecisions(decisions)
+	}
+	if bannedCount > 0 {
+		worker.notify(webhookEvent{
+			Type:      webhookBanWave,
+			AccountID: worker.Account.ID,
+			Message:   fmt.Sprintf("account %s banned %d IPs", worker.Account.ID, bannedCount),
+			Count:     bannedCount,
+			Scenarios: scenariosOf(bannedDecisions),
+		})
+	}
+	worker.publishState()
+	overCapacity := make(map[*models.Decision]struct{}, len(retried))
+	for _, decision := range retried {
+		overCapacity[decision] = struct{}{}
 	}
-	go func() { worker.UpdatedState <- worker.CFStateByAction }()
-	worker.NewIPDecisions = make([]*models.Decision, 0)
+	for _, decision := range worker.NewIPDecisions {
+		if _, ok := overCapacity[decision]; !ok {
+			worker.forgetDecisions([]*models.Decision{decision})
+		}
+	}
+	worker.overCapacity = overCapacity
+	worker.NewIPDecisions = retried
 	return nil
 }
 
-func (worker *CloudflareWorker) DeleteIPs() error {
-	// IP decisions are applied at account level
-	decisonsByAction := dedupAndClassifyDecisionsByAction(worker.ExpiredIPDecisions)
-	for action, decisions := range decisonsByAction {
-		// In case some zones support this action and others don't,  we put this in account's default action.
-		if !allZonesHaveAction(worker.Account.ZoneConfigs, action) {
-			if worker.Account.DefaultAction == "none" {
-				worker.Logger.Debugf("dropping IP delete decisions with unsupported action %s", action)
+// dropUnenforced records the decisions whose IP a backend couldn't enforce as dropped and returns the
+// other ones, along with the decisions which didn't fit in the full IP lists. Those are only recorded as
+// dropped the first time.
+func (worker *CloudflareWorker) dropUnenforced(decisions []*models.Decision, dropped map[string]string) ([]*models.Decision, []*models.Decision) {
+	full := make([]*models.Decision, 0)
+	if len(dropped) == 0 {
+		return decisions, full
+	}
+	enforced := make([]*models.Decision, 0, len(decisions))
+	for _, decision := range decisions {
+		reason, ok := dropped[normalizeDecisionValue(*decision.Value)]
+		if !ok {
+			enforced = append(enforced, decision)
+			continue
+		}
+		if reason == "ip_list_full" {
+			full = append(full, decision)
+			if _, retried := worker.overCapacity[decision]; retried {
 				continue
 			}
-			action = worker.Account.DefaultAction
-			worker.Logger.Debugf("ip delete action defaulted to %s", action)
-
 		}
-		state := worker.CFStateByAction[action]
-		deleteIPs := cloudflare.IPListItemDeleteRequest{Items: make([]cloudflare.IPListItemDeleteItemRequest, 0)}
-		for _, decision := range decisions {
-			// delete only if ip already exists in state.
-			ip := normalizeDecisionValue(*decision.Value)
-			if item, ok := state.IPListState.ItemByIP[ip]; ok {
-				deleteIPs.Items = append(deleteIPs.Items, cloudflare.IPListItemDeleteItemRequest{ID: item.ID})
+		worker.Metrics.recordDropped(worker.Account.ID, []*models.Decision{decision}, reason)
+	}
+	return enforced, full
+}
+
+// forgetOverCapacity stops retrying the decisions which didn't fit in the IP lists on the values of the
+// expired decisions.
+func (worker *CloudflareWorker) forgetOverCapacity(expired []*models.Decision) {
+	if len(worker.overCapacity) == 0 {
+		return
+	}
+	expiredValues := make(map[string]struct{}, len(expired))
+	for _, decision := range expired {
+		expiredValues[normalizeDecisionValue(*decision.Value)] = struct{}{}
+	}
+	pending := make([]*models.Decision, 0, len(worker.NewIPDecisions))
+	for _, decision := range worker.NewIPDecisions {
+		if _, ok := worker.overCapacity[decision]; ok {
+			if _, ok := expiredValues[normalizeDecisionValue(*decision.Value)]; ok {
+				delete(worker.overCapacity, decision)
+				worker.forgetDecisions([]*models.Decision{decision})
+				continue
 			}
 		}
+		pending = append(pending, decision)
+	}
+	worker.NewIPDecisions = pending
+}
 
-		if len(deleteIPs.Items) > 0 {
-			_, err := worker.getAPI().DeleteIPListItems(worker.Ctx, state.IPListState.IPList.ID, deleteIPs)
+func (worker *CloudflareWorker) DeleteIPs() error {
+	worker.forgetOverCapacity(worker.ExpiredIPDecisions)
+	worker.rememberDecisions(worker.ExpiredIPDecisions, true)
+	decisonsByAction := worker.classifyDecisions(worker.ExpiredIPDecisions, true)
+	for action, decisions := range decisonsByAction {
+		accountAction, ok := worker.accountActionFor(action)
+		if !ok {
+			worker.Logger.Debugf("dropping IP delete decisions with unsupported action %s", action)
+			worker.Metrics.recordDropped(worker.Account.ID, decisions, "unsupported_action")
+			continue
+		}
+		if accountAction != action {
+			worker.Logger.Debugf("ip delete action defaulted to %s", accountAction)
+		}
+		remove := decisionValues(decisions)
+		for _, backend := range worker.getBackends() {
+			result, err := backend.ApplyIPs(accountAction, nil, remove)
 			if err != nil {
 				return err
 			}
-			worker.CFStateByAction[action].IPListState.IPList.NumItems -= len(deleteIPs.Items)
-			ipByID := make(map[string]string)
-			for ip, item := range worker.CFStateByAction[action].IPListState.ItemByIP {
-				ipByID[item.ID] = ip
-			}
-			for _, item := range deleteIPs.Items {
-				delete(worker.CFStateByAction[action].IPListState.ItemByIP, ipByID[item.ID])
+			if result.Removed > 0 {
+				worker.Logger.WithFields(log.Fields{"backend": backend.Name()}).Infof("unbanned %d IPs", result.Removed)
 			}
 		}
-
+		worker.Metrics.recordApplied(worker.Account.ID, decisions, true)
+		worker.confirmDecisions(decisions)
 	}
-	go func() { worker.UpdatedState <- worker.CFStateByAction }()
+	worker.publishState()
+	worker.forgetDecisions(worker.ExpiredIPDecisions)
 	worker.ExpiredIPDecisions = make([]*models.Decision, 0)
 	return nil
 }
@@ -474,9 +693,14 @@ func (worker *CloudflareWorker) DeleteIPs() error {
 func (worker *CloudflareWorker) stateIsNew() bool {
 
 	isNew := false
-	for _, action := range worker.CFStateByAction {
+	listActions := worker.ipListActions()
+	for action, state := range worker.CFStateByAction {
+		if _, ok := listActions[action]; !ok {
+			// enforced without ip list.
+			continue
+		}
 		// this means that ip list is not created, hence the state is new.
-		if action.IPListState.IPList.CreatedOn == nil {
+		if state.IPListState.IPList.CreatedOn == nil {
 			isNew = true
 			break
 		}
@@ -486,11 +710,11 @@ func (worker *CloudflareWorker) stateIsNew() bool {
 
 func (worker *CloudflareWorker) SetUpCloudflareIfNewState() error {
 
-	defer func() { worker.UpdatedState <- worker.CFStateByAction }()
+	defer worker.publishState()
 
 	if !worker.stateIsNew() {
 		worker.Logger.Info("state hasn't changed, not setting up CF")
-		worker.Wg.Done()
+		worker.doneSettingUpIPList()
 		return nil
 	}
 
@@ -499,7 +723,7 @@ func (worker *CloudflareWorker) SetUpCloudflareIfNewState() error {
 		worker.Logger.Errorf("error %s in creating IP List", err.Error())
 		return err
 	}
-	worker.Wg.Done()
+	worker.doneSettingUpIPList()
 	worker.Wg.Wait()
 	worker.Logger.Debug("ip list setup complete")
 	err = worker.setUpRules()
@@ -510,28 +734,62 @@ func (worker *CloudflareWorker) SetUpCloudflareIfNewState() error {
 	return nil
 }
 
+// doneSettingUpIPList tells the other workers that this one is done setting up its IP lists. It is only
+// counted once, a restarted worker or one which failed before setting up doesn't block the others.
+func (worker *CloudflareWorker) doneSettingUpIPList() {
+	if worker.setUpDone {
+		return
+	}
+	worker.setUpDone = true
+	worker.Wg.Done()
+}
+
+// Init connects the worker to cloudflare and applies the changes of the config to the cached state.
 func (worker *CloudflareWorker) Init() error {
+	return worker.init(true)
+}
 
-	defer func() { worker.UpdatedState <- worker.CFStateByAction }()
+// InitCleanup connects the worker to cloudflare and keeps the cached state as is, so that the cleanup
+// deletes what was created, even if the config changed since.
+func (worker *CloudflareWorker) InitCleanup() error {
+	return worker.init(false)
+}
+
+func (worker *CloudflareWorker) init(reconcile bool) error {
+
+	defer worker.publishState()
 
 	var err error
 
 	worker.Logger = log.WithFields(log.Fields{"account_id": worker.Account.ID})
-	worker.NewIPDecisions = make([]*models.Decision, 0)
-	worker.ExpiredIPDecisions = make([]*models.Decision, 0)
+	// a restarted worker keeps the decisions collected before it failed.
+	if worker.NewIPDecisions == nil {
+		worker.NewIPDecisions = make([]*models.Decision, 0)
+	}
+	if worker.ExpiredIPDecisions == nil {
+		worker.ExpiredIPDecisions = make([]*models.Decision, 0)
+	}
 
 	if worker.API == nil { // this for easy swapping during tests
 		worker.API, err = cloudflare.NewWithAPIToken(worker.Account.Token, cloudflare.UsingAccount(worker.Account.ID))
+		if err != nil {
+			return err
+		}
+		if worker.Audit != nil {
+			worker.API = newAuditingCloudflareAPI(worker.API, worker)
+		}
+		if worker.Metrics != nil {
+			worker.API = newInstrumentedCloudflareAPI(worker.API, worker.Metrics)
+		}
 	}
 
-	worker.Logger.Debug("setup of API complete")
-
-	if len(worker.CFStateByAction) != 0 {
-		// no  need to  setup ip lists and rules, since cache is being used.
-		return nil
+	if _, wrapped := worker.API.(*recordingCloudflareAPI); worker.DryRun && !wrapped {
+		// reads still reach cloudflare, mutations are only logged.
+		worker.API = newDryRunCloudflareAPI(worker.API, worker.Account.ID, worker.Logger, worker.DryRunCount)
+		worker.Logger.Info("dry run enabled, no change will be made at cloudflare")
 	}
 
-	worker.CFStateByAction = make(map[string]*CloudflareState)
+	worker.Logger.Debug("setup of API complete")
 
 	zones, err := worker.API.ListZones(worker.Ctx)
 	if err != nil {
@@ -543,27 +801,35 @@ func (worker *CloudflareWorker) Init() error {
 		zoneByID[zone.ID] = zone
 	}
 
+	worker.detectEntitlements(zoneByID)
+	if reconcile {
+		if err := worker.checkEntitlements(); err != nil {
+			return err
+		}
+	}
+
 	for _, z := range worker.Account.ZoneConfigs {
-		if zone, ok := zoneByID[z.ID]; ok {
-			// FIXME this is probably wrong.
-			if !zone.Plan.IsSubscribed && len(z.Actions) > 1 {
-				return fmt.Errorf("zone %s 's plan doesn't support multiple actionss", z.ID)
-			}
+		if _, ok := zoneByID[z.ID]; !ok {
+			return fmt.Errorf("account %s doesn't have access to one %s", worker.Account.ID, z.ID)
+		}
+	}
 
-			for _, action := range z.Actions {
-				listName := fmt.Sprintf("%s_%s", worker.Account.IPListPrefix, action)
-				worker.CFStateByAction[action] = &CloudflareState{
-					AccountID:   worker.Account.ID,
-					Action:      action,
-					IPListState: IPListState{IPList: &cloudflare.IPList{Name: listName}, ItemByIP: make(map[string]cloudflare.IPListItem)},
-				}
-				worker.CFStateByAction[action].FilterIDByZoneID = make(map[string]string)
-				worker.CFStateByAction[action].CountrySet = make(map[string]struct{})
-				worker.CFStateByAction[action].AutonomousSystemSet = make(map[string]struct{})
+	if len(worker.CFStateByAction) != 0 && !reconcile {
+		return nil
+	}
+	if len(worker.CFStateByAction) != 0 {
+		// cache is being used, only the changes of the config since it was written need to be applied.
+		if err := worker.loadStateItems(); err != nil {
+			return err
+		}
+		return worker.reconcileState()
+	}
 
-			}
-		} else {
-			return fmt.Errorf("account %s doesn't have access to one %s", worker.Account.ID, z.ID)
+	worker.CFStateByAction = make(map[string]*CloudflareState)
+
+	for _, z := range worker.Account.ZoneConfigs {
+		for _, action := range z.Actions {
+			worker.CFStateByAction[action] = worker.newCloudflareState(action)
 		}
 	}
 	return err
@@ -593,11 +859,14 @@ func (worker *CloudflareWorker) getContainerByDecisionScope(scope string, decisi
 		return container, nil
 	}
 }
-func (worker *CloudflareWorker) insertDecision(decision *models.Decision, decisionIsExpired bool) {
+
+// insertDecision queues the decision for the next sync, it returns false if its scope isn't supported.
+func (worker *CloudflareWorker) insertDecision(decision *models.Decision, decisionIsExpired bool) bool {
 	container, err := worker.getContainerByDecisionScope(*decision.Scope, decisionIsExpired)
 	if err != nil {
 		worker.Logger.Debugf("ignored new decision with scope=%s, type=%s, value=%s", *decision.Scope, *decision.Type, *decision.Value)
-		return
+		worker.Metrics.recordDropped(worker.Account.ID, []*models.Decision{decision}, "unsupported_scope")
+		return false
 	}
 	decisionStatus := "new"
 	if decisionIsExpired {
@@ -605,19 +874,32 @@ func (worker *CloudflareWorker) insertDecision(decision *models.Decision, decisi
 	}
 	worker.Logger.Infof("found %s decision with value=%s, scope=%s, type=%s", decisionStatus, *decision.Value, *decision.Scope, *decision.Type)
 	*container = append(*container, decision)
+	return true
 }
 
 func (worker *CloudflareWorker) CollectLAPIStream(streamDecision *models.DecisionsStreamResponse) {
+	receivedAt := time.Now()
+	worker.recordLAPIBans(streamDecision.New)
 	for _, decision := range streamDecision.New {
-		worker.insertDecision(decision, false)
+		worker.Metrics.recordReceived(worker.Account.ID, decision, false)
+		if worker.insertDecision(decision, false) {
+			worker.trackDecision(decision, false, receivedAt)
+		}
 	}
 	for _, decision := range streamDecision.Deleted {
-		worker.insertDecision(decision, true)
+		worker.Metrics.recordReceived(worker.Account.ID, decision, true)
+	}
+	for _, decision := range worker.keepManualBans(streamDecision.Deleted) {
+		if worker.insertDecision(decision, true) {
+			worker.trackDecision(decision, true, receivedAt)
+		}
 	}
 }
 
 func (worker *CloudflareWorker) SendASBans() error {
-	decisionsByAction := dedupAndClassifyDecisionsByAction(worker.NewASDecisions)
+	worker.rememberDecisions(worker.NewASDecisions, false)
+	decisionsByAction := worker.classifyDecisions(worker.NewASDecisions, false)
+	bannedByAction := make(map[string][]*models.Decision)
 	for _, zoneCfg := range worker.Account.ZoneConfigs {
 		zoneLogger := worker.Logger.WithFields(log.Fields{"zone_id": zoneCfg.ID})
 		for action, decisions := range decisionsByAction {
@@ -626,16 +908,24 @@ func (worker *CloudflareWorker) SendASBans() error {
 				if _, ok := worker.CFStateByAction[action].AutonomousSystemSet[*decision.Value]; !ok {
 					zoneLogger.Debugf("found new AS ban for %s", *decision.Value)
 					worker.CFStateByAction[action].AutonomousSystemSet[*decision.Value] = struct{}{}
+					bannedByAction[action] = append(bannedByAction[action], decision)
 				}
 			}
 		}
 	}
+	worker.queueRuleBans(webhookASBan, bannedByAction)
+	for _, decisions := range decisionsByAction {
+		worker.Metrics.recordApplied(worker.Account.ID, decisions, false)
+		worker.awaitRules(decisions)
+	}
+	worker.forgetDecisions(worker.NewASDecisions)
 	worker.NewASDecisions = make([]*models.Decision, 0)
 	return nil
 }
 
 func (worker *CloudflareWorker) DeleteASBans() error {
-	decisionsByAction := dedupAndClassifyDecisionsByAction(worker.ExpiredASDecisions)
+	worker.rememberDecisions(worker.ExpiredASDecisions, true)
+	decisionsByAction := worker.classifyDecisions(worker.ExpiredASDecisions, true)
 	for _, zoneCfg := range worker.Account.ZoneConfigs {
 		zoneLogger := worker.Logger.WithFields(log.Fields{"zone_id": zoneCfg.ID})
 		for action, decisions := range decisionsByAction {
@@ -648,6 +938,11 @@ func (worker *CloudflareWorker) DeleteASBans() error {
 			}
 		}
 	}
+	for _, decisions := range decisionsByAction {
+		worker.Metrics.recordApplied(worker.Account.ID, decisions, true)
+		worker.awaitRules(decisions)
+	}
+	worker.forgetDecisions(worker.ExpiredASDecisions)
 	worker.ExpiredASDecisions = make([]*models.Decision, 0)
 	return nil
 }
@@ -664,7 +959,9 @@ func (worker *CloudflareWorker) normalizeActionForZone(action string, zoneCfg Zo
 }
 
 func (worker *CloudflareWorker) SendCountryBans() error {
-	decisionsByAction := dedupAndClassifyDecisionsByAction(worker.NewCountryDecisions)
+	worker.rememberDecisions(worker.NewCountryDecisions, false)
+	decisionsByAction := worker.classifyDecisions(worker.NewCountryDecisions, false)
+	bannedByAction := make(map[string][]*models.Decision)
 	for _, zoneCfg := range worker.Account.ZoneConfigs {
 		zoneLogger := worker.Logger.WithFields(log.Fields{"zone_id": zoneCfg.ID})
 		for action, decisions := range decisionsByAction {
@@ -673,16 +970,24 @@ func (worker *CloudflareWorker) SendCountryBans() error {
 				if _, ok := worker.CFStateByAction[action].CountrySet[*decision.Value]; !ok {
 					zoneLogger.Debugf("found new country ban for %s", *decision.Value)
 					worker.CFStateByAction[action].CountrySet[*decision.Value] = struct{}{}
+					bannedByAction[action] = append(bannedByAction[action], decision)
 				}
 			}
 		}
 	}
+	worker.queueRuleBans(webhookCountryBan, bannedByAction)
+	for _, decisions := range decisionsByAction {
+		worker.Metrics.recordApplied(worker.Account.ID, decisions, false)
+		worker.awaitRules(decisions)
+	}
+	worker.forgetDecisions(worker.NewCountryDecisions)
 	worker.NewCountryDecisions = make([]*models.Decision, 0)
 	return nil
 }
 
 func (worker *CloudflareWorker) DeleteCountryBans() error {
-	decisionsByAction := dedupAndClassifyDecisionsByAction(worker.ExpiredCountryDecisions)
+	worker.rememberDecisions(worker.ExpiredCountryDecisions, true)
+	decisionsByAction := worker.classifyDecisions(worker.ExpiredCountryDecisions, true)
 	for _, zoneCfg := range worker.Account.ZoneConfigs {
 		zoneLogger := worker.Logger.WithFields(log.Fields{"zone_id": zoneCfg.ID})
 		for action, decisions := range decisionsByAction {
@@ -695,48 +1000,51 @@ func (worker *CloudflareWorker) DeleteCountryBans() error {
 			}
 		}
 	}
+	for _, decisions := range decisionsByAction {
+		worker.Metrics.recordApplied(worker.Account.ID, decisions, true)
+		worker.awaitRules(decisions)
+	}
+	worker.forgetDecisions(worker.ExpiredCountryDecisions)
 	worker.ExpiredCountryDecisions = make([]*models.Decision, 0)
 	return nil
 }
 func (worker *CloudflareWorker) UpdateRules() error {
 	stateIsNew := false
 	for action, state := range worker.CFStateByAction {
-		if !worker.CFStateByAction[action].UpdateExpr() {
+		if !state.UpdateExpr() {
 			// expression is still same, why bother.
 			worker.Logger.Debugf("rule for %s action is unchanged", action)
 			continue
 		}
 		stateIsNew = true
-		for _, zone := range worker.Account.ZoneConfigs {
-			zoneLogger := worker.Logger.WithFields(log.Fields{"zone_id": zone.ID})
-			updatedFilters := make([]cloudflare.Filter, 0)
-			if _, ok := zone.ActionSet[action]; ok {
-				// check whether this action is supported by this zone
-				updatedFilters = append(updatedFilters, cloudflare.Filter{ID: state.FilterIDByZoneID[zone.ID], Expression: state.CurrExpr})
-			}
-			if len(updatedFilters) > 0 {
-				zoneLogger.Infof("updating %d rules", len(updatedFilters))
-				_, err := worker.getAPI().UpdateFilters(worker.Ctx, zone.ID, updatedFilters)
-				if err != nil {
-					return err
-				}
-			} else {
-				zoneLogger.Debug("rules are same")
+		for _, backend := range worker.getBackends() {
+			if _, err := backend.ApplyRule(action, state.CurrExpr); err != nil {
+				return err
 			}
 		}
 	}
 	if stateIsNew {
-		go func() { worker.UpdatedState <- worker.CFStateByAction }()
+		worker.publishState()
 	}
+	worker.sendRuleBans()
+	worker.confirmRules()
+	worker.auditDecisions = nil
 	return nil
 }
 
 func (worker *CloudflareWorker) runProcessorOnDecisions(processor func() error, decisions []*models.Decision) {
 	if len(decisions) > 0 {
 		worker.Logger.Infof("processing decisions with scope=%s", *decisions[0].Scope)
+		endSpan := worker.startSpan("apply decisions",
+			attribute.String("scope", scopeLabel(decisions[0])),
+			attribute.Int("decisions", len(decisions)),
+			attribute.Float64("oldest_decision_seconds", worker.oldestDecision(decisions, time.Now()).Seconds()),
+		)
 		err := processor()
+		endSpan(err)
 		if err != nil {
 			worker.Logger.Error(err)
+			worker.Health.recordError(err)
 		}
 	}
 }
@@ -754,10 +1062,23 @@ func (worker *CloudflareWorker) Run() error {
 		return err
 	}
 
+	err = worker.restorePausedRules()
+	if err != nil {
+		worker.Logger.Error(err.Error())
+		return err
+	}
+
+	worker.Health.setReady()
+	worker.publishStatus()
 	ticker := time.NewTicker(worker.UpdateFrequency)
+	defer ticker.Stop()
 	for {
+		worker.Health.recordTick()
 		select {
 		case <-ticker.C:
+			syncStart := time.Now()
+			endSyncSpan := worker.startSpan("sync")
+			worker.expireManualBans(syncStart)
 			worker.runProcessorOnDecisions(worker.DeleteIPs, worker.ExpiredIPDecisions)
 			worker.runProcessorOnDecisions(worker.AddNewIPs, worker.NewIPDecisions)
 			worker.runProcessorOnDecisions(worker.DeleteCountryBans, worker.ExpiredCountryDecisions)
@@ -765,15 +1086,35 @@ func (worker *CloudflareWorker) Run() error {
 			worker.runProcessorOnDecisions(worker.DeleteASBans, worker.ExpiredASDecisions)
 			worker.runProcessorOnDecisions(worker.SendASBans, worker.NewASDecisions)
 
+			endRulesSpan := worker.startSpan("update rules")
 			err := worker.UpdateRules()
+			endRulesSpan(err)
+			endSyncSpan(err)
 			if err != nil {
 				worker.Logger.Error(err)
 				return err
 			}
+			worker.Health.recordSync(syncStart)
+			worker.Metrics.recordTick(worker.Account.ID, syncStart)
+			worker.publishStatus()
 
 		case decisions := <-worker.LAPIStream:
 			worker.Logger.Debug("collecting decisions from LAPI")
 			worker.CollectLAPIStream(decisions)
+			worker.Health.recordPoll()
+			worker.publishStatus()
+
+		case req := <-worker.AdminRequests:
+			err := req.apply(worker)
+			if err != nil {
+				worker.Logger.Error(err)
+				worker.Health.recordError(err)
+			}
+			req.done <- err
+
+		case <-worker.Stop:
+			worker.stop()
+			return nil
 		}
 	}
 
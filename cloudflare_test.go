@@ -6,8 +6,10 @@ import (
 	"reflect"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/cloudflare/cloudflare-go"
 	"github.com/crowdsecurity/crowdsec/pkg/models"
@@ -24,6 +26,7 @@ type mockCloudflareAPI struct {
 	FilterList        []cloudflare.Filter
 	IPListItems       map[string][]cloudflare.IPListItem
 	ZoneList          []cloudflare.Zone
+	AccessRulesByZone map[string][]cloudflare.AccessRule // the account level rules are under the empty zone ID
 }
 
 func (cfAPI *mockCloudflareAPI) Filters(ctx context.Context, zoneID string, pageOpts cloudflare.PaginationOptions) ([]cloudflare.Filter, error) {
@@ -35,7 +38,7 @@ func (cfAPI *mockCloudflareAPI) ListZones(ctx context.Context, z ...string) ([]c
 }
 
 func (cfAPI *mockCloudflareAPI) CreateIPList(ctx context.Context, name string, desc string, typ string) (cloudflare.IPList, error) {
-	ipList := cloudflare.IPList{ID: strconv.Itoa(len(cfAPI.IPLists))}
+	ipList := cloudflare.IPList{ID: strconv.Itoa(len(cfAPI.IPLists)) + "-" + name, Name: name}
 	cfAPI.IPLists = append(cfAPI.IPLists, ipList)
 	return ipList, nil
 }
@@ -54,6 +57,10 @@ func (cfAPI *mockCloudflareAPI) ListIPLists(ctx context.Context) ([]cloudflare.I
 	return cfAPI.IPLists, nil
 }
 
+func (cfAPI *mockCloudflareAPI) ListIPListItems(ctx context.Context, id string) ([]cloudflare.IPListItem, error) {
+	return cfAPI.IPListItems[id], nil
+}
+
 func (cfAPI *mockCloudflareAPI) CreateFirewallRules(ctx context.Context, zone string, rules []cloudflare.FirewallRule) ([]cloudflare.FirewallRule, error) {
 	cfAPI.FirewallRulesList = append(cfAPI.FirewallRulesList, rules...)
 	for i := range cfAPI.FirewallRulesList {
@@ -109,6 +116,17 @@ func (cfAPI *mockCloudflareAPI) FirewallRules(ctx context.Context, zone string,
 	return cfAPI.FirewallRulesList, nil
 }
 
+func (cfAPI *mockCloudflareAPI) UpdateFirewallRules(ctx context.Context, zone string, rules []cloudflare.FirewallRule) ([]cloudflare.FirewallRule, error) {
+	for _, rule := range rules {
+		for i := range cfAPI.FirewallRulesList {
+			if cfAPI.FirewallRulesList[i].ID == rule.ID {
+				cfAPI.FirewallRulesList[i] = rule
+			}
+		}
+	}
+	return rules, nil
+}
+
 func (cfAPI *mockCloudflareAPI) CreateIPListItems(ctx context.Context, id string, items []cloudflare.IPListItemCreateRequest) ([]cloudflare.IPListItem, error) {
 	IPItems := make([]cloudflare.IPListItem, len(items))
 	for j := range cfAPI.IPLists {
@@ -150,6 +168,60 @@ func (cfAPI *mockCloudflareAPI) DeleteIPListItems(ctx context.Context, id string
 	return cfAPI.IPListItems[id], nil
 }
 
+func (cfAPI *mockCloudflareAPI) listAccessRules(zoneID string, accessRule cloudflare.AccessRule) (*cloudflare.AccessRuleListResponse, error) {
+	resp := &cloudflare.AccessRuleListResponse{Result: make([]cloudflare.AccessRule, 0)}
+	resp.TotalPages = 1
+	for _, rule := range cfAPI.AccessRulesByZone[zoneID] {
+		if strings.Contains(rule.Notes, accessRule.Notes) {
+			resp.Result = append(resp.Result, rule)
+		}
+	}
+	return resp, nil
+}
+
+func (cfAPI *mockCloudflareAPI) createAccessRule(zoneID string, accessRule cloudflare.AccessRule) (*cloudflare.AccessRuleResponse, error) {
+	if cfAPI.AccessRulesByZone == nil {
+		cfAPI.AccessRulesByZone = make(map[string][]cloudflare.AccessRule)
+	}
+	accessRule.ID = fmt.Sprintf("%s-%d", zoneID, len(cfAPI.AccessRulesByZone[zoneID]))
+	cfAPI.AccessRulesByZone[zoneID] = append(cfAPI.AccessRulesByZone[zoneID], accessRule)
+	return &cloudflare.AccessRuleResponse{Result: accessRule}, nil
+}
+
+func (cfAPI *mockCloudflareAPI) deleteAccessRule(zoneID string, id string) (*cloudflare.AccessRuleResponse, error) {
+	for i, rule := range cfAPI.AccessRulesByZone[zoneID] {
+		if rule.ID == id {
+			cfAPI.AccessRulesByZone[zoneID] = append(cfAPI.AccessRulesByZone[zoneID][:i], cfAPI.AccessRulesByZone[zoneID][i+1:]...)
+			return &cloudflare.AccessRuleResponse{Result: rule}, nil
+		}
+	}
+	return nil, fmt.Errorf("access rule %s not found", id)
+}
+
+func (cfAPI *mockCloudflareAPI) ListAccountAccessRules(ctx context.Context, accountID string, accessRule cloudflare.AccessRule, page int) (*cloudflare.AccessRuleListResponse, error) {
+	return cfAPI.listAccessRules("", accessRule)
+}
+
+func (cfAPI *mockCloudflareAPI) CreateAccountAccessRule(ctx context.Context, accountID string, accessRule cloudflare.AccessRule) (*cloudflare.AccessRuleResponse, error) {
+	return cfAPI.createAccessRule("", accessRule)
+}
+
+func (cfAPI *mockCloudflareAPI) DeleteAccountAccessRule(ctx context.Context, accountID, accessRuleID string) (*cloudflare.AccessRuleResponse, error) {
+	return cfAPI.deleteAccessRule("", accessRuleID)
+}
+
+func (cfAPI *mockCloudflareAPI) ListZoneAccessRules(ctx context.Context, zoneID string, accessRule cloudflare.AccessRule, page int) (*cloudflare.AccessRuleListResponse, error) {
+	return cfAPI.listAccessRules(zoneID, accessRule)
+}
+
+func (cfAPI *mockCloudflareAPI) CreateZoneAccessRule(ctx context.Context, zoneID string, accessRule cloudflare.AccessRule) (*cloudflare.AccessRuleResponse, error) {
+	return cfAPI.createAccessRule(zoneID, accessRule)
+}
+
+func (cfAPI *mockCloudflareAPI) DeleteZoneAccessRule(ctx context.Context, zoneID, accessRuleID string) (*cloudflare.AccessRuleResponse, error) {
+	return cfAPI.deleteAccessRule(zoneID, accessRuleID)
+}
+
 var dummyCFAccount AccountConfig = AccountConfig{
 	ID: "dummyID",
 	ZoneConfigs: []ZoneConfig{
@@ -173,6 +245,25 @@ var mockCfAPI cloudflareAPI = &mockCloudflareAPI{
 	IPListItems: make(map[string][]cloudflare.IPListItem),
 }
 
+// newTestWorker returns a worker of account1 enforcing challenge in zone1, with the state of
+// newTestState. Tests replace its account, API and states to check other setups.
+func newTestWorker() *CloudflareWorker {
+	var tokenCallCount uint32
+	return &CloudflareWorker{
+		Account: AccountConfig{
+			ID:            "account1",
+			DefaultAction: "challenge",
+			IPListPrefix:  "crowdsec",
+			ZoneConfigs:   []ZoneConfig{{ID: "zone1", Actions: []string{"challenge"}, ActionSet: map[string]struct{}{"challenge": {}}}},
+		},
+		API:             &mockCloudflareAPI{IPListItems: make(map[string][]cloudflare.IPListItem)},
+		CFStateByAction: map[string]*CloudflareState{"challenge": newTestState("account1", "challenge", 0)},
+		Logger:          log.WithFields(log.Fields{"account_id": "test worker"}),
+		Count:           prometheus.NewCounter(prometheus.CounterOpts{}),
+		tokenCallCount:  &tokenCallCount,
+	}
+}
+
 func TestIPFirewallSetUp(t *testing.T) {
 
 	ctx := context.Background()
@@ -182,7 +273,7 @@ func TestIPFirewallSetUp(t *testing.T) {
 		API:            mockCfAPI,
 		Account:        dummyCFAccount,
 		Wg:             &wg,
-		UpdatedState:   make(chan map[string]*CloudflareState, 2),
+		UpdatedState:   make(chan *stateUpdate, 2),
 		Count:          prometheus.NewCounter(prometheus.CounterOpts{}),
 		tokenCallCount: &mockAPICallCounter,
 	}
@@ -197,8 +288,8 @@ func TestIPFirewallSetUp(t *testing.T) {
 		t.Errorf("expected only 2 IP list found %d", len(ipLists))
 	}
 
-	if ipLists[1].Description != "" {
-		t.Error("old iplist exists")
+	if ipLists[0].ID != "11" || ipLists[0].Description != "already" {
+		t.Error("expected the existing iplist to be kept")
 	}
 
 	fr, err := mockCfAPI.FirewallRules(ctx, "", cloudflare.PaginationOptions{})
@@ -210,6 +301,50 @@ func TestIPFirewallSetUp(t *testing.T) {
 	}
 }
 
+func TestCloudflareWorker_setUpIPList_keepsItems(t *testing.T) {
+	createdOn := time.Now()
+	api := &mockCloudflareAPI{
+		IPLists:     []cloudflare.IPList{{ID: "11", Name: "crowdsec_block", CreatedOn: &createdOn}},
+		ZoneList:    []cloudflare.Zone{{ID: "zone1"}},
+		IPListItems: map[string][]cloudflare.IPListItem{"11": {{ID: "i1", IP: "1.2.3.4", Comment: "crowdsec/ssh-bf"}, {ID: "i2", IP: "5.6.7.8", Comment: "manual: incident"}}},
+	}
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	var tokenCallCount uint32
+	worker := CloudflareWorker{
+		API:            api,
+		Account:        dummyCFAccount,
+		Wg:             &wg,
+		UpdatedState:   make(chan *stateUpdate, 10),
+		Count:          prometheus.NewCounter(prometheus.CounterOpts{}),
+		tokenCallCount: &tokenCallCount,
+	}
+	if err := worker.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := worker.SetUpCloudflareIfNewState(); err != nil {
+		t.Fatal(err)
+	}
+	state := worker.CFStateByAction["block"]
+	if state.IPListState.IPList.ID != "11" || len(state.IPListState.ItemByIP) != 2 || len(api.IPLists) != 1 {
+		t.Fatalf("expected the existing list and its items to be kept, found %+v %+v", state.IPListState.IPList, state.IPListState.ItemByIP)
+	}
+	if ban := state.ManualBans["5.6.7.8"]; ban.Comment != "incident" || time.Until(ban.Expiration) > defaultManualBanDuration {
+		t.Errorf("expected the items to expire as manual bans, found %+v", state.ManualBans)
+	}
+
+	// CrowdSec still bans 1.2.3.4, the other item is lifted once its manual ban expired.
+	ip, ban, scope, scenario := "1.2.3.4", "ban", "ip", "crowdsec/ssh-bf"
+	worker.CollectLAPIStream(&models.DecisionsStreamResponse{New: []*models.Decision{{Value: &ip, Type: &ban, Scope: &scope, Scenario: &scenario}}})
+	worker.expireManualBans(time.Now().Add(defaultManualBanDuration))
+	if err := worker.flushDecisions(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state.IPListState.ItemByIP["1.2.3.4"]; !ok || len(state.IPListState.ItemByIP) != 1 {
+		t.Errorf("expected only 1.2.3.4 to stay banned, found %+v", state.IPListState.ItemByIP)
+	}
+}
+
 func TestCollectLAPIStream(t *testing.T) {
 	wg := sync.WaitGroup{}
 	wg.Add(1)
@@ -229,7 +364,7 @@ func TestCollectLAPIStream(t *testing.T) {
 		Account:        dummyCFAccount,
 		API:            mockCfAPI,
 		Wg:             &wg,
-		UpdatedState:   make(chan map[string]*CloudflareState, 1),
+		UpdatedState:   make(chan *stateUpdate, 1),
 		Count:          prometheus.NewCounter(prometheus.CounterOpts{}),
 		tokenCallCount: &mockAPICallCounter,
 	}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"strings"
 	"time"
 
@@ -15,31 +16,100 @@ import (
 )
 
 type ZoneConfig struct {
-	ID        string              `yaml:"zone_id"`
-	Actions   []string            `yaml:"actions,omitempty"`
-	ActionSet map[string]struct{} `yaml:",omitempty"`
+	ID          string              `yaml:"zone_id"`
+	Actions     []string            `yaml:"actions,omitempty"`
+	ActionSet   map[string]struct{} `yaml:",omitempty"`
+	Enforcement string              `yaml:"enforcement,omitempty"`
 }
 type AccountConfig struct {
-	ID            string       `yaml:"id"`
-	ZoneConfigs   []ZoneConfig `yaml:"zones"`
-	Token         string       `yaml:"token"`
-	IPListPrefix  string       `yaml:"ip_list_prefix"`
-	DefaultAction string       `yaml:"default_action"`
+	ID                 string       `yaml:"id"`
+	ZoneConfigs        []ZoneConfig `yaml:"zones"`
+	Token              string       `yaml:"token"`
+	IPListPrefix       string       `yaml:"ip_list_prefix"`
+	DefaultAction      string       `yaml:"default_action"`
+	Enforcement        string       `yaml:"enforcement,omitempty"`
+	AccessRuleFallback bool         `yaml:"access_rule_fallback,omitempty"`
 }
 type CloudflareConfig struct {
 	Accounts        []AccountConfig `yaml:"accounts"`
 	UpdateFrequency time.Duration   `yaml:"update_frequency"`
 }
 
+// HTTPConfig is the configuration of the server of the metrics and health endpoints.
+type HTTPConfig struct {
+	ListenAddr        string        `yaml:"listen_addr"`
+	TLSCertPath       string        `yaml:"tls_cert_path"`
+	TLSKeyPath        string        `yaml:"tls_key_path"`
+	BasicAuthUsername string        `yaml:"basic_auth_username"`
+	BasicAuthPassword string        `yaml:"basic_auth_password"`
+	StaleAfter        time.Duration `yaml:"stale_after"`
+}
+
+// TracingConfig is the configuration of the OpenTelemetry spans of the syncs with cloudflare.
+type TracingConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Output  string `yaml:"output"` // stdout or the path of a file
+}
+
+// AuditLogConfig is the configuration of the log of the changes made at cloudflare, it is disabled
+// without a path.
+type AuditLogConfig struct {
+	Path       string `yaml:"path"`
+	MaxSize    int    `yaml:"max_size"` // megabytes, 100 by default
+	MaxBackups int    `yaml:"max_backups"`
+	MaxAge     int    `yaml:"max_age"` // days
+	Compress   bool   `yaml:"compress"`
+}
+
+// LAPISourceConfig is a CrowdSec LAPI the decisions are pulled from. Only the new decisions whose
+// scenario contains one of ScenariosContaining and none of ScenariosNotContaining, and whose origin is
+// one of Origins, are kept, every decision is kept when they are empty.
+type LAPISourceConfig struct {
+	Name                   string        `yaml:"name"`
+	URL                    string        `yaml:"url"`
+	Key                    string        `yaml:"key"`
+	UpdateFrequency        time.Duration `yaml:"update_frequency"`
+	CACertPath             string        `yaml:"ca_cert_path"`
+	CertPath               string        `yaml:"cert_path"`
+	KeyPath                string        `yaml:"key_path"`
+	InsecureSkipVerify     bool          `yaml:"insecure_skip_verify"`
+	Scopes                 []string      `yaml:"scopes"`
+	ScenariosContaining    []string      `yaml:"scenarios_containing"`
+	ScenariosNotContaining []string      `yaml:"scenarios_not_containing"`
+	Origins                []string      `yaml:"origins"`
+}
+
+// WebhookConfig is an HTTP endpoint notified of the events of the bouncer, all of them when Events is
+// empty. Template renders the JSON body from the event, which is sent as is without template.
+type WebhookConfig struct {
+	URL              string            `yaml:"url"`
+	Events           []string          `yaml:"events"`
+	Headers          map[string]string `yaml:"headers"`
+	Template         string            `yaml:"template"`
+	BanWaveThreshold int               `yaml:"ban_wave_threshold"` // IPs banned in one tick, 100 by default
+	Timeout          time.Duration     `yaml:"timeout"`
+	MaxAttempts      int               `yaml:"max_attempts"`
+}
+
 type bouncerConfig struct {
-	CrowdSecLAPIUrl             string           `yaml:"crowdsec_lapi_url"`
-	CrowdSecLAPIKey             string           `yaml:"crowdsec_lapi_key"`
-	CrowdsecUpdateFrequencyYAML string           `yaml:"crowdsec_update_frequency"`
-	CloudflareConfig            CloudflareConfig `yaml:"cloudflare_config"`
-	Daemon                      bool             `yaml:"daemon"`
-	LogMode                     string           `yaml:"log_mode"`
-	LogDir                      string           `yaml:"log_dir"`
-	LogLevel                    log.Level        `yaml:"log_level"`
+	CrowdSecLAPIUrl             string             `yaml:"crowdsec_lapi_url"`
+	CrowdSecLAPIKey             string             `yaml:"crowdsec_lapi_key"`
+	CrowdsecUpdateFrequencyYAML string             `yaml:"crowdsec_update_frequency"`
+	LAPISources                 []LAPISourceConfig `yaml:"crowdsec_lapi_sources"`
+	CloudflareConfig            CloudflareConfig   `yaml:"cloudflare_config"`
+	Daemon                      bool               `yaml:"daemon"`
+	DryRun                      bool               `yaml:"dry_run"`
+	StateStore                  string             `yaml:"state_store"`
+	CachePath                   string             `yaml:"cache_path"`
+	HTTP                        HTTPConfig         `yaml:"http"`
+	AdminSocket                 string             `yaml:"admin_socket"`
+	ShutdownTimeout             time.Duration      `yaml:"shutdown_timeout"`
+	Tracing                     TracingConfig      `yaml:"tracing"`
+	AuditLog                    AuditLogConfig     `yaml:"audit_log"`
+	Webhooks                    []WebhookConfig    `yaml:"webhooks"`
+	LogMode                     string             `yaml:"log_mode"`
+	LogDir                      string             `yaml:"log_dir"`
+	LogLevel                    log.Level          `yaml:"log_level"`
 }
 
 // NewConfig creates bouncerConfig from the file at provided path
@@ -59,6 +129,11 @@ func NewConfig(configPath string) (*bouncerConfig, error) {
 	zoneIdSet := make(map[string]bool)    // for verifying that each zoneID is unique
 	validAction := map[string]bool{"challenge": true, "block": true, "js_challenge": true}
 	validChoiceMsg := "valid choices are either of 'block', 'js_challenge', 'challenge'"
+	// managed challenge is only available as an access rule mode.
+	validAccessRuleAction := map[string]bool{"challenge": true, "block": true, "js_challenge": true, "managed_challenge": true}
+	validAccessRuleChoiceMsg := "valid choices for access rules are either of 'block', 'js_challenge', 'challenge', 'managed_challenge'"
+	validEnforcement := map[string]bool{"": true, ipListEnforcement: true, accessRuleEnforcement: true}
+	validEnforcementMsg := fmt.Sprintf("valid choices are either of '%s', '%s'", ipListEnforcement, accessRuleEnforcement)
 
 	for i, account := range config.CloudflareConfig.Accounts {
 		if _, ok := accountIDSet[account.ID]; ok {
@@ -73,10 +148,18 @@ func NewConfig(configPath string) (*bouncerConfig, error) {
 			config.CloudflareConfig.Accounts[i].IPListPrefix = "crowdsec"
 		}
 
+		if _, ok := validEnforcement[account.Enforcement]; !ok {
+			return nil, fmt.Errorf("account %s 's enforcement '%s' is invalid. %s", account.ID, account.Enforcement, validEnforcementMsg)
+		}
+
 		if len(account.DefaultAction) == 0 {
 			return nil, fmt.Errorf("account %s has no default action", account.ID)
 		}
-		if _, ok := validAction[account.DefaultAction]; !ok {
+		if account.Enforcement == accessRuleEnforcement {
+			if _, ok := validAccessRuleAction[account.DefaultAction]; !ok {
+				return nil, fmt.Errorf("account %s 's default action is invalid. %s ", account.ID, validAccessRuleChoiceMsg)
+			}
+		} else if _, ok := validAction[account.DefaultAction]; !ok {
 			return nil, fmt.Errorf("account %s 's default action is invalid. %s ", account.ID, validChoiceMsg)
 		}
 
@@ -85,8 +168,16 @@ func NewConfig(configPath string) (*bouncerConfig, error) {
 			if len(zone.Actions) == 0 {
 				return nil, fmt.Errorf("account %s 's zone %s has no action", account.ID, zone.ID)
 			}
+			if _, ok := validEnforcement[zone.Enforcement]; !ok {
+				return nil, fmt.Errorf("zone %s 's enforcement '%s' is invalid. %s", zone.ID, zone.Enforcement, validEnforcementMsg)
+			}
+			zoneUsesAccessRules := zone.Enforcement == accessRuleEnforcement || (zone.Enforcement == "" && account.Enforcement == accessRuleEnforcement)
 			for _, a := range zone.Actions {
-				if _, ok := validAction[a]; !ok {
+				if zoneUsesAccessRules {
+					if _, ok := validAccessRuleAction[a]; !ok {
+						return nil, fmt.Errorf("invalid actions '%s', %s", a, validAccessRuleChoiceMsg)
+					}
+				} else if _, ok := validAction[a]; !ok {
 					return nil, fmt.Errorf("invalid actions '%s', %s", a, validChoiceMsg)
 				}
 				config.CloudflareConfig.Accounts[i].ZoneConfigs[j].ActionSet[a] = struct{}{}
@@ -99,6 +190,42 @@ func NewConfig(configPath string) (*bouncerConfig, error) {
 
 		}
 	}
+	if config.StateStore != "" && config.StateStore != jsonStateStore && config.StateStore != boltStateStore {
+		return nil, fmt.Errorf("state store '%s' is invalid, valid choices are either of '%s', '%s'", config.StateStore, jsonStateStore, boltStateStore)
+	}
+	if config.HTTP.ListenAddr == "" {
+		config.HTTP.ListenAddr = ":2112"
+	}
+	if config.AdminSocket == "" {
+		config.AdminSocket = "/run/crowdsec-cloudflare-bouncer.sock"
+	}
+	if config.ShutdownTimeout <= 0 {
+		config.ShutdownTimeout = defaultShutdownTimeout
+	}
+	if (config.HTTP.TLSCertPath == "") != (config.HTTP.TLSKeyPath == "") {
+		return nil, fmt.Errorf("http tls_cert_path and tls_key_path must be set together")
+	}
+	if config.HTTP.StaleAfter < 0 {
+		return nil, fmt.Errorf("http stale_after must be positive")
+	}
+	if config.AuditLog.MaxSize < 0 || config.AuditLog.MaxBackups < 0 || config.AuditLog.MaxAge < 0 {
+		return nil, fmt.Errorf("audit_log max_size, max_backups and max_age must be positive")
+	}
+	sourceNames := make(map[string]bool)
+	for i := range config.LAPISources {
+		if err := validateLAPISource(&config.LAPISources[i]); err != nil {
+			return nil, err
+		}
+		if sourceNames[config.LAPISources[i].Name] {
+			return nil, fmt.Errorf("lapi source %s is duplicated", config.LAPISources[i].Name)
+		}
+		sourceNames[config.LAPISources[i].Name] = true
+	}
+	for i := range config.Webhooks {
+		if err := validateWebhook(&config.Webhooks[i]); err != nil {
+			return nil, err
+		}
+	}
 	/*Configure logging*/
 	if err = types.SetDefaultLoggerConfig(config.LogMode, config.LogDir, config.LogLevel); err != nil {
 		log.Fatal(err.Error())
@@ -123,6 +250,36 @@ func NewConfig(configPath string) (*bouncerConfig, error) {
 	return config, nil
 }
 
+// validateWebhook checks the webhook and sets its defaults.
+func validateWebhook(webhook *WebhookConfig) error {
+	if u, err := url.Parse(webhook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook url '%s' is invalid, expecting an http or https url", webhook.URL)
+	}
+	for _, event := range webhook.Events {
+		if !contains(webhookEvents, event) {
+			return fmt.Errorf("webhook %s has unknown event '%s', valid choices are %s", webhook.URL, event, strings.Join(webhookEvents, ", "))
+		}
+	}
+	if webhook.Template != "" {
+		if _, err := parseWebhookTemplate(webhook.Template); err != nil {
+			return fmt.Errorf("webhook %s has an invalid template: %w", webhook.URL, err)
+		}
+	}
+	if webhook.BanWaveThreshold < 0 || webhook.Timeout < 0 || webhook.MaxAttempts < 0 {
+		return fmt.Errorf("webhook %s ban_wave_threshold, timeout and max_attempts must be positive", webhook.URL)
+	}
+	if webhook.BanWaveThreshold == 0 {
+		webhook.BanWaveThreshold = defaultBanWaveThreshold
+	}
+	if webhook.Timeout == 0 {
+		webhook.Timeout = defaultWebhookTimeout
+	}
+	if webhook.MaxAttempts == 0 {
+		webhook.MaxAttempts = defaultWebhookMaxAttempts
+	}
+	return nil
+}
+
 func ConfigTokens(tokens string, baseConfigPath string) (string, error) {
 	baseConfig := &bouncerConfig{}
 	configBuff, err := ioutil.ReadFile(baseConfigPath)
@@ -188,7 +345,7 @@ func ConfigTokens(tokens string, baseConfigPath string) (string, error) {
 		words := strings.Split(line, " ")
 		lastWord := words[len(words)-1]
 		if zone, ok := zoneByID[lastWord]; ok {
-			line = fmt.Sprintf("%s #%s", line, zone.Name)
+			line = fmt.Sprintf("%s #%s (%s)", line, zone.Name, entitlementsComment(zone))
 		} else if account, ok := accountByID[lastWord]; ok {
 			line = fmt.Sprintf("%s #%s", line, account.Name)
 		}
@@ -45,10 +45,51 @@ func TestNewConfig(t *testing.T) {
 					},
 					UpdateFrequency: time.Second * 30,
 				},
-				Daemon:   false,
-				LogMode:  "stdout",
-				LogDir:   "/var/log/",
-				LogLevel: log.InfoLevel,
+				HTTP:            HTTPConfig{ListenAddr: ":2112"},
+				AdminSocket:     "/run/crowdsec-cloudflare-bouncer.sock",
+				ShutdownTimeout: defaultShutdownTimeout,
+				Daemon:          false,
+				LogMode:         "stdout",
+				LogDir:          "/var/log/",
+				LogLevel:        log.InfoLevel,
+			},
+			wantErr: false,
+		},
+		{
+			name: "valid access rules",
+			args: args{"./test_data/valid_access_rules_config.yaml"},
+			want: &bouncerConfig{
+				CrowdSecLAPIUrl:             "http://localhost:8080/",
+				CrowdSecLAPIKey:             "${LAPI_KEY}",
+				CrowdsecUpdateFrequencyYAML: "10s",
+				CloudflareConfig: CloudflareConfig{
+					Accounts: []AccountConfig{
+						{
+							ID: "${CF_ACC_ID}",
+							ZoneConfigs: []ZoneConfig{
+								{
+									ID:      "${CF_ZONE_ID}",
+									Actions: []string{"managed_challenge"},
+									ActionSet: map[string]struct{}{
+										"managed_challenge": {},
+									},
+								},
+							},
+							Token:         "${CF_TOKEN}",
+							IPListPrefix:  "crowdsec",
+							DefaultAction: "managed_challenge",
+							Enforcement:   "access_rules",
+						},
+					},
+					UpdateFrequency: time.Second * 30,
+				},
+				HTTP:            HTTPConfig{ListenAddr: ":2112"},
+				AdminSocket:     "/run/crowdsec-cloudflare-bouncer.sock",
+				ShutdownTimeout: defaultShutdownTimeout,
+				Daemon:          false,
+				LogMode:         "stdout",
+				LogDir:          "/var/log/",
+				LogLevel:        log.InfoLevel,
 			},
 			wantErr: false,
 		},
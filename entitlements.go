@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/cloudflare/cloudflare-go"
+)
+
+// planEntitlements are the limits of a cloudflare plan which matter to the bouncer.
+// IP lists are owned by the account, their limits are shared by all the zones of the account.
+type planEntitlements struct {
+	Plan          string
+	Known         bool
+	FirewallRules int
+	IPLists       int
+	IPListItems   int
+}
+
+// entitlementsByPlan contains the limits published by cloudflare, keyed by the legacy ID of the plan.
+// The API has no public endpoint for the entitlements of a zone, they are derived from its plan. The
+// actions aren't part of them, every plan supports the actions of the bouncer, and the lists aren't
+// sharded, an action has a single IP list whatever the item limit.
+var entitlementsByPlan = map[string]planEntitlements{
+	"free":       {FirewallRules: 5, IPLists: 1, IPListItems: 10000},
+	"pro":        {FirewallRules: 20, IPLists: 1, IPListItems: 10000},
+	"business":   {FirewallRules: 100, IPLists: 10, IPListItems: 10000},
+	"enterprise": {FirewallRules: 1000, IPLists: 1000, IPListItems: 500000},
+}
+
+// entitlementsForPlan returns the entitlements of the plan. The limits of unknown plans are left to 0
+// and aren't enforced.
+func entitlementsForPlan(plan cloudflare.ZonePlan) planEntitlements {
+	entitlements, ok := entitlementsByPlan[plan.LegacyID]
+	entitlements.Plan = plan.LegacyID
+	if entitlements.Plan == "" {
+		entitlements.Plan = plan.Name
+	}
+	entitlements.Known = ok
+	return entitlements
+}
+
+// accountListEntitlements returns the IP list entitlements of the account, which are the ones of its best plan.
+func accountListEntitlements(zoneEntitlements map[string]planEntitlements) planEntitlements {
+	best := planEntitlements{}
+	for _, entitlements := range zoneEntitlements {
+		if !entitlements.Known {
+			continue
+		}
+		if !best.Known || entitlements.IPLists > best.IPLists || entitlements.IPListItems > best.IPListItems {
+			best = entitlements
+		}
+	}
+	return best
+}
+
+func (entitlements planEntitlements) String() string {
+	if !entitlements.Known {
+		return fmt.Sprintf("plan %s, unknown limits", entitlements.Plan)
+	}
+	return fmt.Sprintf("plan %s, %d firewall rules, %d ip lists, %d ip list items", entitlements.Plan, entitlements.FirewallRules, entitlements.IPLists, entitlements.IPListItems)
+}
+
+// detectEntitlements stores the entitlements of the worker's zones from their plans.
+func (worker *CloudflareWorker) detectEntitlements(zoneByID map[string]cloudflare.Zone) {
+	worker.ZoneEntitlements = make(map[string]planEntitlements)
+	for _, z := range worker.Account.ZoneConfigs {
+		zone, ok := zoneByID[z.ID]
+		if !ok {
+			continue
+		}
+		worker.ZoneEntitlements[z.ID] = entitlementsForPlan(zone.Plan)
+		worker.Logger.Debugf("zone %s has %s", z.ID, worker.ZoneEntitlements[z.ID])
+	}
+	worker.ListEntitlements = accountListEntitlements(worker.ZoneEntitlements)
+}
+
+// checkEntitlements validates the account config against the entitlements. When the plans don't allow
+// enough IP lists, no enforcement is set in the config and access_rule_fallback is enabled, the account
+// falls back to access rules.
+func (worker *CloudflareWorker) checkEntitlements() error {
+	for _, zone := range worker.ipListZones() {
+		entitlements, ok := worker.ZoneEntitlements[zone.ID]
+		if !ok || !entitlements.Known {
+			continue
+		}
+		if len(zone.Actions) > entitlements.FirewallRules {
+			return fmt.Errorf("zone %s needs %d firewall rules but its %s", zone.ID, len(zone.Actions), entitlements)
+		}
+	}
+
+	listCount := len(worker.ipListActions())
+	if !worker.ListEntitlements.Known || listCount <= worker.ListEntitlements.IPLists {
+		return nil
+	}
+	explicit := worker.Account.Enforcement != ""
+	for _, zone := range worker.ipListZones() {
+		explicit = explicit || zone.Enforcement != ""
+	}
+	if !explicit && worker.Account.AccessRuleFallback {
+		worker.Logger.Warningf("account needs %d ip lists but its %s, falling back to access rules", listCount, worker.ListEntitlements)
+		worker.notify(webhookEvent{
+			Type:      webhookQuotaWarning,
+			AccountID: worker.Account.ID,
+			Message:   fmt.Sprintf("account %s needs %d ip lists but its %s, falling back to access rules", worker.Account.ID, listCount, worker.ListEntitlements),
+			Count:     listCount,
+		})
+		worker.Account.Enforcement = accessRuleEnforcement
+		return nil
+	}
+	return fmt.Errorf("account %s needs %d ip lists but its %s, use 'enforcement: %s', 'access_rule_fallback: true' or fewer actions", worker.Account.ID, listCount, worker.ListEntitlements, accessRuleEnforcement)
+}
+
+// ipListCapacity returns how many items can still be added to the account's IP lists, or -1 if unknown.
+func (worker *CloudflareWorker) ipListCapacity() int {
+	if !worker.ListEntitlements.Known {
+		return -1
+	}
+	used := 0
+	for action := range worker.ipListActions() {
+		if state, ok := worker.CFStateByAction[action]; ok {
+			used += len(state.IPListState.ItemByIP)
+		}
+	}
+	if used >= worker.ListEntitlements.IPListItems {
+		return 0
+	}
+	return worker.ListEntitlements.IPListItems - used
+}
+
+// notifyIPListsFull sends a quota warning when the IP lists of the account become full, the next one is
+// sent once they were able to take every new IP again.
+func (worker *CloudflareWorker) notifyIPListsFull(overflow int) {
+	if worker.ipListsFull {
+		return
+	}
+	worker.ipListsFull = true
+	message := fmt.Sprintf("ip lists of account %s are full (%s), %d IPs aren't banned", worker.Account.ID, worker.ListEntitlements, overflow)
+	if worker.Account.AccessRuleFallback {
+		message = fmt.Sprintf("ip lists of account %s are full (%s), %d IPs are banned with access rules", worker.Account.ID, worker.ListEntitlements, overflow)
+	}
+	worker.notify(webhookEvent{
+		Type:      webhookQuotaWarning,
+		AccountID: worker.Account.ID,
+		Message:   message,
+		Count:     overflow,
+	})
+}
+
+// entitlementsComment returns the comment describing the zone's entitlements in generated configs.
+func entitlementsComment(zone cloudflare.Zone) string {
+	return entitlementsForPlan(zone.Plan).String()
+}
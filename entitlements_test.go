@@ -0,0 +1,201 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	log "github.com/sirupsen/logrus"
+)
+
+func Test_accountListEntitlements(t *testing.T) {
+	zoneEntitlements := map[string]planEntitlements{
+		"zone1": entitlementsForPlan(cloudflare.ZonePlan{LegacyID: "free"}),
+		"zone2": entitlementsForPlan(cloudflare.ZonePlan{LegacyID: "business"}),
+		"zone3": entitlementsForPlan(cloudflare.ZonePlan{LegacyID: "partners_custom"}),
+	}
+	got := accountListEntitlements(zoneEntitlements)
+	if got.Plan != "business" || got.IPLists != 10 {
+		t.Errorf("expected business entitlements, found %s", got)
+	}
+	if zoneEntitlements["zone3"].Known {
+		t.Errorf("expected unknown plan, found %s", zoneEntitlements["zone3"])
+	}
+}
+
+func TestCloudflareWorker_checkEntitlements(t *testing.T) {
+	free := cloudflare.ZonePlan{LegacyID: "free"}
+	enterprise := cloudflare.ZonePlan{LegacyID: "enterprise"}
+	twoActions := []ZoneConfig{{ID: "zone1", Actions: []string{"block", "challenge"}}}
+	tests := []struct {
+		name            string
+		account         AccountConfig
+		plan            cloudflare.ZonePlan
+		wantErr         bool
+		wantEnforcement string
+	}{
+		{
+			name:    "enough lists",
+			account: AccountConfig{ZoneConfigs: twoActions},
+			plan:    enterprise,
+		},
+		{
+			name:            "not enough lists falls back to access rules",
+			account:         AccountConfig{ZoneConfigs: twoActions, AccessRuleFallback: true},
+			plan:            free,
+			wantEnforcement: accessRuleEnforcement,
+		},
+		{
+			name:    "not enough lists without fallback",
+			account: AccountConfig{ZoneConfigs: twoActions},
+			plan:    free,
+			wantErr: true,
+		},
+		{
+			name:            "not enough lists with explicit ip lists",
+			account:         AccountConfig{ZoneConfigs: twoActions, Enforcement: ipListEnforcement},
+			plan:            free,
+			wantErr:         true,
+			wantEnforcement: ipListEnforcement,
+		},
+		{
+			name:            "too many firewall rules",
+			account:         AccountConfig{ZoneConfigs: []ZoneConfig{{ID: "zone1", Actions: []string{"block", "challenge", "js_challenge", "a", "b", "c"}}}, Enforcement: ipListEnforcement},
+			plan:            free,
+			wantErr:         true,
+			wantEnforcement: ipListEnforcement,
+		},
+		{
+			name:    "unknown plan is not checked",
+			account: AccountConfig{ZoneConfigs: twoActions},
+			plan:    cloudflare.ZonePlan{LegacyID: "custom"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			worker := &CloudflareWorker{Account: tt.account, Logger: log.WithFields(log.Fields{"account_id": "test worker"})}
+			worker.detectEntitlements(map[string]cloudflare.Zone{"zone1": {ID: "zone1", Plan: tt.plan}})
+			err := worker.checkEntitlements()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkEntitlements() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if worker.Account.Enforcement != tt.wantEnforcement {
+				t.Errorf("expected enforcement '%s', found '%s'", tt.wantEnforcement, worker.Account.Enforcement)
+			}
+		})
+	}
+}
+
+func TestCloudflareWorker_ipListCapacity(t *testing.T) {
+	worker := &CloudflareWorker{
+		Account: AccountConfig{ZoneConfigs: []ZoneConfig{{ID: "zone1", Actions: []string{"block"}}}},
+		CFStateByAction: map[string]*CloudflareState{
+			"block": {IPListState: IPListState{ItemByIP: map[string]cloudflare.IPListItem{"1.2.3.4": {}}}},
+		},
+	}
+	if got := worker.ipListCapacity(); got != -1 {
+		t.Errorf("expected unknown capacity, found %d", got)
+	}
+	worker.ListEntitlements = entitlementsForPlan(cloudflare.ZonePlan{LegacyID: "free"})
+	if got := worker.ipListCapacity(); got != 9999 {
+		t.Errorf("expected 9999 items left, found %d", got)
+	}
+}
+
+func TestIPListBackend_overflow(t *testing.T) {
+	decision := func(value string) *models.Decision {
+		scenario, scope, decisionType := "crowdsec/demo", "Ip", "captcha"
+		return &models.Decision{Value: &value, Scope: &scope, Type: &decisionType, Scenario: &scenario}
+	}
+	newWorker := func(fallback bool) *CloudflareWorker {
+		worker := newTestWorker()
+		worker.Account.AccessRuleFallback = fallback
+		worker.Metrics = newBouncerMetrics(prometheus.NewRegistry())
+		worker.ListEntitlements = planEntitlements{Plan: "test", Known: true, IPLists: 1, IPListItems: 1}
+		worker.NewIPDecisions = []*models.Decision{decision("1.2.3.4"), decision("5.6.7.8")}
+		if err := worker.AddNewIPs(); err != nil {
+			t.Fatal(err)
+		}
+		return worker
+	}
+
+	t.Run("without fallback", func(t *testing.T) {
+		worker := newWorker(false)
+		state := worker.CFStateByAction["challenge"]
+		if _, ok := state.IPListState.ItemByIP["1.2.3.4"]; !ok || len(state.IPListState.ItemByIP) != 1 {
+			t.Errorf("expected only 1.2.3.4 in the list, found %+v", state.IPListState.ItemByIP)
+		}
+		if len(state.AccessRuleIDsByZoneID["zone1"]) != 0 {
+			t.Errorf("expected no access rule, found %+v", state.AccessRuleIDsByZoneID)
+		}
+		if got := testutil.ToFloat64(worker.Metrics.decisionsDropped.WithLabelValues("account1", "ip", "ip_list_full")); got != 1 {
+			t.Errorf("expected 1 dropped decision, found %v", got)
+		}
+		if got := testutil.ToFloat64(worker.Metrics.decisionsApplied.WithLabelValues("account1", "ip", "new")); got != 1 {
+			t.Errorf("expected 1 applied decision, found %v", got)
+		}
+		if len(worker.NewIPDecisions) != 1 || *worker.NewIPDecisions[0].Value != "5.6.7.8" {
+			t.Fatalf("expected the decision on 5.6.7.8 to stay pending, found %d decisions", len(worker.NewIPDecisions))
+		}
+
+		// the pending decision is retried until the list has room.
+		if err := worker.AddNewIPs(); err != nil {
+			t.Fatal(err)
+		}
+		if got := testutil.ToFloat64(worker.Metrics.decisionsDropped.WithLabelValues("account1", "ip", "ip_list_full")); got != 1 {
+			t.Errorf("expected the retried decision to be dropped once, found %v", got)
+		}
+		worker.ExpiredIPDecisions = []*models.Decision{decision("1.2.3.4")}
+		if err := worker.DeleteIPs(); err != nil {
+			t.Fatal(err)
+		}
+		if err := worker.AddNewIPs(); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := state.IPListState.ItemByIP["5.6.7.8"]; !ok || len(worker.NewIPDecisions) != 0 {
+			t.Errorf("expected 5.6.7.8 to be banned once the list had room, found %+v", state.IPListState.ItemByIP)
+		}
+
+		// an expiration stops the retries on its value.
+		worker.NewIPDecisions = []*models.Decision{decision("9.9.9.9")}
+		if err := worker.AddNewIPs(); err != nil {
+			t.Fatal(err)
+		}
+		worker.ExpiredIPDecisions = []*models.Decision{decision("9.9.9.9")}
+		if err := worker.DeleteIPs(); err != nil {
+			t.Fatal(err)
+		}
+		if len(worker.NewIPDecisions) != 0 {
+			t.Errorf("expected the decision on 9.9.9.9 not to be retried, found %d decisions", len(worker.NewIPDecisions))
+		}
+	})
+
+	t.Run("with fallback", func(t *testing.T) {
+		worker := newWorker(true)
+		state := worker.CFStateByAction["challenge"]
+		if _, ok := state.AccessRuleIDsByZoneID["zone1"]["5.6.7.8"]; !ok || len(state.AccessRuleIDsByZoneID["zone1"]) != 1 {
+			t.Errorf("expected an access rule for 5.6.7.8, found %+v", state.AccessRuleIDsByZoneID)
+		}
+		if got := testutil.ToFloat64(worker.Metrics.decisionsApplied.WithLabelValues("account1", "ip", "new")); got != 2 {
+			t.Errorf("expected 2 applied decisions, found %v", got)
+		}
+
+		// the overflow moves to the list once it has room.
+		worker.ExpiredIPDecisions = []*models.Decision{decision("1.2.3.4")}
+		if err := worker.DeleteIPs(); err != nil {
+			t.Fatal(err)
+		}
+		worker.NewIPDecisions = []*models.Decision{decision("9.9.9.9")}
+		if err := worker.AddNewIPs(); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := state.IPListState.ItemByIP["5.6.7.8"]; !ok || len(state.IPListState.ItemByIP) != 1 {
+			t.Errorf("expected only 5.6.7.8 in the list, found %+v", state.IPListState.ItemByIP)
+		}
+		if _, ok := state.AccessRuleIDsByZoneID["zone1"]["9.9.9.9"]; !ok || len(state.AccessRuleIDsByZoneID["zone1"]) != 1 {
+			t.Errorf("expected an access rule for 9.9.9.9, found %+v", state.AccessRuleIDsByZoneID)
+		}
+	})
+}
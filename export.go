@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	exportFormatJSON       = "json"
+	exportFormatCSV        = "csv"
+	exportFormatCloudflare = "cloudflare"
+)
+
+// exportedBan is an IP, range, country or AS enforced by the bouncer.
+type exportedBan struct {
+	Value     string   `json:"value"`
+	Scope     string   `json:"scope"`
+	Action    string   `json:"action"`
+	AccountID string   `json:"account_id"`
+	List      string   `json:"list,omitempty"`
+	Comment   string   `json:"comment,omitempty"`
+	Zones     []string `json:"zones"`
+	// Duration is the time left before the ban expires, only known for the manual bans.
+	Duration string `json:"duration,omitempty"`
+}
+
+var exportCSVHeader = []string{"value", "scope", "action", "account_id", "list", "comment", "zones", "duration"}
+
+// decisionTypeByCloudflareAction is the reverse of CloudflareActionByDecisionType.
+var decisionTypeByCloudflareAction = map[string]string{
+	"block":        "ban",
+	"challenge":    "captcha",
+	"js_challenge": "js_challenge",
+}
+
+func ipScope(value string) string {
+	if strings.Contains(value, "/") {
+		return "range"
+	}
+	return "ip"
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// exportBans returns the bans enforced according to the states, sorted by account, action, scope and value.
+func exportBans(states []CloudflareState, accounts []AccountConfig, now time.Time) []exportedBan {
+	zonesByAccount := make(map[string][]string)
+	for _, account := range accounts {
+		for _, zone := range account.ZoneConfigs {
+			zonesByAccount[account.ID] = append(zonesByAccount[account.ID], zone.ID)
+		}
+	}
+	bans := make([]exportedBan, 0)
+	for _, state := range states {
+		ruleZones := make(map[string]struct{})
+		for zoneID := range state.FilterIDByZoneID {
+			ruleZones[zoneID] = struct{}{}
+		}
+		zones := sortedKeys(ruleZones)
+		listName := ""
+		if state.IPListState.IPList != nil {
+			listName = state.IPListState.IPList.Name
+		}
+		for ip, item := range state.IPListState.ItemByIP {
+			bans = append(bans, exportedBan{Value: ip, Scope: ipScope(ip), Action: state.Action, AccountID: state.AccountID, List: listName, Comment: item.Comment, Zones: zones})
+		}
+		for country := range state.CountrySet {
+			bans = append(bans, exportedBan{Value: country, Scope: "country", Action: state.Action, AccountID: state.AccountID, Zones: zones})
+		}
+		for as := range state.AutonomousSystemSet {
+			bans = append(bans, exportedBan{Value: as, Scope: "as", Action: state.Action, AccountID: state.AccountID, Zones: zones})
+		}
+		for zoneID, ruleIDByIP := range state.AccessRuleIDsByZoneID {
+			accessZones := []string{zoneID}
+			if zoneID == "" {
+				// account level rules apply to every zone.
+				accessZones = zonesByAccount[state.AccountID]
+			}
+			for ip := range ruleIDByIP {
+				bans = append(bans, exportedBan{Value: ip, Scope: ipScope(ip), Action: state.Action, AccountID: state.AccountID, Zones: accessZones})
+			}
+		}
+	}
+	for i, ban := range bans {
+		for _, state := range states {
+			if manual, ok := state.ManualBans[ban.Value]; ok && state.AccountID == ban.AccountID && state.Action == ban.Action && manual.Expiration.After(now) {
+				bans[i].Duration = manual.Expiration.Sub(now).Round(time.Second).String()
+			}
+		}
+	}
+	sort.SliceStable(bans, func(i, j int) bool {
+		a, b := bans[i], bans[j]
+		if a.AccountID != b.AccountID {
+			return a.AccountID < b.AccountID
+		}
+		if a.Action != b.Action {
+			return a.Action < b.Action
+		}
+		if a.Scope != b.Scope {
+			return a.Scope < b.Scope
+		}
+		return a.Value < b.Value
+	})
+	return bans
+}
+
+// writeBans writes the bans in the format. The cloudflare format is the CSV of IP list bulk uploads,
+// it only has the IPs and ranges.
+func writeBans(w io.Writer, bans []exportedBan, format string) error {
+	switch format {
+	case exportFormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(bans)
+	case exportFormatCSV:
+		csvWriter := csv.NewWriter(w)
+		if err := csvWriter.Write(exportCSVHeader); err != nil {
+			return err
+		}
+		for _, ban := range bans {
+			record := []string{ban.Value, ban.Scope, ban.Action, ban.AccountID, ban.List, ban.Comment, strings.Join(ban.Zones, " "), ban.Duration}
+			if err := csvWriter.Write(record); err != nil {
+				return err
+			}
+		}
+		csvWriter.Flush()
+		return csvWriter.Error()
+	case exportFormatCloudflare:
+		csvWriter := csv.NewWriter(w)
+		for _, ban := range bans {
+			if ban.Scope != "ip" && ban.Scope != "range" {
+				continue
+			}
+			if err := csvWriter.Write([]string{ban.Value, ban.Comment}); err != nil {
+				return err
+			}
+		}
+		csvWriter.Flush()
+		return csvWriter.Error()
+	}
+	return fmt.Errorf("unknown format '%s', expecting '%s', '%s' or '%s'", format, exportFormatJSON, exportFormatCSV, exportFormatCloudflare)
+}
+
+// readBans reads bans written by writeBans. Bans read from the cloudflare format have no action nor account.
+func readBans(r io.Reader, format string) ([]exportedBan, error) {
+	bans := make([]exportedBan, 0)
+	switch format {
+	case exportFormatJSON:
+		if err := json.NewDecoder(r).Decode(&bans); err != nil {
+			return nil, err
+		}
+		return bans, nil
+	case exportFormatCSV:
+		csvReader := csv.NewReader(r)
+		// the files exported by previous releases have no duration.
+		csvReader.FieldsPerRecord = -1
+		records, err := csvReader.ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		for i, record := range records {
+			if len(record) != len(exportCSVHeader) && len(record) != len(exportCSVHeader)-1 {
+				return nil, fmt.Errorf("line %d has %d fields, expecting %d", i+1, len(record), len(exportCSVHeader))
+			}
+			if i == 0 && record[0] == exportCSVHeader[0] {
+				continue
+			}
+			ban := exportedBan{Value: record[0], Scope: record[1], Action: record[2], AccountID: record[3], List: record[4], Comment: record[5], Zones: strings.Fields(record[6])}
+			if len(record) == len(exportCSVHeader) {
+				ban.Duration = record[7]
+			}
+			bans = append(bans, ban)
+		}
+		return bans, nil
+	case exportFormatCloudflare:
+		csvReader := csv.NewReader(r)
+		csvReader.FieldsPerRecord = -1
+		records, err := csvReader.ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			ban := exportedBan{Value: strings.TrimSpace(record[0])}
+			ban.Scope = ipScope(ban.Value)
+			if len(record) > 1 {
+				ban.Comment = record[1]
+			}
+			bans = append(bans, ban)
+		}
+		return bans, nil
+	}
+	return nil, fmt.Errorf("unknown format '%s', expecting '%s', '%s' or '%s'", format, exportFormatJSON, exportFormatCSV, exportFormatCloudflare)
+}
+
+// importRequest is an import of bans through the admin API.
+type importRequest struct {
+	Bans []exportedBan `json:"bans"`
+	// Duration is the duration of the bans without one.
+	Duration string `json:"duration"`
+}
+
+func (req *importRequest) validate() error {
+	duration, err := time.ParseDuration(req.Duration)
+	if err != nil {
+		return fmt.Errorf("duration '%s' is invalid: %w", req.Duration, err)
+	}
+	if duration <= 0 {
+		return fmt.Errorf("duration must be positive")
+	}
+	return nil
+}
+
+// banRequests returns the manual bans enforcing the imported bans in the account. Bans without account
+// apply to every account, bans without action get the default action of the account and bans without
+// duration last the duration of the import.
+func (req *importRequest) banRequests(account AccountConfig) []*manualBanRequest {
+	banReqs := make([]*manualBanRequest, 0)
+	for _, ban := range req.Bans {
+		if ban.AccountID != "" && ban.AccountID != account.ID {
+			continue
+		}
+		if ban.Action != "" {
+			if _, ok := decisionTypeByCloudflareAction[ban.Action]; !ok {
+				log.Warningf("not importing %s, action %s can't be imported", ban.Value, ban.Action)
+				continue
+			}
+		}
+		// the bans exported from manual bans are already commented as such.
+		comment := strings.TrimPrefix(ban.Comment, manualBanOrigin+": ")
+		if comment == "" || comment == manualBanOrigin {
+			comment = "import"
+		}
+		banReq := &manualBanRequest{Value: ban.Value, Scope: ban.Scope, Action: ban.Action, Comment: comment, Duration: ban.Duration}
+		if banReq.Duration == "" {
+			banReq.Duration = req.Duration
+		}
+		if err := banReq.validate(); err != nil {
+			log.Warningf("not importing %s: %s", ban.Value, err)
+			continue
+		}
+		banReqs = append(banReqs, banReq)
+	}
+	return banReqs
+}
+
+// importBans enforces the bans at cloudflare through the worker, as manual bans expiring after their duration.
+func (worker *CloudflareWorker) importBans(req *importRequest) error {
+	banReqs := req.banRequests(worker.Account)
+	for _, banReq := range banReqs {
+		if err := worker.queueManualBan(banReq); err != nil {
+			return err
+		}
+	}
+	err := worker.flushDecisions()
+	if err == nil {
+		worker.Logger.Infof("imported %d bans", len(banReqs))
+	}
+	worker.publishState()
+	worker.publishStatus()
+	return err
+}
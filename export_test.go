@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+var exportAccounts = []AccountConfig{{
+	ID:            "account1",
+	DefaultAction: "challenge",
+	ZoneConfigs:   []ZoneConfig{{ID: "zone1"}, {ID: "zone2"}},
+}}
+
+var exportStates = []CloudflareState{
+	{
+		AccountID:        "account1",
+		Action:           "block",
+		FilterIDByZoneID: map[string]string{"zone2": "f2", "zone1": "f1"},
+		IPListState: IPListState{
+			IPList: &cloudflare.IPList{Name: "crowdsec_block"},
+			ItemByIP: map[string]cloudflare.IPListItem{
+				"1.2.3.4":     {IP: "1.2.3.4", Comment: "crowdsec/ssh-bf"},
+				"10.0.0.0/24": {IP: "10.0.0.0/24", Comment: "crowdsec/http-probing"},
+			},
+		},
+		CountrySet:            map[string]struct{}{"FR": {}},
+		AutonomousSystemSet:   map[string]struct{}{"1234": {}},
+		AccessRuleIDsByZoneID: map[string]map[string]string{"": {"5.6.7.8": "rule1"}},
+		ManualBans:            map[string]manualBan{"FR": {Scope: "country", DecisionType: "ban", Expiration: exportTime.Add(time.Hour)}},
+	},
+}
+
+var exportTime = time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func Test_exportBans(t *testing.T) {
+	want := []exportedBan{
+		{Value: "1234", Scope: "as", Action: "block", AccountID: "account1", Zones: []string{"zone1", "zone2"}},
+		{Value: "FR", Scope: "country", Action: "block", AccountID: "account1", Zones: []string{"zone1", "zone2"}, Duration: "1h0m0s"},
+		{Value: "1.2.3.4", Scope: "ip", Action: "block", AccountID: "account1", List: "crowdsec_block", Comment: "crowdsec/ssh-bf", Zones: []string{"zone1", "zone2"}},
+		{Value: "5.6.7.8", Scope: "ip", Action: "block", AccountID: "account1", Zones: []string{"zone1", "zone2"}},
+		{Value: "10.0.0.0/24", Scope: "range", Action: "block", AccountID: "account1", List: "crowdsec_block", Comment: "crowdsec/http-probing", Zones: []string{"zone1", "zone2"}},
+	}
+	got := exportBans(exportStates, exportAccounts, exportTime)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want=%+v\n found=%+v", want, got)
+	}
+}
+
+func Test_writeBans(t *testing.T) {
+	bans := exportBans(exportStates, exportAccounts, exportTime)
+	for _, format := range []string{exportFormatJSON, exportFormatCSV} {
+		t.Run(format, func(t *testing.T) {
+			buf := bytes.Buffer{}
+			if err := writeBans(&buf, bans, format); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readBans(&buf, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, bans) {
+				t.Errorf("want=%+v\n found=%+v", bans, got)
+			}
+		})
+	}
+
+	t.Run(exportFormatCloudflare, func(t *testing.T) {
+		buf := bytes.Buffer{}
+		if err := writeBans(&buf, bans, exportFormatCloudflare); err != nil {
+			t.Fatal(err)
+		}
+		want := "1.2.3.4,crowdsec/ssh-bf\n5.6.7.8,\n10.0.0.0/24,crowdsec/http-probing\n"
+		if buf.String() != want {
+			t.Errorf("want=%q, found=%q", want, buf.String())
+		}
+		got, err := readBans(&buf, exportFormatCloudflare)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 3 || got[2].Scope != "range" || got[0].AccountID != "" || got[0].Action != "" {
+			t.Errorf("unexpected bans %+v", got)
+		}
+	})
+
+	if err := writeBans(&bytes.Buffer{}, bans, "xml"); err == nil {
+		t.Error("expected error on unknown format")
+	}
+}
+
+func TestCloudflareWorker_importBans(t *testing.T) {
+	var tokenCallCount uint32
+	api := &mockCloudflareAPI{IPListItems: make(map[string][]cloudflare.IPListItem)}
+	account := AccountConfig{
+		ID:            "account1",
+		DefaultAction: "challenge",
+		IPListPrefix:  "crowdsec",
+		ZoneConfigs:   []ZoneConfig{{ID: "zone1", Actions: []string{"challenge"}, ActionSet: map[string]struct{}{"challenge": {}}}},
+	}
+	worker := &CloudflareWorker{
+		Account: account,
+		API:     api,
+		CFStateByAction: map[string]*CloudflareState{"challenge": {
+			AccountID:           "account1",
+			Action:              "challenge",
+			FilterIDByZoneID:    map[string]string{"zone1": "f1"},
+			IPListState:         IPListState{IPList: &cloudflare.IPList{ID: "list1", Name: "crowdsec_challenge"}, ItemByIP: make(map[string]cloudflare.IPListItem)},
+			CountrySet:          make(map[string]struct{}),
+			AutonomousSystemSet: make(map[string]struct{}),
+		}},
+		Logger:         log.WithFields(log.Fields{"account_id": "test worker"}),
+		Count:          prometheus.NewCounter(prometheus.CounterOpts{}),
+		tokenCallCount: &tokenCallCount,
+	}
+	req := &importRequest{Duration: "4h", Bans: []exportedBan{
+		{Value: "1.2.3.4", Scope: "ip", Comment: "crowdsec/ssh-bf"},
+		{Value: "FR", Scope: "country", Action: "challenge", AccountID: "account1", Comment: "manual: incident", Duration: "30m"},
+		{Value: "5.6.7.8", Scope: "ip", Action: "block", AccountID: "account2"},
+	}}
+	if err := worker.importBans(req); err != nil {
+		t.Fatal(err)
+	}
+	state := worker.CFStateByAction["challenge"]
+	if ban := state.ManualBans["1.2.3.4"]; ban.Comment != "crowdsec/ssh-bf" || time.Until(ban.Expiration) < 3*time.Hour {
+		t.Errorf("expected 1.2.3.4 to be banned for the duration of the import, found %+v", ban)
+	}
+	if ban := state.ManualBans["FR"]; ban.Comment != "incident" || time.Until(ban.Expiration) > 30*time.Minute {
+		t.Errorf("expected FR to be banned for its own duration, found %+v", ban)
+	}
+	if _, ok := state.IPListState.ItemByIP["1.2.3.4"]; !ok || len(state.IPListState.ItemByIP) != 1 {
+		t.Errorf("expected only 1.2.3.4 to be imported, found %+v", state.IPListState.ItemByIP)
+	}
+	if _, ok := state.CountrySet["FR"]; !ok {
+		t.Errorf("expected FR to be imported, found %+v", state.CountrySet)
+	}
+	if state.CurrExpr != `(ip.geoip.country in {"FR"}) or (ip.src in $crowdsec_challenge)` {
+		t.Errorf("unexpected expression %s", state.CurrExpr)
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// workerHealth is the health of the worker of an account. It is written by the worker and read by the
+// HTTP handlers, the methods are safe to call on a nil workerHealth.
+type workerHealth struct {
+	mu               sync.RWMutex
+	accountID        string
+	ready            bool
+	dead             bool
+	disabled         bool
+	degraded         bool
+	restarts         int
+	lastSync         time.Time
+	lastPoll         time.Time
+	lastTick         time.Time
+	pendingDecisions int
+	lastError        string
+	lastErrorAt      time.Time
+	recentErrors     []recordedError
+	// published by the worker for the admin API.
+	pendingNew     int
+	pendingExpired int
+	zones          []zoneStatus
+	actions        []actionStatus
+	apiCallCount   *uint32
+}
+
+// maxRecentErrors is the number of errors of a worker kept for the admin API.
+const maxRecentErrors = 10
+
+type recordedError struct {
+	At    time.Time `json:"at"`
+	Error string    `json:"error"`
+}
+
+// workerHealthStatus is the health of a worker as reported by the endpoints.
+type workerHealthStatus struct {
+	AccountID                string     `json:"account_id"`
+	Ready                    bool       `json:"ready"`
+	Alive                    bool       `json:"alive"`
+	Stale                    bool       `json:"stale"`
+	Degraded                 bool       `json:"degraded"`
+	Disabled                 bool       `json:"disabled"`
+	Restarts                 int        `json:"restarts"`
+	LastCloudflareSync       *time.Time `json:"last_cloudflare_sync,omitempty"`
+	SecondsSinceLastSync     *float64   `json:"seconds_since_last_cloudflare_sync,omitempty"`
+	LastLAPIPoll             *time.Time `json:"last_lapi_poll,omitempty"`
+	SecondsSinceLastLAPIPoll *float64   `json:"seconds_since_last_lapi_poll,omitempty"`
+	PendingDecisions         int        `json:"pending_decisions"`
+	LastError                string     `json:"last_error,omitempty"`
+	LastErrorAt              *time.Time `json:"last_error_at,omitempty"`
+}
+
+func (h *workerHealth) setReady() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ready = true
+	// the worker starts syncing now, it isn't stale yet.
+	h.lastSync = time.Now()
+	h.lastTick = h.lastSync
+}
+
+// recordTick records that the loop of the worker advanced, the systemd watchdog is only fed while the
+// loops of the ready workers advance.
+func (h *workerHealth) recordTick() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastTick = time.Now()
+}
+
+func (h *workerHealth) setDead(err error) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.dead = true
+	if err != nil {
+		h.addError(err)
+	}
+}
+
+// recordRestart records the failure of the worker which is going to be restarted. The worker isn't
+// ready until it is set up again.
+func (h *workerHealth) recordRestart(err error, degraded bool) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ready = false
+	h.restarts++
+	h.degraded = h.degraded || degraded
+	h.addError(err)
+}
+
+// setDisabled records that the account is disabled because of the error, its worker won't be restarted.
+func (h *workerHealth) setDisabled(err error) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ready = false
+	h.disabled = true
+	h.addError(err)
+}
+
+func (h *workerHealth) isDegraded() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.degraded
+}
+
+func (h *workerHealth) isDisabled() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.disabled
+}
+
+// addError records the error, h.mu must be held.
+func (h *workerHealth) addError(err error) {
+	h.lastError = err.Error()
+	h.lastErrorAt = time.Now()
+	h.recentErrors = append(h.recentErrors, recordedError{At: h.lastErrorAt, Error: h.lastError})
+	if len(h.recentErrors) > maxRecentErrors {
+		h.recentErrors = h.recentErrors[len(h.recentErrors)-maxRecentErrors:]
+	}
+}
+
+func (h *workerHealth) recordError(err error) {
+	if h == nil || err == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.addError(err)
+}
+
+// recordSync records a sync with cloudflare which started at the given time. It only counts as
+// successful when no error happened since then, a successful sync clears the degraded status.
+func (h *workerHealth) recordSync(startedAt time.Time) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.lastErrorAt.Before(startedAt) {
+		h.lastSync = time.Now()
+		h.degraded = false
+	}
+}
+
+func (h *workerHealth) recordPoll() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastPoll = time.Now()
+}
+
+// recordStatus records the state of the worker shown by the admin API.
+func (h *workerHealth) recordStatus(zones []zoneStatus, actions []actionStatus, pendingNew int, pendingExpired int) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.zones = zones
+	h.actions = actions
+	h.pendingNew = pendingNew
+	h.pendingExpired = pendingExpired
+	h.pendingDecisions = pendingNew + pendingExpired
+}
+
+func secondsSince(t time.Time, now time.Time) *float64 {
+	seconds := now.Sub(t).Seconds()
+	return &seconds
+}
+
+// status returns the health of the worker. A ready worker is stale when it didn't sync with cloudflare,
+// or didn't receive decisions from LAPI, for longer than staleAfter. It is dead when its loop didn't
+// advance for longer than staleAfter.
+func (h *workerHealth) status(now time.Time, staleAfter time.Duration, pollsLAPI bool) workerHealthStatus {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	stuck := h.ready && !h.lastTick.IsZero() && now.Sub(h.lastTick) > staleAfter
+	status := workerHealthStatus{
+		AccountID:        h.accountID,
+		Ready:            h.ready,
+		Alive:            !h.dead && !stuck,
+		Degraded:         h.degraded,
+		Disabled:         h.disabled,
+		Restarts:         h.restarts,
+		PendingDecisions: h.pendingDecisions,
+		LastError:        h.lastError,
+	}
+	if !h.lastSync.IsZero() {
+		lastSync := h.lastSync
+		status.LastCloudflareSync = &lastSync
+		status.SecondsSinceLastSync = secondsSince(lastSync, now)
+		status.Stale = now.Sub(lastSync) > staleAfter
+	}
+	if !h.lastPoll.IsZero() {
+		lastPoll := h.lastPoll
+		status.LastLAPIPoll = &lastPoll
+		status.SecondsSinceLastLAPIPoll = secondsSince(lastPoll, now)
+	}
+	if pollsLAPI && h.ready {
+		// a worker which never received decisions is stale once it has been ready for staleAfter.
+		reference := h.lastPoll
+		if reference.IsZero() {
+			reference = h.lastSync
+		}
+		status.Stale = status.Stale || now.Sub(reference) > staleAfter
+	}
+	if !h.lastErrorAt.IsZero() {
+		lastErrorAt := h.lastErrorAt
+		status.LastErrorAt = &lastErrorAt
+	}
+	return status
+}
+
+// healthRegistry holds the health of every worker.
+type healthRegistry struct {
+	workers    []*workerHealth
+	sources    []*lapiSourceHealth
+	staleAfter time.Duration
+	pollsLAPI  bool
+}
+
+func newHealthRegistry(staleAfter time.Duration, pollsLAPI bool) *healthRegistry {
+	return &healthRegistry{staleAfter: staleAfter, pollsLAPI: pollsLAPI}
+}
+
+// register returns the health of the account's worker. It must be called before serving.
+func (r *healthRegistry) register(accountID string, apiCallCount *uint32) *workerHealth {
+	h := &workerHealth{accountID: accountID, apiCallCount: apiCallCount}
+	r.workers = append(r.workers, h)
+	return h
+}
+
+// registerSource returns the health of the LAPI source. It must be called before serving.
+func (r *healthRegistry) registerSource(name string, url string) *lapiSourceHealth {
+	h := &lapiSourceHealth{name: name, url: url}
+	r.sources = append(r.sources, h)
+	return h
+}
+
+func (r *healthRegistry) sourceStatuses() []lapiSourceStatus {
+	now := time.Now()
+	statuses := make([]lapiSourceStatus, 0, len(r.sources))
+	for _, h := range r.sources {
+		statuses = append(statuses, h.status(now, r.staleAfter))
+	}
+	return statuses
+}
+
+func (r *healthRegistry) statuses() []workerHealthStatus {
+	now := time.Now()
+	statuses := make([]workerHealthStatus, 0, len(r.workers))
+	for _, h := range r.workers {
+		statuses = append(statuses, h.status(now, r.staleAfter, r.pollsLAPI))
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].AccountID < statuses[j].AccountID })
+	return statuses
+}
+
+func writeHealth(w http.ResponseWriter, healthy bool, statuses []workerHealthStatus, sources []lapiSourceStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	status := "ok"
+	if !healthy {
+		status = "failing"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(struct {
+		Status  string               `json:"status"`
+		Workers []workerHealthStatus `json:"workers"`
+		Sources []lapiSourceStatus   `json:"lapi_sources,omitempty"`
+	}{Status: status, Workers: statuses, Sources: sources})
+}
+
+// handleHealthz fails when a worker is dead or its loop is stuck.
+func (r *healthRegistry) handleHealthz(w http.ResponseWriter, req *http.Request) {
+	statuses := r.statuses()
+	healthy := true
+	for _, status := range statuses {
+		healthy = healthy && status.Alive
+	}
+	writeHealth(w, healthy, statuses, r.sourceStatuses())
+}
+
+// handleReadyz fails when a worker isn't set up yet, is dead, stale, degraded or disabled, or when no LAPI
+// source is up. The decisions of the other sources are still enforced while a source is down.
+func (r *healthRegistry) handleReadyz(w http.ResponseWriter, req *http.Request) {
+	statuses := r.statuses()
+	ready := true
+	for _, status := range statuses {
+		ready = ready && status.Ready && status.Alive && !status.Stale && !status.Degraded && !status.Disabled
+	}
+	sources := r.sourceStatuses()
+	sourceUp := len(sources) == 0
+	for _, source := range sources {
+		sourceUp = sourceUp || (source.Up && !source.Stale)
+	}
+	writeHealth(w, ready && sourceUp, statuses, sources)
+}
+
+func withBasicAuth(username string, password string, next http.Handler) http.Handler {
+	if username == "" && password == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		u, p, ok := req.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(u), []byte(username)) != 1 || subtle.ConstantTimeCompare([]byte(p), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="crowdsec-cloudflare-bouncer"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// newHTTPHandler returns the handler of the metrics and health endpoints.
+func newHTTPHandler(conf HTTPConfig, registry *healthRegistry) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", registry.handleHealthz)
+	mux.HandleFunc("/readyz", registry.handleReadyz)
+	return withBasicAuth(conf.BasicAuthUsername, conf.BasicAuthPassword, mux)
+}
+
+// serveHTTP serves the metrics and health endpoints, with TLS when a certificate is configured.
+func serveHTTP(conf HTTPConfig, registry *healthRegistry) error {
+	server := &http.Server{Addr: conf.ListenAddr, Handler: newHTTPHandler(conf, registry)}
+	if conf.TLSCertPath != "" {
+		return server.ListenAndServeTLS(conf.TLSCertPath, conf.TLSKeyPath)
+	}
+	return server.ListenAndServe()
+}
+
+// healthStaleAfter returns how long a worker can go without syncing with cloudflare or receiving decisions
+// from LAPI before being reported as stale. It defaults to 5 times the longest of the update frequencies.
+func healthStaleAfter(conf *bouncerConfig) time.Duration {
+	if conf.HTTP.StaleAfter > 0 {
+		return conf.HTTP.StaleAfter
+	}
+	frequency := conf.CloudflareConfig.UpdateFrequency
+	if lapiFrequency, err := time.ParseDuration(conf.CrowdsecUpdateFrequencyYAML); err == nil && lapiFrequency > frequency {
+		frequency = lapiFrequency
+	}
+	for _, source := range conf.LAPISources {
+		if source.UpdateFrequency > frequency {
+			frequency = source.UpdateFrequency
+		}
+	}
+	return 5 * frequency
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWorkerHealth_status(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		health    *workerHealth
+		wantReady bool
+		wantAlive bool
+		wantStale bool
+	}{
+		{
+			name:      "not set up",
+			health:    &workerHealth{accountID: "account1"},
+			wantAlive: true,
+		},
+		{
+			name:      "synced and polled",
+			health:    &workerHealth{accountID: "account1", ready: true, lastSync: now.Add(-time.Second), lastPoll: now.Add(-time.Second)},
+			wantReady: true,
+			wantAlive: true,
+		},
+		{
+			name:      "no sync for too long",
+			health:    &workerHealth{accountID: "account1", ready: true, lastSync: now.Add(-time.Hour), lastPoll: now.Add(-time.Second)},
+			wantReady: true,
+			wantAlive: true,
+			wantStale: true,
+		},
+		{
+			name:      "never polled",
+			health:    &workerHealth{accountID: "account1", ready: true, lastSync: now.Add(-time.Hour)},
+			wantReady: true,
+			wantAlive: true,
+			wantStale: true,
+		},
+		{
+			name:      "loop stuck",
+			health:    &workerHealth{accountID: "account1", ready: true, lastSync: now.Add(-time.Second), lastPoll: now.Add(-time.Second), lastTick: now.Add(-time.Hour)},
+			wantReady: true,
+		},
+		{
+			name:      "dead",
+			health:    &workerHealth{accountID: "account1", ready: true, dead: true, lastSync: now, lastPoll: now},
+			wantReady: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := tt.health.status(now, time.Minute, true)
+			if status.Ready != tt.wantReady || status.Alive != tt.wantAlive || status.Stale != tt.wantStale {
+				t.Errorf("want ready=%t alive=%t stale=%t, found %+v", tt.wantReady, tt.wantAlive, tt.wantStale, status)
+			}
+		})
+	}
+}
+
+func TestWorkerHealth_recordSync(t *testing.T) {
+	health := &workerHealth{}
+	health.setReady()
+	start := time.Now()
+	health.recordError(errors.New("rate limited"))
+	lastSync := health.lastSync
+	health.recordSync(start)
+	if health.lastSync != lastSync {
+		t.Error("expected a sync with errors not to count as successful")
+	}
+	health.recordSync(time.Now())
+	if !health.lastSync.After(lastSync) {
+		t.Error("expected the sync to be recorded")
+	}
+
+	var nilHealth *workerHealth
+	nilHealth.recordSync(time.Now())
+	nilHealth.setDead(errors.New("dead"))
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	registry := newHealthRegistry(time.Minute, true)
+	health1 := registry.register("account1", nil)
+	health2 := registry.register("account2", nil)
+	health1.setReady()
+	health1.recordPoll()
+	server := httptest.NewServer(newHTTPHandler(HTTPConfig{}, registry))
+	defer server.Close()
+
+	get := func(path string) (int, []workerHealthStatus) {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body := struct {
+			Workers []workerHealthStatus `json:"workers"`
+		}{}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, body.Workers
+	}
+
+	if code, workers := get("/healthz"); code != http.StatusOK || len(workers) != 2 {
+		t.Errorf("expected healthz to succeed with 2 workers, found %d %+v", code, workers)
+	}
+	if code, _ := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected readyz to fail while account2 isn't set up, found %d", code)
+	}
+	health2.setReady()
+	health2.recordPoll()
+	if code, _ := get("/readyz"); code != http.StatusOK {
+		t.Errorf("expected readyz to succeed, found %d", code)
+	}
+	health2.setDead(errors.New("invalid token"))
+	code, workers := get("/healthz")
+	if code != http.StatusServiceUnavailable || workers[1].LastError != "invalid token" {
+		t.Errorf("expected healthz to fail with the error of account2, found %d %+v", code, workers)
+	}
+	if code, _ := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected readyz to fail, found %d", code)
+	}
+}
+
+func TestHealthEndpointsBasicAuth(t *testing.T) {
+	registry := newHealthRegistry(time.Minute, true)
+	server := httptest.NewServer(newHTTPHandler(HTTPConfig{BasicAuthUsername: "user", BasicAuthPassword: "pass"}, registry))
+	defer server.Close()
+
+	for _, tt := range []struct {
+		username string
+		password string
+		wantCode int
+	}{
+		{wantCode: http.StatusUnauthorized},
+		{username: "user", password: "wrong", wantCode: http.StatusUnauthorized},
+		{username: "user", password: "pass", wantCode: http.StatusOK},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/healthz", nil)
+		if tt.username != "" {
+			req.SetBasicAuth(tt.username, tt.password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.wantCode {
+			t.Errorf("%s:%s want=%d, found=%d", tt.username, tt.password, tt.wantCode, resp.StatusCode)
+		}
+	}
+}
+
+func Test_healthStaleAfter(t *testing.T) {
+	conf := &bouncerConfig{CrowdsecUpdateFrequencyYAML: "1m", CloudflareConfig: CloudflareConfig{UpdateFrequency: 30 * time.Second}}
+	if got := healthStaleAfter(conf); got != 5*time.Minute {
+		t.Errorf("want=5m, found=%s", got)
+	}
+	conf.HTTP.StaleAfter = time.Minute
+	if got := healthStaleAfter(conf); got != time.Minute {
+		t.Errorf("want=1m, found=%s", got)
+	}
+}
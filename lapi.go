@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/apiclient"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultLAPISourceName      = "default"
+	defaultLAPIUpdateFrequency = 10 * time.Second
+)
+
+var defaultLAPIScopes = []string{"ip", "range", "as", "country"}
+
+// validateLAPISource checks the source and sets its defaults.
+func validateLAPISource(source *LAPISourceConfig) error {
+	if source.Name == "" {
+		return fmt.Errorf("crowdsec_lapi_sources entry with url '%s' has no name", source.URL)
+	}
+	if u, err := url.Parse(source.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("lapi source %s has invalid url '%s', expecting an http or https url", source.Name, source.URL)
+	}
+	if source.Key == "" {
+		return fmt.Errorf("lapi source %s is missing key", source.Name)
+	}
+	if (source.CertPath == "") != (source.KeyPath == "") {
+		return fmt.Errorf("lapi source %s cert_path and key_path must be set together", source.Name)
+	}
+	if source.UpdateFrequency < 0 {
+		return fmt.Errorf("lapi source %s update_frequency must be positive", source.Name)
+	}
+	if source.UpdateFrequency == 0 {
+		source.UpdateFrequency = defaultLAPIUpdateFrequency
+	}
+	for _, scope := range source.Scopes {
+		if !contains(defaultLAPIScopes, strings.ToLower(scope)) {
+			return fmt.Errorf("lapi source %s has unsupported scope '%s', valid choices are %s", source.Name, scope, strings.Join(defaultLAPIScopes, ", "))
+		}
+	}
+	if len(source.Scopes) == 0 {
+		source.Scopes = defaultLAPIScopes
+	}
+	return nil
+}
+
+// lapiSourceConfigs returns the LAPI sources of the config, or the one of crowdsec_lapi_url and
+// crowdsec_lapi_key when crowdsec_lapi_sources isn't set.
+func lapiSourceConfigs(conf *bouncerConfig) ([]LAPISourceConfig, error) {
+	if len(conf.LAPISources) > 0 {
+		return conf.LAPISources, nil
+	}
+	source := LAPISourceConfig{Name: defaultLAPISourceName, URL: conf.CrowdSecLAPIUrl, Key: conf.CrowdSecLAPIKey}
+	if conf.CrowdsecUpdateFrequencyYAML != "" {
+		var err error
+		if source.UpdateFrequency, err = time.ParseDuration(conf.CrowdsecUpdateFrequencyYAML); err != nil {
+			return nil, fmt.Errorf("unable to parse crowdsec_update_frequency '%s': %w", conf.CrowdsecUpdateFrequencyYAML, err)
+		}
+	}
+	if err := validateLAPISource(&source); err != nil {
+		return nil, err
+	}
+	return []LAPISourceConfig{source}, nil
+}
+
+func lapiTLSConfig(conf LAPISourceConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: conf.InsecureSkipVerify}
+	if conf.CACertPath != "" {
+		caCert, err := ioutil.ReadFile(conf.CACertPath)
+		if err != nil {
+			return nil, fmt.Errorf("while reading the ca cert of lapi source %s: %w", conf.Name, err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("ca cert of lapi source %s has no PEM certificate", conf.Name)
+		}
+	}
+	if conf.CertPath != "" {
+		cert, err := tls.LoadX509KeyPair(conf.CertPath, conf.KeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("while loading the client cert of lapi source %s: %w", conf.Name, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// lapiUpdate is a poll of the decision stream of a source.
+type lapiUpdate struct {
+	source    string
+	decisions *models.DecisionsStreamResponse
+}
+
+// lapiSource pulls the decision stream of a CrowdSec LAPI.
+type lapiSource struct {
+	conf   LAPISourceConfig
+	client *apiclient.ApiClient
+	health *lapiSourceHealth
+	logger *log.Entry
+}
+
+func newLAPISource(conf LAPISourceConfig, userAgent string, health *lapiSourceHealth) (*lapiSource, error) {
+	apiURL, err := url.Parse(conf.URL)
+	if err != nil {
+		return nil, fmt.Errorf("lapi source %s has invalid url: %w", conf.Name, err)
+	}
+	tlsConfig, err := lapiTLSConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	transport := &apiclient.APIKeyTransport{
+		APIKey:    conf.Key,
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig},
+	}
+	client, err := apiclient.NewDefaultClient(apiURL, "v1", userAgent, transport.Client())
+	if err != nil {
+		return nil, fmt.Errorf("while creating the client of lapi source %s: %w", conf.Name, err)
+	}
+	return &lapiSource{conf: conf, client: client, health: health, logger: log.WithFields(log.Fields{"lapi_source": conf.Name})}, nil
+}
+
+// run polls the source until the context is done. The first poll gets every active decision of the
+// source, it is retried until LAPI answers, the next ones get the changes since the previous one.
+func (s *lapiSource) run(ctx context.Context, updates chan<- lapiUpdate) {
+	ticker := time.NewTicker(s.conf.UpdateFrequency)
+	defer ticker.Stop()
+	startup := true
+	for {
+		decisions, _, err := s.client.Decisions.GetStream(ctx, startup, s.conf.Scopes)
+		if err != nil {
+			s.logger.Errorf("while polling decisions: %s", err)
+			s.health.recordError(err)
+		} else {
+			filtered := s.filter(decisions)
+			s.health.recordPoll(len(decisions.New)-len(filtered.New), len(filtered.New), len(filtered.Deleted))
+			select {
+			case updates <- lapiUpdate{source: s.conf.Name, decisions: filtered}:
+			case <-ctx.Done():
+				return
+			}
+			startup = false
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// filter keeps the new decisions matching the scenarios and origins of the source. The deleted ones are
+// kept, the merger ignores the deletion of decisions it doesn't know when another source has them.
+func (s *lapiSource) filter(decisions *models.DecisionsStreamResponse) *models.DecisionsStreamResponse {
+	filtered := &models.DecisionsStreamResponse{New: make(models.GetDecisionsResponse, 0, len(decisions.New)), Deleted: decisions.Deleted}
+	for _, decision := range decisions.New {
+		if s.matches(decision) {
+			filtered.New = append(filtered.New, decision)
+		}
+	}
+	return filtered
+}
+
+func (s *lapiSource) matches(decision *models.Decision) bool {
+	scenario := stringValue(decision.Scenario)
+	if len(s.conf.ScenariosContaining) > 0 && !containsAny(scenario, s.conf.ScenariosContaining) {
+		return false
+	}
+	if containsAny(scenario, s.conf.ScenariosNotContaining) {
+		return false
+	}
+	return len(s.conf.Origins) == 0 || contains(s.conf.Origins, stringValue(decision.Origin))
+}
+
+func containsAny(s string, substrings []string) bool {
+	for _, substring := range substrings {
+		if strings.Contains(s, substring) {
+			return true
+		}
+	}
+	return false
+}
+
+type mergeKey struct {
+	scope        string
+	value        string
+	decisionType string
+}
+
+type sourceDecisionID struct {
+	source string
+	id     int64
+}
+
+func decisionMergeKey(decision *models.Decision) mergeKey {
+	return mergeKey{
+		scope:        strings.ToLower(stringValue(decision.Scope)),
+		value:        normalizeDecisionValue(stringValue(decision.Value)),
+		decisionType: stringValue(decision.Type),
+	}
+}
+
+// decisionMerger merges the decision streams of the sources for the workers. It counts the sources
+// which have an active decision on a value with a type, the deletion of a decision only reaches the
+// workers when no source has one anymore.
+type decisionMerger struct {
+	active        map[mergeKey]map[sourceDecisionID]struct{}
+	countBySource map[string]int
+	healthByName  map[string]*lapiSourceHealth
+}
+
+func newDecisionMerger(healthByName map[string]*lapiSourceHealth) *decisionMerger {
+	return &decisionMerger{
+		active:        make(map[mergeKey]map[sourceDecisionID]struct{}),
+		countBySource: make(map[string]int),
+		healthByName:  healthByName,
+	}
+}
+
+// merge returns the decisions of the update to send to the workers.
+func (m *decisionMerger) merge(update lapiUpdate) *models.DecisionsStreamResponse {
+	merged := &models.DecisionsStreamResponse{New: update.decisions.New, Deleted: make(models.GetDecisionsResponse, 0)}
+	for _, decision := range update.decisions.New {
+		key := decisionMergeKey(decision)
+		if m.active[key] == nil {
+			m.active[key] = make(map[sourceDecisionID]struct{})
+		}
+		id := sourceDecisionID{source: update.source, id: decision.ID}
+		if _, ok := m.active[key][id]; !ok {
+			m.active[key][id] = struct{}{}
+			m.countBySource[update.source]++
+		}
+	}
+	for _, decision := range update.decisions.Deleted {
+		key := decisionMergeKey(decision)
+		decisions := m.active[key]
+		for id := range decisions {
+			// without ID, every decision of the source on the value is deleted.
+			if id.source == update.source && (decision.ID == 0 || id.id == decision.ID) {
+				delete(decisions, id)
+				m.countBySource[update.source]--
+			}
+		}
+		if len(decisions) > 0 {
+			continue
+		}
+		delete(m.active, key)
+		merged.Deleted = append(merged.Deleted, decision)
+	}
+	m.healthByName[update.source].setActiveDecisions(m.countBySource[update.source])
+	return merged
+}
+
+// lapiSourceHealth is the health of a LAPI source, the methods are safe to call on a nil
+// lapiSourceHealth.
+type lapiSourceHealth struct {
+	mu              sync.RWMutex
+	name            string
+	url             string
+	polls           int
+	errors          int
+	filtered        int
+	receivedNew     int
+	receivedDeleted int
+	activeDecisions int
+	lastPoll        time.Time
+	lastPollFailed  bool
+	lastError       string
+	lastErrorAt     time.Time
+}
+
+// lapiSourceStatus is the health of a LAPI source as reported by the endpoints.
+type lapiSourceStatus struct {
+	Name                 string     `json:"name"`
+	URL                  string     `json:"url"`
+	Up                   bool       `json:"up"`
+	Stale                bool       `json:"stale"`
+	LastPoll             *time.Time `json:"last_poll,omitempty"`
+	SecondsSinceLastPoll *float64   `json:"seconds_since_last_poll,omitempty"`
+	Polls                int        `json:"polls"`
+	Errors               int        `json:"errors"`
+	ActiveDecisions      int        `json:"active_decisions"`
+	LastError            string     `json:"last_error,omitempty"`
+	LastErrorAt          *time.Time `json:"last_error_at,omitempty"`
+}
+
+func (h *lapiSourceHealth) recordPoll(filtered int, receivedNew int, receivedDeleted int) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.polls++
+	h.filtered += filtered
+	h.receivedNew += receivedNew
+	h.receivedDeleted += receivedDeleted
+	h.lastPoll = time.Now()
+	h.lastPollFailed = false
+}
+
+func (h *lapiSourceHealth) recordError(err error) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.polls++
+	h.errors++
+	h.lastPollFailed = true
+	h.lastError = err.Error()
+	h.lastErrorAt = time.Now()
+}
+
+func (h *lapiSourceHealth) setActiveDecisions(count int) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.activeDecisions = count
+}
+
+// status returns the health of the source. It is up when its last poll succeeded, and stale when it
+// didn't answer for longer than staleAfter.
+func (h *lapiSourceHealth) status(now time.Time, staleAfter time.Duration) lapiSourceStatus {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	status := lapiSourceStatus{
+		Name:            h.name,
+		URL:             h.url,
+		Up:              !h.lastPoll.IsZero() && !h.lastPollFailed,
+		Stale:           h.lastPoll.IsZero() || now.Sub(h.lastPoll) > staleAfter,
+		Polls:           h.polls,
+		Errors:          h.errors,
+		ActiveDecisions: h.activeDecisions,
+		LastError:       h.lastError,
+	}
+	if !h.lastPoll.IsZero() {
+		lastPoll := h.lastPoll
+		status.LastPoll = &lastPoll
+		status.SecondsSinceLastPoll = secondsSince(lastPoll, now)
+	}
+	if !h.lastErrorAt.IsZero() {
+		lastErrorAt := h.lastErrorAt
+		status.LastErrorAt = &lastErrorAt
+	}
+	return status
+}
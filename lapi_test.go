@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newStreamDecision(id int64, value string, decisionType string) *models.Decision {
+	scope, scenario, origin := "Ip", "crowdsecurity/ssh-bf", "crowdsec"
+	return &models.Decision{ID: id, Value: &value, Scope: &scope, Type: &decisionType, Scenario: &scenario, Origin: &origin}
+}
+
+func TestDecisionMerger(t *testing.T) {
+	registry := newHealthRegistry(time.Minute, true)
+	healthByName := map[string]*lapiSourceHealth{
+		"eu": registry.registerSource("eu", "http://eu:8080/"),
+		"us": registry.registerSource("us", "http://us:8080/"),
+	}
+	merger := newDecisionMerger(healthByName)
+	stream := func(newDecisions []*models.Decision, deleted []*models.Decision) *models.DecisionsStreamResponse {
+		return &models.DecisionsStreamResponse{New: newDecisions, Deleted: deleted}
+	}
+
+	merged := merger.merge(lapiUpdate{source: "eu", decisions: stream([]*models.Decision{newStreamDecision(1, "1.2.3.4", "ban"), newStreamDecision(2, "5.6.7.8", "ban")}, nil)})
+	if len(merged.New) != 2 {
+		t.Fatalf("expected the new decisions to be forwarded, found %+v", merged.New)
+	}
+	merger.merge(lapiUpdate{source: "us", decisions: stream([]*models.Decision{newStreamDecision(7, "1.2.3.4", "ban"), newStreamDecision(8, "1.2.3.4", "captcha")}, nil)})
+	if got := healthByName["us"].status(time.Now(), time.Minute).ActiveDecisions; got != 2 {
+		t.Errorf("expected 2 active decisions for us, found %d", got)
+	}
+
+	merged = merger.merge(lapiUpdate{source: "eu", decisions: stream(nil, []*models.Decision{newStreamDecision(1, "1.2.3.4", "ban"), newStreamDecision(2, "5.6.7.8", "ban")})})
+	if len(merged.Deleted) != 1 || *merged.Deleted[0].Value != "5.6.7.8" {
+		t.Errorf("expected 1.2.3.4 to stay banned while us has a decision on it, found %+v", merged.Deleted)
+	}
+	merged = merger.merge(lapiUpdate{source: "us", decisions: stream(nil, []*models.Decision{newStreamDecision(8, "1.2.3.4", "captcha")})})
+	if len(merged.Deleted) != 1 || *merged.Deleted[0].Type != "captcha" {
+		t.Errorf("expected the captcha to be deleted, the ban is another decision, found %+v", merged.Deleted)
+	}
+	merged = merger.merge(lapiUpdate{source: "us", decisions: stream(nil, []*models.Decision{newStreamDecision(7, "1.2.3.4", "ban")})})
+	if len(merged.Deleted) != 1 || *merged.Deleted[0].Value != "1.2.3.4" {
+		t.Errorf("expected 1.2.3.4 to be unbanned once no source has a decision on it, found %+v", merged.Deleted)
+	}
+	if got := healthByName["eu"].status(time.Now(), time.Minute).ActiveDecisions; got != 0 {
+		t.Errorf("expected no active decision for eu, found %d", got)
+	}
+	// a deletion of a value no source knows, like a ban of the cache from a previous run, is forwarded.
+	merged = merger.merge(lapiUpdate{source: "eu", decisions: stream(nil, []*models.Decision{newStreamDecision(3, "9.9.9.9", "ban")})})
+	if len(merged.Deleted) != 1 {
+		t.Errorf("expected the unknown deletion to be forwarded, found %+v", merged.Deleted)
+	}
+}
+
+func TestLAPISource_run(t *testing.T) {
+	var mu sync.Mutex
+	requests := make([]*http.Request, 0)
+	lapi := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r)
+		count := len(requests)
+		mu.Unlock()
+		if count == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		decision := newStreamDecision(int64(count), "1.2.3.4", "ban")
+		filtered := newStreamDecision(100, "5.6.7.8", "ban")
+		otherOrigin := "cscli"
+		filtered.Origin = &otherOrigin
+		json.NewEncoder(w).Encode(models.DecisionsStreamResponse{New: models.GetDecisionsResponse{decision, filtered}})
+	}))
+	defer lapi.Close()
+
+	conf := LAPISourceConfig{Name: "eu", URL: lapi.URL + "/", Key: "secret", UpdateFrequency: 10 * time.Millisecond, Origins: []string{"crowdsec"}}
+	if err := validateLAPISource(&conf); err != nil {
+		t.Fatal(err)
+	}
+	registry := newHealthRegistry(time.Minute, true)
+	health := registry.registerSource(conf.Name, conf.URL)
+	source, err := newLAPISource(conf, "test", health)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := make(chan lapiUpdate)
+	go source.run(ctx, updates)
+	for i := 0; i < 2; i++ {
+		select {
+		case update := <-updates:
+			if update.source != "eu" || len(update.decisions.New) != 1 || *update.decisions.New[0].Origin != "crowdsec" {
+				t.Errorf("expected the decision of the kept origin, found %+v", update.decisions.New)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no update from the source")
+		}
+	}
+	cancel()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i, startup := range []string{"true", "true", "false"} {
+		if got := requests[i].URL.Query().Get("startup"); got != startup {
+			t.Errorf("request %d: expected startup=%s, found %s", i, startup, got)
+		}
+	}
+	if got := requests[0].Header.Get("X-Api-Key"); got != "secret" {
+		t.Errorf("expected the key of the source, found %s", got)
+	}
+	if got := requests[0].URL.Query().Get("scopes"); got != "ip,range,as,country" {
+		t.Errorf("expected the default scopes, found %s", got)
+	}
+	status := health.status(time.Now(), time.Minute)
+	if !status.Up || status.Errors != 1 || status.LastError == "" {
+		t.Errorf("expected the source to be up after its failed first poll, found %+v", status)
+	}
+	if got := testutil.CollectAndCount(healthCollector{registry: registry}, "cloudflare_lapi_filtered_decisions"); got != 1 {
+		t.Errorf("expected the filtered decisions of the source, found %d series", got)
+	}
+}
+
+func Test_lapiSourceConfigs(t *testing.T) {
+	sources, err := lapiSourceConfigs(&bouncerConfig{CrowdSecLAPIUrl: "http://localhost:8080/", CrowdSecLAPIKey: "key", CrowdsecUpdateFrequencyYAML: "30s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != 1 || sources[0].Name != defaultLAPISourceName || sources[0].UpdateFrequency != 30*time.Second || len(sources[0].Scopes) != 4 {
+		t.Errorf("expected the source of crowdsec_lapi_url, found %+v", sources)
+	}
+	if _, err := lapiSourceConfigs(&bouncerConfig{CrowdSecLAPIUrl: "http://localhost:8080/"}); err == nil {
+		t.Error("expected an error without key")
+	}
+	invalid := []LAPISourceConfig{
+		{URL: "http://localhost:8080/", Key: "key"},
+		{Name: "eu", URL: "localhost:8080", Key: "key"},
+		{Name: "eu", URL: "http://localhost:8080/", Key: "key", CertPath: "cert.pem"},
+		{Name: "eu", URL: "http://localhost:8080/", Key: "key", Scopes: []string{"username"}},
+	}
+	for _, source := range invalid {
+		if err := validateLAPISource(&source); err == nil {
+			t.Errorf("expected %+v to be invalid", source)
+		}
+	}
+}
+
+func TestHealthEndpoints_lapiSources(t *testing.T) {
+	registry := newHealthRegistry(time.Minute, true)
+	worker := registry.register("account1", nil)
+	worker.setReady()
+	worker.recordPoll()
+	eu := registry.registerSource("eu", "http://eu:8080/")
+	us := registry.registerSource("us", "http://us:8080/")
+	server := httptest.NewServer(newHTTPHandler(HTTPConfig{}, registry))
+	defer server.Close()
+
+	readyz := func() int {
+		resp, err := http.Get(server.URL + "/readyz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := readyz(); code != http.StatusServiceUnavailable {
+		t.Errorf("expected readyz to fail before a source answered, found %d", code)
+	}
+	eu.recordPoll(0, 1, 0)
+	us.recordError(context.DeadlineExceeded)
+	if code := readyz(); code != http.StatusOK {
+		t.Errorf("expected readyz to succeed while a source is up, found %d", code)
+	}
+}
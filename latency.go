@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/crowdsecurity/cs-cloudflare-bouncer/version"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer is a no-op until setUpTracing installs an exporter.
+var tracer = otel.Tracer("github.com/crowdsecurity/cs-cloudflare-bouncer")
+
+// trackedDecision is a decision received from LAPI which isn't live at cloudflare yet.
+type trackedDecision struct {
+	receivedAt time.Time
+	scope      string
+	expired    bool
+}
+
+// trackDecision records when the decision was received from LAPI, its propagation is measured once it
+// is live at cloudflare.
+func (worker *CloudflareWorker) trackDecision(decision *models.Decision, decisionIsExpired bool, receivedAt time.Time) {
+	if worker.receivedDecisions == nil {
+		worker.receivedDecisions = make(map[*models.Decision]trackedDecision)
+	}
+	worker.receivedDecisions[decision] = trackedDecision{receivedAt: receivedAt, scope: scopeLabel(decision), expired: decisionIsExpired}
+}
+
+// confirmDecisions records the propagation of the decisions, which are live at cloudflare.
+func (worker *CloudflareWorker) confirmDecisions(decisions []*models.Decision) {
+	now := time.Now()
+	for _, decision := range decisions {
+		if tracked, ok := worker.receivedDecisions[decision]; ok {
+			worker.Metrics.recordPropagation(worker.Account.ID, tracked, now)
+			delete(worker.receivedDecisions, decision)
+		}
+	}
+}
+
+// awaitRules defers the propagation of the decisions until the rules of the account are updated, the
+// country and AS bans are only live once they are in the expression of the rules.
+func (worker *CloudflareWorker) awaitRules(decisions []*models.Decision) {
+	for _, decision := range decisions {
+		if tracked, ok := worker.receivedDecisions[decision]; ok {
+			worker.awaitingRules = append(worker.awaitingRules, tracked)
+			delete(worker.receivedDecisions, decision)
+		}
+	}
+}
+
+// confirmRules records the propagation of the decisions waiting for the rules, which are updated.
+func (worker *CloudflareWorker) confirmRules() {
+	now := time.Now()
+	for _, tracked := range worker.awaitingRules {
+		worker.Metrics.recordPropagation(worker.Account.ID, tracked, now)
+	}
+	worker.awaitingRules = nil
+}
+
+// forgetDecisions stops tracking the decisions which won't be confirmed: the duplicates and the dropped
+// ones.
+func (worker *CloudflareWorker) forgetDecisions(decisions []*models.Decision) {
+	for _, decision := range decisions {
+		delete(worker.receivedDecisions, decision)
+	}
+}
+
+// oldestDecision returns how long the oldest of the tracked decisions has been waiting.
+func (worker *CloudflareWorker) oldestDecision(decisions []*models.Decision, now time.Time) time.Duration {
+	var oldest time.Duration
+	for _, decision := range decisions {
+		if tracked, ok := worker.receivedDecisions[decision]; ok && now.Sub(tracked.receivedAt) > oldest {
+			oldest = now.Sub(tracked.receivedAt)
+		}
+	}
+	return oldest
+}
+
+// startSpan starts a span of the worker. The calls to cloudflare made until it ends are its children.
+func (worker *CloudflareWorker) startSpan(name string, attributes ...attribute.KeyValue) func(err error) {
+	parent := worker.Ctx
+	ctx, span := tracer.Start(parent, name, trace.WithAttributes(append(attributes, attribute.String("account_id", worker.Account.ID))...))
+	worker.Ctx = ctx
+	return func(err error) {
+		endSpan(span, err)
+		worker.Ctx = parent
+	}
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// setUpTracing exports the spans to stdout or to the file of the config. The returned function flushes
+// the spans and must be called before exiting.
+func setUpTracing(conf TracingConfig) (func(context.Context) error, error) {
+	if !conf.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+	var output io.Writer = os.Stdout
+	var file *os.File
+	if conf.Output != "" && conf.Output != "stdout" {
+		var err error
+		file, err = os.OpenFile(conf.Output, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("while opening the tracing output: %w", err)
+		}
+		output = file
+	}
+	exporter, err := stdouttrace.New(stdouttrace.WithWriter(output))
+	if err != nil {
+		return nil, fmt.Errorf("while creating the span exporter: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String(name),
+			semconv.ServiceVersionKey.String(version.VersionStr()),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if file != nil {
+			file.Close()
+		}
+		return err
+	}, nil
+}
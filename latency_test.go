@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestCloudflareWorker_decisionPropagation(t *testing.T) {
+	worker := newTestWorker()
+	worker.Metrics = newBouncerMetrics(prometheus.NewRegistry())
+	decision := func(value string, scope string) *models.Decision {
+		decisionType, scenario := "captcha", "test"
+		return &models.Decision{Value: &value, Scope: &scope, Type: &decisionType, Scenario: &scenario}
+	}
+	worker.CollectLAPIStream(&models.DecisionsStreamResponse{New: []*models.Decision{
+		decision("1.2.3.4", "Ip"),
+		decision("1.2.3.4", "Ip"),
+		decision("FR", "Country"),
+		decision("user", "Username"),
+	}})
+	if len(worker.receivedDecisions) != 3 {
+		t.Fatalf("expected the decisions of supported scopes to be tracked, found %d", len(worker.receivedDecisions))
+	}
+	propagation := worker.Metrics.decisionPropagation
+
+	if err := worker.AddNewIPs(); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.CollectAndCount(propagation); got != 1 {
+		t.Errorf("expected the propagation of the IP once its list item is created, found %d series", got)
+	}
+	if err := worker.SendCountryBans(); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.CollectAndCount(propagation); got != 1 {
+		t.Errorf("expected the country to wait for the rules, found %d series", got)
+	}
+	if err := worker.UpdateRules(); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.CollectAndCount(propagation); got != 2 {
+		t.Errorf("expected the propagation of the country once the rules are updated, found %d series", got)
+	}
+	if len(worker.receivedDecisions) != 0 || len(worker.awaitingRules) != 0 {
+		t.Errorf("expected every decision to be confirmed or forgotten, found %v and %v", worker.receivedDecisions, worker.awaitingRules)
+	}
+}
+
+func Test_setUpTracing(t *testing.T) {
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+	output := filepath.Join(t.TempDir(), "spans.json")
+	shutdownTracing, err := setUpTracing(TracingConfig{Enabled: true, Output: output})
+	if err != nil {
+		t.Fatal(err)
+	}
+	worker := newTestWorker()
+	worker.Ctx = context.Background()
+	worker.API = newInstrumentedCloudflareAPI(worker.API, newBouncerMetrics(prometheus.NewRegistry()))
+	endSpan := worker.startSpan("sync")
+	if _, err := worker.API.ListIPLists(worker.Ctx); err != nil {
+		t.Fatal(err)
+	}
+	endSpan(nil)
+	if worker.Ctx != context.Background() {
+		t.Error("expected the context of the worker to be restored")
+	}
+	if err := shutdownTracing(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	spans, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{`"Name":"sync"`, `"Name":"cloudflare list_ip_lists"`} {
+		if !strings.Contains(string(spans), name) {
+			t.Errorf("expected span %s, found %s", name, spans)
+		}
+	}
+}
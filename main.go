@@ -2,25 +2,20 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
-	"os/signal"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
-	"syscall"
 	"time"
 
 	"github.com/coreos/go-systemd/daemon"
 	"github.com/crowdsecurity/crowdsec/pkg/models"
 	"github.com/crowdsecurity/cs-cloudflare-bouncer/version"
-	csbouncer "github.com/crowdsecurity/go-cs-bouncer"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"github.com/sirupsen/logrus/hooks/writer"
 	"gopkg.in/tomb.v2"
@@ -29,79 +24,46 @@ import (
 const DEFAULT_CONFIG_PATH string = "/etc/crowdsec/bouncers/crowdsec-cloudflare-bouncer.yaml"
 const (
 	name = "crowdsec-cloudflare-bouncer"
+	// stateUpdatesPerAccount is how many updates of a worker can wait for the state writer, the ticks
+	// don't wait for its disk writes.
+	stateUpdatesPerAccount = 10
 )
 
-var cachePath string = "/etc/crowdsec/bouncers/cloudflare-cache.json"
+var cachePath string = "/var/lib/crowdsec-cloudflare-bouncer/cloudflare-cache.json"
 
-func HandleSignals() {
-	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, syscall.SIGTERM)
-	exitChan := make(chan int)
-	go func() {
-		for {
-			s := <-signalChan
-			switch s {
-			case syscall.SIGTERM:
-				exitChan <- 0
-			}
-		}
-	}()
-	code := <-exitChan
-	log.Infof("Shutting down cloudflare-bouncer service")
-	os.Exit(code)
-}
+// legacyCachePath is where the cache was kept by previous releases.
+var legacyCachePath string = "/etc/crowdsec/bouncers/cloudflare-cache.json"
 
-func loadCachedStates(states *[]CloudflareState) error {
-	if _, err := os.Stat(cachePath); err != nil {
-		log.Debug("no cache found")
-		return nil
-	}
-	f, err := os.Open(cachePath)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	data, err := io.ReadAll(f)
-	if err != nil {
-		return err
-	}
-	err = json.Unmarshal(data, &states)
-	return err
-}
-
-func dumpStates(states *[]CloudflareState) error {
-	data, err := json.MarshalIndent(states, "", "	")
-	if err != nil {
-		return err
-	}
-	err = os.WriteFile(cachePath, data, 0666)
-	if err != nil {
-		return err
+// updateStates replaces the states with the received snapshots of the same account and action, and adds the others.
+// The states are kept sorted by account and action.
+func updateStates(states *[]CloudflareState, newStates map[string]*CloudflareState) {
+	indexByKey := make(map[string]int, len(*states))
+	for i := range *states {
+		indexByKey[stateKey(&(*states)[i])] = i
 	}
-	return nil
-}
-
-func deleteCacheIfExists() error {
-	var err error
-	if _, err = os.Stat(cachePath); err == nil {
-		err = os.Remove(cachePath)
+	for _, receivedState := range newStates {
+		if i, ok := indexByKey[stateKey(receivedState)]; ok {
+			(*states)[i] = *receivedState
+			continue
+		}
+		*states = append(*states, *receivedState)
+		indexByKey[stateKey(receivedState)] = len(*states) - 1
 	}
-	return err
+	sort.SliceStable(*states, func(i, j int) bool {
+		if (*states)[i].AccountID != (*states)[j].AccountID {
+			return (*states)[i].AccountID < (*states)[j].AccountID
+		}
+		return (*states)[i].Action < (*states)[j].Action
+	})
 }
 
-func updateStates(states *[]CloudflareState, newStates map[string]*CloudflareState) {
-	found := false
-	for i, state := range *states {
-		for _, receivedState := range newStates {
-			if receivedState.AccountID == state.AccountID && receivedState.Action == state.Action {
-				(*states)[i] = *receivedState
-				found = true
-			}
-		}
-	}
-	if !found {
-		for _, receivedState := range newStates {
-			*states = append(*states, *receivedState)
+// resetAPICallCounters resets the per token API call counters every second.
+func resetAPICallCounters(APICountByToken map[string]*uint32) {
+	apiCallCounterWindow := time.NewTicker(time.Second)
+	for {
+		<-apiCallCounterWindow.C
+		for token := range APICountByToken {
+			atomic.SwapUint32(APICountByToken[token], 0)
 		}
 	}
 }
@@ -112,15 +74,22 @@ func main() {
 	// By using channels, after every nth second feed the decisions to each cf routine.
 	// Each cf routine maintains it's own IP list and cache.
 
-	configTokens := flag.String("g", "", "comma separated tokens to generate config for")
-	configPath := flag.String("c", "", "path to config file")
-	onlySetup := flag.Bool("s", false, "only setup the ip lists and rules for cloudflare and exit")
-	delete := flag.Bool("d", false, "delete IP lists and firewall rules which are created by the bouncer")
-	ver := flag.Bool("v", false, "Display version information and exit")
-	flag.Parse()
+	opts, err := parseCommandLine(os.Args[1:], os.Stderr)
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	onlySetup := opts.command == setupCommand
+	delete := opts.command == cleanupCommand
+	plan := opts.plan
+	importPath := opts.importPath
 
-	if *ver {
-		version.Show()
+	if opts.command == versionCommand {
+		if err := writeVersion(os.Stdout, opts.output); err != nil {
+			log.Fatal(err)
+		}
 		return
 	}
 
@@ -132,33 +101,108 @@ func main() {
 		},
 	})
 
-	if *delete && *onlySetup {
-		log.Fatal("conflicting cli arguments, pass only one of '-d' or '-s' ")
-	}
-
-	if configPath == nil || *configPath == "" {
-		*configPath = DEFAULT_CONFIG_PATH
-	}
-
-	if configTokens != nil && *configTokens != "" {
-		cfg, err := ConfigTokens(*configTokens, *configPath)
+	switch opts.command {
+	case generateCommand:
+		cfg, err := ConfigTokens(opts.tokens, opts.configPath)
 		if err != nil {
 			log.Fatal(err)
 		}
 		fmt.Print(cfg)
 		return
+	case validateCommand:
+		if err := runValidateCommand(os.Stdout, opts.configPath, opts.output); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
-	conf, err := NewConfig(*configPath)
+
+	conf, err := NewConfig(opts.configPath)
 	if err != nil {
 		log.Fatal(err)
 	}
+	// the cache belongs to every account of the config, even when the command only handles some of them.
+	owner := newCacheOwner(conf.CloudflareConfig.Accounts)
+	if err := selectConfigAccounts(conf, opts.accounts); err != nil {
+		log.Fatal(err)
+	}
+	scope := cleanupScope{ZoneIDs: opts.zones, Actions: opts.actions}
+	if err := scope.selectAccounts(conf); err != nil {
+		log.Fatal(err)
+	}
+	// the accounts left without zone by the cleanup are removed from the cache, the others are updated in place.
+	cleanedIDs := make([]string, 0)
+	for _, account := range conf.CloudflareConfig.Accounts {
+		if len(scope.remainingAccount(account).ZoneConfigs) == 0 {
+			cleanedIDs = append(cleanedIDs, account.ID)
+		}
+	}
 
-	if *delete || *onlySetup {
+	switch opts.command {
+	case statusCommand:
+		statuses, err := queryStatus(conf.AdminSocket)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := writeStatus(os.Stdout, statuses, opts.output); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "pause", "resume":
+		if err := runPauseCommand(os.Stdout, conf.AdminSocket, opts.args, opts.command == "resume"); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "ban", "unban":
+		if err := runManualBanCommand(os.Stdout, conf.AdminSocket, opts.args, opts.command == "unban"); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if delete || onlySetup || importPath != "" {
 		log.SetOutput(os.Stdout)
 	}
+	if opts.exportPath != "" {
+		log.SetOutput(os.Stderr)
+	}
+
+	var importedBans []exportedBan
+	if importPath != "" {
+		f, err := os.Open(importPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		importedBans, err = readBans(f, opts.banFormat)
+		f.Close()
+		if err != nil {
+			log.Fatalf("while reading %s: %s", importPath, err)
+		}
+	}
 
-	var csLAPI *csbouncer.StreamBouncer
-	ctx := context.Background()
+	if opts.dryRun {
+		conf.DryRun = true
+	}
+	if conf.DryRun {
+		log.Warn("dry run mode, changes will be logged instead of being made at cloudflare and the cache won't be updated")
+	}
+
+	if importPath != "" && !conf.DryRun && adminRunning(conf.AdminSocket) {
+		// the running bouncer owns the cache, its workers enforce the bans.
+		results, err := postAdminRequest(conf.AdminSocket, "/import", importRequest{Bans: importedBans, Duration: opts.banDuration.String()})
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := writeAdminResults(os.Stdout, results, fmt.Sprintf("imported bans of %s", importPath)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// shutdownCtx is cancelled when the bouncer is asked to stop, apiCtx once the workers had
+	// shutdown_timeout to finish their current batch and flush their pending decisions.
+	shutdownCtx, shutdown := context.WithCancel(context.Background())
+	apiCtx, cancelAPICalls := context.WithCancel(context.Background())
+	defer cancelAPICalls()
 
 	zoneLocks := make([]ZoneLock, 0)
 	for _, account := range conf.CloudflareConfig.Accounts {
@@ -177,28 +221,140 @@ func main() {
 		Name: "cloudflare_api_calls",
 		Help: "The total number of API calls to cloudflare made by CrowdSec bouncer",
 	})
+	var DryRunCount *prometheus.CounterVec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cloudflare_dry_run_changes",
+		Help: "The total number of changes to cloudflare skipped because of dry run mode",
+	}, []string{"operation", "resource"})
+	var WorkerRestarts *prometheus.CounterVec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cloudflare_worker_restarts",
+		Help: "The total number of restarts of the worker of an account after it failed",
+	}, []string{"account_id"})
+	metrics := newBouncerMetrics(prometheus.DefaultRegisterer)
+	registerBuildInfo(prometheus.DefaultRegisterer)
 
 	// lapiStreams are used to forward the decisions to all the workers
 	lapiStreams := make([]chan *models.DecisionsStreamResponse, 0)
-	stateStream := make(chan map[string]*CloudflareState)
-	workerStates := make([]CloudflareState, 0)
+	stateStream := make(chan *stateUpdate, stateUpdatesPerAccount*len(conf.CloudflareConfig.Accounts))
 	APICountByToken := make(map[string]*uint32)
 
-	err = loadCachedStates(&workerStates)
+	if conf.CachePath != "" {
+		cachePath = conf.CachePath
+	}
+	// plan, export and dry run only read the cache, they leave it as is.
+	readOnlyCache := plan || opts.exportPath != "" || conf.DryRun
+	if !readOnlyCache {
+		// the cache is written by one bouncer at a time.
+		unlock, err := lockCache()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer unlock()
+	}
+	if conf.CachePath == "" && readOnlyCache {
+		readLegacyCacheInPlace()
+	} else if conf.CachePath == "" {
+		if err := migrateLegacyCache(); err != nil {
+			log.Fatalf("while moving legacy cache: %s", err)
+		}
+	}
+	var store stateStore
+	if readOnlyCache {
+		store, err = openStateStoreReadOnly(conf.StateStore)
+	} else {
+		store, err = openStateStore(conf.StateStore)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+	if err := adoptStateStore(store, owner); err != nil {
+		log.Fatal(err)
+	}
+
+	if opts.exportPath != "" {
+		states, err := store.LoadAll()
+		if err != nil {
+			log.Fatal(err)
+		}
+		out := os.Stdout
+		if opts.exportPath != "-" {
+			if out, err = os.OpenFile(opts.exportPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+				log.Fatal(err)
+			}
+			defer out.Close()
+		}
+		if err := writeBans(out, exportBans(states, conf.CloudflareConfig.Accounts, time.Now()), opts.banFormat); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if plan {
+		log.SetOutput(os.Stderr)
+		for _, account := range conf.CloudflareConfig.Accounts {
+			if _, ok := APICountByToken[account.Token]; !ok {
+				var tokenCallCount uint32 = 0
+				APICountByToken[account.Token] = &tokenCallCount
+			}
+		}
+		go resetAPICallCounters(APICountByToken)
+		mode := planModeSetup
+		if delete {
+			mode = planModeCleanup
+		}
+		cachedStates, err := store.LoadAll()
+		if err != nil {
+			log.Fatal(err)
+		}
+		changes, err := runPlan(conf, cachedStates, mode, scope, APICountByToken)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := writePlan(os.Stdout, changes, opts.output); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	go handleSignals(shutdown, conf.Daemon)
+
+	shutdownTracing, err := setUpTracing(conf.Tracing)
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			log.Errorf("while flushing the spans: %s", err)
+		}
+	}()
+
+	audit := newAuditLog(conf.AuditLog)
+	defer audit.Close()
 
+	webhooks, err := newWebhookNotifier(conf.Webhooks)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// the events of a run are sent before exiting.
+	flushWebhooks := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		webhooks.Close(ctx)
+	}
+	defer flushWebhooks()
+
+	runsWorkers := !onlySetup && !delete && importPath == ""
+	healthRegistry := newHealthRegistry(healthStaleAfter(conf), runsWorkers)
+	admin := newAdminAPI(healthRegistry)
+	prometheus.MustRegister(healthCollector{registry: healthRegistry})
 	for _, account := range conf.CloudflareConfig.Accounts {
 		lapiStream := make(chan *models.DecisionsStreamResponse)
 		lapiStreams = append(lapiStreams, lapiStream)
-		states := make(map[string]*CloudflareState)
-		for _, s := range workerStates {
-			//TODO  search can be avoided by having a map by account id
-			tmp := s
-			if s.AccountID == account.ID {
-				states[s.Action] = &tmp
-			}
+		states, err := store.LoadAccount(account.ID)
+		if err != nil {
+			log.Fatal(err)
 		}
 		var tokenCallCount uint32 = 0
 		if _, ok := APICountByToken[account.Token]; !ok {
@@ -208,7 +364,8 @@ func main() {
 		wg.Add(1)
 		worker := CloudflareWorker{
 			Account:         account,
-			Ctx:             ctx,
+			Ctx:             apiCtx,
+			Stop:            shutdownCtx.Done(),
 			ZoneLocks:       zoneLocks,
 			LAPIStream:      lapiStream,
 			UpdateFrequency: conf.CloudflareConfig.UpdateFrequency,
@@ -216,17 +373,32 @@ func main() {
 			UpdatedState:    stateStream,
 			CFStateByAction: states,
 			Count:           Count,
+			DryRun:          conf.DryRun,
+			DryRunCount:     DryRunCount,
+			Metrics:         metrics,
+			Audit:           audit,
+			Webhooks:        webhooks,
+			Health:          healthRegistry.register(account.ID, APICountByToken[account.Token]),
+			AdminRequests:   admin.register(account),
 			tokenCallCount:  APICountByToken[account.Token],
 		}
-		if *onlySetup {
+		if onlySetup {
 			workerTomb.Go(func() error {
 				var err error = nil
 				defer func() {
+					if err != nil {
+						worker.Health.setDead(err)
+					}
+					worker.notifyRun(webhookSetup, err)
 					workerTomb.Kill(err)
 					stateStream <- nil
 				}()
 
-				worker.CFStateByAction = nil
+				if scope.isEmpty() {
+					worker.CFStateByAction = nil
+				} else {
+					worker.restrictSetUp(scope)
+				}
 				err = worker.Init()
 				if err != nil {
 					return err
@@ -235,44 +407,81 @@ func main() {
 				return err
 
 			})
-		} else if *delete {
+		} else if importPath != "" {
 			workerTomb.Go(func() error {
 				var err error = nil
 				defer func() {
+					if err != nil {
+						worker.Health.setDead(err)
+					}
 					workerTomb.Kill(err)
 					stateStream <- nil
 				}()
 				err = worker.Init()
 				if err != nil {
-					return nil
+					return err
+				}
+				err = worker.SetUpCloudflareIfNewState()
+				if err != nil {
+					return err
+				}
+				err = worker.importBans(&importRequest{Bans: importedBans, Duration: opts.banDuration.String()})
+				return err
+			})
+		} else if delete {
+			workerTomb.Go(func() error {
+				var err error = nil
+				defer func() {
+					if err != nil {
+						worker.Health.setDead(err)
+					}
+					worker.notifyRun(webhookCleanup, err)
+					workerTomb.Kill(err)
+					stateStream <- nil
+				}()
+				err = worker.InitCleanup()
+				if err != nil {
+					return err
 				}
-				err = worker.deleteExistingIPList()
+				err = worker.cleanUpScope(scope)
 				return err
 
 			})
 		} else {
+			registerWorkerGauges(account.ID, worker.Health)
+			supervisor := newWorkerSupervisor(&worker, WorkerRestarts.WithLabelValues(account.ID))
 			workerTomb.Go(func() error {
-				err := worker.Run()
-				return err
+				supervisor.run()
+				return nil
 			})
 		}
 	}
 
-	if !*onlySetup && !*delete {
-		csLAPI = &csbouncer.StreamBouncer{
-			APIKey:         conf.CrowdSecLAPIKey,
-			APIUrl:         conf.CrowdSecLAPIUrl,
-			TickerInterval: conf.CrowdsecUpdateFrequencyYAML,
-			UserAgent:      fmt.Sprintf("%s/%s", name, version.VersionStr()),
-			Scopes:         []string{"ip", "range", "as", "country"},
+	if runsWorkers {
+		sourceConfs, err := lapiSourceConfigs(conf)
+		if err != nil {
+			log.Fatal(err)
 		}
-		if err := csLAPI.Init(); err != nil {
-			log.Fatalf(err.Error())
+		userAgent := fmt.Sprintf("%s/%s", name, version.VersionStr())
+		updates := make(chan lapiUpdate)
+		sourceHealth := make(map[string]*lapiSourceHealth)
+		for _, sourceConf := range sourceConfs {
+			sourceHealth[sourceConf.Name] = healthRegistry.registerSource(sourceConf.Name, sourceConf.URL)
+			source, err := newLAPISource(sourceConf, userAgent, sourceHealth[sourceConf.Name])
+			if err != nil {
+				log.Fatal(err)
+			}
+			go source.run(shutdownCtx, updates)
 		}
+		merger := newDecisionMerger(sourceHealth)
+		go func() {
+			if err := serveAdmin(conf.AdminSocket, admin); err != nil {
+				log.Errorf("admin API on %s stopped: %s", conf.AdminSocket, err)
+			}
+		}()
 		dispatchTomb.Go(func() error {
-			go csLAPI.Run()
 			for {
-				decisions := <-csLAPI.Stream
+				decisions := merger.merge(<-updates)
 				// broadcast decision to each worker
 				for _, lapiStream := range lapiStreams {
 					lapiStream <- decisions
@@ -284,16 +493,25 @@ func main() {
 	stateTomb.Go(func() error {
 		aliveWorkerCount := len(conf.CloudflareConfig.Accounts)
 		for {
-			newStates := <-stateStream
-			if newStates == nil {
+			update, ok := <-stateStream
+			if !ok {
+				// the workers stopped, their last states are written.
+				return nil
+			}
+			if update == nil {
+				update = &stateUpdate{}
 				aliveWorkerCount--
 				if aliveWorkerCount == 0 {
 					err := stateTomb.Killf("all workers are dead")
 					return err
 				}
 			}
-			updateStates(&workerStates, newStates)
-			err := dumpStates(&workerStates)
+			if conf.DryRun {
+				// the state contains changes which were never made at cloudflare.
+				log.Debug("dry run, not updating cache")
+				continue
+			}
+			err := store.Update(update)
 			log.Debug("updated cache")
 			if err != nil {
 				log.Error(err)
@@ -303,49 +521,79 @@ func main() {
 	})
 
 	serverTomb.Go(func() error {
-		http.Handle("/metrics", promhttp.Handler())
-		err := http.ListenAndServe(":2112", nil)
+		err := serveHTTP(conf.HTTP, healthRegistry)
 		return err
 	})
 
-	if conf.Daemon {
+	if conf.Daemon && runsWorkers {
+		// READY=1 is sent once the workers are set up.
+		notifier, err := newSystemdNotifier(healthRegistry, conf.CloudflareConfig.UpdateFrequency)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go notifier.run(shutdownCtx.Done())
+	} else if conf.Daemon {
 		sent, err := daemon.SdNotify(false, "READY=1")
 		if !sent && err != nil {
 			log.Fatalf("failed to notify: %v", err)
 		}
-		go HandleSignals()
 	}
 
-	apiCallCounterWindow := time.NewTicker(time.Second)
-	go func() {
-		for {
-			<-apiCallCounterWindow.C
-			for token := range APICountByToken {
-				atomic.SwapUint32(APICountByToken[token], 0)
-			}
-		}
-	}()
+	go resetAPICallCounters(APICountByToken)
 
+	stopping := shutdownCtx.Done()
+	var shutdownDeadline <-chan time.Time
 	for {
 		select {
+		case <-stopping:
+			// the workers finish their current batch and flush their pending decisions, the API
+			// calls still running at the deadline are cancelled.
+			time.AfterFunc(conf.ShutdownTimeout, func() {
+				log.Warningf("workers didn't stop within %s, cancelling their calls to cloudflare", conf.ShutdownTimeout)
+				cancelAPICalls()
+			})
+			shutdownDeadline = time.After(conf.ShutdownTimeout + 10*time.Second)
+			stopping = nil
+		case <-shutdownDeadline:
+			log.Fatal("workers didn't stop after their calls to cloudflare were cancelled")
 		case <-workerTomb.Dying():
 			dispatchTomb.Kill(nil)
 			err := workerTomb.Err()
 			if err != nil {
+				flushWebhooks()
 				log.Fatal(err)
 			}
-			if *onlySetup || *delete {
+			if onlySetup || delete || importPath != "" {
 				stateTomb.Wait()
-				if *delete {
-					err = deleteCacheIfExists()
+				if delete && !conf.DryRun && len(cleanedIDs) < len(owner.AccountIDs) {
+					if err := forgetAccounts(store, owner, cleanedIDs); err != nil {
+						log.Errorf("while updating cache got %s", err.Error())
+					}
+					if len(cleanedIDs) > 0 {
+						log.Infof("deleted cf config of accounts %s", strings.Join(cleanedIDs, ", "))
+					}
+					if !scope.isEmpty() {
+						log.Info("deleted cf config of the selected zones and actions")
+					}
+				} else if delete && !conf.DryRun {
+					err = store.Delete()
 					if err != nil {
 						log.Errorf("while deleting cache got %s", err.Error())
 					}
 					log.Info("deleted all cf config")
 
+				} else if importPath != "" {
+					log.Infof("imported bans of %s", importPath)
 				} else {
 					log.Info("setup complete")
 				}
+			} else {
+				// every worker published its final state.
+				close(stateStream)
+				if err := stateTomb.Wait(); err != nil {
+					log.Error(err)
+				}
+				log.Info("shutdown complete")
 			}
 			stateTomb.Kill(nil)
 			return
@@ -25,7 +25,7 @@ func Test_loadCachedStates(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			cachePath = tt.args.dataPath
 			states := make([]CloudflareState, 0)
-			if err := loadCachedStates(&states); err != nil {
+			if _, err := loadCachedStates(&states); err != nil {
 				t.Error(err)
 			}
 			ti, _ := time.Parse(time.RFC3339, "2021-06-17T12:40:19Z")
@@ -107,6 +107,22 @@ func Test_updateStates(t *testing.T) {
 				{Action: "block", AccountID: "2"},
 			},
 		},
+		{
+			name: "unknown action next to a known one",
+			args: args{
+				states: &[]CloudflareState{
+					{Action: "block", AccountID: "1"},
+				},
+				newStates: map[string]*CloudflareState{
+					"block":     {Action: "block", AccountID: "1", CurrExpr: "ip.src.asnum in 1234"},
+					"challenge": {Action: "challenge", AccountID: "1"},
+				},
+			},
+			want: &[]CloudflareState{
+				{Action: "block", AccountID: "1", CurrExpr: "ip.src.asnum in 1234"},
+				{Action: "challenge", AccountID: "1"},
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+)
+
+const (
+	defaultManualBanDuration = 4 * time.Hour
+	// manualBanOrigin is the origin of the decisions made through the admin API, it prefixes the
+	// comment of their IP list items so they can be told apart from the CrowdSec ones.
+	manualBanOrigin = "manual"
+)
+
+// manualBan is a ban made through the admin API. It is kept in the state of its action until it expires.
+type manualBan struct {
+	Scope        string
+	DecisionType string
+	Comment      string
+	Expiration   time.Time
+	// LAPIBanned is whether a LAPI decision bans the value too, the value stays enforced when the manual
+	// ban is lifted.
+	LAPIBanned bool `json:",omitempty"`
+}
+
+// manualBanRequest is a ban or unban request of the admin API.
+type manualBanRequest struct {
+	Value string `json:"value"`
+	Scope string `json:"scope"`
+	// Action is the cloudflare action, the default action of the account when empty.
+	Action   string   `json:"action,omitempty"`
+	Duration string   `json:"duration,omitempty"`
+	Comment  string   `json:"comment,omitempty"`
+	Accounts []string `json:"accounts,omitempty"`
+	Unban    bool     `json:"unban,omitempty"`
+}
+
+// validate normalizes the request and checks that it can be applied.
+func (req *manualBanRequest) validate() error {
+	req.Value = strings.TrimSpace(req.Value)
+	if req.Value == "" {
+		return fmt.Errorf("missing value")
+	}
+	if req.Scope == "" {
+		req.Scope = ipScope(req.Value)
+	}
+	req.Scope = strings.ToLower(req.Scope)
+	switch req.Scope {
+	case "ip", "range", "country", "as":
+	default:
+		return fmt.Errorf("scope '%s' is invalid, expecting 'ip', 'range', 'country' or 'as'", req.Scope)
+	}
+	if req.Action != "" {
+		if _, ok := decisionTypeByCloudflareAction[req.Action]; !ok {
+			return fmt.Errorf("action '%s' is invalid, expecting 'block', 'challenge' or 'js_challenge'", req.Action)
+		}
+	}
+	if req.Unban {
+		return nil
+	}
+	if req.Duration == "" {
+		req.Duration = defaultManualBanDuration.String()
+	}
+	duration, err := time.ParseDuration(req.Duration)
+	if err != nil {
+		return fmt.Errorf("duration '%s' is invalid: %w", req.Duration, err)
+	}
+	if duration <= 0 {
+		return fmt.Errorf("duration must be positive")
+	}
+	return nil
+}
+
+// decisionType returns the type of the decision of the request. Decisions of an unknown type are
+// enforced with the default action of the account.
+func (req *manualBanRequest) decisionType() string {
+	if req.Action == "" {
+		return manualBanOrigin
+	}
+	return decisionTypeByCloudflareAction[req.Action]
+}
+
+func manualBanScenario(comment string) string {
+	if comment == "" {
+		return manualBanOrigin
+	}
+	return fmt.Sprintf("%s: %s", manualBanOrigin, comment)
+}
+
+func newManualDecision(value string, ban manualBan) *models.Decision {
+	origin := manualBanOrigin
+	scenario := manualBanScenario(ban.Comment)
+	duration := time.Until(ban.Expiration).Round(time.Second).String()
+	return &models.Decision{Value: &value, Scope: &ban.Scope, Type: &ban.DecisionType, Scenario: &scenario, Origin: &origin, Duration: &duration}
+}
+
+// manualBanState returns the state keeping the manual bans of the decision type.
+func (worker *CloudflareWorker) manualBanState(decisionType string) (*CloudflareState, error) {
+	action, ok := worker.accountActionFor(CloudflareActionByDecisionType[decisionType])
+	if !ok {
+		return nil, fmt.Errorf("account %s doesn't enforce decisions of type %s", worker.Account.ID, decisionType)
+	}
+	state, ok := worker.CFStateByAction[action]
+	if !ok {
+		return nil, fmt.Errorf("account %s has no state for action %s", worker.Account.ID, action)
+	}
+	return state, nil
+}
+
+// findManualBan returns the active manual ban of the value and the state keeping it.
+func (worker *CloudflareWorker) findManualBan(value string) (manualBan, *CloudflareState, bool) {
+	for _, state := range worker.CFStateByAction {
+		if ban, ok := state.ManualBans[value]; ok {
+			return ban, state, true
+		}
+	}
+	return manualBan{}, nil, false
+}
+
+// isEnforced returns whether the value is banned at cloudflare or about to be, in any action.
+func (worker *CloudflareWorker) isEnforced(value string) bool {
+	for _, container := range [][]*models.Decision{worker.NewIPDecisions, worker.NewCountryDecisions, worker.NewASDecisions} {
+		for _, decision := range container {
+			if normalizeDecisionValue(*decision.Value) == value {
+				return true
+			}
+		}
+	}
+	for _, state := range worker.CFStateByAction {
+		if _, ok := state.IPListState.ItemByIP[value]; ok {
+			return true
+		}
+		if _, ok := state.CountrySet[value]; ok {
+			return true
+		}
+		if _, ok := state.AutonomousSystemSet[value]; ok {
+			return true
+		}
+		for _, ruleIDByIP := range state.AccessRuleIDsByZoneID {
+			if _, ok := ruleIDByIP[value]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// liftManualBan queues the expired decision of the manual ban, unless a LAPI decision still bans the value.
+func (worker *CloudflareWorker) liftManualBan(value string, ban manualBan) {
+	if ban.LAPIBanned {
+		worker.Logger.Infof("keeping the ban of %s from LAPI", value)
+		return
+	}
+	worker.insertDecision(newManualDecision(value, ban), true)
+}
+
+// applyManualBan enforces the ban or unban at once, without waiting for the next update.
+func (worker *CloudflareWorker) applyManualBan(req *manualBanRequest) error {
+	if err := worker.queueManualBan(req); err != nil {
+		return err
+	}
+	err := worker.flushDecisions()
+	worker.publishState()
+	worker.publishStatus()
+	return err
+}
+
+// queueManualBan records the ban or unban and queues its decision for the next flush.
+func (worker *CloudflareWorker) queueManualBan(req *manualBanRequest) error {
+	value := normalizeDecisionValue(req.Value)
+	if req.Unban {
+		ban, state, ok := worker.findManualBan(value)
+		if ok {
+			delete(state.ManualBans, value)
+		} else {
+			ban = manualBan{Scope: req.Scope, DecisionType: req.decisionType()}
+		}
+		worker.Logger.Infof("manually unbanning %s", value)
+		worker.liftManualBan(value, ban)
+		return nil
+	}
+	duration, _ := time.ParseDuration(req.Duration)
+	ban := manualBan{Scope: req.Scope, DecisionType: req.decisionType(), Comment: req.Comment, Expiration: time.Now().Add(duration)}
+	state, err := worker.manualBanState(ban.DecisionType)
+	if err != nil {
+		return err
+	}
+	if previousBan, previous, ok := worker.findManualBan(value); ok {
+		ban.LAPIBanned = previousBan.LAPIBanned
+		delete(previous.ManualBans, value)
+	} else {
+		// without a manual ban, the value can only be enforced because of LAPI.
+		ban.LAPIBanned = worker.isEnforced(value)
+	}
+	if state.ManualBans == nil {
+		state.ManualBans = make(map[string]manualBan)
+	}
+	state.ManualBans[value] = ban
+	worker.insertDecision(newManualDecision(value, ban), false)
+	worker.Logger.Infof("manually banning %s until %s", value, ban.Expiration.Format(time.RFC3339))
+	return nil
+}
+
+// expireManualBans turns the manual bans which expired into expired decisions.
+func (worker *CloudflareWorker) expireManualBans(now time.Time) {
+	for _, state := range worker.CFStateByAction {
+		for value, ban := range state.ManualBans {
+			if ban.Expiration.After(now) {
+				continue
+			}
+			delete(state.ManualBans, value)
+			worker.Logger.Infof("manual ban of %s expired", value)
+			worker.liftManualBan(value, ban)
+		}
+	}
+}
+
+// recordLAPIBans marks the manual bans of the values which LAPI bans too, so that they stay enforced
+// when the manual bans are lifted.
+func (worker *CloudflareWorker) recordLAPIBans(decisions []*models.Decision) {
+	for _, decision := range decisions {
+		value := normalizeDecisionValue(*decision.Value)
+		if ban, state, ok := worker.findManualBan(value); ok {
+			ban.LAPIBanned = true
+			state.ManualBans[value] = ban
+		}
+	}
+}
+
+// keepManualBans drops the expired decisions of LAPI on values which are manually banned, the manual ban
+// is lifted when it expires.
+func (worker *CloudflareWorker) keepManualBans(decisions []*models.Decision) []*models.Decision {
+	kept := make([]*models.Decision, 0, len(decisions))
+	for _, decision := range decisions {
+		value := normalizeDecisionValue(*decision.Value)
+		if ban, state, ok := worker.findManualBan(value); ok {
+			worker.Logger.Debugf("keeping manual ban of %s", *decision.Value)
+			ban.LAPIBanned = false
+			state.ManualBans[value] = ban
+			worker.Metrics.recordDropped(worker.Account.ID, []*models.Decision{decision}, "manual_ban")
+			continue
+		}
+		kept = append(kept, decision)
+	}
+	return kept
+}
+
+// flushDecisions enforces the pending decisions at cloudflare.
+func (worker *CloudflareWorker) flushDecisions() error {
+	for _, processor := range []func() error{worker.DeleteIPs, worker.AddNewIPs, worker.DeleteCountryBans, worker.SendCountryBans, worker.DeleteASBans, worker.SendASBans, worker.UpdateRules} {
+		if err := processor(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runManualBanCommand parses the arguments of the ban or unban command and sends it to the running bouncer.
+func runManualBanCommand(w io.Writer, socketPath string, args []string, unban bool) error {
+	command := "ban"
+	if unban {
+		command = "unban"
+	}
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	scope := flags.String("scope", "", "scope of the value, either 'ip', 'range', 'country' or 'as', guessed for IPs and ranges")
+	action := flags.String("action", "", "cloudflare action, either 'block', 'challenge' or 'js_challenge', the default action of the account when empty")
+	accounts := flags.String("accounts", "", "comma separated IDs of the accounts, every account when empty")
+	duration := flags.Duration("duration", defaultManualBanDuration, "duration of the ban")
+	comment := flags.String("comment", "", "comment of the ban, shown in the IP list items")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s [-c config] %s [options] <value>\n", name, command)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("%s expects exactly one value", command)
+	}
+	req := manualBanRequest{Value: flags.Arg(0), Scope: *scope, Action: *action, Comment: *comment, Unban: unban}
+	if !unban {
+		req.Duration = duration.String()
+	}
+	if *accounts != "" {
+		req.Accounts = strings.Split(*accounts, ",")
+	}
+	if err := req.validate(); err != nil {
+		return err
+	}
+	results, err := requestManualBan(socketPath, req)
+	if err != nil {
+		return err
+	}
+	return writeAdminResults(w, results, fmt.Sprintf("%sned %s", command, req.Value))
+}
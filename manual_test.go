@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+)
+
+// commentRecordingAPI records the comments of the created IP list items, which the mock drops.
+type commentRecordingAPI struct {
+	*mockCloudflareAPI
+	commentByIP map[string]string
+}
+
+func (cfAPI *commentRecordingAPI) CreateIPListItems(ctx context.Context, id string, items []cloudflare.IPListItemCreateRequest) ([]cloudflare.IPListItem, error) {
+	for _, item := range items {
+		cfAPI.commentByIP[item.IP] = item.Comment
+	}
+	return cfAPI.mockCloudflareAPI.CreateIPListItems(ctx, id, items)
+}
+
+func Test_manualBanRequest_validate(t *testing.T) {
+	tests := []struct {
+		name      string
+		req       manualBanRequest
+		wantScope string
+		wantErr   bool
+	}{
+		{name: "ip", req: manualBanRequest{Value: "1.2.3.4"}, wantScope: "ip"},
+		{name: "range", req: manualBanRequest{Value: "1.2.3.0/24"}, wantScope: "range"},
+		{name: "country", req: manualBanRequest{Value: "FR", Scope: "Country"}, wantScope: "country"},
+		{name: "missing value", req: manualBanRequest{}, wantErr: true},
+		{name: "invalid scope", req: manualBanRequest{Value: "x", Scope: "user"}, wantErr: true},
+		{name: "invalid action", req: manualBanRequest{Value: "1.2.3.4", Action: "managed"}, wantErr: true},
+		{name: "invalid duration", req: manualBanRequest{Value: "1.2.3.4", Duration: "-1h"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.req.validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validate() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if err == nil && tt.req.Scope != tt.wantScope {
+				t.Errorf("want scope=%s, found=%s", tt.wantScope, tt.req.Scope)
+			}
+		})
+	}
+}
+
+func TestCloudflareWorker_applyManualBan(t *testing.T) {
+	worker := newTestWorker()
+	api := &commentRecordingAPI{mockCloudflareAPI: worker.API.(*mockCloudflareAPI), commentByIP: make(map[string]string)}
+	worker.API = api
+	state := worker.CFStateByAction["challenge"]
+
+	req := &manualBanRequest{Value: "1.2.3.4", Comment: "incident 42"}
+	if err := req.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := worker.applyManualBan(req); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state.IPListState.ItemByIP["1.2.3.4"]; !ok {
+		t.Fatalf("expected 1.2.3.4 to be banned at once, found %+v", state.IPListState.ItemByIP)
+	}
+	if comment := api.commentByIP["1.2.3.4"]; comment != "manual: incident 42" {
+		t.Errorf("expected the manual comment, found %q", comment)
+	}
+	if ban, ok := state.ManualBans["1.2.3.4"]; !ok || time.Until(ban.Expiration) < 3*time.Hour {
+		t.Fatalf("expected the manual ban to be kept in the state, found %+v", state.ManualBans)
+	}
+
+	country := &manualBanRequest{Value: "FR", Scope: "country", Duration: "1m"}
+	if err := worker.applyManualBan(country); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state.CountrySet["FR"]; !ok || !strings.Contains(state.CurrExpr, `"FR"`) {
+		t.Fatalf("expected FR to be banned at once, found %+v %s", state.CountrySet, state.CurrExpr)
+	}
+
+	// LAPI deleting a decision on a manually banned IP doesn't lift the manual ban.
+	ip, ban, scope := "1.2.3.4", "ban", "ip"
+	worker.CollectLAPIStream(&models.DecisionsStreamResponse{Deleted: []*models.Decision{{Value: &ip, Type: &ban, Scope: &scope}}})
+	if len(worker.ExpiredIPDecisions) != 0 {
+		t.Errorf("expected the expired decision of LAPI to be dropped, found %d", len(worker.ExpiredIPDecisions))
+	}
+
+	worker.expireManualBans(time.Now().Add(2 * time.Minute))
+	if err := worker.flushDecisions(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state.CountrySet["FR"]; ok {
+		t.Error("expected the manual ban of FR to expire")
+	}
+	if _, ok := state.IPListState.ItemByIP["1.2.3.4"]; !ok {
+		t.Error("expected the manual ban of 1.2.3.4 not to expire yet")
+	}
+
+	unban := &manualBanRequest{Value: "1.2.3.4", Unban: true}
+	if err := worker.applyManualBan(unban); err != nil {
+		t.Fatal(err)
+	}
+	if len(state.IPListState.ItemByIP) != 0 || len(state.ManualBans) != 0 {
+		t.Errorf("expected 1.2.3.4 to be unbanned, found %+v %+v", state.IPListState.ItemByIP, state.ManualBans)
+	}
+}
+
+func TestCloudflareState_manualBansPersisted(t *testing.T) {
+	state := newTestState("account1", "block", 1)
+	state.ManualBans = map[string]manualBan{"1.2.3.4": {Scope: "ip", DecisionType: "ban", Comment: "incident", Expiration: time.Now().Add(time.Hour).UTC()}}
+	data, err := json.Marshal(state.snapshot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := CloudflareState{}
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.ManualBans["1.2.3.4"].Expiration.Equal(state.ManualBans["1.2.3.4"].Expiration) || loaded.ManualBans["1.2.3.4"].Comment != "incident" {
+		t.Errorf("expected the manual bans to be persisted, found %+v", loaded.ManualBans)
+	}
+}
+
+func TestAdminAPI_handleBan(t *testing.T) {
+	api := newAdminAPI(newHealthRegistry(time.Minute, true))
+	api.timeout = time.Second
+	requests1 := api.register(AccountConfig{ID: "account1"})
+	api.register(AccountConfig{ID: "account2"})
+	go func() {
+		for req := range requests1 {
+			req.done <- nil
+		}
+	}()
+	server := httptest.NewServer(newAdminHandler(api))
+	defer server.Close()
+
+	post := func(path string, body string) (int, []adminResult) {
+		resp, err := http.Post(server.URL+path, "application/json", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		results := make([]adminResult, 0)
+		json.NewDecoder(resp.Body).Decode(&results)
+		return resp.StatusCode, results
+	}
+
+	if code, results := post("/ban", `{"value": "1.2.3.4", "accounts": ["account1"]}`); code != http.StatusOK || len(results) != 1 || results[0].Error != "" {
+		t.Errorf("expected the ban to succeed, found %d %+v", code, results)
+	}
+	if code, _ := post("/ban", `{"value": "1.2.3.4", "accounts": ["account3"]}`); code != http.StatusBadRequest {
+		t.Errorf("expected unknown account to be rejected, found %d", code)
+	}
+	if code, _ := post("/unban", `{"value": ""}`); code != http.StatusBadRequest {
+		t.Errorf("expected missing value to be rejected, found %d", code)
+	}
+	// account2's worker never reads its requests.
+	code, results := post("/unban", `{"value": "1.2.3.4"}`)
+	if code != http.StatusInternalServerError || len(results) != 2 || results[0].Error != "" || results[1].Error == "" {
+		t.Errorf("expected the unban to fail on account2 only, found %d %+v", code, results)
+	}
+	close(requests1)
+}
+
+func TestCloudflareWorker_manualBanOutlivedByLAPI(t *testing.T) {
+	worker := newTestWorker()
+	state := worker.CFStateByAction["challenge"]
+	lapiBan := func(value string) *models.DecisionsStreamResponse {
+		ban, scope, duration, scenario := "ban", "ip", "4h", "crowdsecurity/demo"
+		return &models.DecisionsStreamResponse{New: []*models.Decision{{Value: &value, Type: &ban, Scope: &scope, Duration: &duration, Scenario: &scenario}}}
+	}
+
+	// LAPI bans 1.2.3.4 before the manual ban.
+	worker.CollectLAPIStream(lapiBan("1.2.3.4"))
+	if err := worker.flushDecisions(); err != nil {
+		t.Fatal(err)
+	}
+	if err := worker.applyManualBan(&manualBanRequest{Value: "1.2.3.4", Scope: "ip", Duration: "1h"}); err != nil {
+		t.Fatal(err)
+	}
+	// LAPI bans 1.2.3.5 during its manual ban.
+	if err := worker.applyManualBan(&manualBanRequest{Value: "1.2.3.5", Scope: "ip", Duration: "1h"}); err != nil {
+		t.Fatal(err)
+	}
+	worker.CollectLAPIStream(lapiBan("1.2.3.5"))
+	// 1.2.3.6 is only banned manually.
+	if err := worker.applyManualBan(&manualBanRequest{Value: "1.2.3.6", Scope: "ip", Duration: "1h"}); err != nil {
+		t.Fatal(err)
+	}
+
+	worker.expireManualBans(time.Now().Add(2 * time.Hour))
+	if err := worker.flushDecisions(); err != nil {
+		t.Fatal(err)
+	}
+	if len(state.ManualBans) != 0 {
+		t.Errorf("expected the manual bans to expire, found %+v", state.ManualBans)
+	}
+	for _, ip := range []string{"1.2.3.4", "1.2.3.5"} {
+		if _, ok := state.IPListState.ItemByIP[ip]; !ok {
+			t.Errorf("expected the LAPI ban of %s to outlive the manual one", ip)
+		}
+	}
+	if _, ok := state.IPListState.ItemByIP["1.2.3.6"]; ok {
+		t.Error("expected the manual ban of 1.2.3.6 to be lifted")
+	}
+}
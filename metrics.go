@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/crowdsecurity/cs-cloudflare-bouncer/version"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// bouncerMetrics are the metrics updated by the workers, the methods are safe to call on a nil
+// bouncerMetrics.
+type bouncerMetrics struct {
+	decisionsReceived     *prometheus.CounterVec
+	decisionsApplied      *prometheus.CounterVec
+	decisionsDeduplicated *prometheus.CounterVec
+	decisionsDefaulted    *prometheus.CounterVec
+	decisionsDropped      *prometheus.CounterVec
+	tickDuration          *prometheus.HistogramVec
+	decisionPropagation   *prometheus.HistogramVec
+	apiDuration           *prometheus.HistogramVec
+	apiErrors             *prometheus.CounterVec
+}
+
+func newBouncerMetrics(registerer prometheus.Registerer) *bouncerMetrics {
+	factory := promauto.With(registerer)
+	return &bouncerMetrics{
+		decisionsReceived: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "cloudflare_decisions_received",
+			Help: "The total number of decisions received from CrowdSec",
+		}, []string{"account_id", "scope", "type"}),
+		decisionsApplied: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "cloudflare_decisions_applied",
+			Help: "The total number of decisions enforced at cloudflare",
+		}, []string{"account_id", "scope", "type"}),
+		decisionsDeduplicated: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "cloudflare_decisions_deduplicated",
+			Help: "The total number of decisions skipped because a decision on the same value was applied with them",
+		}, []string{"account_id", "scope", "type"}),
+		decisionsDefaulted: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "cloudflare_decisions_defaulted",
+			Help: "The total number of decisions enforced with the default action instead of their own",
+		}, []string{"account_id", "scope", "reason"}),
+		decisionsDropped: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "cloudflare_decisions_dropped",
+			Help: "The total number of decisions which were not enforced",
+		}, []string{"account_id", "scope", "reason"}),
+		tickDuration: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "cloudflare_tick_duration_seconds",
+			Help:    "The time taken by a worker to apply its pending decisions at cloudflare",
+			Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+		}, []string{"account_id"}),
+		decisionPropagation: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "cloudflare_decision_propagation_seconds",
+			Help:    "The time from the reception of a decision from CrowdSec to its enforcement at cloudflare",
+			Buckets: []float64{1, 2, 5, 10, 15, 20, 30, 45, 60, 90, 120, 300, 600},
+		}, []string{"account_id", "scope", "type"}),
+		apiDuration: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "cloudflare_api_request_duration_seconds",
+			Help:    "The latency of the calls to the cloudflare API",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"endpoint", "zone_id"}),
+		apiErrors: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "cloudflare_api_errors",
+			Help: "The total number of failed calls to the cloudflare API",
+		}, []string{"endpoint", "zone_id", "status"}),
+	}
+}
+
+func scopeLabel(decision *models.Decision) string {
+	if decision.Scope == nil {
+		return ""
+	}
+	return strings.ToLower(*decision.Scope)
+}
+
+func decisionTypeLabel(decisionIsExpired bool) string {
+	if decisionIsExpired {
+		return "expired"
+	}
+	return "new"
+}
+
+func (m *bouncerMetrics) recordReceived(accountID string, decision *models.Decision, decisionIsExpired bool) {
+	if m == nil {
+		return
+	}
+	m.decisionsReceived.WithLabelValues(accountID, scopeLabel(decision), decisionTypeLabel(decisionIsExpired)).Inc()
+}
+
+func (m *bouncerMetrics) recordApplied(accountID string, decisions []*models.Decision, decisionIsExpired bool) {
+	if m == nil || len(decisions) == 0 {
+		return
+	}
+	m.decisionsApplied.WithLabelValues(accountID, scopeLabel(decisions[0]), decisionTypeLabel(decisionIsExpired)).Add(float64(len(decisions)))
+}
+
+func (m *bouncerMetrics) recordDeduplicated(accountID string, scope string, decisionIsExpired bool, count int) {
+	if m == nil || count == 0 {
+		return
+	}
+	m.decisionsDeduplicated.WithLabelValues(accountID, scope, decisionTypeLabel(decisionIsExpired)).Add(float64(count))
+}
+
+func (m *bouncerMetrics) recordDefaulted(accountID string, decisions []*models.Decision, reason string) {
+	if m == nil || len(decisions) == 0 {
+		return
+	}
+	m.decisionsDefaulted.WithLabelValues(accountID, scopeLabel(decisions[0]), reason).Add(float64(len(decisions)))
+}
+
+func (m *bouncerMetrics) recordDropped(accountID string, decisions []*models.Decision, reason string) {
+	if m == nil {
+		return
+	}
+	for _, decision := range decisions {
+		m.decisionsDropped.WithLabelValues(accountID, scopeLabel(decision), reason).Inc()
+	}
+}
+
+func (m *bouncerMetrics) recordTick(accountID string, startedAt time.Time) {
+	if m == nil {
+		return
+	}
+	m.tickDuration.WithLabelValues(accountID).Observe(time.Since(startedAt).Seconds())
+}
+
+func (m *bouncerMetrics) recordPropagation(accountID string, decision trackedDecision, liveAt time.Time) {
+	if m == nil {
+		return
+	}
+	m.decisionPropagation.WithLabelValues(accountID, decision.scope, decisionTypeLabel(decision.expired)).Observe(liveAt.Sub(decision.receivedAt).Seconds())
+}
+
+// classifyDecisions dedups and classifies the decisions by action like dedupAndClassifyDecisionsByAction, and
+// counts the duplicates and the decisions of unsupported types.
+func (worker *CloudflareWorker) classifyDecisions(decisions []*models.Decision, decisionIsExpired bool) map[string][]*models.Decision {
+	decisionsByAction := dedupAndClassifyDecisionsByAction(decisions)
+	if len(decisions) == 0 {
+		return decisionsByAction
+	}
+	kept := 0
+	for _, actionDecisions := range decisionsByAction {
+		kept += len(actionDecisions)
+	}
+	worker.Metrics.recordDeduplicated(worker.Account.ID, scopeLabel(decisions[0]), decisionIsExpired, len(decisions)-kept)
+	worker.Metrics.recordDefaulted(worker.Account.ID, decisionsByAction["defaulted"], "unsupported_type")
+	return decisionsByAction
+}
+
+// instrumentedCloudflareAPI measures the latency and the errors of the calls to the wrapped API, and traces
+// them.
+type instrumentedCloudflareAPI struct {
+	api     cloudflareAPI
+	metrics *bouncerMetrics
+}
+
+func newInstrumentedCloudflareAPI(api cloudflareAPI, metrics *bouncerMetrics) *instrumentedCloudflareAPI {
+	return &instrumentedCloudflareAPI{api: api, metrics: metrics}
+}
+
+// errorStatus returns the HTTP status of the failed call, or "unknown" when the error doesn't have one,
+// because cloudflare didn't answer or cloudflare-go didn't keep it.
+func errorStatus(err error) string {
+	var requestErr *cloudflare.APIRequestError
+	if errors.As(err, &requestErr) && requestErr.StatusCode != 0 {
+		return strconv.Itoa(requestErr.StatusCode)
+	}
+	return "unknown"
+}
+
+// start starts the span of a call to the endpoint, the returned function records its latency and its error.
+// The zone is empty for the calls which don't apply to a zone.
+func (api *instrumentedCloudflareAPI) start(ctx context.Context, endpoint string, zoneID string) (context.Context, func(err error)) {
+	startedAt := time.Now()
+	ctx, span := tracer.Start(ctx, "cloudflare "+endpoint, trace.WithSpanKind(trace.SpanKindClient))
+	if zoneID != "" {
+		span.SetAttributes(attribute.String("zone_id", zoneID))
+	}
+	return ctx, func(err error) {
+		api.metrics.apiDuration.WithLabelValues(endpoint, zoneID).Observe(time.Since(startedAt).Seconds())
+		if err != nil {
+			api.metrics.apiErrors.WithLabelValues(endpoint, zoneID, errorStatus(err)).Inc()
+			span.SetAttributes(attribute.String("status", errorStatus(err)))
+		}
+		endSpan(span, err)
+	}
+}
+
+func (api *instrumentedCloudflareAPI) Filters(ctx context.Context, zoneID string, pageOpts cloudflare.PaginationOptions) ([]cloudflare.Filter, error) {
+	ctx, done := api.start(ctx, "filters", zoneID)
+	filters, err := api.api.Filters(ctx, zoneID, pageOpts)
+	done(err)
+	return filters, err
+}
+
+func (api *instrumentedCloudflareAPI) ListZones(ctx context.Context, z ...string) ([]cloudflare.Zone, error) {
+	ctx, done := api.start(ctx, "list_zones", "")
+	zones, err := api.api.ListZones(ctx, z...)
+	done(err)
+	return zones, err
+}
+
+func (api *instrumentedCloudflareAPI) CreateIPList(ctx context.Context, name string, desc string, typ string) (cloudflare.IPList, error) {
+	ctx, done := api.start(ctx, "create_ip_list", "")
+	ipList, err := api.api.CreateIPList(ctx, name, desc, typ)
+	done(err)
+	return ipList, err
+}
+
+func (api *instrumentedCloudflareAPI) DeleteIPList(ctx context.Context, id string) (cloudflare.IPListDeleteResponse, error) {
+	ctx, done := api.start(ctx, "delete_ip_list", "")
+	resp, err := api.api.DeleteIPList(ctx, id)
+	done(err)
+	return resp, err
+}
+
+func (api *instrumentedCloudflareAPI) ListIPLists(ctx context.Context) ([]cloudflare.IPList, error) {
+	ctx, done := api.start(ctx, "list_ip_lists", "")
+	ipLists, err := api.api.ListIPLists(ctx)
+	done(err)
+	return ipLists, err
+}
+
+func (api *instrumentedCloudflareAPI) ListIPListItems(ctx context.Context, id string) ([]cloudflare.IPListItem, error) {
+	ctx, done := api.start(ctx, "list_ip_list_items", "")
+	items, err := api.api.ListIPListItems(ctx, id)
+	done(err)
+	return items, err
+}
+
+func (api *instrumentedCloudflareAPI) CreateFirewallRules(ctx context.Context, zone string, rules []cloudflare.FirewallRule) ([]cloudflare.FirewallRule, error) {
+	ctx, done := api.start(ctx, "create_firewall_rules", zone)
+	created, err := api.api.CreateFirewallRules(ctx, zone, rules)
+	done(err)
+	return created, err
+}
+
+func (api *instrumentedCloudflareAPI) DeleteFirewallRules(ctx context.Context, zoneID string, firewallRuleIDs []string) error {
+	ctx, done := api.start(ctx, "delete_firewall_rules", zoneID)
+	err := api.api.DeleteFirewallRules(ctx, zoneID, firewallRuleIDs)
+	done(err)
+	return err
+}
+
+func (api *instrumentedCloudflareAPI) FirewallRules(ctx context.Context, zone string, opts cloudflare.PaginationOptions) ([]cloudflare.FirewallRule, error) {
+	ctx, done := api.start(ctx, "firewall_rules", zone)
+	rules, err := api.api.FirewallRules(ctx, zone, opts)
+	done(err)
+	return rules, err
+}
+
+func (api *instrumentedCloudflareAPI) UpdateFirewallRules(ctx context.Context, zone string, rules []cloudflare.FirewallRule) ([]cloudflare.FirewallRule, error) {
+	ctx, done := api.start(ctx, "update_firewall_rules", zone)
+	updated, err := api.api.UpdateFirewallRules(ctx, zone, rules)
+	done(err)
+	return updated, err
+}
+
+func (api *instrumentedCloudflareAPI) CreateIPListItems(ctx context.Context, id string, items []cloudflare.IPListItemCreateRequest) ([]cloudflare.IPListItem, error) {
+	ctx, done := api.start(ctx, "create_ip_list_items", "")
+	created, err := api.api.CreateIPListItems(ctx, id, items)
+	done(err)
+	return created, err
+}
+
+func (api *instrumentedCloudflareAPI) DeleteIPListItems(ctx context.Context, id string, items cloudflare.IPListItemDeleteRequest) ([]cloudflare.IPListItem, error) {
+	ctx, done := api.start(ctx, "delete_ip_list_items", "")
+	remaining, err := api.api.DeleteIPListItems(ctx, id, items)
+	done(err)
+	return remaining, err
+}
+
+func (api *instrumentedCloudflareAPI) DeleteFilters(ctx context.Context, zoneID string, filterIDs []string) error {
+	ctx, done := api.start(ctx, "delete_filters", zoneID)
+	err := api.api.DeleteFilters(ctx, zoneID, filterIDs)
+	done(err)
+	return err
+}
+
+func (api *instrumentedCloudflareAPI) UpdateFilters(ctx context.Context, zoneID string, filters []cloudflare.Filter) ([]cloudflare.Filter, error) {
+	ctx, done := api.start(ctx, "update_filters", zoneID)
+	updated, err := api.api.UpdateFilters(ctx, zoneID, filters)
+	done(err)
+	return updated, err
+}
+
+func (api *instrumentedCloudflareAPI) ListAccountAccessRules(ctx context.Context, accountID string, accessRule cloudflare.AccessRule, page int) (*cloudflare.AccessRuleListResponse, error) {
+	ctx, done := api.start(ctx, "list_account_access_rules", "")
+	resp, err := api.api.ListAccountAccessRules(ctx, accountID, accessRule, page)
+	done(err)
+	return resp, err
+}
+
+func (api *instrumentedCloudflareAPI) CreateAccountAccessRule(ctx context.Context, accountID string, accessRule cloudflare.AccessRule) (*cloudflare.AccessRuleResponse, error) {
+	ctx, done := api.start(ctx, "create_account_access_rule", "")
+	resp, err := api.api.CreateAccountAccessRule(ctx, accountID, accessRule)
+	done(err)
+	return resp, err
+}
+
+func (api *instrumentedCloudflareAPI) DeleteAccountAccessRule(ctx context.Context, accountID, accessRuleID string) (*cloudflare.AccessRuleResponse, error) {
+	ctx, done := api.start(ctx, "delete_account_access_rule", "")
+	resp, err := api.api.DeleteAccountAccessRule(ctx, accountID, accessRuleID)
+	done(err)
+	return resp, err
+}
+
+func (api *instrumentedCloudflareAPI) ListZoneAccessRules(ctx context.Context, zoneID string, accessRule cloudflare.AccessRule, page int) (*cloudflare.AccessRuleListResponse, error) {
+	ctx, done := api.start(ctx, "list_zone_access_rules", zoneID)
+	resp, err := api.api.ListZoneAccessRules(ctx, zoneID, accessRule, page)
+	done(err)
+	return resp, err
+}
+
+func (api *instrumentedCloudflareAPI) CreateZoneAccessRule(ctx context.Context, zoneID string, accessRule cloudflare.AccessRule) (*cloudflare.AccessRuleResponse, error) {
+	ctx, done := api.start(ctx, "create_zone_access_rule", zoneID)
+	resp, err := api.api.CreateZoneAccessRule(ctx, zoneID, accessRule)
+	done(err)
+	return resp, err
+}
+
+func (api *instrumentedCloudflareAPI) DeleteZoneAccessRule(ctx context.Context, zoneID, accessRuleID string) (*cloudflare.AccessRuleResponse, error) {
+	ctx, done := api.start(ctx, "delete_zone_access_rule", zoneID)
+	resp, err := api.api.DeleteZoneAccessRule(ctx, zoneID, accessRuleID)
+	done(err)
+	return resp, err
+}
+
+var (
+	ipListItemsDesc       = prometheus.NewDesc("cloudflare_ip_list_items", "The number of items in the IP list of an action", []string{"account_id", "action"}, nil)
+	accessRulesDesc       = prometheus.NewDesc("cloudflare_access_rules", "The number of access rules of an action in a zone, or in the account for an empty zone", []string{"account_id", "zone_id", "action"}, nil)
+	bannedCountriesDesc   = prometheus.NewDesc("cloudflare_banned_countries", "The number of countries banned with an action", []string{"account_id", "action"}, nil)
+	bannedASDesc          = prometheus.NewDesc("cloudflare_banned_autonomous_systems", "The number of autonomous systems banned with an action", []string{"account_id", "action"}, nil)
+	pendingDecisionsDesc  = prometheus.NewDesc("cloudflare_pending_decisions", "The number of decisions waiting for the next sync with cloudflare", []string{"account_id", "type"}, nil)
+	lastSyncTimestampDesc = prometheus.NewDesc("cloudflare_last_sync_timestamp_seconds", "The time of the last successful sync with cloudflare", []string{"account_id"}, nil)
+
+	lapiPollsDesc             = prometheus.NewDesc("cloudflare_lapi_polls", "The total number of polls of the decision stream of a LAPI source", []string{"source"}, nil)
+	lapiPollErrorsDesc        = prometheus.NewDesc("cloudflare_lapi_poll_errors", "The total number of failed polls of a LAPI source", []string{"source"}, nil)
+	lapiDecisionsDesc         = prometheus.NewDesc("cloudflare_lapi_decisions", "The total number of decisions received from a LAPI source", []string{"source", "type"}, nil)
+	lapiFilteredDesc          = prometheus.NewDesc("cloudflare_lapi_filtered_decisions", "The total number of new decisions of a LAPI source dropped by its filters", []string{"source"}, nil)
+	lapiActiveDecisionsDesc   = prometheus.NewDesc("cloudflare_lapi_active_decisions", "The number of active decisions of a LAPI source", []string{"source"}, nil)
+	lapiUpDesc                = prometheus.NewDesc("cloudflare_lapi_up", "Whether the last poll of a LAPI source succeeded", []string{"source"}, nil)
+	lapiLastPollTimestampDesc = prometheus.NewDesc("cloudflare_lapi_last_poll_timestamp_seconds", "The time of the last successful poll of a LAPI source", []string{"source"}, nil)
+)
+
+// healthCollector exports the state the workers publish for the admin API, so the metrics of removed
+// actions disappear with them, and the health of the LAPI sources.
+type healthCollector struct {
+	registry *healthRegistry
+}
+
+func (c healthCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{ipListItemsDesc, accessRulesDesc, bannedCountriesDesc, bannedASDesc, pendingDecisionsDesc, lastSyncTimestampDesc,
+		lapiPollsDesc, lapiPollErrorsDesc, lapiDecisionsDesc, lapiFilteredDesc, lapiActiveDecisionsDesc, lapiUpDesc, lapiLastPollTimestampDesc} {
+		ch <- desc
+	}
+}
+
+func (c healthCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, h := range c.registry.workers {
+		h.mu.RLock()
+		for _, action := range h.actions {
+			ch <- prometheus.MustNewConstMetric(ipListItemsDesc, prometheus.GaugeValue, float64(action.IPListSize), h.accountID, action.Action)
+			for zoneID, count := range action.AccessRulesByZoneID {
+				ch <- prometheus.MustNewConstMetric(accessRulesDesc, prometheus.GaugeValue, float64(count), h.accountID, zoneID, action.Action)
+			}
+			ch <- prometheus.MustNewConstMetric(bannedCountriesDesc, prometheus.GaugeValue, float64(len(action.Countries)), h.accountID, action.Action)
+			ch <- prometheus.MustNewConstMetric(bannedASDesc, prometheus.GaugeValue, float64(len(action.AutonomousSystems)), h.accountID, action.Action)
+		}
+		ch <- prometheus.MustNewConstMetric(pendingDecisionsDesc, prometheus.GaugeValue, float64(h.pendingNew), h.accountID, "new")
+		ch <- prometheus.MustNewConstMetric(pendingDecisionsDesc, prometheus.GaugeValue, float64(h.pendingExpired), h.accountID, "expired")
+		if !h.lastSync.IsZero() {
+			ch <- prometheus.MustNewConstMetric(lastSyncTimestampDesc, prometheus.GaugeValue, float64(h.lastSync.UnixNano())/1e9, h.accountID)
+		}
+		h.mu.RUnlock()
+	}
+	for _, h := range c.registry.sources {
+		h.mu.RLock()
+		ch <- prometheus.MustNewConstMetric(lapiPollsDesc, prometheus.CounterValue, float64(h.polls), h.name)
+		ch <- prometheus.MustNewConstMetric(lapiPollErrorsDesc, prometheus.CounterValue, float64(h.errors), h.name)
+		ch <- prometheus.MustNewConstMetric(lapiDecisionsDesc, prometheus.CounterValue, float64(h.receivedNew), h.name, "new")
+		ch <- prometheus.MustNewConstMetric(lapiDecisionsDesc, prometheus.CounterValue, float64(h.receivedDeleted), h.name, "deleted")
+		ch <- prometheus.MustNewConstMetric(lapiFilteredDesc, prometheus.CounterValue, float64(h.filtered), h.name)
+		ch <- prometheus.MustNewConstMetric(lapiActiveDecisionsDesc, prometheus.GaugeValue, float64(h.activeDecisions), h.name)
+		up := 0.0
+		if !h.lastPoll.IsZero() && !h.lastPollFailed {
+			up = 1
+		}
+		ch <- prometheus.MustNewConstMetric(lapiUpDesc, prometheus.GaugeValue, up, h.name)
+		if !h.lastPoll.IsZero() {
+			ch <- prometheus.MustNewConstMetric(lapiLastPollTimestampDesc, prometheus.GaugeValue, float64(h.lastPoll.UnixNano())/1e9, h.name)
+		}
+		h.mu.RUnlock()
+	}
+}
+
+// registerBuildInfo exports the version of the bouncer as the labels of a constant gauge.
+func registerBuildInfo(registerer prometheus.Registerer) {
+	promauto.With(registerer).NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "cloudflare_bouncer_build_info",
+		Help: "The version of the bouncer, the value is always 1",
+		ConstLabels: prometheus.Labels{
+			"version":    version.VersionStr(),
+			"build_date": version.BuildDate,
+			"go_version": version.GoVersion,
+		},
+	}, func() float64 { return 1 })
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBouncerMetrics_decisions(t *testing.T) {
+	worker := newTestWorker()
+	worker.Metrics = newBouncerMetrics(prometheus.NewRegistry())
+	decision := func(value string, scope string, decisionType string) *models.Decision {
+		scenario := "test"
+		return &models.Decision{Value: &value, Scope: &scope, Type: &decisionType, Scenario: &scenario}
+	}
+	worker.CollectLAPIStream(&models.DecisionsStreamResponse{New: []*models.Decision{
+		decision("1.2.3.4", "Ip", "captcha"),
+		decision("1.2.3.4", "Ip", "captcha"),
+		decision("5.6.7.8", "Ip", "unknown"),
+		decision("FR", "Country", "captcha"),
+		decision("user", "Username", "captcha"),
+	}})
+	if err := worker.AddNewIPs(); err != nil {
+		t.Fatal(err)
+	}
+	if err := worker.SendCountryBans(); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := worker.Metrics
+	for _, tt := range []struct {
+		name   string
+		metric prometheus.Collector
+		want   float64
+	}{
+		{"received IPs", metrics.decisionsReceived.WithLabelValues("account1", "ip", "new"), 3},
+		{"received countries", metrics.decisionsReceived.WithLabelValues("account1", "country", "new"), 1},
+		{"dropped scope", metrics.decisionsDropped.WithLabelValues("account1", "username", "unsupported_scope"), 1},
+		{"deduplicated IPs", metrics.decisionsDeduplicated.WithLabelValues("account1", "ip", "new"), 1},
+		{"defaulted IPs", metrics.decisionsDefaulted.WithLabelValues("account1", "ip", "unsupported_type"), 1},
+		{"applied IPs", metrics.decisionsApplied.WithLabelValues("account1", "ip", "new"), 2},
+		{"applied countries", metrics.decisionsApplied.WithLabelValues("account1", "country", "new"), 1},
+	} {
+		if got := testutil.ToFloat64(tt.metric); got != tt.want {
+			t.Errorf("%s: want %v, found %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func Test_errorStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&cloudflare.APIRequestError{StatusCode: http.StatusForbidden}, "403"},
+		{errors.New("HTTP status 503: service failure"), "unknown"},
+		{context.DeadlineExceeded, "unknown"},
+	}
+	for _, tt := range tests {
+		if got := errorStatus(tt.err); got != tt.want {
+			t.Errorf("%v: want %s, found %s", tt.err, tt.want, got)
+		}
+	}
+}
+
+func TestInstrumentedCloudflareAPI(t *testing.T) {
+	metrics := newBouncerMetrics(prometheus.NewRegistry())
+	api := newInstrumentedCloudflareAPI(&failingZonesAPI{mockCloudflareAPI: &mockCloudflareAPI{}, err: &cloudflare.APIRequestError{StatusCode: http.StatusTooManyRequests}}, metrics)
+	if _, err := api.ListIPLists(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := api.ListZones(context.Background()); err == nil {
+		t.Fatal("expected the error of the wrapped API")
+	}
+	if _, err := api.UpdateFilters(context.Background(), "zone1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.CollectAndCount(metrics.apiDuration); got != 3 {
+		t.Errorf("expected the latency of the 3 endpoints, found %d series", got)
+	}
+	if !metrics.apiDuration.DeleteLabelValues("update_filters", "zone1") {
+		t.Error("expected the latency of the filters update to be labeled with its zone")
+	}
+	if got := testutil.ToFloat64(metrics.apiErrors.WithLabelValues("list_zones", "", "429")); got != 1 {
+		t.Errorf("expected the error to be counted, found %v", got)
+	}
+	if got := testutil.CollectAndCount(metrics.apiErrors); got != 1 {
+		t.Errorf("expected only the failed call to be counted, found %d series", got)
+	}
+}
+
+func TestHealthCollector(t *testing.T) {
+	registry := newHealthRegistry(time.Minute, true)
+	h := registry.register("account1", nil)
+	h.recordStatus(nil, []actionStatus{{Action: "block", IPListSize: 3, Countries: []string{"FR", "DE"}, AccessRulesByZoneID: map[string]int{"zone1": 2, "": 1}}}, 2, 1)
+	expected := `
+# HELP cloudflare_access_rules The number of access rules of an action in a zone, or in the account for an empty zone
+# TYPE cloudflare_access_rules gauge
+cloudflare_access_rules{account_id="account1",action="block",zone_id=""} 1
+cloudflare_access_rules{account_id="account1",action="block",zone_id="zone1"} 2
+# HELP cloudflare_banned_countries The number of countries banned with an action
+# TYPE cloudflare_banned_countries gauge
+cloudflare_banned_countries{account_id="account1",action="block"} 2
+# HELP cloudflare_ip_list_items The number of items in the IP list of an action
+# TYPE cloudflare_ip_list_items gauge
+cloudflare_ip_list_items{account_id="account1",action="block"} 3
+# HELP cloudflare_pending_decisions The number of decisions waiting for the next sync with cloudflare
+# TYPE cloudflare_pending_decisions gauge
+cloudflare_pending_decisions{account_id="account1",type="expired"} 1
+cloudflare_pending_decisions{account_id="account1",type="new"} 2
+`
+	collector := healthCollector{registry: registry}
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "cloudflare_access_rules", "cloudflare_banned_countries", "cloudflare_ip_list_items", "cloudflare_pending_decisions"); err != nil {
+		t.Error(err)
+	}
+	if got := testutil.CollectAndCount(collector, "cloudflare_last_sync_timestamp_seconds"); got != 0 {
+		t.Errorf("expected no sync timestamp before the first sync, found %d", got)
+	}
+	h.setReady()
+	if got := testutil.CollectAndCount(collector, "cloudflare_last_sync_timestamp_seconds"); got != 1 {
+		t.Errorf("expected the sync timestamp, found %d", got)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/cloudflare/cloudflare-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// pauseRequest is a pause or resume request of the admin API. It applies to the selected zones of the
+// selected accounts, every zone of every account when none are selected.
+type pauseRequest struct {
+	Accounts []string `json:"accounts,omitempty"`
+	Zones    []string `json:"zones,omitempty"`
+	Resume   bool     `json:"resume,omitempty"`
+}
+
+// isPaused returns true if the rule of the state is paused in the zone.
+func (cfState *CloudflareState) isPaused(zoneID string) bool {
+	_, ok := cfState.PausedZoneIDs[zoneID]
+	return ok
+}
+
+// pausedActions returns the actions whose rule is paused in the zone.
+func (worker *CloudflareWorker) pausedActions(zoneID string) []string {
+	actions := make([]string, 0)
+	for action, state := range worker.CFStateByAction {
+		if state.isPaused(zoneID) {
+			actions = append(actions, action)
+		}
+	}
+	sort.Strings(actions)
+	return actions
+}
+
+// hasAccessRules returns true if decisions are enforced with access rules in the zone, either because
+// the zone uses them or because they hold the IPs which didn't fit in the full IP lists.
+func (worker *CloudflareWorker) hasAccessRules(zone ZoneConfig) bool {
+	if worker.usesAccessRules(zone) {
+		return true
+	}
+	for _, state := range worker.CFStateByAction {
+		if len(state.AccessRuleIDsByZoneID[zone.ID]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// setRulesPaused pauses or resumes the firewall rules of the bouncer in the zones, the zone IDs select
+// every zone when empty. Access rules can't be paused, pausing fails once the rules are paused if
+// decisions are still enforced with access rules in some of the zones.
+func (worker *CloudflareWorker) setRulesPaused(zoneIDs []string, paused bool) error {
+	selected := make(map[string]struct{}, len(zoneIDs))
+	for _, zoneID := range zoneIDs {
+		selected[zoneID] = struct{}{}
+	}
+	unpaused := make([]string, 0)
+	for _, zone := range worker.Account.ZoneConfigs {
+		if _, ok := selected[zone.ID]; len(selected) > 0 && !ok {
+			continue
+		}
+		zoneLogger := worker.Logger.WithFields(log.Fields{"zone_id": zone.ID})
+		if paused && worker.hasAccessRules(zone) {
+			zoneLogger.Warning("decisions are enforced with access rules, which can't be paused")
+			unpaused = append(unpaused, zone.ID)
+		}
+		if worker.usesAccessRules(zone) {
+			continue
+		}
+		if err := worker.setZoneRulesPaused(zone, paused); err != nil {
+			return err
+		}
+		if paused {
+			zoneLogger.Warning("paused the rules of the bouncer, decisions are not enforced")
+		} else {
+			zoneLogger.Info("resumed the rules of the bouncer")
+		}
+	}
+	worker.publishState()
+	worker.publishStatus()
+	if len(unpaused) > 0 {
+		return fmt.Errorf("decisions are still enforced with access rules, which can't be paused, in zones %s", strings.Join(unpaused, ", "))
+	}
+	return nil
+}
+
+// setZoneRulesPaused pauses or resumes the rules of the zone's actions at cloudflare and records it in their states.
+func (worker *CloudflareWorker) setZoneRulesPaused(zone ZoneConfig, paused bool) error {
+	ruleByFilterID := make(map[string]cloudflare.FirewallRule)
+	rules, err := worker.getAPI().FirewallRules(worker.Ctx, zone.ID, cloudflare.PaginationOptions{})
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		ruleByFilterID[rule.Filter.ID] = rule
+	}
+	updatedRules := make([]cloudflare.FirewallRule, 0)
+	updatedStates := make([]*CloudflareState, 0)
+	for action := range zone.ActionSet {
+		state, ok := worker.CFStateByAction[action]
+		if !ok {
+			continue
+		}
+		rule, ok := ruleByFilterID[state.FilterIDByZoneID[zone.ID]]
+		if !ok {
+			return fmt.Errorf("rule of action %s not found in zone %s", action, zone.ID)
+		}
+		updatedStates = append(updatedStates, state)
+		if rule.Paused == paused {
+			continue
+		}
+		rule.Paused = paused
+		updatedRules = append(updatedRules, rule)
+	}
+	if len(updatedRules) > 0 {
+		if _, err := worker.getAPI().UpdateFirewallRules(worker.Ctx, zone.ID, updatedRules); err != nil {
+			return err
+		}
+	}
+	for _, state := range updatedStates {
+		if !paused {
+			delete(state.PausedZoneIDs, zone.ID)
+			continue
+		}
+		if state.PausedZoneIDs == nil {
+			state.PausedZoneIDs = make(map[string]struct{})
+		}
+		state.PausedZoneIDs[zone.ID] = struct{}{}
+	}
+	return nil
+}
+
+// restorePausedRules pauses again the rules which were paused before a restart, in case they were
+// recreated or resumed outside of the bouncer.
+func (worker *CloudflareWorker) restorePausedRules() error {
+	for _, zone := range worker.ipListZones() {
+		if len(worker.pausedActions(zone.ID)) == 0 {
+			continue
+		}
+		worker.Logger.WithFields(log.Fields{"zone_id": zone.ID}).Warning("rules of the bouncer are paused, run resume to enforce decisions")
+		if err := worker.setZoneRulesPaused(zone, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runPauseCommand parses the arguments of the pause or resume command and sends it to the running bouncer.
+func runPauseCommand(w io.Writer, socketPath string, args []string, resume bool) error {
+	command := "pause"
+	if resume {
+		command = "resume"
+	}
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	accounts := flags.String("accounts", "", "comma separated IDs of the accounts, every account when empty")
+	zones := flags.String("zones", "", "comma separated IDs of the zones, every zone of the accounts when empty")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s [-c config] %s [options]\n", name, command)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return fmt.Errorf("%s expects no argument", command)
+	}
+	req := pauseRequest{Resume: resume}
+	if *accounts != "" {
+		req.Accounts = strings.Split(*accounts, ",")
+	}
+	if *zones != "" {
+		req.Zones = strings.Split(*zones, ",")
+	}
+	results, err := postAdminRequest(socketPath, "/"+command, req)
+	if err != nil {
+		return err
+	}
+	return writeAdminResults(w, results, command+"d")
+}
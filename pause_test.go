@@ -0,0 +1,98 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+)
+
+func pausedRuleIDs(api cloudflareAPI) []string {
+	paused := make([]string, 0)
+	for _, rule := range api.(*mockCloudflareAPI).FirewallRulesList {
+		if rule.Paused {
+			paused = append(paused, rule.ID)
+		}
+	}
+	return paused
+}
+
+func TestCloudflareWorker_setRulesPaused(t *testing.T) {
+	worker := newTestWorker()
+	worker.Account.DefaultAction = "block"
+	worker.Account.ZoneConfigs = []ZoneConfig{
+		{ID: "zone1", Actions: []string{"block"}, ActionSet: map[string]struct{}{"block": {}}},
+		{ID: "zone2", Actions: []string{"block"}, ActionSet: map[string]struct{}{"block": {}}},
+		{ID: "zone3", Actions: []string{"block"}, ActionSet: map[string]struct{}{"block": {}}, Enforcement: accessRuleEnforcement},
+	}
+	worker.API = &mockCloudflareAPI{FirewallRulesList: []cloudflare.FirewallRule{
+		{ID: "rule1", Filter: cloudflare.Filter{ID: "filter1"}},
+		{ID: "rule2", Filter: cloudflare.Filter{ID: "filter2"}},
+	}}
+	state := &CloudflareState{AccountID: "account1", Action: "block", FilterIDByZoneID: map[string]string{"zone1": "filter1", "zone2": "filter2"}}
+	worker.CFStateByAction = map[string]*CloudflareState{"block": state}
+
+	if err := worker.setRulesPaused([]string{"zone2"}, true); err != nil {
+		t.Fatal(err)
+	}
+	if got := pausedRuleIDs(worker.API); !reflect.DeepEqual(got, []string{"rule2"}) {
+		t.Errorf("expected only rule2 to be paused, found %v", got)
+	}
+	if !state.isPaused("zone2") || state.isPaused("zone1") {
+		t.Errorf("expected zone2 to be paused in the state, found %+v", state.PausedZoneIDs)
+	}
+
+	// zone3 enforces decisions with access rules, and so does zone2 with the IPs which didn't fit in the list.
+	state.AccessRuleIDsByZoneID = map[string]map[string]string{"zone2": {"1.2.3.4": "accessrule1"}}
+	if err := worker.setRulesPaused(nil, true); err == nil || !strings.Contains(err.Error(), "zones zone2, zone3") {
+		t.Errorf("expected the zones with access rules to be reported, found %v", err)
+	}
+	if got := pausedRuleIDs(worker.API); len(got) != 2 {
+		t.Errorf("expected every rule to be paused, found %v", got)
+	}
+	if state.isPaused("zone3") {
+		t.Error("expected the access rules zone not to be paused")
+	}
+	if !reflect.DeepEqual(worker.pausedActions("zone1"), []string{"block"}) {
+		t.Errorf("unexpected paused actions %v", worker.pausedActions("zone1"))
+	}
+
+	// the rules were resumed outside of the bouncer, a restart pauses them again.
+	api := worker.API.(*mockCloudflareAPI)
+	for i := range api.FirewallRulesList {
+		api.FirewallRulesList[i].Paused = false
+	}
+	restarted := newTestWorker()
+	restarted.Account = worker.Account
+	restarted.API = api
+	restarted.CFStateByAction = map[string]*CloudflareState{"block": state.snapshot()}
+	if err := restarted.restorePausedRules(); err != nil {
+		t.Fatal(err)
+	}
+	if got := pausedRuleIDs(api); len(got) != 2 {
+		t.Errorf("expected the rules to be paused again, found %v", got)
+	}
+
+	if err := restarted.setRulesPaused(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := pausedRuleIDs(api); len(got) != 0 || len(restarted.CFStateByAction["block"].PausedZoneIDs) != 0 {
+		t.Errorf("expected every rule to be resumed, found %v %+v", got, restarted.CFStateByAction["block"].PausedZoneIDs)
+	}
+}
+
+func TestAdminAPI_selectZoneAccounts(t *testing.T) {
+	api := newAdminAPI(newHealthRegistry(time.Minute, true))
+	api.register(AccountConfig{ID: "account1", ZoneConfigs: []ZoneConfig{{ID: "zone1"}, {ID: "zone2"}}})
+	api.register(AccountConfig{ID: "account2", ZoneConfigs: []ZoneConfig{{ID: "zone3"}}})
+
+	got, err := api.selectZoneAccounts(api.accountIDs, []string{"zone3", "zone1"})
+	if err != nil || !reflect.DeepEqual(got, []string{"account1", "account2"}) {
+		t.Errorf("unexpected accounts %v %v", got, err)
+	}
+	if _, err := api.selectZoneAccounts([]string{"account1"}, []string{"zone3"}); err == nil {
+		t.Error("expected error on zone of an unselected account")
+	}
+}
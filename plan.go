@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	planModeSetup   = "setup"
+	planModeCleanup = "cleanup"
+
+	// placeholder for the IDs cloudflare assigns to created objects.
+	knownAfterApply = "(known after apply)"
+)
+
+// cloudflareChange is a single mutation the bouncer would make at cloudflare.
+type cloudflareChange struct {
+	Operation string   `json:"operation"` // create, update or delete
+	Resource  string   `json:"resource"`  // ip_list, ip_list_items, firewall_rule, filter or access_rule
+	AccountID string   `json:"account_id"`
+	ZoneID    string   `json:"zone_id,omitempty"`
+	ID        string   `json:"id,omitempty"`
+	Name      string   `json:"name,omitempty"`
+	Detail    string   `json:"detail,omitempty"`
+	Items     []string `json:"items,omitempty"`
+}
+
+// recordingCloudflareAPI forwards reads to the wrapped API and records every mutation
+// instead of sending it. The returned objects look like the ones cloudflare would send back
+// so that the worker code paths can run unchanged on top of it.
+type recordingCloudflareAPI struct {
+	api       cloudflareAPI
+	accountID string
+	mu        sync.Mutex
+	Changes   []cloudflareChange
+	// when set, changes are handed to onChange instead of being accumulated in Changes.
+	onChange   func(cloudflareChange)
+	ipListByID map[string]cloudflare.IPList
+	ruleByID   map[string]cloudflare.FirewallRule
+	filterByID map[string]cloudflare.Filter
+}
+
+func newRecordingCloudflareAPI(api cloudflareAPI, accountID string) *recordingCloudflareAPI {
+	return &recordingCloudflareAPI{
+		api:        api,
+		accountID:  accountID,
+		Changes:    make([]cloudflareChange, 0),
+		ipListByID: make(map[string]cloudflare.IPList),
+		ruleByID:   make(map[string]cloudflare.FirewallRule),
+		filterByID: make(map[string]cloudflare.Filter),
+	}
+}
+
+func (rec *recordingCloudflareAPI) record(change cloudflareChange) {
+	change.AccountID = rec.accountID
+	if rec.onChange != nil {
+		rec.onChange(change)
+		return
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.Changes = append(rec.Changes, change)
+}
+
+func (rec *recordingCloudflareAPI) Filters(ctx context.Context, zoneID string, pageOpts cloudflare.PaginationOptions) ([]cloudflare.Filter, error) {
+	filters, err := rec.api.Filters(ctx, zoneID, pageOpts)
+	if err != nil {
+		return nil, err
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	for _, filter := range filters {
+		rec.filterByID[filter.ID] = filter
+	}
+	return filters, nil
+}
+
+func (rec *recordingCloudflareAPI) ListZones(ctx context.Context, z ...string) ([]cloudflare.Zone, error) {
+	return rec.api.ListZones(ctx, z...)
+}
+
+func (rec *recordingCloudflareAPI) ListIPLists(ctx context.Context) ([]cloudflare.IPList, error) {
+	ipLists, err := rec.api.ListIPLists(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	for _, ipList := range ipLists {
+		rec.ipListByID[ipList.ID] = ipList
+	}
+	return ipLists, nil
+}
+
+func (rec *recordingCloudflareAPI) ListIPListItems(ctx context.Context, id string) ([]cloudflare.IPListItem, error) {
+	return rec.api.ListIPListItems(ctx, id)
+}
+
+func (rec *recordingCloudflareAPI) FirewallRules(ctx context.Context, zone string, opts cloudflare.PaginationOptions) ([]cloudflare.FirewallRule, error) {
+	rules, err := rec.api.FirewallRules(ctx, zone, opts)
+	if err != nil {
+		return nil, err
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	for _, rule := range rules {
+		rec.ruleByID[rule.ID] = rule
+	}
+	return rules, nil
+}
+
+func (rec *recordingCloudflareAPI) CreateIPList(ctx context.Context, name string, desc string, typ string) (cloudflare.IPList, error) {
+	rec.record(cloudflareChange{Operation: "create", Resource: "ip_list", ID: knownAfterApply, Name: name, Detail: desc})
+	now := time.Now()
+	return cloudflare.IPList{ID: knownAfterApply, Name: name, Description: desc, Kind: typ, CreatedOn: &now, ModifiedOn: &now}, nil
+}
+
+func (rec *recordingCloudflareAPI) DeleteIPList(ctx context.Context, id string) (cloudflare.IPListDeleteResponse, error) {
+	change := cloudflareChange{Operation: "delete", Resource: "ip_list", ID: id}
+	rec.mu.Lock()
+	if ipList, ok := rec.ipListByID[id]; ok {
+		change.Name = ipList.Name
+		change.Detail = fmt.Sprintf("drops %d items", ipList.NumItems)
+	}
+	rec.mu.Unlock()
+	rec.record(change)
+	resp := cloudflare.IPListDeleteResponse{}
+	resp.Result.ID = id
+	return resp, nil
+}
+
+func (rec *recordingCloudflareAPI) CreateFirewallRules(ctx context.Context, zone string, rules []cloudflare.FirewallRule) ([]cloudflare.FirewallRule, error) {
+	created := make([]cloudflare.FirewallRule, len(rules))
+	for i, rule := range rules {
+		rec.record(cloudflareChange{Operation: "create", Resource: "firewall_rule", ZoneID: zone, ID: knownAfterApply, Name: rule.Description, Detail: fmt.Sprintf("%s if %s", rule.Action, rule.Filter.Expression)})
+		created[i] = rule
+		created[i].ID = knownAfterApply
+		created[i].Filter.ID = knownAfterApply
+	}
+	return created, nil
+}
+
+func (rec *recordingCloudflareAPI) UpdateFirewallRules(ctx context.Context, zone string, rules []cloudflare.FirewallRule) ([]cloudflare.FirewallRule, error) {
+	for _, rule := range rules {
+		detail := "resume"
+		if rule.Paused {
+			detail = "pause"
+		}
+		rec.record(cloudflareChange{Operation: "update", Resource: "firewall_rule", ZoneID: zone, ID: rule.ID, Name: rule.Description, Detail: detail})
+	}
+	return rules, nil
+}
+
+func (rec *recordingCloudflareAPI) DeleteFirewallRules(ctx context.Context, zoneID string, firewallRuleIDs []string) error {
+	for _, id := range firewallRuleIDs {
+		change := cloudflareChange{Operation: "delete", Resource: "firewall_rule", ZoneID: zoneID, ID: id}
+		rec.mu.Lock()
+		if rule, ok := rec.ruleByID[id]; ok {
+			change.Name = rule.Description
+			change.Detail = fmt.Sprintf("%s if %s", rule.Action, rule.Filter.Expression)
+		}
+		rec.mu.Unlock()
+		rec.record(change)
+	}
+	return nil
+}
+
+func (rec *recordingCloudflareAPI) CreateIPListItems(ctx context.Context, id string, items []cloudflare.IPListItemCreateRequest) ([]cloudflare.IPListItem, error) {
+	ips := make([]string, len(items))
+	created := make([]cloudflare.IPListItem, len(items))
+	for i, item := range items {
+		ips[i] = item.IP
+		// the worker maps items back to IPs by ID, so they must be unique.
+		created[i] = cloudflare.IPListItem{ID: fmt.Sprintf("%s %s", knownAfterApply, item.IP), IP: item.IP, Comment: item.Comment}
+	}
+	rec.record(cloudflareChange{Operation: "create", Resource: "ip_list_items", ID: id, Items: ips})
+	return created, nil
+}
+
+func (rec *recordingCloudflareAPI) DeleteIPListItems(ctx context.Context, id string, items cloudflare.IPListItemDeleteRequest) ([]cloudflare.IPListItem, error) {
+	ids := make([]string, len(items.Items))
+	for i, item := range items.Items {
+		ids[i] = item.ID
+	}
+	rec.record(cloudflareChange{Operation: "delete", Resource: "ip_list_items", ID: id, Items: ids})
+	return []cloudflare.IPListItem{}, nil
+}
+
+func (rec *recordingCloudflareAPI) DeleteFilters(ctx context.Context, zoneID string, filterIDs []string) error {
+	for _, id := range filterIDs {
+		change := cloudflareChange{Operation: "delete", Resource: "filter", ZoneID: zoneID, ID: id}
+		rec.mu.Lock()
+		if filter, ok := rec.filterByID[id]; ok {
+			change.Detail = filter.Expression
+		}
+		rec.mu.Unlock()
+		rec.record(change)
+	}
+	return nil
+}
+
+func (rec *recordingCloudflareAPI) UpdateFilters(ctx context.Context, zoneID string, filters []cloudflare.Filter) ([]cloudflare.Filter, error) {
+	for _, filter := range filters {
+		rec.record(cloudflareChange{Operation: "update", Resource: "filter", ZoneID: zoneID, ID: filter.ID, Detail: filter.Expression})
+	}
+	return filters, nil
+}
+
+func (rec *recordingCloudflareAPI) ListAccountAccessRules(ctx context.Context, accountID string, accessRule cloudflare.AccessRule, page int) (*cloudflare.AccessRuleListResponse, error) {
+	return rec.api.ListAccountAccessRules(ctx, accountID, accessRule, page)
+}
+
+func (rec *recordingCloudflareAPI) ListZoneAccessRules(ctx context.Context, zoneID string, accessRule cloudflare.AccessRule, page int) (*cloudflare.AccessRuleListResponse, error) {
+	return rec.api.ListZoneAccessRules(ctx, zoneID, accessRule, page)
+}
+
+func (rec *recordingCloudflareAPI) recordAccessRuleCreation(zoneID string, accessRule cloudflare.AccessRule) *cloudflare.AccessRuleResponse {
+	value := accessRule.Configuration.Value
+	rec.record(cloudflareChange{Operation: "create", Resource: "access_rule", ZoneID: zoneID, ID: knownAfterApply, Name: accessRule.Notes, Detail: accessRule.Mode, Items: []string{value}})
+	resp := &cloudflare.AccessRuleResponse{Result: accessRule}
+	resp.Result.ID = fmt.Sprintf("%s %s", knownAfterApply, value)
+	return resp
+}
+
+func (rec *recordingCloudflareAPI) CreateAccountAccessRule(ctx context.Context, accountID string, accessRule cloudflare.AccessRule) (*cloudflare.AccessRuleResponse, error) {
+	return rec.recordAccessRuleCreation("", accessRule), nil
+}
+
+func (rec *recordingCloudflareAPI) CreateZoneAccessRule(ctx context.Context, zoneID string, accessRule cloudflare.AccessRule) (*cloudflare.AccessRuleResponse, error) {
+	return rec.recordAccessRuleCreation(zoneID, accessRule), nil
+}
+
+func (rec *recordingCloudflareAPI) DeleteAccountAccessRule(ctx context.Context, accountID, accessRuleID string) (*cloudflare.AccessRuleResponse, error) {
+	rec.record(cloudflareChange{Operation: "delete", Resource: "access_rule", ID: accessRuleID})
+	return &cloudflare.AccessRuleResponse{Result: cloudflare.AccessRule{ID: accessRuleID}}, nil
+}
+
+func (rec *recordingCloudflareAPI) DeleteZoneAccessRule(ctx context.Context, zoneID, accessRuleID string) (*cloudflare.AccessRuleResponse, error) {
+	rec.record(cloudflareChange{Operation: "delete", Resource: "access_rule", ZoneID: zoneID, ID: accessRuleID})
+	return &cloudflare.AccessRuleResponse{Result: cloudflare.AccessRule{ID: accessRuleID}}, nil
+}
+
+// newDryRunCloudflareAPI returns an API which logs every mutation and counts it in dryRunCount instead of sending it.
+func newDryRunCloudflareAPI(api cloudflareAPI, accountID string, logger *log.Entry, dryRunCount *prometheus.CounterVec) *recordingCloudflareAPI {
+	rec := newRecordingCloudflareAPI(api, accountID)
+	rec.onChange = func(change cloudflareChange) {
+		logger.WithFields(log.Fields{
+			"dry_run":   true,
+			"operation": change.Operation,
+			"resource":  change.Resource,
+			"zone_id":   change.ZoneID,
+			"id":        change.ID,
+			"name":      change.Name,
+			"detail":    change.Detail,
+			"items":     change.Items,
+		}).Infof("dry run: skipped %s of %s", change.Operation, change.Resource)
+		if dryRunCount != nil {
+			dryRunCount.WithLabelValues(change.Operation, change.Resource).Inc()
+		}
+	}
+	return rec
+}
+
+// newPlanWorker returns a worker for the account whose mutations are recorded by the returned recorder.
+func newPlanWorker(account AccountConfig, api cloudflareAPI, states map[string]*CloudflareState, tokenCallCount *uint32) (*CloudflareWorker, *recordingCloudflareAPI) {
+	recorder := newRecordingCloudflareAPI(api, account.ID)
+	worker := &CloudflareWorker{
+		Account:         account,
+		Ctx:             context.Background(),
+		API:             recorder,
+		UpdatedState:    make(chan *stateUpdate, 1),
+		CFStateByAction: states,
+		Count:           prometheus.NewCounter(prometheus.CounterOpts{Name: "cloudflare_plan_api_calls"}),
+		tokenCallCount:  tokenCallCount,
+	}
+	return worker, recorder
+}
+
+// planAccount runs the setup or cleanup code path of the worker and returns the changes it would make.
+// The scope restricts the setup or the cleanup.
+func planAccount(worker *CloudflareWorker, recorder *recordingCloudflareAPI, mode string, scope cleanupScope) ([]cloudflareChange, error) {
+	// Init publishes the state once, drain it since no state writer is running.
+	defer func() {
+		for len(worker.UpdatedState) > 0 {
+			<-worker.UpdatedState
+		}
+	}()
+
+	switch mode {
+	case planModeSetup:
+		if scope.isEmpty() {
+			worker.CFStateByAction = nil
+		} else {
+			worker.restrictSetUp(scope)
+		}
+		if err := worker.Init(); err != nil {
+			return nil, err
+		}
+		<-worker.UpdatedState
+		if !worker.stateIsNew() {
+			// the cached state is set up, Init set up the zones of the scope.
+			break
+		}
+		if err := worker.setUpIPList(); err != nil {
+			return nil, err
+		}
+		if err := worker.setUpRules(); err != nil {
+			return nil, err
+		}
+	case planModeCleanup:
+		if err := worker.InitCleanup(); err != nil {
+			return nil, err
+		}
+		<-worker.UpdatedState
+		if err := worker.cleanUpScope(scope); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown plan mode '%s'", mode)
+	}
+	return recorder.Changes, nil
+}
+
+func summarizeChanges(changes []cloudflareChange) string {
+	countByOperation := make(map[string]int)
+	for _, change := range changes {
+		countByOperation[change.Operation]++
+	}
+	return fmt.Sprintf("Plan: %d to create, %d to update, %d to delete.", countByOperation["create"], countByOperation["update"], countByOperation["delete"])
+}
+
+var symbolByOperation = map[string]string{
+	"create": "+",
+	"update": "~",
+	"delete": "-",
+}
+
+func writePlan(w io.Writer, changes []cloudflareChange, format string) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "	")
+		return encoder.Encode(changes)
+	case "table", "":
+		if len(changes) == 0 {
+			_, err := fmt.Fprintln(w, "No changes. Cloudflare matches the configuration.")
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "\tRESOURCE\tACCOUNT\tZONE\tID\tNAME\tDETAIL")
+		for _, change := range changes {
+			detail := change.Detail
+			if len(change.Items) > 0 {
+				items := append([]string{}, change.Items...)
+				sort.Strings(items)
+				detail = strings.TrimSpace(fmt.Sprintf("%s %d items: %s", detail, len(items), strings.Join(items, ", ")))
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", symbolByOperation[change.Operation], change.Resource, change.AccountID, change.ZoneID, change.ID, change.Name, detail)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		_, err := fmt.Fprintln(w, summarizeChanges(changes))
+		return err
+	default:
+		return fmt.Errorf("unknown plan output format '%s', expecting 'table' or 'json'", format)
+	}
+}
+
+// runPlan computes the changes setup or cleanup would make for every account of the config.
+func runPlan(conf *bouncerConfig, cachedStates []CloudflareState, mode string, scope cleanupScope, apiCountByToken map[string]*uint32) ([]cloudflareChange, error) {
+	changes := make([]cloudflareChange, 0)
+	for _, account := range conf.CloudflareConfig.Accounts {
+		api, err := cloudflare.NewWithAPIToken(account.Token, cloudflare.UsingAccount(account.ID))
+		if err != nil {
+			return nil, err
+		}
+		states := make(map[string]*CloudflareState)
+		for _, s := range cachedStates {
+			tmp := s
+			if s.AccountID == account.ID {
+				states[s.Action] = &tmp
+			}
+		}
+		worker, recorder := newPlanWorker(account, api, states, apiCountByToken[account.Token])
+		accountChanges, err := planAccount(worker, recorder, mode, scope)
+		if err != nil {
+			return nil, fmt.Errorf("while planning account %s: %w", account.ID, err)
+		}
+		log.Debugf("account %s has %d planned changes", account.ID, len(accountChanges))
+		changes = append(changes, accountChanges...)
+	}
+	return changes, nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newPlanMockAPI() *mockCloudflareAPI {
+	return &mockCloudflareAPI{
+		IPLists: []cloudflare.IPList{{ID: "11", Name: "crowdsec_block", NumItems: 3}, {ID: "12", Name: "crowd"}},
+		FirewallRulesList: []cloudflare.FirewallRule{
+			{ID: "r1", Action: "block", Filter: cloudflare.Filter{ID: "f1", Expression: "ip.src in $crowdsec_block"}},
+			{ID: "r2", Filter: cloudflare.Filter{ID: "f2", Expression: "ip.src in $dummy"}},
+		},
+		FilterList: []cloudflare.Filter{
+			{ID: "f1", Expression: "ip.src in $crowdsec_block"},
+			{ID: "f2", Expression: "ip.src in $dummy"},
+		},
+		ZoneList:    []cloudflare.Zone{{ID: "zone1"}},
+		IPListItems: make(map[string][]cloudflare.IPListItem),
+	}
+}
+
+func TestPlanAccount(t *testing.T) {
+	type change struct {
+		Operation string
+		Resource  string
+		ID        string
+	}
+	tests := []struct {
+		name string
+		mode string
+		want []change
+	}{
+		{
+			name: "setup keeps existing list and replaces rules",
+			mode: planModeSetup,
+			want: []change{
+				{"delete", "firewall_rule", "r1"},
+				{"delete", "filter", "f1"},
+				{"create", "firewall_rule", knownAfterApply},
+			},
+		},
+		{
+			name: "cleanup deletes list and its dependencies",
+			mode: planModeCleanup,
+			want: []change{
+				{"delete", "firewall_rule", "r1"},
+				{"delete", "filter", "f1"},
+				{"delete", "ip_list", "11"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newPlanMockAPI()
+			var tokenCallCount uint32
+			worker, recorder := newPlanWorker(dummyCFAccount, api, nil, &tokenCallCount)
+			changes, err := planAccount(worker, recorder, tt.mode, cleanupScope{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]change, len(changes))
+			for i, c := range changes {
+				got[i] = change{c.Operation, c.Resource, c.ID}
+				if c.AccountID != dummyCFAccount.ID {
+					t.Errorf("change %+v has account %s", c, c.AccountID)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("want=%+v, found=%+v", tt.want, got)
+			}
+
+			// nothing must have been applied.
+			ipLists, _ := api.ListIPLists(context.Background())
+			if len(ipLists) != 2 {
+				t.Errorf("expected 2 IP lists to be untouched, found %d", len(ipLists))
+			}
+			if len(api.FirewallRulesList) != 2 || len(api.FilterList) != 2 {
+				t.Errorf("expected rules and filters to be untouched, found %d rules %d filters", len(api.FirewallRulesList), len(api.FilterList))
+			}
+		})
+	}
+}
+
+func Test_writePlan(t *testing.T) {
+	changes := []cloudflareChange{
+		{Operation: "create", Resource: "ip_list", AccountID: "acc", ID: knownAfterApply, Name: "crowdsec_block"},
+		{Operation: "delete", Resource: "ip_list_items", AccountID: "acc", ID: "11", Items: []string{"1.2.3.4"}},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := writePlan(buf, changes, "table"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "Plan: 1 to create, 0 to update, 1 to delete.") {
+		t.Errorf("missing summary in %s", buf.String())
+	}
+	if !strings.Contains(buf.String(), "1.2.3.4") {
+		t.Errorf("missing list items in %s", buf.String())
+	}
+
+	buf.Reset()
+	if err := writePlan(buf, changes, "json"); err != nil {
+		t.Fatal(err)
+	}
+	decoded := make([]cloudflareChange, 0)
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, changes) {
+		t.Errorf("want=%+v, found=%+v", changes, decoded)
+	}
+
+	if err := writePlan(buf, changes, "yaml"); err == nil {
+		t.Error("expected error for unknown format")
+	}
+}
+
+func TestDryRunWorker(t *testing.T) {
+	api := newPlanMockAPI()
+	dryRunCount := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_dry_run_changes"}, []string{"operation", "resource"})
+	var tokenCallCount uint32
+	worker := &CloudflareWorker{
+		Account:        dummyCFAccount,
+		API:            api,
+		UpdatedState:   make(chan *stateUpdate, 10),
+		Count:          prometheus.NewCounter(prometheus.CounterOpts{}),
+		DryRun:         true,
+		DryRunCount:    dryRunCount,
+		tokenCallCount: &tokenCallCount,
+	}
+	if err := worker.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := worker.setUpIPList(); err != nil {
+		t.Fatal(err)
+	}
+
+	ip := "1.2.3.4"
+	ban := "ban"
+	scenario := "crowdsec/demo"
+	worker.NewIPDecisions = []*models.Decision{{Value: &ip, Type: &ban, Scenario: &scenario}}
+	if err := worker.AddNewIPs(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := worker.CFStateByAction["block"].IPListState.ItemByIP[ip]; !ok {
+		t.Errorf("expected %s to be in state after dry run ban", ip)
+	}
+	if len(api.IPListItems) != 0 {
+		t.Errorf("expected no item to be sent to cloudflare, found %+v", api.IPListItems)
+	}
+
+	worker.ExpiredIPDecisions = []*models.Decision{{Value: &ip, Type: &ban, Scenario: &scenario}}
+	if err := worker.DeleteIPs(); err != nil {
+		t.Fatal(err)
+	}
+	if len(worker.CFStateByAction["block"].IPListState.ItemByIP) != 0 {
+		t.Errorf("expected empty state after dry run unban, found %+v", worker.CFStateByAction["block"].IPListState.ItemByIP)
+	}
+
+	if got := testutil.ToFloat64(dryRunCount.WithLabelValues("create", "ip_list_items")); got != 1 {
+		t.Errorf("expected 1 skipped item creation, found %f", got)
+	}
+	if got := testutil.ToFloat64(dryRunCount.WithLabelValues("delete", "ip_list_items")); got != 1 {
+		t.Errorf("expected 1 skipped item deletion, found %f", got)
+	}
+	if len(api.IPLists) != 2 {
+		t.Errorf("expected IP lists to be untouched, found %+v", api.IPLists)
+	}
+}
+
+func TestPlanAccount_cleanupKeepsCachedState(t *testing.T) {
+	api := newPlanMockAPI()
+	api.IPLists = append(api.IPLists, cloudflare.IPList{ID: "13", Name: "crowdsec_challenge"})
+	// the cached state has an action removed from the config and lacks the one added since.
+	cached := map[string]*CloudflareState{"challenge": {
+		AccountID:        dummyCFAccount.ID,
+		Action:           "challenge",
+		FilterIDByZoneID: map[string]string{},
+		IPListState:      IPListState{IPList: &cloudflare.IPList{ID: "13", Name: "crowdsec_challenge"}, ItemByIP: map[string]cloudflare.IPListItem{}},
+	}}
+	var tokenCallCount uint32
+	worker, recorder := newPlanWorker(dummyCFAccount, api, cached, &tokenCallCount)
+	changes, err := planAccount(worker, recorder, planModeCleanup, cleanupScope{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range changes {
+		if c.Operation == "create" {
+			t.Errorf("expected cleanup not to apply the config to the cached state, found %+v", c)
+		}
+	}
+	if _, ok := worker.CFStateByAction["block"]; ok {
+		t.Errorf("expected the cached state to be kept as is, found %+v", worker.CFStateByAction)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/cloudflare/cloudflare-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// newCloudflareState returns the state of an action which has nothing at cloudflare yet.
+func (worker *CloudflareWorker) newCloudflareState(action string) *CloudflareState {
+	return &CloudflareState{
+		AccountID:           worker.Account.ID,
+		Action:              action,
+		IPListState:         IPListState{IPList: &cloudflare.IPList{Name: worker.ipListName(action)}, ItemByIP: make(map[string]cloudflare.IPListItem)},
+		FilterIDByZoneID:    make(map[string]string),
+		CountrySet:          make(map[string]struct{}),
+		AutonomousSystemSet: make(map[string]struct{}),
+	}
+}
+
+func (worker *CloudflareWorker) ipListName(action string) string {
+	return fmt.Sprintf("%s_%s", worker.Account.IPListPrefix, action)
+}
+
+func hasIPList(state *CloudflareState) bool {
+	return state.IPListState.IPList != nil && state.IPListState.IPList.ID != ""
+}
+
+// reconcileState makes the cached state and cloudflare match the config, which may have changed since the
+// cache was written. IP lists are created, renamed or deleted, and the firewall rules of the zones are
+// created or deleted, without touching the IPs which are still enforced.
+func (worker *CloudflareWorker) reconcileState() error {
+	actions := make(map[string]struct{})
+	for _, zone := range worker.Account.ZoneConfigs {
+		for _, action := range zone.Actions {
+			actions[action] = struct{}{}
+		}
+	}
+	listActions := worker.ipListActions()
+
+	for action, state := range worker.CFStateByAction {
+		if _, ok := actions[action]; ok {
+			continue
+		}
+		worker.Logger.Infof("action %s was removed from the config, deleting its components", action)
+		if err := worker.deleteStateIPList(state); err != nil {
+			return err
+		}
+		for zoneID := range state.AccessRuleIDsByZoneID {
+			if err := worker.deleteStateAccessRules(state, zoneID); err != nil {
+				return err
+			}
+		}
+		delete(worker.CFStateByAction, action)
+	}
+
+	for action := range actions {
+		if _, ok := worker.CFStateByAction[action]; !ok {
+			worker.Logger.Infof("action %s was added to the config", action)
+			worker.CFStateByAction[action] = worker.newCloudflareState(action)
+		}
+	}
+
+	for action, state := range worker.CFStateByAction {
+		if _, ok := listActions[action]; !ok {
+			if hasIPList(state) {
+				worker.Logger.Infof("action %s isn't enforced with ip lists anymore", action)
+				if err := worker.deleteStateIPList(state); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err := worker.reconcileIPList(state); err != nil {
+			return err
+		}
+		if err := worker.reconcileZoneRules(state); err != nil {
+			return err
+		}
+	}
+	return worker.reconcileAccessRules()
+}
+
+// deleteStateIPList deletes the IP list of the state with the rules using it, and resets the state.
+func (worker *CloudflareWorker) deleteStateIPList(state *CloudflareState) error {
+	if hasIPList(state) {
+		if err := worker.removeIPListDependencies(state.IPListState.IPList.Name); err != nil {
+			return err
+		}
+		if _, err := worker.getAPI().DeleteIPList(worker.Ctx, state.IPListState.IPList.ID); err != nil {
+			return err
+		}
+		worker.Logger.Infof("deleted ip list %s", state.IPListState.IPList.Name)
+	}
+	fresh := worker.newCloudflareState(state.Action)
+	state.IPListState = fresh.IPListState
+	state.FilterIDByZoneID = fresh.FilterIDByZoneID
+	state.UpdateExpr()
+	return nil
+}
+
+// createStateIPList creates the IP list of the state with the given items, replacing any list with the same name.
+func (worker *CloudflareWorker) createStateIPList(state *CloudflareState, items []cloudflare.IPListItemCreateRequest) error {
+	name := worker.ipListName(state.Action)
+	IPLists, err := worker.getAPI().ListIPLists(worker.Ctx)
+	if err != nil {
+		return err
+	}
+	if id := worker.getIPListID(name, IPLists); id != nil {
+		worker.Logger.Infof("ip list %s already exists", name)
+		if err := worker.removeIPListDependencies(name); err != nil {
+			return err
+		}
+		if _, err := worker.getAPI().DeleteIPList(worker.Ctx, *id); err != nil {
+			return err
+		}
+	}
+	ipList, err := worker.getAPI().CreateIPList(worker.Ctx, name, fmt.Sprintf("%s IP list by crowdsec", state.Action), "ip")
+	if err != nil {
+		return err
+	}
+	ipList.Name = name
+	state.IPListState = IPListState{IPList: &ipList, ItemByIP: make(map[string]cloudflare.IPListItem)}
+	if len(items) > 0 {
+		created, err := worker.getAPI().CreateIPListItems(worker.Ctx, ipList.ID, items)
+		if err != nil {
+			return err
+		}
+		for _, item := range created {
+			state.IPListState.ItemByIP[item.IP] = item
+		}
+		state.IPListState.IPList.NumItems = len(state.IPListState.ItemByIP)
+	}
+	state.FilterIDByZoneID = make(map[string]string)
+	state.UpdateExpr()
+	worker.Logger.Infof("created ip list %s with %d items", name, len(items))
+	return nil
+}
+
+// reconcileIPList creates the IP list of the state if it is missing, and renames it when the prefix changed.
+func (worker *CloudflareWorker) reconcileIPList(state *CloudflareState) error {
+	if !hasIPList(state) {
+		return worker.createStateIPList(state, nil)
+	}
+	oldList := *state.IPListState.IPList
+	if oldList.Name == worker.ipListName(state.Action) {
+		return nil
+	}
+	// ip lists can't be renamed, the items are moved to a new list.
+	worker.Logger.Infof("ip list prefix changed, moving %s to %s", oldList.Name, worker.ipListName(state.Action))
+	items := make([]cloudflare.IPListItemCreateRequest, 0, len(state.IPListState.ItemByIP))
+	for ip, item := range state.IPListState.ItemByIP {
+		items = append(items, cloudflare.IPListItemCreateRequest{IP: ip, Comment: item.Comment})
+	}
+	if err := worker.createStateIPList(state, items); err != nil {
+		return err
+	}
+	if err := worker.removeIPListDependencies(oldList.Name); err != nil {
+		return err
+	}
+	_, err := worker.getAPI().DeleteIPList(worker.Ctx, oldList.ID)
+	return err
+}
+
+// reconcileZoneRules creates the firewall rule of the state in the zones which gained the action,
+// and deletes it from the zones which lost it.
+func (worker *CloudflareWorker) reconcileZoneRules(state *CloudflareState) error {
+	desired := make(map[string]struct{})
+	for _, zone := range worker.ipListZones() {
+		if _, ok := zone.ActionSet[state.Action]; ok {
+			desired[zone.ID] = struct{}{}
+		}
+	}
+	listRef := fmt.Sprintf("$%s", state.IPListState.IPList.Name)
+
+	for zoneID := range state.FilterIDByZoneID {
+		if _, ok := desired[zoneID]; ok {
+			continue
+		}
+		zoneLogger := worker.Logger.WithFields(log.Fields{"zone_id": zoneID})
+		zoneLogger.Infof("zone doesn't have action %s anymore, deleting its rule", state.Action)
+		if err := worker.deleteRulesContainingStringFromZoneIDs(listRef, []string{zoneID}); err != nil {
+			// the zone may have been removed from the account too.
+			zoneLogger.Warningf("while deleting rule: %s", err)
+		} else if err := worker.deleteFiltersContainingStringFromZoneIDs(listRef, []string{zoneID}); err != nil {
+			zoneLogger.Warningf("while deleting filter: %s", err)
+		}
+		delete(state.FilterIDByZoneID, zoneID)
+		delete(state.PausedZoneIDs, zoneID)
+	}
+
+	for zoneID := range desired {
+		if _, ok := state.FilterIDByZoneID[zoneID]; ok {
+			continue
+		}
+		firewallRules := []cloudflare.FirewallRule{{Filter: cloudflare.Filter{Expression: state.CurrExpr}, Action: state.Action, Description: fmt.Sprintf("CrowdSec %s rule", state.Action)}}
+		rule, err := worker.getAPI().CreateFirewallRules(worker.Ctx, zoneID, firewallRules)
+		if err != nil {
+			return err
+		}
+		state.FilterIDByZoneID[zoneID] = rule[0].Filter.ID
+		worker.Logger.WithFields(log.Fields{"zone_id": zoneID}).Infof("created %s rule", state.Action)
+	}
+	return nil
+}
+
+// reconcileAccessRules deletes the access rules of the zones, or of the account, which don't use access rules,
+// or their action, anymore. The access rules of the IP list zones are kept with access_rule_fallback.
+func (worker *CloudflareWorker) reconcileAccessRules() error {
+	actionsByScope := make(map[string]map[string]struct{})
+	for _, backend := range worker.newBackends() {
+		if b, ok := backend.(*accessRuleBackend); ok {
+			actionsByScope[b.zoneID] = make(map[string]struct{})
+		}
+	}
+	if worker.Account.AccessRuleFallback {
+		for _, zone := range worker.ipListZones() {
+			actionsByScope[zone.ID] = make(map[string]struct{})
+		}
+	}
+	for _, zone := range worker.Account.ZoneConfigs {
+		actions, ok := actionsByScope[zone.ID]
+		if !ok && worker.usesAccessRules(zone) {
+			// enforced by the access rules of the account.
+			actions, ok = actionsByScope[""]
+		}
+		if !ok {
+			continue
+		}
+		for action := range zone.ActionSet {
+			actions[action] = struct{}{}
+		}
+	}
+	for action, state := range worker.CFStateByAction {
+		for zoneID := range state.AccessRuleIDsByZoneID {
+			if _, ok := actionsByScope[zoneID][action]; ok {
+				continue
+			}
+			if err := worker.deleteStateAccessRules(state, zoneID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deleteStateAccessRules deletes the access rules of the state in the zone, or at account level for the empty zone ID.
+func (worker *CloudflareWorker) deleteStateAccessRules(state *CloudflareState, zoneID string) error {
+	backend := &accessRuleBackend{worker: worker, zoneID: zoneID}
+	ruleIDByIP := state.AccessRuleIDsByZoneID[zoneID]
+	for _, id := range ruleIDByIP {
+		if err := backend.deleteRule(id); err != nil {
+			return err
+		}
+	}
+	if len(ruleIDByIP) > 0 {
+		backend.logger().Infof("deleted %d %s access rules", len(ruleIDByIP), state.Action)
+	}
+	delete(state.AccessRuleIDsByZoneID, zoneID)
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestCloudflareWorker_reconcileState(t *testing.T) {
+	var tokenCallCount uint32
+	api := &mockCloudflareAPI{
+		IPLists: []cloudflare.IPList{{ID: "11", Name: "crowdsec_block"}, {ID: "12", Name: "crowdsec_challenge"}},
+		FirewallRulesList: []cloudflare.FirewallRule{
+			{ID: "r1", Filter: cloudflare.Filter{ID: "f1", Expression: "(ip.src in $crowdsec_block)"}},
+			{ID: "r2", Filter: cloudflare.Filter{ID: "f3", Expression: "(ip.src in $crowdsec_challenge)"}},
+		},
+		IPListItems: map[string][]cloudflare.IPListItem{"11": {{ID: "i1", IP: "1.2.3.4"}}},
+		ZoneList:    []cloudflare.Zone{{ID: "zone1"}, {ID: "zone2"}},
+	}
+	// the cache was written with the default prefix, challenge on zone1 and block on both zones.
+	cached := map[string]*CloudflareState{
+		"block": {
+			AccountID:        "dummyID",
+			Action:           "block",
+			CurrExpr:         "(ip.src in $crowdsec_block)",
+			FilterIDByZoneID: map[string]string{"zone1": "f1", "zone2": "f2"},
+			IPListState: IPListState{
+				IPList:   &cloudflare.IPList{ID: "11", Name: "crowdsec_block"},
+				ItemByIP: map[string]cloudflare.IPListItem{"1.2.3.4": {ID: "i1", IP: "1.2.3.4", Comment: "crowdsec/demo"}},
+			},
+		},
+		"challenge": {
+			AccountID:        "dummyID",
+			Action:           "challenge",
+			CurrExpr:         "(ip.src in $crowdsec_challenge)",
+			FilterIDByZoneID: map[string]string{"zone1": "f3"},
+			IPListState: IPListState{
+				IPList:   &cloudflare.IPList{ID: "12", Name: "crowdsec_challenge"},
+				ItemByIP: map[string]cloudflare.IPListItem{},
+			},
+		},
+	}
+	worker := &CloudflareWorker{
+		Account: AccountConfig{
+			ID:            "dummyID",
+			IPListPrefix:  "cs",
+			DefaultAction: "block",
+			ZoneConfigs: []ZoneConfig{{
+				ID:        "zone1",
+				Actions:   []string{"block", "js_challenge"},
+				ActionSet: map[string]struct{}{"block": {}, "js_challenge": {}},
+			}},
+		},
+		API:             api,
+		Ctx:             context.Background(),
+		CFStateByAction: cached,
+		Logger:          log.WithFields(log.Fields{"account_id": "test worker"}),
+		Count:           prometheus.NewCounter(prometheus.CounterOpts{}),
+		tokenCallCount:  &tokenCallCount,
+	}
+
+	if err := worker.reconcileState(); err != nil {
+		t.Fatal(err)
+	}
+
+	actions := make([]string, 0)
+	for action, state := range worker.CFStateByAction {
+		actions = append(actions, action)
+		if _, ok := state.FilterIDByZoneID["zone1"]; !ok || len(state.FilterIDByZoneID) != 1 {
+			t.Errorf("expected %s rule on zone1 only, found %+v", action, state.FilterIDByZoneID)
+		}
+		if want := "cs_" + action; state.IPListState.IPList.Name != want || state.CurrExpr != "(ip.src in $"+want+")" {
+			t.Errorf("expected list %s, found %s with expression %s", want, state.IPListState.IPList.Name, state.CurrExpr)
+		}
+	}
+	sort.Strings(actions)
+	if !reflect.DeepEqual(actions, []string{"block", "js_challenge"}) {
+		t.Errorf("expected block and js_challenge states, found %+v", actions)
+	}
+	if _, ok := worker.CFStateByAction["block"].IPListState.ItemByIP["1.2.3.4"]; !ok {
+		t.Errorf("expected banned IP to be moved to the new list, found %+v", worker.CFStateByAction["block"].IPListState.ItemByIP)
+	}
+
+	listNames := make([]string, 0)
+	for _, ipList := range api.IPLists {
+		listNames = append(listNames, ipList.Name)
+	}
+	sort.Strings(listNames)
+	if !reflect.DeepEqual(listNames, []string{"cs_block", "cs_js_challenge"}) {
+		t.Errorf("expected old lists to be replaced, found %+v", listNames)
+	}
+	for _, rule := range api.FirewallRulesList {
+		if strings.Contains(rule.Filter.Expression, "$crowdsec_") {
+			t.Errorf("expected rules of old lists to be deleted, found %+v", rule)
+		}
+	}
+	if len(api.FirewallRulesList) != 2 {
+		t.Errorf("expected one rule per action, found %+v", api.FirewallRulesList)
+	}
+}
@@ -59,5 +59,5 @@ fi
 
 install_bouncer
 echo "Please configure '${CONFIG_DIR}crowdsec-cloudflare-bouncer.yaml'."
-echo "Configuration can be autogenerated using /usr/local/bin/crowdsec-cloudflare-bouncer -g <CF_TOKEN_1>,<CF_TOKEN_2> "
+echo "Configuration can be autogenerated using /usr/local/bin/crowdsec-cloudflare-bouncer generate <CF_TOKEN_1>,<CF_TOKEN_2> "
 echo "After configuration run the command 'systemctl start crowdsec-cloudflare-bouncer.service' to start the bouncer"
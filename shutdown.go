@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/coreos/go-systemd/daemon"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultShutdownTimeout = 30 * time.Second
+
+// handleSignals cancels the context on the first SIGTERM or SIGINT, so that the bouncer shuts down
+// gracefully, and exits at once on the second one.
+func handleSignals(cancel context.CancelFunc, notifySystemd bool) {
+	signalChan := make(chan os.Signal, 2)
+	signal.Notify(signalChan, syscall.SIGTERM, syscall.SIGINT)
+	s := <-signalChan
+	log.Infof("received %s, shutting down cloudflare-bouncer service", s)
+	if notifySystemd {
+		if _, err := daemon.SdNotify(false, "STOPPING=1"); err != nil {
+			log.Errorf("failed to notify: %v", err)
+		}
+	}
+	cancel()
+	s = <-signalChan
+	log.Warningf("received %s again, exiting without waiting for the workers", s)
+	os.Exit(1)
+}
+
+// stop flushes the pending decisions to cloudflare and publishes the final state of the worker. The
+// flush is aborted if the worker's context is cancelled because the shutdown timed out.
+func (worker *CloudflareWorker) stop() {
+	pendingDecisions := len(worker.NewIPDecisions) + len(worker.ExpiredIPDecisions) +
+		len(worker.NewCountryDecisions) + len(worker.ExpiredCountryDecisions) +
+		len(worker.NewASDecisions) + len(worker.ExpiredASDecisions)
+	if pendingDecisions > 0 {
+		worker.Logger.Infof("flushing %d pending decisions before stopping", pendingDecisions)
+		if err := worker.flushDecisions(); err != nil {
+			worker.Logger.Errorf("while flushing pending decisions: %s", err)
+		}
+	}
+	worker.publishState()
+	worker.Logger.Info("worker stopped")
+}
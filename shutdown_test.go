@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+)
+
+func TestCloudflareWorker_stop(t *testing.T) {
+	worker := newTestWorker()
+	stateStream := make(chan *stateUpdate)
+	worker.UpdatedState = stateStream
+	lastItems := make(chan map[string]cloudflare.IPListItem)
+	go func() {
+		var items map[string]cloudflare.IPListItem
+		for update := range stateStream {
+			items = update.applyItems("challenge", items)
+		}
+		lastItems <- items
+	}()
+	ip, decisionType, scope, scenario := "1.2.3.4", "captcha", "ip", "crowdsec/demo"
+	worker.CollectLAPIStream(&models.DecisionsStreamResponse{New: []*models.Decision{{Value: &ip, Type: &decisionType, Scope: &scope, Scenario: &scenario}}})
+
+	worker.stop()
+	if len(worker.NewIPDecisions) != 0 {
+		t.Errorf("expected the pending decisions to be flushed, found %d", len(worker.NewIPDecisions))
+	}
+	close(stateStream)
+	final := <-lastItems
+	if _, ok := final["1.2.3.4"]; !ok {
+		t.Errorf("expected the final state to have the flushed decision, found %+v", final)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"github.com/cloudflare/cloudflare-go"
+)
+
+func copyStringSet(set map[string]struct{}) map[string]struct{} {
+	if set == nil {
+		return nil
+	}
+	copied := make(map[string]struct{}, len(set))
+	for key := range set {
+		copied[key] = struct{}{}
+	}
+	return copied
+}
+
+func copyStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(m))
+	for key, value := range m {
+		copied[key] = value
+	}
+	return copied
+}
+
+// snapshot returns a deep copy of the state, which the worker can keep mutating while the copy is written.
+func (cfState *CloudflareState) snapshot() *CloudflareState {
+	copied := cfState.snapshotWithoutItems()
+	if cfState.IPListState.ItemByIP != nil {
+		copied.IPListState.ItemByIP = make(map[string]cloudflare.IPListItem, len(cfState.IPListState.ItemByIP))
+		for ip, item := range cfState.IPListState.ItemByIP {
+			copied.IPListState.ItemByIP[ip] = item
+		}
+	}
+	return copied
+}
+
+// snapshotWithoutItems returns a deep copy of the state without its IP list items.
+func (cfState *CloudflareState) snapshotWithoutItems() *CloudflareState {
+	copied := *cfState
+	copied.FilterIDByZoneID = copyStringMap(cfState.FilterIDByZoneID)
+	copied.CountrySet = copyStringSet(cfState.CountrySet)
+	copied.AutonomousSystemSet = copyStringSet(cfState.AutonomousSystemSet)
+	copied.PausedZoneIDs = copyStringSet(cfState.PausedZoneIDs)
+	if cfState.IPListState.IPList != nil {
+		ipList := *cfState.IPListState.IPList
+		copied.IPListState.IPList = &ipList
+	}
+	copied.IPListState.ItemByIP = nil
+	copied.IPListState.loadItems = nil
+	if cfState.AccessRuleIDsByZoneID != nil {
+		copied.AccessRuleIDsByZoneID = make(map[string]map[string]string, len(cfState.AccessRuleIDsByZoneID))
+		for zoneID, ruleIDByIP := range cfState.AccessRuleIDsByZoneID {
+			copied.AccessRuleIDsByZoneID[zoneID] = copyStringMap(ruleIDByIP)
+		}
+	}
+	if cfState.ManualBans != nil {
+		copied.ManualBans = make(map[string]manualBan, len(cfState.ManualBans))
+		for value, ban := range cfState.ManualBans {
+			copied.ManualBans[value] = ban
+		}
+	}
+	return &copied
+}
+
+// stateUpdate is what a worker publishes to the state writer. The IP list items aren't part of the
+// states, only the items which changed since the previous update of the worker are sent.
+type stateUpdate struct {
+	// States are the states of the account by action, without their IP list items.
+	States map[string]*CloudflareState
+	// ItemChanges are the changed items by action and IP, nil for the deleted ones.
+	ItemChanges map[string]map[string]*cloudflare.IPListItem
+	// ReplacedItems are the actions whose stored items are replaced by their item changes.
+	ReplacedItems map[string]struct{}
+}
+
+// newStateUpdate returns the update replacing the stored states, with their items, by the states.
+func newStateUpdate(states map[string]*CloudflareState) *stateUpdate {
+	update := &stateUpdate{
+		States:        make(map[string]*CloudflareState, len(states)),
+		ItemChanges:   make(map[string]map[string]*cloudflare.IPListItem, len(states)),
+		ReplacedItems: make(map[string]struct{}, len(states)),
+	}
+	for key, state := range states {
+		update.States[key] = state.snapshotWithoutItems()
+		update.ItemChanges[key] = make(map[string]*cloudflare.IPListItem, len(state.IPListState.ItemByIP))
+		for ip, item := range state.IPListState.ItemByIP {
+			item := item
+			update.ItemChanges[key][ip] = &item
+		}
+		update.ReplacedItems[key] = struct{}{}
+	}
+	return update
+}
+
+// applyItems returns the items of the state after the update, from the items stored before it.
+// The stored items are modified.
+func (update *stateUpdate) applyItems(key string, stored map[string]cloudflare.IPListItem) map[string]cloudflare.IPListItem {
+	if _, ok := update.ReplacedItems[key]; ok || stored == nil {
+		stored = make(map[string]cloudflare.IPListItem, len(update.ItemChanges[key]))
+	}
+	for ip, item := range update.ItemChanges[key] {
+		if item == nil {
+			delete(stored, ip)
+		} else {
+			stored[ip] = *item
+		}
+	}
+	return stored
+}
+
+// stateUpdate returns the update of the states of the worker since its previous one.
+func (worker *CloudflareWorker) stateUpdate() *stateUpdate {
+	if worker.publishedItemIDs == nil {
+		worker.publishedItemIDs = make(map[string]map[string]string)
+	}
+	update := &stateUpdate{
+		States:        make(map[string]*CloudflareState, len(worker.CFStateByAction)),
+		ItemChanges:   make(map[string]map[string]*cloudflare.IPListItem),
+		ReplacedItems: make(map[string]struct{}),
+	}
+	for action, state := range worker.CFStateByAction {
+		update.States[action] = state.snapshotWithoutItems()
+		if !state.IPListState.itemsLoaded() {
+			// the stored items are still the ones of the state.
+			continue
+		}
+		published, ok := worker.publishedItemIDs[action]
+		if !ok {
+			update.ReplacedItems[action] = struct{}{}
+		}
+		changes := make(map[string]*cloudflare.IPListItem)
+		ids := make(map[string]string, len(state.IPListState.ItemByIP))
+		for ip, item := range state.IPListState.ItemByIP {
+			ids[ip] = item.ID
+			if id, found := published[ip]; found && id == item.ID {
+				continue
+			}
+			item := item
+			changes[ip] = &item
+		}
+		for ip := range published {
+			if _, found := ids[ip]; !found {
+				changes[ip] = nil
+			}
+		}
+		if len(changes) > 0 || !ok {
+			update.ItemChanges[action] = changes
+		}
+		worker.publishedItemIDs[action] = ids
+	}
+	for action := range worker.publishedItemIDs {
+		if _, ok := worker.CFStateByAction[action]; !ok {
+			delete(worker.publishedItemIDs, action)
+		}
+	}
+	return update
+}
+
+// loadStateItems reads the IP list items of the states which were loaded without them. They are the
+// published items the next updates are computed from.
+func (worker *CloudflareWorker) loadStateItems() error {
+	if worker.publishedItemIDs == nil {
+		worker.publishedItemIDs = make(map[string]map[string]string)
+	}
+	for action, state := range worker.CFStateByAction {
+		if state.IPListState.itemsLoaded() {
+			continue
+		}
+		if err := state.IPListState.load(); err != nil {
+			return err
+		}
+		ids := make(map[string]string, len(state.IPListState.ItemByIP))
+		for ip, item := range state.IPListState.ItemByIP {
+			ids[ip] = item.ID
+		}
+		worker.publishedItemIDs[action] = ids
+	}
+	return nil
+}
+
+// publishState sends the update of the states to the state writer. Sending from the worker's goroutine
+// keeps the updates of a worker in order, the writer never sees an older state after a newer one.
+func (worker *CloudflareWorker) publishState() {
+	if worker.UpdatedState == nil {
+		return
+	}
+	worker.UpdatedState <- worker.stateUpdate()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestCloudflareState_snapshot(t *testing.T) {
+	state := newTestState("account1", "block", 2)
+	state.AccessRuleIDsByZoneID = map[string]map[string]string{"": {"1.2.3.4": "rule1"}}
+	snapshot := state.snapshot()
+	if !reflect.DeepEqual(state, snapshot) {
+		t.Fatalf("expected=%+v\n found=%+v", state, snapshot)
+	}
+
+	state.IPListState.ItemByIP["1.2.3.4"] = cloudflare.IPListItem{ID: "new"}
+	state.IPListState.IPList.NumItems = 3
+	state.FilterIDByZoneID["zone2"] = "filter2"
+	state.CountrySet["FR"] = struct{}{}
+	state.AccessRuleIDsByZoneID[""]["5.6.7.8"] = "rule2"
+	if len(snapshot.IPListState.ItemByIP) != 2 || snapshot.IPListState.IPList.NumItems != 0 || len(snapshot.FilterIDByZoneID) != 1 ||
+		len(snapshot.CountrySet) != 0 || len(snapshot.AccessRuleIDsByZoneID[""]) != 1 {
+		t.Errorf("expected snapshot to be unchanged, found %+v", snapshot)
+	}
+}
+
+// TestConcurrentWorkersStatePublication is meant to be run with -race.
+func TestConcurrentWorkersStatePublication(t *testing.T) {
+	cachePath = filepath.Join(t.TempDir(), "cache.json")
+	stateStream := make(chan *stateUpdate)
+	store := &jsonFileStore{states: make([]CloudflareState, 0)}
+	writerDone := make(chan error)
+	go func() {
+		for update := range stateStream {
+			if err := store.Update(update); err != nil {
+				writerDone <- err
+				return
+			}
+		}
+		writerDone <- nil
+	}()
+
+	ban := "ban"
+	scenario := "crowdsec/demo"
+	workerCount := 4
+	wg := sync.WaitGroup{}
+	for i := 0; i < workerCount; i++ {
+		var tokenCallCount uint32
+		accountID := fmt.Sprintf("account%d", i)
+		worker := &CloudflareWorker{
+			Account: AccountConfig{
+				ID:            accountID,
+				ZoneConfigs:   []ZoneConfig{{ID: accountID + "zone", Actions: []string{"block"}, ActionSet: map[string]struct{}{"block": {}}}},
+				DefaultAction: "block",
+				IPListPrefix:  "crowdsec",
+			},
+			API:          &mockCloudflareAPI{IPListItems: make(map[string][]cloudflare.IPListItem)},
+			UpdatedState: stateStream,
+			CFStateByAction: map[string]*CloudflareState{
+				"block": {
+					AccountID:   accountID,
+					Action:      "block",
+					IPListState: IPListState{IPList: &cloudflare.IPList{ID: "list", Name: "crowdsec_block"}, ItemByIP: make(map[string]cloudflare.IPListItem)},
+				},
+			},
+			Logger:         log.WithFields(log.Fields{"account_id": accountID}),
+			Count:          prometheus.NewCounter(prometheus.CounterOpts{}),
+			tokenCallCount: &tokenCallCount,
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for round := 0; round < 2; round++ {
+				ip := fmt.Sprintf("1.2.3.%d", round)
+				worker.NewIPDecisions = []*models.Decision{{Value: &ip, Type: &ban, Scenario: &scenario}}
+				if err := worker.AddNewIPs(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+			ip := "1.2.3.0"
+			worker.ExpiredIPDecisions = []*models.Decision{{Value: &ip, Type: &ban, Scenario: &scenario}}
+			if err := worker.DeleteIPs(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(stateStream)
+	if err := <-writerDone; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(store.states) != workerCount {
+		t.Fatalf("expected one state per worker, found %d", len(store.states))
+	}
+	for i, state := range store.states {
+		if state.AccountID != fmt.Sprintf("account%d", i) {
+			t.Errorf("expected states sorted by account, found %s at %d", state.AccountID, i)
+		}
+		if _, ok := state.IPListState.ItemByIP["1.2.3.1"]; !ok || len(state.IPListState.ItemByIP) != 1 {
+			t.Errorf("expected the last snapshot of %s, found %+v", state.AccountID, state.IPListState.ItemByIP)
+		}
+	}
+}
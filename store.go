@@ -0,0 +1,562 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	jsonStateStore = "json"
+	boltStateStore = "bolt"
+)
+
+// stateStore persists the states of the workers across restarts.
+type stateStore interface {
+	// LoadAccount returns the states of the account by action. Their IP list items may be loaded lazily.
+	LoadAccount(accountID string) (map[string]*CloudflareState, error)
+	// LoadAll returns the states of every account, with their IP list items.
+	LoadAll() ([]CloudflareState, error)
+	// Update persists the update sent by a worker. The other states of its account are removed, their
+	// actions were removed from the account.
+	Update(update *stateUpdate) error
+	// Delete removes every state.
+	Delete() error
+	// Owner returns the owner of the stored states, nil if unknown.
+	Owner() *cacheOwner
+	// SetOwner changes the owner and forgets the states of the accounts it doesn't have.
+	// Like the states, it is persisted by the next update.
+	SetOwner(owner cacheOwner)
+	Close() error
+}
+
+// adoptStateStore makes the store belong to the owner. States written for other accounts by another
+// instance are refused, the states of accounts removed from the config are forgotten.
+func adoptStateStore(store stateStore, owner cacheOwner) error {
+	cached := store.Owner()
+	if cached == nil || cached.ConfigHash == owner.ConfigHash {
+		store.SetOwner(owner)
+		return nil
+	}
+	accountIDs := make(map[string]struct{}, len(owner.AccountIDs))
+	for _, id := range owner.AccountIDs {
+		accountIDs[id] = struct{}{}
+	}
+	removed := make([]string, 0)
+	for _, id := range cached.AccountIDs {
+		if _, ok := accountIDs[id]; !ok {
+			removed = append(removed, id)
+		}
+	}
+	if len(cached.AccountIDs) > 0 && len(removed) == len(cached.AccountIDs) {
+		return fmt.Errorf("cache %s belongs to another config with accounts %s, set a different 'cache_path' for each bouncer instance or run with -d first",
+			cachePath, strings.Join(cached.AccountIDs, ", "))
+	}
+	log.Infof("config changed since the cache was written")
+	for _, id := range removed {
+		log.Warningf("account %s was removed from the config, forgetting its state. Its IP lists and rules are left at cloudflare", id)
+	}
+	store.SetOwner(owner)
+	return nil
+}
+
+// forgetAccounts removes the states of the accounts from the store, the other accounts of the owner keep theirs.
+// The config hash is kept, the cleaned accounts are set up again by the next run of the same config.
+func forgetAccounts(store stateStore, owner cacheOwner, accountIDs []string) error {
+	forgotten := cacheOwner{AccountIDs: accountIDs}
+	kept := cacheOwner{ConfigHash: owner.ConfigHash, AccountIDs: make([]string, 0, len(owner.AccountIDs))}
+	for _, id := range owner.AccountIDs {
+		if !ownsAccount(forgotten, id) {
+			kept.AccountIDs = append(kept.AccountIDs, id)
+		}
+	}
+	store.SetOwner(kept)
+	return store.Update(&stateUpdate{})
+}
+
+// removedState returns a function telling if a stored state is replaced by the update without being part of it.
+func removedState(states map[string]*CloudflareState) func(key string) bool {
+	accountIDs := make(map[string]struct{}, 1)
+	keys := make(map[string]struct{}, len(states))
+	for _, state := range states {
+		accountIDs[state.AccountID] = struct{}{}
+		keys[stateKey(state)] = struct{}{}
+	}
+	return func(key string) bool {
+		_, updated := keys[key]
+		_, replaced := accountIDs[strings.SplitN(key, "/", 2)[0]]
+		return replaced && !updated
+	}
+}
+
+func ownsAccount(owner cacheOwner, accountID string) bool {
+	for _, id := range owner.AccountIDs {
+		if id == accountID {
+			return true
+		}
+	}
+	return false
+}
+
+// openStateStore opens the store selected by the config. A corrupt JSON cache is discarded, the other
+// errors are returned so that a valid cache which can't be read isn't lost.
+func openStateStore(kind string) (stateStore, error) {
+	switch kind {
+	case "", jsonStateStore:
+		store := &jsonFileStore{states: make([]CloudflareState, 0)}
+		owner, err := loadCachedStates(&store.states)
+		if err != nil && !errors.Is(err, errCorruptCache) {
+			return nil, fmt.Errorf("while reading cache %s: %w", cachePath, err)
+		}
+		if err != nil {
+			discardCorruptCache(err)
+			store.states = make([]CloudflareState, 0)
+			owner = nil
+		}
+		store.owner = owner
+		return store, nil
+	case boltStateStore:
+		return openBoltStore(boltPath())
+	}
+	return nil, fmt.Errorf("unknown state store '%s'", kind)
+}
+
+// errReadOnlyStore is returned by the writes to a store opened read-only.
+var errReadOnlyStore = errors.New("the cache is opened read-only")
+
+// openStateStoreReadOnly opens the store selected by the config for the commands which only read it,
+// such as plan, export and dry run. The cache is left as is: a corrupt cache is ignored instead of being
+// discarded and a missing bolt store is read from the JSON cache instead of importing it.
+func openStateStoreReadOnly(kind string) (stateStore, error) {
+	switch kind {
+	case "", jsonStateStore:
+	case boltStateStore:
+		if _, err := os.Stat(boltPath()); err == nil {
+			store, err := openBoltStoreReadOnly(boltPath())
+			if err != nil {
+				return nil, err
+			}
+			return readOnlyStore{store}, nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown state store '%s'", kind)
+	}
+	store := &jsonFileStore{states: make([]CloudflareState, 0)}
+	owner, err := loadCachedStates(&store.states)
+	if errors.Is(err, errCorruptCache) {
+		log.Warningf("ignoring cache %s: %s", cachePath, err)
+		return readOnlyStore{&jsonFileStore{states: make([]CloudflareState, 0)}}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("while reading cache %s: %w", cachePath, err)
+	}
+	store.owner = owner
+	return readOnlyStore{store}, nil
+}
+
+// readOnlyStore refuses the writes to the store, the owner is only changed in memory.
+type readOnlyStore struct {
+	stateStore
+}
+
+func (s readOnlyStore) Update(update *stateUpdate) error {
+	return errReadOnlyStore
+}
+
+func (s readOnlyStore) Delete() error {
+	return errReadOnlyStore
+}
+
+// jsonFileStore keeps every state in memory and rewrites the whole cache file on each update.
+type jsonFileStore struct {
+	states []CloudflareState
+	owner  *cacheOwner
+}
+
+func (s *jsonFileStore) LoadAccount(accountID string) (map[string]*CloudflareState, error) {
+	states := make(map[string]*CloudflareState)
+	for i := range s.states {
+		if s.states[i].AccountID == accountID {
+			// the updates modify the stored items, the worker gets its own.
+			states[s.states[i].Action] = s.states[i].snapshot()
+		}
+	}
+	return states, nil
+}
+
+func (s *jsonFileStore) LoadAll() ([]CloudflareState, error) {
+	return s.states, nil
+}
+
+func (s *jsonFileStore) Update(update *stateUpdate) error {
+	isRemoved := removedState(update.States)
+	kept := make([]CloudflareState, 0, len(s.states))
+	storedItems := make(map[string]map[string]cloudflare.IPListItem, len(s.states))
+	for _, state := range s.states {
+		if !isRemoved(stateKey(&state)) {
+			kept = append(kept, state)
+			storedItems[stateKey(&state)] = state.IPListState.ItemByIP
+		}
+	}
+	s.states = kept
+	states := make(map[string]*CloudflareState, len(update.States))
+	for key, state := range update.States {
+		updated := *state
+		updated.IPListState.ItemByIP = update.applyItems(key, storedItems[stateKey(state)])
+		states[key] = &updated
+	}
+	updateStates(&s.states, states)
+	return dumpStates(&s.states, s.owner)
+}
+
+func (s *jsonFileStore) Delete() error {
+	s.states = make([]CloudflareState, 0)
+	return deleteCacheIfExists()
+}
+
+func (s *jsonFileStore) Owner() *cacheOwner {
+	return s.owner
+}
+
+func (s *jsonFileStore) SetOwner(owner cacheOwner) {
+	s.owner = &owner
+	kept := make([]CloudflareState, 0, len(s.states))
+	for _, state := range s.states {
+		if ownsAccount(owner, state.AccountID) {
+			kept = append(kept, state)
+		}
+	}
+	s.states = kept
+}
+
+func (s *jsonFileStore) Close() error {
+	return nil
+}
+
+var (
+	boltStatesBucket = []byte("states")
+	boltItemsBucket  = []byte("items")
+	boltMetaBucket   = []byte("meta")
+	boltOwnerKey     = []byte("owner")
+)
+
+// boltPath returns the path of the bolt store, next to the JSON cache.
+func boltPath() string {
+	return strings.TrimSuffix(cachePath, ".json") + ".db"
+}
+
+// boltStore persists each state without its IP list items in the states bucket, and the items in a
+// bucket per state, keyed by IP. Updates only write the items which changed, the items of a state are
+// read when its worker needs them.
+type boltStore struct {
+	db    *bolt.DB
+	path  string
+	owner *cacheOwner
+	// the owner changed since the last update.
+	ownerChanged bool
+}
+
+// openBoltStore opens the store, importing the JSON cache if the store is new.
+func openBoltStore(path string) (*boltStore, error) {
+	_, statErr := os.Stat(path)
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	s := &boltStore{db: db, path: path}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltStatesBucket, boltItemsBucket, boltMetaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		if value := tx.Bucket(boltMetaBucket).Get(boltOwnerKey); value != nil {
+			s.owner = &cacheOwner{}
+			return json.Unmarshal(value, s.owner)
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if os.IsNotExist(statErr) {
+		if err := s.importJSONCache(); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// openBoltStoreReadOnly opens an existing store without writing to it.
+func openBoltStoreReadOnly(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	s := &boltStore{db: db, path: path}
+	err = db.View(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltStatesBucket, boltItemsBucket, boltMetaBucket} {
+			if tx.Bucket(name) == nil {
+				return fmt.Errorf("bucket %s not found in %s", name, path)
+			}
+		}
+		if value := tx.Bucket(boltMetaBucket).Get(boltOwnerKey); value != nil {
+			s.owner = &cacheOwner{}
+			return json.Unmarshal(value, s.owner)
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *boltStore) importJSONCache() error {
+	states := make([]CloudflareState, 0)
+	owner, err := loadCachedStates(&states)
+	if errors.Is(err, errCorruptCache) {
+		log.Warningf("not importing cache %s: %s", cachePath, err)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("while importing cache %s: %w", cachePath, err)
+	}
+	if len(states) == 0 {
+		return nil
+	}
+	if owner != nil {
+		s.owner = owner
+		s.ownerChanged = true
+	}
+	byKey := make(map[string]*CloudflareState, len(states))
+	for i := range states {
+		byKey[stateKey(&states[i])] = &states[i]
+	}
+	if err := s.update(newStateUpdate(byKey), nil); err != nil {
+		return err
+	}
+	log.Infof("imported %d states from %s", len(states), cachePath)
+	return nil
+}
+
+func stateKey(state *CloudflareState) string {
+	return state.AccountID + "/" + state.Action
+}
+
+// readState reads the state without its items.
+func (s *boltStore) readState(key []byte, value []byte) (*CloudflareState, error) {
+	state := &CloudflareState{}
+	if err := json.Unmarshal(value, state); err != nil {
+		return nil, fmt.Errorf("while reading state %s: %w", key, err)
+	}
+	return state, nil
+}
+
+// readItems reads the items of the state.
+func (s *boltStore) readItems(tx *bolt.Tx, key []byte) (map[string]cloudflare.IPListItem, error) {
+	itemByIP := make(map[string]cloudflare.IPListItem)
+	items := tx.Bucket(boltItemsBucket).Bucket(key)
+	if items == nil {
+		return itemByIP, nil
+	}
+	err := items.ForEach(func(ip, value []byte) error {
+		item := cloudflare.IPListItem{}
+		if err := json.Unmarshal(value, &item); err != nil {
+			return fmt.Errorf("while reading item %s of state %s: %w", ip, key, err)
+		}
+		itemByIP[string(ip)] = item
+		return nil
+	})
+	return itemByIP, err
+}
+
+// LoadAccount returns the states of the account, their items are read on first use.
+func (s *boltStore) LoadAccount(accountID string) (map[string]*CloudflareState, error) {
+	states := make(map[string]*CloudflareState)
+	prefix := []byte(accountID + "/")
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltStatesBucket).Cursor()
+		for key, value := c.Seek(prefix); key != nil && strings.HasPrefix(string(key), string(prefix)); key, value = c.Next() {
+			state, err := s.readState(key, value)
+			if err != nil {
+				return err
+			}
+			key := append([]byte{}, key...)
+			state.IPListState.loadItems = func() (itemByIP map[string]cloudflare.IPListItem, err error) {
+				err = s.db.View(func(tx *bolt.Tx) error {
+					itemByIP, err = s.readItems(tx, key)
+					return err
+				})
+				return itemByIP, err
+			}
+			states[state.Action] = state
+		}
+		return nil
+	})
+	return states, err
+}
+
+func (s *boltStore) LoadAll() ([]CloudflareState, error) {
+	states := make([]CloudflareState, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltStatesBucket).ForEach(func(key, value []byte) error {
+			state, err := s.readState(key, value)
+			if err != nil {
+				return err
+			}
+			if state.IPListState.ItemByIP, err = s.readItems(tx, key); err != nil {
+				return err
+			}
+			states = append(states, *state)
+			return nil
+		})
+	})
+	return states, err
+}
+
+func (s *boltStore) Update(update *stateUpdate) error {
+	return s.update(update, removedState(update.States))
+}
+
+// update writes the update and deletes the stored states for which isRemoved returns true, when set.
+func (s *boltStore) update(update *stateUpdate, isRemoved func(key string) bool) error {
+	if len(update.States) == 0 && !s.ownerChanged {
+		return nil
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if s.ownerChanged {
+			if err := s.writeOwner(tx); err != nil {
+				return err
+			}
+		}
+		if isRemoved != nil {
+			if err := s.deleteStates(tx, isRemoved); err != nil {
+				return err
+			}
+		}
+		names := make([]string, 0, len(update.States))
+		for name := range update.States {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			state := update.States[name]
+			key := []byte(stateKey(state))
+			value, err := json.Marshal(state)
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket(boltStatesBucket).Put(key, value); err != nil {
+				return err
+			}
+			if _, ok := update.ReplacedItems[name]; ok && tx.Bucket(boltItemsBucket).Bucket(key) != nil {
+				if err := tx.Bucket(boltItemsBucket).DeleteBucket(key); err != nil {
+					return err
+				}
+			}
+			items, err := tx.Bucket(boltItemsBucket).CreateBucketIfNotExists(key)
+			if err != nil {
+				return err
+			}
+			for ip, item := range update.ItemChanges[name] {
+				if item == nil {
+					if err := items.Delete([]byte(ip)); err != nil {
+						return err
+					}
+					continue
+				}
+				value, err := json.Marshal(item)
+				if err != nil {
+					return err
+				}
+				if err := items.Put([]byte(ip), value); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.ownerChanged = false
+	return nil
+}
+
+// writeOwner persists the owner and deletes the states of the accounts it doesn't have.
+func (s *boltStore) writeOwner(tx *bolt.Tx) error {
+	value, err := json.Marshal(s.owner)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltMetaBucket).Put(boltOwnerKey, value); err != nil {
+		return err
+	}
+	return s.deleteStates(tx, func(key string) bool {
+		return !ownsAccount(*s.owner, strings.SplitN(key, "/", 2)[0])
+	})
+}
+
+// deleteStates deletes the states, with their items, whose key is selected.
+func (s *boltStore) deleteStates(tx *bolt.Tx, selected func(key string) bool) error {
+	forgotten := make([][]byte, 0)
+	err := tx.Bucket(boltStatesBucket).ForEach(func(key, value []byte) error {
+		if selected(string(key)) {
+			forgotten = append(forgotten, append([]byte{}, key...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range forgotten {
+		if err := tx.Bucket(boltStatesBucket).Delete(key); err != nil {
+			return err
+		}
+		if tx.Bucket(boltItemsBucket).Bucket(key) != nil {
+			if err := tx.Bucket(boltItemsBucket).DeleteBucket(key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *boltStore) Owner() *cacheOwner {
+	return s.owner
+}
+
+func (s *boltStore) SetOwner(owner cacheOwner) {
+	s.owner = &owner
+	s.ownerChanged = true
+}
+
+func (s *boltStore) Delete() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltStatesBucket, boltItemsBucket, boltMetaBucket} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/cloudflare/cloudflare-go"
+)
+
+func newTestState(accountID string, action string, itemCount int) *CloudflareState {
+	state := &CloudflareState{
+		AccountID:        accountID,
+		Action:           action,
+		CurrExpr:         fmt.Sprintf("(ip.src in $crowdsec_%s)", action),
+		FilterIDByZoneID: map[string]string{"zone1": "filter1"},
+		IPListState: IPListState{
+			IPList:   &cloudflare.IPList{ID: "list1", Name: "crowdsec_" + action},
+			ItemByIP: make(map[string]cloudflare.IPListItem, itemCount),
+		},
+		CountrySet:          map[string]struct{}{},
+		AutonomousSystemSet: map[string]struct{}{},
+	}
+	for i := 0; i < itemCount; i++ {
+		ip := fmt.Sprintf("10.%d.%d.%d", i/65536, (i/256)%256, i%256)
+		state.IPListState.ItemByIP[ip] = cloudflare.IPListItem{ID: fmt.Sprintf("item%d", i), IP: ip, Comment: "crowdsec/demo"}
+	}
+	return state
+}
+
+func TestBoltStore(t *testing.T) {
+	cachePath = filepath.Join(t.TempDir(), "cache.json")
+	jsonStates := []CloudflareState{*newTestState("account1", "block", 2)}
+	if err := dumpStates(&jsonStates, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := openBoltStore(boltPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.LoadAccount("account1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["block"].IPListState.itemsLoaded() {
+		t.Errorf("expected the items to be loaded lazily, found %+v", got["block"].IPListState.ItemByIP)
+	}
+	worker := &CloudflareWorker{CFStateByAction: got}
+	if err := worker.loadStateItems(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got["block"], &jsonStates[0]) {
+		t.Errorf("expected the JSON cache to be imported, found %+v", got)
+	}
+
+	block := got["block"]
+	delete(block.IPListState.ItemByIP, "10.0.0.0")
+	block.IPListState.ItemByIP["1.2.3.4"] = cloudflare.IPListItem{ID: "new", IP: "1.2.3.4"}
+	update := worker.stateUpdate()
+	wantChanges := map[string]*cloudflare.IPListItem{"10.0.0.0": nil, "1.2.3.4": {ID: "new", IP: "1.2.3.4"}}
+	if !reflect.DeepEqual(update.ItemChanges["block"], wantChanges) || len(update.ReplacedItems) != 0 {
+		t.Errorf("expected only the changed items to be published, found %+v", update)
+	}
+	if err := store.Update(update); err != nil {
+		t.Fatal(err)
+	}
+	challenge := newTestState("account2", "challenge", 1)
+	if err := store.Update(newStateUpdate(map[string]*CloudflareState{"challenge": challenge})); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = openBoltStore(boltPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	all, err := store.LoadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 {
+		t.Fatalf("expected 2 states, found %d", len(all))
+	}
+	got, err = store.LoadAccount("account1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := got["block"].IPListState.load(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got["block"], block) {
+		t.Errorf("expected=%+v\n found=%+v", block.IPListState.ItemByIP, got["block"].IPListState.ItemByIP)
+	}
+
+	if err := store.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if all, _ := store.LoadAll(); len(all) != 0 {
+		t.Errorf("expected no state after delete, found %d", len(all))
+	}
+}
+
+func Test_forgetAccounts(t *testing.T) {
+	cachePath = filepath.Join(t.TempDir(), "cache.json")
+	for kind, open := range map[string]func() (stateStore, error){
+		jsonStateStore: func() (stateStore, error) { return openStateStore(jsonStateStore) },
+		boltStateStore: func() (stateStore, error) { return openBoltStore(boltPath()) },
+	} {
+		t.Run(kind, func(t *testing.T) {
+			store, err := open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			owner := newCacheOwner([]AccountConfig{{ID: "account1"}, {ID: "account2"}})
+			store.SetOwner(owner)
+			for _, state := range []*CloudflareState{newTestState("account1", "block", 1), newTestState("account2", "block", 1)} {
+				if err := store.Update(newStateUpdate(map[string]*CloudflareState{"block": state})); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := forgetAccounts(store, owner, []string{"account2"}); err != nil {
+				t.Fatal(err)
+			}
+			store.Close()
+
+			store, err = open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			all, err := store.LoadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(all) != 1 || all[0].AccountID != "account1" {
+				t.Errorf("expected only the state of account1 to be kept, found %+v", all)
+			}
+			if err := adoptStateStore(store, owner); err != nil {
+				t.Errorf("expected the store to still belong to the config, found %s", err)
+			}
+		})
+	}
+}
+
+// benchmarkStateStore measures the update published by a worker after one item of a 50k items list changed.
+func benchmarkStateStore(b *testing.B, open func() stateStore) {
+	cachePath = filepath.Join(b.TempDir(), "cache.json")
+	store := open()
+	defer store.Close()
+	state := newTestState("account1", "block", 50000)
+	worker := &CloudflareWorker{CFStateByAction: map[string]*CloudflareState{"block": state}}
+	if err := store.Update(worker.stateUpdate()); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ip := fmt.Sprintf("192.168.%d.%d", (i/256)%256, i%256)
+		state.IPListState.ItemByIP[ip] = cloudflare.IPListItem{ID: ip, IP: ip}
+		if err := store.Update(worker.stateUpdate()); err != nil {
+			b.Fatal(err)
+		}
+		delete(state.IPListState.ItemByIP, ip)
+	}
+}
+
+func BenchmarkJSONFileStore_Update(b *testing.B) {
+	benchmarkStateStore(b, func() stateStore { return &jsonFileStore{states: make([]CloudflareState, 0)} })
+}
+
+func BenchmarkBoltStore_Update(b *testing.B) {
+	benchmarkStateStore(b, func() stateStore {
+		store, err := openBoltStore(boltPath())
+		if err != nil {
+			b.Fatal(err)
+		}
+		return store
+	})
+}
+
+func Test_openStateStoreReadOnly(t *testing.T) {
+	t.Run("corrupt cache is left as is", func(t *testing.T) {
+		cachePath = filepath.Join(t.TempDir(), "cache.json")
+		if err := os.WriteFile(cachePath, []byte(`{"version": 2, "chec`), 0600); err != nil {
+			t.Fatal(err)
+		}
+		store, err := openStateStoreReadOnly(jsonStateStore)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if states, _ := store.LoadAll(); len(states) != 0 {
+			t.Errorf("expected no state, found %+v", states)
+		}
+		if err := store.Update(&stateUpdate{}); !errors.Is(err, errReadOnlyStore) {
+			t.Errorf("expected the update to be refused, found %v", err)
+		}
+		if _, err := os.Stat(cachePath); err != nil {
+			t.Errorf("expected the cache to be kept, found %v", err)
+		}
+	})
+
+	t.Run("bolt store", func(t *testing.T) {
+		cachePath = filepath.Join(t.TempDir(), "cache.json")
+		jsonStates := []CloudflareState{*newTestState("account1", "block", 2)}
+		if err := dumpStates(&jsonStates, &cacheOwner{AccountIDs: []string{"account1"}}); err != nil {
+			t.Fatal(err)
+		}
+		// the JSON cache is read without being imported.
+		store, err := openStateStoreReadOnly(boltStateStore)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if states, _ := store.LoadAll(); len(states) != 1 {
+			t.Errorf("expected the JSON cache to be read, found %+v", states)
+		}
+		if _, err := os.Stat(boltPath()); !os.IsNotExist(err) {
+			t.Errorf("expected no bolt store to be created, found %v", err)
+		}
+
+		written, err := openBoltStore(boltPath())
+		if err != nil {
+			t.Fatal(err)
+		}
+		written.Close()
+		store, err = openStateStoreReadOnly(boltStateStore)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		store.SetOwner(cacheOwner{AccountIDs: []string{"account2"}})
+		if err := store.Delete(); !errors.Is(err, errReadOnlyStore) {
+			t.Errorf("expected the deletion to be refused, found %v", err)
+		}
+		states, err := store.LoadAll()
+		if err != nil || len(states) != 1 || len(states[0].IPListState.ItemByIP) != 2 {
+			t.Errorf("expected the bolt store to be read, found %+v, %v", states, err)
+		}
+	})
+
+	t.Run("legacy cache is read in place", func(t *testing.T) {
+		dir := t.TempDir()
+		legacyCachePath = filepath.Join(dir, "etc", "cache.json")
+		cachePath = filepath.Join(dir, "lib", "cache.json")
+		if err := os.Mkdir(filepath.Dir(legacyCachePath), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(legacyCachePath, []byte(`[{"Action": "block"}]`), 0600); err != nil {
+			t.Fatal(err)
+		}
+		readLegacyCacheInPlace()
+		store, err := openStateStoreReadOnly(jsonStateStore)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if states, _ := store.LoadAll(); len(states) != 1 {
+			t.Errorf("expected the legacy cache to be read, found %+v", states)
+		}
+		if _, err := os.Stat(legacyCachePath); err != nil {
+			t.Errorf("expected the legacy cache to be kept, found %v", err)
+		}
+	})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	minRestartBackoff = 5 * time.Second
+	maxRestartBackoff = 5 * time.Minute
+	// degradedAfterFailures is the number of consecutive failures after which an account is degraded.
+	degradedAfterFailures = 3
+)
+
+// cloudflare error codes of an invalid or revoked token.
+var authErrorCodes = []int{6003, 9103, 9109, 10000}
+
+var errWorkerNotRunning = errors.New("worker of the account is not running")
+
+// isAuthError returns true if cloudflare rejected the credentials of the account, restarting the
+// worker won't help.
+func isAuthError(err error) bool {
+	var apiErr *cloudflare.APIRequestError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	if apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden {
+		return true
+	}
+	for _, code := range authErrorCodes {
+		if apiErr.InternalErrorCodeIs(code) {
+			return true
+		}
+	}
+	return false
+}
+
+// workerSupervisor runs the worker of an account and restarts it with an exponential backoff when it
+// fails, so that the failure of an account doesn't stop the enforcement of the others.
+type workerSupervisor struct {
+	worker        *CloudflareWorker
+	restarts      prometheus.Counter
+	minBackoff    time.Duration
+	maxBackoff    time.Duration
+	degradedAfter int
+}
+
+func newWorkerSupervisor(worker *CloudflareWorker, restarts prometheus.Counter) *workerSupervisor {
+	return &workerSupervisor{
+		worker:        worker,
+		restarts:      restarts,
+		minBackoff:    minRestartBackoff,
+		maxBackoff:    maxRestartBackoff,
+		degradedAfter: degradedAfterFailures,
+	}
+}
+
+// backoff returns how long to wait before restarting the worker after its nth consecutive failure.
+func (s *workerSupervisor) backoff(failures int) time.Duration {
+	backoff := s.minBackoff
+	for i := 1; i < failures && backoff < s.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > s.maxBackoff {
+		return s.maxBackoff
+	}
+	return backoff
+}
+
+// run runs the worker until the bouncer stops. The consecutive failures are counted again once the
+// worker ran for longer than the longest backoff. An account whose credentials are rejected is disabled,
+// a worker which panics is dead.
+func (s *workerSupervisor) run() {
+	defer func() {
+		if r := recover(); r != nil {
+			err := fmt.Errorf("worker panicked: %v", r)
+			s.worker.Logger.Error(err)
+			s.worker.Health.setDead(err)
+			s.notify(webhookWorkerFailure, fmt.Sprintf("worker of account %s died", s.worker.Account.ID), 1, err)
+			s.wait(nil, true)
+		}
+	}()
+	failures := 0
+	for {
+		startedAt := time.Now()
+		err := s.worker.Run()
+		if err == nil {
+			return
+		}
+		// the other workers don't wait for this one to set up its IP lists.
+		s.worker.doneSettingUpIPList()
+		if isAuthError(err) {
+			s.worker.Logger.Errorf("cloudflare rejected the credentials, the account is disabled until the bouncer is restarted: %s", err)
+			s.worker.Health.setDisabled(err)
+			s.notify(webhookWorkerFailure, fmt.Sprintf("account %s is disabled, cloudflare rejected its credentials", s.worker.Account.ID), 1, err)
+			s.wait(nil, true)
+			return
+		}
+		if time.Since(startedAt) > s.maxBackoff {
+			failures = 0
+		}
+		failures++
+		degraded := failures >= s.degradedAfter
+		s.worker.Health.recordRestart(err, degraded)
+		s.restarts.Inc()
+		backoff := s.backoff(failures)
+		if degraded {
+			s.worker.Logger.Errorf("account is degraded after %d consecutive failures, restarting the worker in %s: %s", failures, backoff, err)
+			s.notify(webhookWorkerFailure, fmt.Sprintf("account %s is degraded after %d consecutive failures, restarting its worker in %s", s.worker.Account.ID, failures, backoff), failures, err)
+		} else {
+			s.worker.Logger.Warningf("worker failed, restarting it in %s: %s", backoff, err)
+			s.notify(webhookWorkerFailure, fmt.Sprintf("worker of account %s failed, restarting it in %s", s.worker.Account.ID, backoff), failures, err)
+		}
+		if !s.wait(time.After(backoff), false) {
+			return
+		}
+		s.notify(webhookWorkerRestart, fmt.Sprintf("worker of account %s restarted after %d consecutive failures", s.worker.Account.ID, failures), failures, err)
+	}
+}
+
+func (s *workerSupervisor) notify(eventType string, message string, failures int, err error) {
+	s.worker.notify(webhookEvent{
+		Type:      eventType,
+		AccountID: s.worker.Account.ID,
+		Message:   message,
+		Failures:  failures,
+		Error:     err.Error(),
+	})
+}
+
+// wait keeps the worker responsive while it isn't running, the decisions of LAPI are collected until it
+// restarts or discarded when it won't, the admin requests fail. It returns false if the bouncer stopped.
+func (s *workerSupervisor) wait(restart <-chan time.Time, discardDecisions bool) bool {
+	worker := s.worker
+	for {
+		select {
+		case <-restart:
+			return true
+		case decisions := <-worker.LAPIStream:
+			if !discardDecisions {
+				worker.CollectLAPIStream(decisions)
+			}
+		case req := <-worker.AdminRequests:
+			req.done <- errWorkerNotRunning
+		case <-worker.Stop:
+			// LAPI sends every active decision again when the bouncer starts, the pending ones aren't lost.
+			worker.publishState()
+			worker.Logger.Info("worker stopped")
+			return false
+		}
+	}
+}
+
+// registerWorkerGauges exposes whether the account is degraded or disabled as metrics.
+func registerWorkerGauges(accountID string, health *workerHealth) {
+	gauge := func(name string, help string, value func() bool) {
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        name,
+			Help:        help,
+			ConstLabels: prometheus.Labels{"account_id": accountID},
+		}, func() float64 {
+			if value() {
+				return 1
+			}
+			return 0
+		})
+	}
+	gauge("cloudflare_worker_degraded", "Whether the worker of the account failed repeatedly since its last successful sync", health.isDegraded)
+	gauge("cloudflare_worker_disabled", "Whether the account is disabled because cloudflare rejected its credentials", health.isDisabled)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// failingZonesAPI fails to list the zones, the worker fails as soon as it starts.
+type failingZonesAPI struct {
+	*mockCloudflareAPI
+	err error
+}
+
+func (cfAPI *failingZonesAPI) ListZones(ctx context.Context, z ...string) ([]cloudflare.Zone, error) {
+	return nil, cfAPI.err
+}
+
+func newFailingTestSupervisor(err error) (*workerSupervisor, chan struct{}, prometheus.Counter) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	stop := make(chan struct{})
+	worker := newTestWorker()
+	worker.API = &failingZonesAPI{mockCloudflareAPI: &mockCloudflareAPI{}, err: err}
+	worker.Wg = &wg
+	worker.Stop = stop
+	worker.LAPIStream = make(chan *models.DecisionsStreamResponse)
+	worker.AdminRequests = make(chan *adminRequest)
+	worker.Health = newHealthRegistry(time.Minute, true).register(worker.Account.ID, worker.tokenCallCount)
+	restarts := prometheus.NewCounter(prometheus.CounterOpts{})
+	supervisor := newWorkerSupervisor(worker, restarts)
+	supervisor.minBackoff = time.Millisecond
+	supervisor.maxBackoff = 50 * time.Millisecond
+	supervisor.degradedAfter = 2
+	return supervisor, stop, restarts
+}
+
+func Test_workerSupervisor_backoff(t *testing.T) {
+	supervisor := &workerSupervisor{minBackoff: time.Second, maxBackoff: 10 * time.Second}
+	for failures, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 5: 10 * time.Second, 100: 10 * time.Second} {
+		if got := supervisor.backoff(failures); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", failures, got, want)
+		}
+	}
+}
+
+func Test_isAuthError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "forbidden", err: &cloudflare.APIRequestError{StatusCode: 403}, want: true},
+		{name: "invalid token", err: fmt.Errorf("while listing zones: %w", &cloudflare.APIRequestError{StatusCode: 400, Errors: []cloudflare.ResponseInfo{{Code: 9109}}}), want: true},
+		{name: "server error", err: &cloudflare.APIRequestError{StatusCode: 500}, want: false},
+		{name: "other error", err: errors.New("connection reset"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isAuthError(tt.err); got != tt.want {
+				t.Errorf("isAuthError() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_workerSupervisor_restarts(t *testing.T) {
+	supervisor, stop, restarts := newFailingTestSupervisor(errors.New("connection reset"))
+	done := make(chan struct{})
+	go func() {
+		supervisor.run()
+		close(done)
+	}()
+
+	health := supervisor.worker.Health
+	deadline := time.Now().Add(5 * time.Second)
+	for health.status(time.Now(), time.Minute, true).Restarts < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the worker to be restarted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// the other workers don't wait for the failed one to set up.
+	supervisor.worker.Wg.Wait()
+
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the supervisor to stop")
+	}
+	status := health.status(time.Now(), time.Minute, true)
+	if !status.Degraded || status.Ready || status.Disabled || status.LastError != "connection reset" {
+		t.Errorf("expected the account to be degraded, found %+v", status)
+	}
+	if count := testutil.ToFloat64(restarts); int(count) != status.Restarts {
+		t.Errorf("expected %d restarts in the metric, found %f", status.Restarts, count)
+	}
+}
+
+func Test_workerSupervisor_authError(t *testing.T) {
+	supervisor, stop, restarts := newFailingTestSupervisor(&cloudflare.APIRequestError{StatusCode: 403, Errors: []cloudflare.ResponseInfo{{Code: 10000, Message: "Authentication error"}}})
+	done := make(chan struct{})
+	go func() {
+		supervisor.run()
+		close(done)
+	}()
+
+	req := &adminRequest{apply: func(worker *CloudflareWorker) error { return nil }, done: make(chan error, 1)}
+	supervisor.worker.AdminRequests <- req
+	if err := <-req.done; err != errWorkerNotRunning {
+		t.Errorf("expected the admin request to fail, found %v", err)
+	}
+	status := supervisor.worker.Health.status(time.Now(), time.Minute, true)
+	if !status.Disabled || status.Restarts != 0 || testutil.ToFloat64(restarts) != 0 {
+		t.Errorf("expected the account to be disabled without restarting, found %+v", status)
+	}
+
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the supervisor to stop")
+	}
+}
+
+// panickingZonesAPI panics when listing the zones.
+type panickingZonesAPI struct {
+	*mockCloudflareAPI
+}
+
+func (cfAPI *panickingZonesAPI) ListZones(ctx context.Context, z ...string) ([]cloudflare.Zone, error) {
+	panic("unexpected response")
+}
+
+func Test_workerSupervisor_panic(t *testing.T) {
+	supervisor, stop, _ := newFailingTestSupervisor(nil)
+	supervisor.worker.API = &panickingZonesAPI{mockCloudflareAPI: &mockCloudflareAPI{}}
+	done := make(chan struct{})
+	go func() {
+		supervisor.run()
+		close(done)
+	}()
+
+	// the dead worker still drains the decisions of LAPI, the other workers aren't blocked.
+	supervisor.worker.LAPIStream <- &models.DecisionsStreamResponse{}
+	status := supervisor.worker.Health.status(time.Now(), time.Minute, true)
+	if status.Alive || status.LastError != "worker panicked: unexpected response" {
+		t.Errorf("expected the worker to be dead, found %+v", status)
+	}
+
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the supervisor to stop")
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-systemd/daemon"
+	log "github.com/sirupsen/logrus"
+)
+
+// systemdStatusInterval is how often the status of the bouncer is sent to systemd.
+const systemdStatusInterval = 5 * time.Second
+
+// workerProgress is the part of the health of a worker reported to systemd.
+type workerProgress struct {
+	accountID         string
+	ready             bool
+	dead              bool
+	degraded          bool
+	disabled          bool
+	lastTick          time.Time
+	lastSync          time.Time
+	listItems         int
+	countries         int
+	autonomousSystems int
+}
+
+// settled tells whether the worker is done setting up, or given up on. A worker which keeps failing its
+// setup doesn't delay the readiness of the others once it is degraded.
+func (p workerProgress) settled() bool {
+	return p.ready || p.dead || p.degraded || p.disabled
+}
+
+func (h *workerHealth) progress() workerProgress {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	progress := workerProgress{
+		accountID: h.accountID,
+		ready:     h.ready,
+		dead:      h.dead,
+		degraded:  h.degraded,
+		disabled:  h.disabled,
+		lastTick:  h.lastTick,
+		lastSync:  h.lastSync,
+	}
+	for _, action := range h.actions {
+		progress.listItems += action.IPListSize
+		progress.countries += len(action.Countries)
+		progress.autonomousSystems += len(action.AutonomousSystems)
+	}
+	return progress
+}
+
+// systemdNotifier tells systemd when the bouncer is ready, feeds the watchdog while the loops of the
+// workers advance and keeps the status of the service up to date.
+type systemdNotifier struct {
+	registry *healthRegistry
+	notify   func(state string) error
+	// watchdog is the WatchdogSec of the service, zero when the watchdog is disabled.
+	watchdog time.Duration
+	// hungAfter is how long the loop of a ready worker can go without advancing.
+	hungAfter  time.Duration
+	ready      bool
+	hung       map[string]bool
+	lastStatus string
+}
+
+func newSystemdNotifier(registry *healthRegistry, updateFrequency time.Duration) (*systemdNotifier, error) {
+	watchdog, err := daemon.SdWatchdogEnabled(false)
+	if err != nil {
+		return nil, fmt.Errorf("while reading the systemd watchdog settings: %w", err)
+	}
+	return &systemdNotifier{
+		registry: registry,
+		notify: func(state string) error {
+			_, err := daemon.SdNotify(false, state)
+			return err
+		},
+		watchdog:  watchdog,
+		hungAfter: watchdog + updateFrequency,
+		hung:      make(map[string]bool),
+	}, nil
+}
+
+// interval returns how often the notifications are sent, the watchdog is fed twice per WatchdogSec.
+func (n *systemdNotifier) interval() time.Duration {
+	if n.watchdog > 0 && n.watchdog/2 < systemdStatusInterval {
+		return n.watchdog / 2
+	}
+	return systemdStatusInterval
+}
+
+// notifications returns the state to send to systemd. READY=1 is sent once every worker settled, the
+// watchdog is fed until the loop of a ready worker stops advancing. The workers still setting up don't
+// hold the watchdog back, their setup is bounded by TimeoutStartSec.
+func (n *systemdNotifier) notifications(now time.Time) string {
+	progress := make([]workerProgress, 0, len(n.registry.workers))
+	for _, h := range n.registry.workers {
+		progress = append(progress, h.progress())
+	}
+	sort.Slice(progress, func(i, j int) bool { return progress[i].accountID < progress[j].accountID })
+
+	settled := true
+	hung := make([]string, 0)
+	for _, p := range progress {
+		settled = settled && p.settled()
+		isHung := p.ready && !p.dead && now.Sub(p.lastTick) > n.hungAfter
+		if isHung {
+			hung = append(hung, p.accountID)
+			if !n.hung[p.accountID] {
+				log.Errorf("the worker of account %s didn't advance for %s, the systemd watchdog isn't fed anymore", p.accountID, now.Sub(p.lastTick).Round(time.Second))
+			}
+		}
+		n.hung[p.accountID] = isHung
+	}
+
+	states := make([]string, 0, 3)
+	if !n.ready && settled {
+		n.ready = true
+		states = append(states, "READY=1")
+	}
+	if n.watchdog > 0 && len(hung) == 0 {
+		states = append(states, "WATCHDOG=1")
+	}
+	if status := systemdStatus(progress, hung, now); status != n.lastStatus {
+		n.lastStatus = status
+		states = append(states, "STATUS="+status)
+	}
+	return strings.Join(states, "\n")
+}
+
+// systemdStatus summarizes the accounts, the size of their lists and the oldest of their last syncs.
+func systemdStatus(progress []workerProgress, hung []string, now time.Time) string {
+	var ready, settingUp, degraded, disabled, dead, listItems, countries, autonomousSystems int
+	var oldestSync time.Time
+	for _, p := range progress {
+		switch {
+		case p.dead:
+			dead++
+		case p.disabled:
+			disabled++
+		case p.degraded:
+			degraded++
+		case p.ready:
+			ready++
+		default:
+			settingUp++
+		}
+		listItems += p.listItems
+		countries += p.countries
+		autonomousSystems += p.autonomousSystems
+		if p.ready && (oldestSync.IsZero() || p.lastSync.Before(oldestSync)) {
+			oldestSync = p.lastSync
+		}
+	}
+	accounts := []string{fmt.Sprintf("%d/%d accounts ready", ready, len(progress))}
+	for _, count := range []struct {
+		n     int
+		label string
+	}{{settingUp, "setting up"}, {degraded, "degraded"}, {disabled, "disabled"}, {dead, "dead"}} {
+		if count.n > 0 {
+			accounts = append(accounts, fmt.Sprintf("%d %s", count.n, count.label))
+		}
+	}
+	status := fmt.Sprintf("%s; %d IPs, %d countries, %d AS banned", strings.Join(accounts, ", "), listItems, countries, autonomousSystems)
+	if !oldestSync.IsZero() {
+		status += fmt.Sprintf("; last sync %s ago", now.Sub(oldestSync).Round(time.Second))
+	}
+	if len(hung) > 0 {
+		status += "; hung: " + strings.Join(hung, ", ")
+	}
+	return status
+}
+
+// run sends the notifications until stop is closed.
+func (n *systemdNotifier) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(n.interval())
+	defer ticker.Stop()
+	failing := false
+	for {
+		if states := n.notifications(time.Now()); states != "" {
+			err := n.notify(states)
+			if err != nil && !failing {
+				log.Errorf("failed to notify systemd: %v", err)
+			}
+			failing = err != nil
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSystemdNotifier_notifications(t *testing.T) {
+	registry := newHealthRegistry(time.Minute, true)
+	h1 := registry.register("account1", nil)
+	h2 := registry.register("account2", nil)
+	n := &systemdNotifier{registry: registry, watchdog: time.Minute, hungAfter: time.Minute + 10*time.Second, hung: make(map[string]bool)}
+
+	states := n.notifications(time.Now())
+	if strings.Contains(states, "READY=1") {
+		t.Errorf("expected no readiness before the workers are set up, found %q", states)
+	}
+	if !strings.Contains(states, "WATCHDOG=1") || !strings.Contains(states, "STATUS=0/2 accounts ready, 2 setting up") {
+		t.Errorf("expected the watchdog to be fed during the setup, found %q", states)
+	}
+
+	h1.setReady()
+	h1.recordStatus(nil, []actionStatus{{Action: "block", IPListSize: 3, Countries: []string{"FR"}}}, 0, 0)
+	h2.recordRestart(errors.New("failed"), true)
+	states = n.notifications(time.Now())
+	if !strings.Contains(states, "READY=1") {
+		t.Errorf("expected readiness once every worker settled, found %q", states)
+	}
+	if !strings.Contains(states, "STATUS=1/2 accounts ready, 1 degraded; 3 IPs, 1 countries, 0 AS banned; last sync 0s ago") {
+		t.Errorf("unexpected status %q", states)
+	}
+	if states := n.notifications(time.Now()); strings.Contains(states, "READY=1") || strings.Contains(states, "STATUS=") {
+		t.Errorf("expected readiness once and the status only when it changes, found %q", states)
+	}
+
+	states = n.notifications(time.Now().Add(2 * time.Minute))
+	if strings.Contains(states, "WATCHDOG=1") || !strings.Contains(states, "hung: account1") {
+		t.Errorf("expected the watchdog to starve when the loop of a worker doesn't advance, found %q", states)
+	}
+	h1.recordTick()
+	if states := n.notifications(time.Now()); !strings.Contains(states, "WATCHDOG=1") {
+		t.Errorf("expected the watchdog to be fed again, found %q", states)
+	}
+}
+
+func TestSystemdNotifier_withoutWatchdog(t *testing.T) {
+	registry := newHealthRegistry(time.Minute, true)
+	registry.register("account1", nil).setReady()
+	n := &systemdNotifier{registry: registry, hung: make(map[string]bool)}
+	if n.interval() != systemdStatusInterval {
+		t.Errorf("unexpected interval %s", n.interval())
+	}
+	if states := n.notifications(time.Now()); strings.Contains(states, "WATCHDOG=1") || !strings.Contains(states, "READY=1") {
+		t.Errorf("unexpected notifications %q", states)
+	}
+	n.watchdog = 4 * time.Second
+	if n.interval() != 2*time.Second {
+		t.Errorf("expected the watchdog to be fed twice per period, found %s", n.interval())
+	}
+}
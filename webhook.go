@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// events which can be sent to webhooks.
+const (
+	webhookBanWave       = "ban_wave"
+	webhookCountryBan    = "country_ban"
+	webhookASBan         = "as_ban"
+	webhookWorkerFailure = "worker_failure"
+	webhookWorkerRestart = "worker_restart"
+	webhookQuotaWarning  = "quota_warning"
+	webhookSetup         = "setup"
+	webhookCleanup       = "cleanup"
+)
+
+var webhookEvents = []string{webhookBanWave, webhookCountryBan, webhookASBan, webhookWorkerFailure, webhookWorkerRestart, webhookQuotaWarning, webhookSetup, webhookCleanup}
+
+const (
+	defaultWebhookTimeout     = 10 * time.Second
+	defaultWebhookMaxAttempts = 4
+	defaultBanWaveThreshold   = 100
+	webhookQueueSize          = 100
+)
+
+// webhookEvent is the data of a webhook, it is sent as is unless the webhook has a template.
+type webhookEvent struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	AccountID string    `json:"account_id,omitempty"`
+	Message   string    `json:"message"`
+	Action    string    `json:"action,omitempty"`
+	Count     int       `json:"count,omitempty"`
+	Values    []string  `json:"values,omitempty"` // the banned countries or AS
+	Scenarios []string  `json:"scenarios,omitempty"`
+	Failures  int       `json:"failures,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	DryRun    bool      `json:"dry_run,omitempty"`
+}
+
+// parseWebhookTemplate parses the template of the body of a webhook. json quotes a value and join joins
+// strings, to build JSON from the event.
+func parseWebhookTemplate(text string) (*template.Template, error) {
+	return template.New("webhook").Funcs(template.FuncMap{
+		"json": func(value interface{}) (string, error) {
+			encoded, err := json.Marshal(value)
+			return string(encoded), err
+		},
+		"join": strings.Join,
+	}).Parse(text)
+}
+
+type webhook struct {
+	conf     WebhookConfig
+	events   map[string]struct{}
+	template *template.Template
+	// the events waiting to be delivered.
+	queue chan webhookEvent
+}
+
+func (hook *webhook) wants(event webhookEvent) bool {
+	if _, ok := hook.events[event.Type]; len(hook.events) > 0 && !ok {
+		return false
+	}
+	return event.Type != webhookBanWave || event.Count > hook.conf.BanWaveThreshold
+}
+
+func (hook *webhook) body(event webhookEvent) ([]byte, error) {
+	if hook.template == nil {
+		return json.Marshal(event)
+	}
+	var body bytes.Buffer
+	if err := hook.template.Execute(&body, event); err != nil {
+		return nil, err
+	}
+	if !json.Valid(body.Bytes()) {
+		return nil, fmt.Errorf("template rendered invalid JSON: %s", body.String())
+	}
+	return body.Bytes(), nil
+}
+
+// webhookNotifier sends the events to the webhooks which want them. Each webhook has its own queue and
+// delivery goroutine, so that the workers never wait for a webhook and a failing webhook doesn't delay
+// the others. The deliveries are retried with an exponential backoff. The methods are safe to call on a
+// nil webhookNotifier.
+type webhookNotifier struct {
+	webhooks     []*webhook
+	client       *http.Client
+	retryBackoff time.Duration
+	// ctx is cancelled when the deliveries are abandoned.
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	closed bool
+}
+
+// newWebhookNotifier returns the notifier of the webhooks and starts their delivery, nil without
+// webhook.
+func newWebhookNotifier(confs []WebhookConfig) (*webhookNotifier, error) {
+	if len(confs) == 0 {
+		return nil, nil
+	}
+	notifier := &webhookNotifier{
+		client:       &http.Client{},
+		retryBackoff: time.Second,
+	}
+	for _, conf := range confs {
+		hook := &webhook{conf: conf, events: make(map[string]struct{}), queue: make(chan webhookEvent, webhookQueueSize)}
+		for _, event := range conf.Events {
+			hook.events[event] = struct{}{}
+		}
+		if conf.Template != "" {
+			var err error
+			if hook.template, err = parseWebhookTemplate(conf.Template); err != nil {
+				return nil, fmt.Errorf("webhook %s has an invalid template: %w", conf.URL, err)
+			}
+		}
+		notifier.webhooks = append(notifier.webhooks, hook)
+	}
+	notifier.ctx, notifier.cancel = context.WithCancel(context.Background())
+	for _, hook := range notifier.webhooks {
+		notifier.wg.Add(1)
+		go notifier.run(hook)
+	}
+	return notifier, nil
+}
+
+func (n *webhookNotifier) notify(event webhookEvent) {
+	if n == nil {
+		return
+	}
+	event.Time = time.Now().UTC()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return
+	}
+	for _, hook := range n.webhooks {
+		if !hook.wants(event) {
+			continue
+		}
+		select {
+		case hook.queue <- event:
+		default:
+			log.Warningf("webhook queue is full, dropping %s event for %s", event.Type, hook.conf.URL)
+		}
+	}
+}
+
+// run delivers the events of the webhook until its queue is closed.
+func (n *webhookNotifier) run(hook *webhook) {
+	defer n.wg.Done()
+	for event := range hook.queue {
+		if err := n.deliver(hook, event); err != nil {
+			log.Errorf("while sending %s event to webhook %s: %s", event.Type, hook.conf.URL, err)
+		}
+	}
+}
+
+// deliver posts the event to the webhook, it is retried on network errors, 429 and 5xx.
+func (n *webhookNotifier) deliver(hook *webhook, event webhookEvent) error {
+	body, err := hook.body(event)
+	if err != nil {
+		return err
+	}
+	backoff := n.retryBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := n.post(hook.conf, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= hook.conf.MaxAttempts {
+			return err
+		}
+		log.Debugf("webhook %s failed, retrying in %s: %s", hook.conf.URL, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-n.ctx.Done():
+			return fmt.Errorf("%w, not retrying: %s", err, n.ctx.Err())
+		}
+		backoff *= 2
+	}
+}
+
+func (n *webhookNotifier) post(conf WebhookConfig, body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(n.ctx, conf.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, conf.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range conf.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, fmt.Errorf("HTTP status %d", resp.StatusCode)
+}
+
+// Close stops accepting events and waits for the queued ones to be delivered. When the context is done
+// first, the deliveries in progress are interrupted.
+func (n *webhookNotifier) Close(ctx context.Context) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	if !n.closed {
+		n.closed = true
+		for _, hook := range n.webhooks {
+			close(hook.queue)
+		}
+	}
+	n.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		n.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Warning("some webhooks weren't sent before exiting")
+		n.cancel()
+	}
+}
+
+// scenariosOf returns the sorted distinct scenarios of the decisions.
+func scenariosOf(decisions []*models.Decision) []string {
+	set := make(map[string]struct{})
+	for _, decision := range decisions {
+		if decision.Scenario != nil {
+			set[*decision.Scenario] = struct{}{}
+		}
+	}
+	scenarios := make([]string, 0, len(set))
+	for scenario := range set {
+		scenarios = append(scenarios, scenario)
+	}
+	sort.Strings(scenarios)
+	return scenarios
+}
+
+// notify sends the event of the worker, the events of a dry run are tagged as such.
+func (worker *CloudflareWorker) notify(event webhookEvent) {
+	if worker.DryRun {
+		event.DryRun = true
+		event.Message += " (dry run)"
+	}
+	worker.Webhooks.notify(event)
+}
+
+// queueRuleBans queues an event for each action with newly banned countries or AS, they are sent once
+// UpdateRules pushed the expressions banning them.
+func (worker *CloudflareWorker) queueRuleBans(eventType string, bannedByAction map[string][]*models.Decision) {
+	scope := "countries"
+	if eventType == webhookASBan {
+		scope = "AS"
+	}
+	actions := make([]string, 0, len(bannedByAction))
+	for action := range bannedByAction {
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
+	for _, action := range actions {
+		decisions := bannedByAction[action]
+		values := make([]string, len(decisions))
+		for i, decision := range decisions {
+			values[i] = *decision.Value
+		}
+		sort.Strings(values)
+		worker.pendingRuleBans = append(worker.pendingRuleBans, webhookEvent{
+			Type:      eventType,
+			AccountID: worker.Account.ID,
+			Message:   fmt.Sprintf("account %s banned %s %s with action %s", worker.Account.ID, scope, strings.Join(values, ", "), action),
+			Action:    action,
+			Count:     len(values),
+			Values:    values,
+			Scenarios: scenariosOf(decisions),
+		})
+	}
+}
+
+// sendRuleBans sends the events of the countries and AS banned by the rules UpdateRules pushed.
+func (worker *CloudflareWorker) sendRuleBans() {
+	for _, event := range worker.pendingRuleBans {
+		worker.notify(event)
+	}
+	worker.pendingRuleBans = nil
+}
+
+// notifyRun sends the event of a setup or cleanup run of the account.
+func (worker *CloudflareWorker) notifyRun(eventType string, err error) {
+	event := webhookEvent{Type: eventType, AccountID: worker.Account.ID}
+	if err != nil {
+		event.Message = fmt.Sprintf("%s of account %s failed", eventType, worker.Account.ID)
+		event.Error = err.Error()
+	} else {
+		event.Message = fmt.Sprintf("%s of account %s complete", eventType, worker.Account.ID)
+	}
+	worker.notify(event)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+)
+
+// webhookServer answers with the statuses in order, then with 200, and records the bodies it received.
+type webhookServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	bodies   []string
+	headers  []http.Header
+}
+
+func newWebhookServer(statuses ...int) *webhookServer {
+	server := &webhookServer{statuses: statuses}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		server.bodies = append(server.bodies, string(body))
+		server.headers = append(server.headers, r.Header)
+		if len(server.statuses) > 0 {
+			w.WriteHeader(server.statuses[0])
+			server.statuses = server.statuses[1:]
+		}
+	}))
+	return server
+}
+
+func (server *webhookServer) received() []string {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return append([]string{}, server.bodies...)
+}
+
+func newTestWebhookNotifier(t *testing.T, confs ...WebhookConfig) *webhookNotifier {
+	for i := range confs {
+		if err := validateWebhook(&confs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	notifier, err := newWebhookNotifier(confs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notifier.retryBackoff = time.Millisecond
+	return notifier
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	server := newWebhookServer(http.StatusInternalServerError, http.StatusTooManyRequests)
+	defer server.Close()
+	rejecting := newWebhookServer(http.StatusBadRequest)
+	defer rejecting.Close()
+	notifier := newTestWebhookNotifier(t,
+		WebhookConfig{
+			URL:              server.URL,
+			Events:           []string{webhookCountryBan, webhookBanWave},
+			Headers:          map[string]string{"Authorization": "Bearer token"},
+			Template:         `{"text": {{ json .Message }}, "countries": {{ json (join .Values ",") }}}`,
+			BanWaveThreshold: 10,
+		},
+		WebhookConfig{URL: rejecting.URL},
+	)
+	notifier.notify(webhookEvent{Type: webhookBanWave, Message: "small wave", Count: 10})
+	notifier.notify(webhookEvent{Type: webhookWorkerRestart, Message: "restarted"})
+	notifier.notify(webhookEvent{Type: webhookCountryBan, Message: "banned FR", Values: []string{"FR", "DE"}})
+	notifier.Close(context.Background())
+
+	bodies := server.received()
+	if len(bodies) != 3 {
+		t.Fatalf("expected the country ban to be retried until it succeeds, found %v", bodies)
+	}
+	var body map[string]string
+	if err := json.Unmarshal([]byte(bodies[2]), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body["text"] != "banned FR" || body["countries"] != "FR,DE" {
+		t.Errorf("unexpected body %s", bodies[2])
+	}
+	if got := server.headers[0].Get("Authorization"); got != "Bearer token" {
+		t.Errorf("expected the headers of the webhook, found %s", got)
+	}
+
+	bodies = rejecting.received()
+	if len(bodies) != 2 {
+		t.Fatalf("expected the events but the small wave once, without retry of the rejected one, found %v", bodies)
+	}
+	var event webhookEvent
+	if err := json.Unmarshal([]byte(bodies[0]), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != webhookWorkerRestart || event.Message != "restarted" || event.Time.IsZero() {
+		t.Errorf("expected the event as is without template, found %s", bodies[0])
+	}
+
+	// the notifier is closed, the events are dropped.
+	notifier.notify(webhookEvent{Type: webhookSetup})
+}
+
+func Test_validateWebhook(t *testing.T) {
+	tests := []struct {
+		name    string
+		webhook WebhookConfig
+		wantErr bool
+	}{
+		{name: "valid", webhook: WebhookConfig{URL: "https://hooks.example.com/x", Events: []string{webhookCountryBan}}},
+		{name: "missing url", webhook: WebhookConfig{}, wantErr: true},
+		{name: "unknown event", webhook: WebhookConfig{URL: "https://hooks.example.com/x", Events: []string{"ban"}}, wantErr: true},
+		{name: "invalid template", webhook: WebhookConfig{URL: "https://hooks.example.com/x", Template: "{{ .Message "}, wantErr: true},
+		{name: "negative threshold", webhook: WebhookConfig{URL: "https://hooks.example.com/x", BanWaveThreshold: -1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateWebhook(&tt.webhook)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateWebhook() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (tt.webhook.BanWaveThreshold != defaultBanWaveThreshold || tt.webhook.Timeout != defaultWebhookTimeout || tt.webhook.MaxAttempts != defaultWebhookMaxAttempts) {
+				t.Errorf("expected the defaults to be set, found %+v", tt.webhook)
+			}
+		})
+	}
+}
+
+func TestCloudflareWorker_webhookEvents(t *testing.T) {
+	server := newWebhookServer()
+	defer server.Close()
+	worker := newTestWorker()
+	worker.Webhooks = newTestWebhookNotifier(t, WebhookConfig{URL: server.URL, BanWaveThreshold: 1})
+	decision := func(value string, scope string) *models.Decision {
+		decisionType, scenario := "captcha", "crowdsecurity/http-probing"
+		return &models.Decision{Value: &value, Scope: &scope, Type: &decisionType, Scenario: &scenario}
+	}
+	worker.CollectLAPIStream(&models.DecisionsStreamResponse{New: []*models.Decision{
+		decision("1.2.3.4", "Ip"),
+		decision("5.6.7.8", "Ip"),
+		decision("FR", "Country"),
+	}})
+	if err := worker.AddNewIPs(); err != nil {
+		t.Fatal(err)
+	}
+	if err := worker.SendCountryBans(); err != nil {
+		t.Fatal(err)
+	}
+	// the country ban is sent once the rules enforce it.
+	if len(worker.pendingRuleBans) != 1 {
+		t.Fatalf("expected the country ban to wait for the rules, found %+v", worker.pendingRuleBans)
+	}
+	if err := worker.UpdateRules(); err != nil {
+		t.Fatal(err)
+	}
+	// the country is already banned, no event is sent again.
+	worker.CollectLAPIStream(&models.DecisionsStreamResponse{New: []*models.Decision{decision("FR", "Country")}})
+	if err := worker.SendCountryBans(); err != nil {
+		t.Fatal(err)
+	}
+	if err := worker.UpdateRules(); err != nil {
+		t.Fatal(err)
+	}
+	worker.DryRun = true
+	worker.notifyRun(webhookSetup, nil)
+	worker.Webhooks.Close(context.Background())
+
+	bodies := server.received()
+	if len(bodies) != 3 {
+		t.Fatalf("expected a ban wave, a country ban and a setup, found %v", bodies)
+	}
+	events := make([]webhookEvent, len(bodies))
+	for i, body := range bodies {
+		if err := json.Unmarshal([]byte(body), &events[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if events[0].Type != webhookBanWave || events[0].Count != 2 || events[0].AccountID != "account1" || len(events[0].Scenarios) != 1 {
+		t.Errorf("unexpected ban wave %+v", events[0])
+	}
+	if events[1].Type != webhookCountryBan || events[1].Action != "challenge" || len(events[1].Values) != 1 || events[1].Values[0] != "FR" {
+		t.Errorf("unexpected country ban %+v", events[1])
+	}
+	if events[0].DryRun || !events[2].DryRun || !strings.HasSuffix(events[2].Message, "(dry run)") {
+		t.Errorf("expected only the dry run setup to be tagged, found %+v", events)
+	}
+}
+
+func TestWebhookNotifier_deadWebhook(t *testing.T) {
+	dead := newWebhookServer()
+	dead.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	defer dead.Close()
+	server := newWebhookServer()
+	defer server.Close()
+	notifier := newTestWebhookNotifier(t,
+		WebhookConfig{URL: dead.URL, MaxAttempts: 100},
+		WebhookConfig{URL: server.URL},
+	)
+	notifier.retryBackoff = time.Hour
+	notifier.notify(webhookEvent{Type: webhookWorkerRestart, Message: "first"})
+	notifier.notify(webhookEvent{Type: webhookWorkerRestart, Message: "second"})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(server.received()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if bodies := server.received(); len(bodies) != 2 {
+		t.Errorf("expected the events to be sent despite the dead webhook, found %v", bodies)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	notifier.Close(ctx)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the close to interrupt the retries, it took %s", elapsed)
+	}
+}